@@ -4,9 +4,11 @@ import (
 	"borderless_coding_server/config"
 	"borderless_coding_server/internal/handlers"
 	"borderless_coding_server/internal/middleware"
+	"borderless_coding_server/internal/models"
 	"borderless_coding_server/internal/services"
 	"borderless_coding_server/pkg/cache"
 	"borderless_coding_server/pkg/database"
+	"borderless_coding_server/pkg/mailer"
 	"borderless_coding_server/pkg/storage"
 	"context"
 	"net/http"
@@ -54,6 +56,13 @@ func main() {
 	}
 	defer cache.CloseRedis()
 
+	// Seed permissions and the admin role, and migrate roles stored in user metadata
+	revocationService := services.NewTokenRevocationService(logger)
+	roleService := services.NewRoleService(revocationService, logger)
+	if err := roleService.Bootstrap(context.Background()); err != nil {
+		logger.Fatalf("Failed to bootstrap roles: %v", err)
+	}
+
 	// Initialize MinIO
 	if err := storage.ConnectMinIO(cfg); err != nil {
 		logger.Warnf("Failed to connect to MinIO: %v", err)
@@ -70,27 +79,71 @@ func main() {
 
 	// Initialize services
 	userService := services.NewUserService()
-	projectService := services.NewProjectService()
+	authorizer := services.NewAuthorizer()
+	projectService := services.NewProjectService(authorizer)
 	chatService := services.NewChatService()
+	passwordHasher := services.NewPasswordHasher(services.Argon2Params{
+		Memory:      uint32(cfg.Argon2Memory),
+		Iterations:  uint32(cfg.Argon2Iterations),
+		Parallelism: uint8(cfg.Argon2Parallelism),
+	})
+	mailService, err := mailer.New(cfg)
+	if err != nil {
+		logger.Fatalf("Failed to configure mailer: %v", err)
+	}
+	oidcRegistry, err := services.NewOIDCRegistry(cfg.OIDCProviders, nil)
+	if err != nil {
+		logger.Fatalf("Failed to configure OIDC providers: %v", err)
+	}
 	authService := services.NewAuthService(
 		cfg.GoogleClientID,
 		cfg.GoogleClientSecret,
 		cfg.GoogleRedirectURL,
-		cfg.JWTSecret,
+		revocationService,
+		services.NewDBCredentialStore(),
+		passwordHasher,
+		services.NewRoutingSender(
+			services.NewEmailSender(mailService, cfg.AppBaseURL),
+			services.NewSMSCodeSender(services.NewLogSMSSender(logger)),
+		),
+		oidcRegistry,
 	)
-	jwtService := services.NewJWTService(cfg.JWTSecret)
+	jwtService := services.NewJWTService(cfg.JWTSigningAlgorithm, services.KeyRotationPolicy{
+		Interval: cfg.JWTKeyRotationInterval,
+		Overlap:  cfg.JWTKeyOverlap,
+	}, logger)
+	if err := jwtService.RotateKeys(context.Background()); err != nil {
+		logger.Fatalf("Failed to load signing keys: %v", err)
+	}
+	jwtService.StartKeyRotation()
 	buildService := services.NewBuildService(cfg.ClaudeCLIPath, logger)
+	quotaService := services.NewQuotaService(cfg.StaticFolderPath, logger)
+	templateService := services.NewTemplateService(cfg.MinIOBucketName, cfg.ProjectTemplateZip, logger)
+	workspaceService := services.NewWorkspaceService(cfg.LocalStoragePath, cfg.MinIOBucketName, templateService, quotaService, logger)
+	previewLinkSecret, err := services.LoadPreviewLinkSecret(context.Background(), cfg.PreviewLinkSecret)
+	if err != nil {
+		logger.Fatalf("Failed to load preview link secret: %v", err)
+	}
+	previewService := services.NewPreviewService(buildService, workspaceService, templateService, quotaService, previewLinkSecret, logger)
+	devServerService := services.NewDevServerService(buildService, workspaceService, templateService, cfg.DevServerIdleTimeout, logger)
+	// Running dev servers pick up every published change
+	workspaceService.OnPublish(devServerService.Refresh)
 
 	// Initialize handlers
 	healthHandler := handlers.NewHealthHandler(logger)
-	userHandler := handlers.NewUserHandler(userService, logger)
-	projectHandler := handlers.NewProjectHandler(projectService, logger)
-	chatHandler := handlers.NewChatHandler(chatService, logger)
-	authHandler := handlers.NewAuthHandler(authService, jwtService, logger)
-	buildHandler := handlers.NewBuildHandler(buildService, logger)
+	userHandler := handlers.NewUserHandler(userService, authService, authorizer, logger)
+	projectHandler := handlers.NewProjectHandler(projectService, workspaceService, quotaService, templateService, previewService, authorizer, logger)
+	chatHandler := handlers.NewChatHandler(chatService, projectService, workspaceService, authorizer, logger)
+	authHandler := handlers.NewAuthHandler(authService, jwtService, roleService, logger)
+	buildHandler := handlers.NewBuildHandler(buildService, projectService, logger)
+	memberHandler := handlers.NewMemberHandler(projectService, authorizer, logger)
+	fileHandler := handlers.NewFileHandler(projectService, workspaceService, quotaService, logger)
+	templateHandler := handlers.NewTemplateHandler(templateService, logger)
+	roleHandler := handlers.NewRoleHandler(roleService, logger)
+	previewHandler := handlers.NewPreviewHandler(projectService, previewService, devServerService, logger)
 
 	// Setup routes
-	setupRoutes(router, healthHandler, userHandler, projectHandler, chatHandler, authHandler, buildHandler, jwtService, cfg)
+	setupRoutes(router, healthHandler, userHandler, projectHandler, chatHandler, authHandler, buildHandler, fileHandler, templateHandler, memberHandler, roleHandler, previewHandler, jwtService, roleService, revocationService, cfg)
 
 	// Create HTTP server
 	server := &http.Server{
@@ -120,17 +173,30 @@ func main() {
 		logger.Fatalf("Server forced to shutdown: %v", err)
 	}
 
+	// Stop live preview dev servers so their processes do not outlive the server
+	devServerService.StopAll(10 * time.Second)
+
 	logger.Info("Server exited")
 }
 
-func setupRoutes(router *gin.Engine, healthHandler *handlers.HealthHandler, userHandler *handlers.UserHandler, projectHandler *handlers.ProjectHandler, chatHandler *handlers.ChatHandler, authHandler *handlers.AuthHandler, buildHandler *handlers.BuildHandler, jwtService *services.JWTService, cfg *config.Config) {
+func setupRoutes(router *gin.Engine, healthHandler *handlers.HealthHandler, userHandler *handlers.UserHandler, projectHandler *handlers.ProjectHandler, chatHandler *handlers.ChatHandler, authHandler *handlers.AuthHandler, buildHandler *handlers.BuildHandler, fileHandler *handlers.FileHandler, templateHandler *handlers.TemplateHandler, memberHandler *handlers.MemberHandler, roleHandler *handlers.RoleHandler, previewHandler *handlers.PreviewHandler, jwtService *services.JWTService, roleService *services.RoleService, revocationService *services.TokenRevocationService, cfg *config.Config) {
 	// Health check routes
 	router.GET("/health", healthHandler.HealthCheck)
 	router.GET("/health/ready", healthHandler.ReadinessCheck)
 	router.GET("/health/live", healthHandler.LivenessCheck)
 
-	// Serve static preview files
-	router.Static("/static", cfg.StaticFolderPath)
+	// Public keys access tokens are verified with
+	router.GET("/.well-known/jwks.json", authHandler.JWKS)
+
+	// Project previews, with the visibility of their project
+	preview := router.Group("/preview")
+	preview.Use(middleware.OptionalAuthMiddleware(jwtService, roleService, revocationService))
+	{
+		preview.GET("/:project_id/*filepath", previewHandler.ServePreview)
+		preview.HEAD("/:project_id/*filepath", previewHandler.ServePreview)
+	}
+	router.GET("/static/:project_id/*filepath", previewHandler.RedirectLegacyPreview)
+	router.HEAD("/static/:project_id/*filepath", previewHandler.RedirectLegacyPreview)
 
 	// Authentication routes (public)
 	auth := router.Group("/auth")
@@ -140,13 +206,40 @@ func setupRoutes(router *gin.Engine, healthHandler *handlers.HealthHandler, user
 		auth.POST("/login", authHandler.Login)
 		auth.POST("/google/url", authHandler.GetGoogleAuthURL)
 		auth.POST("/google/callback", authHandler.GoogleCallback)
+		auth.GET("/oidc", authHandler.ListOIDCProviders)
+		auth.POST("/oidc/:provider/url", authHandler.GetOIDCAuthURL)
+		auth.POST("/oidc/:provider/callback", authHandler.OIDCCallback)
+		auth.POST("/oidc/:provider/link/url", middleware.AuthMiddleware(jwtService, roleService, revocationService), authHandler.GetOIDCLinkURL)
+		auth.POST("/oidc/:provider/link", middleware.AuthMiddleware(jwtService, roleService, revocationService), authHandler.LinkOIDCIdentity)
+		auth.GET("/identities", middleware.AuthMiddleware(jwtService, roleService, revocationService), authHandler.ListIdentities)
+		auth.DELETE("/identities/:identity_id", middleware.AuthMiddleware(jwtService, roleService, revocationService), authHandler.UnlinkIdentity)
 		auth.POST("/refresh", authHandler.RefreshToken)
 		auth.POST("/logout", authHandler.Logout)
-		auth.POST("/logout-all", middleware.AuthMiddleware(jwtService), authHandler.LogoutAll)
+		auth.POST("/logout-all", middleware.AuthMiddleware(jwtService, roleService, revocationService), authHandler.LogoutAll)
 		auth.GET("/validate", authHandler.ValidateToken)
-		auth.GET("/profile", middleware.AuthMiddleware(jwtService), authHandler.GetProfile)
-		auth.GET("/sessions", middleware.AuthMiddleware(jwtService), authHandler.GetSessions)
-		auth.DELETE("/sessions/:session_id", middleware.AuthMiddleware(jwtService), authHandler.RevokeSession)
+		auth.POST("/password/forgot", authHandler.ForgotPassword)
+		auth.POST("/password/reset", authHandler.ResetPassword)
+		auth.POST("/password/change", middleware.AuthMiddleware(jwtService, roleService, revocationService), authHandler.ChangePassword)
+		auth.POST("/email/verification", middleware.AuthMiddleware(jwtService, roleService, revocationService), authHandler.RequestEmailVerification)
+		auth.POST("/email/verification/confirm", authHandler.ConfirmEmailVerification)
+		auth.POST("/magic-link", authHandler.RequestMagicLink)
+		auth.POST("/magic-link/login", authHandler.MagicLinkLogin)
+		auth.POST("/phone/code", authHandler.RequestPhoneLoginCode)
+		auth.POST("/phone/login", authHandler.PhoneLogin)
+		auth.GET("/phones", middleware.AuthMiddleware(jwtService, roleService, revocationService), authHandler.ListPhones)
+		auth.POST("/phones", middleware.AuthMiddleware(jwtService, roleService, revocationService), authHandler.AddPhone)
+		auth.POST("/phones/:phone_id/verify", middleware.AuthMiddleware(jwtService, roleService, revocationService), authHandler.VerifyPhone)
+		auth.DELETE("/phones/:phone_id", middleware.AuthMiddleware(jwtService, roleService, revocationService), authHandler.RemovePhone)
+		auth.POST("/mfa/challenge", authHandler.MFAChallenge)
+		auth.POST("/mfa/challenge/enroll", authHandler.MFAChallengeEnroll)
+		auth.GET("/mfa", middleware.AuthMiddleware(jwtService, roleService, revocationService), authHandler.GetMFAStatus)
+		auth.POST("/mfa/totp", middleware.AuthMiddleware(jwtService, roleService, revocationService), authHandler.BeginTOTPEnrollment)
+		auth.POST("/mfa/totp/confirm", middleware.AuthMiddleware(jwtService, roleService, revocationService), authHandler.ConfirmTOTPEnrollment)
+		auth.POST("/mfa/disable", middleware.AuthMiddleware(jwtService, roleService, revocationService), authHandler.DisableMFA)
+		auth.POST("/mfa/recovery-codes", middleware.AuthMiddleware(jwtService, roleService, revocationService), authHandler.RegenerateRecoveryCodes)
+		auth.GET("/profile", middleware.AuthMiddleware(jwtService, roleService, revocationService), authHandler.GetProfile)
+		auth.GET("/sessions", middleware.AuthMiddleware(jwtService, roleService, revocationService), authHandler.GetSessions)
+		auth.DELETE("/sessions/:session_id", middleware.AuthMiddleware(jwtService, roleService, revocationService), authHandler.RevokeSession)
 	}
 
 	// API v1 routes
@@ -168,7 +261,7 @@ func setupRoutes(router *gin.Engine, healthHandler *handlers.HealthHandler, user
 
 		// Protected routes (authentication required)
 		protected := v1.Group("")
-		protected.Use(middleware.AuthMiddleware(jwtService))
+		protected.Use(middleware.AuthMiddleware(jwtService, roleService, revocationService))
 		protected.Use(middleware.RequireActiveUser())
 		{
 			// User routes
@@ -195,16 +288,41 @@ func setupRoutes(router *gin.Engine, healthHandler *handlers.HealthHandler, user
 				projects.DELETE("/:id", projectHandler.DeleteProject)
 				projects.PUT("/:id/visibility", projectHandler.UpdateProjectVisibility)
 				projects.PUT("/:id/storage-quota", projectHandler.UpdateProjectStorageQuota)
+				projects.GET("/:id/storage-usage", projectHandler.GetProjectStorageUsage)
+				projects.POST("/:id/fork", projectHandler.ForkProject)
 				projects.GET("/:id/chat-sessions", projectHandler.GetProjectChatSessions)
 			}
 
+			// Project member routes
+			projectMembers := protected.Group("/projects/:id/members")
+			{
+				projectMembers.GET("", memberHandler.ListMembers)
+				projectMembers.POST("", memberHandler.InviteMember)
+				projectMembers.POST("/accept", memberHandler.AcceptInvitation)
+				projectMembers.PUT("/:user_id", memberHandler.UpdateMember)
+				projectMembers.DELETE("/:user_id", memberHandler.RemoveMember)
+			}
+			protected.GET("/project-invitations", memberHandler.ListInvitations)
+
 			// User-specific project routes
 			userProjects := protected.Group("/users/:id/projects")
 			{
 				userProjects.POST("", projectHandler.CreateProject)
+				userProjects.POST("/import", projectHandler.ImportProject)
 				userProjects.GET("/slug/:slug", projectHandler.GetProjectBySlug)
 			}
 
+			// Project template routes
+			templates := protected.Group("/templates")
+			{
+				templates.GET("", templateHandler.ListTemplates)
+				templates.GET("/:id", templateHandler.GetTemplate)
+				templates.POST("", middleware.RequirePermission(models.PermissionTemplatesManage), templateHandler.CreateTemplate)
+				templates.PUT("/:id", middleware.RequirePermission(models.PermissionTemplatesManage), templateHandler.UpdateTemplate)
+				templates.PUT("/:id/archive", middleware.RequirePermission(models.PermissionTemplatesManage), templateHandler.UploadTemplateArchive)
+				templates.DELETE("/:id", middleware.RequirePermission(models.PermissionTemplatesManage), templateHandler.DeleteTemplate)
+			}
+
 			// Chat session routes
 			chatSessions := protected.Group("/chat-sessions")
 			{
@@ -227,6 +345,27 @@ func setupRoutes(router *gin.Engine, healthHandler *handlers.HealthHandler, user
 				userChatSessions.GET("/recent", chatHandler.GetRecentChatSessions)
 			}
 
+			// Role administration routes
+			admin := protected.Group("/admin")
+			admin.Use(middleware.RequirePermission(models.PermissionRolesManage))
+			{
+				admin.GET("/permissions", roleHandler.ListPermissions)
+				admin.GET("/roles", roleHandler.ListRoles)
+				admin.POST("/roles", roleHandler.CreateRole)
+				admin.DELETE("/roles/:id", roleHandler.DeleteRole)
+				admin.GET("/users/:id/roles", roleHandler.GetUserRoles)
+				admin.POST("/users/:id/roles", roleHandler.GrantUserRole)
+				admin.DELETE("/users/:id/roles/:role", roleHandler.RevokeUserRole)
+			}
+
+			// Sign-in security policies
+			mfaPolicies := protected.Group("/admin/mfa-policies")
+			mfaPolicies.Use(middleware.RequirePermission(models.PermissionSecurityManage))
+			{
+				mfaPolicies.GET("", authHandler.ListMFAPolicies)
+				mfaPolicies.PUT("/:level", authHandler.SetMFAPolicy)
+			}
+
 			// Project-specific chat session routes are already handled above via
 			// projects.GET(":id/chat-sessions", projectHandler.GetProjectChatSessions)
 
@@ -259,11 +398,29 @@ func setupRoutes(router *gin.Engine, healthHandler *handlers.HealthHandler, user
 				projectBuilds.GET("", buildHandler.GetProjectBuilds)
 			}
 
+			// Project file routes
+			projectFiles := protected.Group("/projects/:id/files")
+			{
+				projectFiles.GET("", fileHandler.ListFiles)
+				projectFiles.DELETE("", fileHandler.DeleteFile)
+				projectFiles.GET("/content", fileHandler.ReadFile)
+				projectFiles.PUT("/content", fileHandler.WriteFile)
+				projectFiles.POST("/directories", fileHandler.CreateDirectory)
+				projectFiles.POST("/move", fileHandler.MoveFile)
+			}
+			projects.GET("/:id/export", fileHandler.ExportProject)
+
 			// Project chat SSE (Claude)
 			projects.POST("/:id/chat", chatHandler.StreamClaudeChat)
 
 			// Project preview build
 			projects.POST("/:id/preview", projectHandler.BuildPreview)
+			projects.POST("/:id/preview/link", previewHandler.CreatePreviewLink)
+			projects.POST("/:id/preview/live", previewHandler.StartLivePreview)
+			projects.GET("/:id/preview/live", previewHandler.GetLivePreview)
+			projects.DELETE("/:id/preview/live", previewHandler.StopLivePreview)
+			projects.GET("/:id/preview/deployments", projectHandler.ListPreviewDeployments)
+			projects.POST("/:id/preview/deployments/:deployment_id/rollback", projectHandler.RollbackPreviewDeployment)
 
 		}
 	}
@@ -0,0 +1,592 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"borderless_coding_server/config"
+	"borderless_coding_server/internal/handlers"
+	"borderless_coding_server/internal/models"
+	"borderless_coding_server/internal/services"
+	"borderless_coding_server/pkg/database"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// testSubject is a caller together with its role on the project used by project routes
+type testSubject struct {
+	subject services.Subject
+	role    models.ProjectRole
+}
+
+func newTestSubject(role models.ProjectRole, siteRoles ...string) testSubject {
+	return testSubject{subject: services.Subject{UserID: uuid.New(), Roles: siteRoles}, role: role}
+}
+
+func newPermittedSubject(permissions ...string) testSubject {
+	return testSubject{subject: services.Subject{UserID: uuid.New(), Roles: []string{"support"}, Permissions: permissions}}
+}
+
+// Subjects every route is checked against. "self" is the user addressed by /users/:id routes,
+// "viewer" is the member addressed by /projects/:id/members/:user_id routes, "user_admin" holds
+// a custom role with the users.* permissions.
+var testSubjects = map[string]testSubject{
+	"anonymous":  {},
+	"stranger":   newTestSubject(""),
+	"self":       newTestSubject(""),
+	"viewer":     newTestSubject(models.ProjectRoleViewer),
+	"editor":     newTestSubject(models.ProjectRoleEditor),
+	"maintainer": newTestSubject(models.ProjectRoleAdmin),
+	"owner":      newTestSubject(models.ProjectRoleOwner),
+	"site_admin": newTestSubject("", models.RoleAdmin),
+	"user_admin": newPermittedSubject(models.PermissionUsersRead, models.PermissionUsersManage),
+}
+
+var (
+	allowEveryone      = []string{"stranger", "self", "viewer", "editor", "maintainer", "owner", "site_admin", "user_admin"}
+	allowSelf          = []string{"self", "site_admin", "user_admin"}
+	allowUserAdmin     = []string{"site_admin", "user_admin"}
+	allowSiteAdmin     = []string{"site_admin"}
+	allowProjectRead   = []string{"viewer", "editor", "maintainer", "owner", "site_admin"}
+	allowProjectWrite  = []string{"editor", "maintainer", "owner", "site_admin"}
+	allowProjectManage = []string{"maintainer", "owner", "site_admin"}
+	allowProjectDelete = []string{"owner", "site_admin"}
+	allowLeaveProject  = []string{"viewer", "maintainer", "owner", "site_admin"}
+	// The fixture project is private, and private projects are only forkable by their owner
+	allowPrivateFork = []string{"owner"}
+)
+
+// routePolicy is the authorization expected for a route. Routes without a resource kind are
+// either public or only need an authenticated user, and return the caller's own data.
+type routePolicy struct {
+	method     string
+	path       string
+	public     bool
+	kind       services.ResourceKind
+	action     services.Action
+	permission string // required on system resources
+	allow      []string
+}
+
+var routePolicies = []routePolicy{
+	{method: "GET", path: "/", public: true},
+	{method: "GET", path: "/health", public: true},
+	{method: "GET", path: "/health/ready", public: true},
+	{method: "GET", path: "/health/live", public: true},
+	{method: "GET", path: "/.well-known/jwks.json", public: true},
+	{method: "GET", path: "/static/:project_id/*filepath", public: true},
+	{method: "HEAD", path: "/static/:project_id/*filepath", public: true},
+	// Previews check project visibility themselves, see PreviewHandler.ServePreview
+	{method: "GET", path: "/preview/:project_id/*filepath", public: true},
+	{method: "HEAD", path: "/preview/:project_id/*filepath", public: true},
+	{method: "GET", path: "/api/v1/ping", public: true},
+	{method: "GET", path: "/api/v1/public/projects", public: true},
+
+	{method: "GET", path: "/auth/pbkey", public: true},
+	{method: "POST", path: "/auth/register", public: true},
+	{method: "POST", path: "/auth/login", public: true},
+	{method: "POST", path: "/auth/google/url", public: true},
+	{method: "POST", path: "/auth/google/callback", public: true},
+	{method: "GET", path: "/auth/oidc", public: true},
+	{method: "POST", path: "/auth/oidc/:provider/url", public: true},
+	{method: "POST", path: "/auth/oidc/:provider/callback", public: true},
+	{method: "POST", path: "/auth/oidc/:provider/link/url", allow: allowEveryone},
+	{method: "POST", path: "/auth/oidc/:provider/link", allow: allowEveryone},
+	{method: "GET", path: "/auth/identities", allow: allowEveryone},
+	{method: "DELETE", path: "/auth/identities/:identity_id", allow: allowEveryone},
+	{method: "POST", path: "/auth/refresh", public: true},
+	{method: "POST", path: "/auth/logout", public: true},
+	{method: "GET", path: "/auth/validate", public: true},
+	{method: "POST", path: "/auth/password/forgot", public: true},
+	{method: "POST", path: "/auth/password/reset", public: true},
+	{method: "POST", path: "/auth/password/change", allow: allowEveryone},
+	{method: "POST", path: "/auth/email/verification", allow: allowEveryone},
+	{method: "POST", path: "/auth/email/verification/confirm", public: true},
+	{method: "POST", path: "/auth/magic-link", public: true},
+	{method: "POST", path: "/auth/magic-link/login", public: true},
+	{method: "POST", path: "/auth/phone/code", public: true},
+	{method: "POST", path: "/auth/phone/login", public: true},
+	{method: "GET", path: "/auth/phones", allow: allowEveryone},
+	{method: "POST", path: "/auth/phones", allow: allowEveryone},
+	{method: "POST", path: "/auth/phones/:phone_id/verify", allow: allowEveryone},
+	{method: "DELETE", path: "/auth/phones/:phone_id", allow: allowEveryone},
+	{method: "POST", path: "/auth/mfa/challenge", public: true},
+	{method: "POST", path: "/auth/mfa/challenge/enroll", public: true},
+	{method: "GET", path: "/auth/mfa", allow: allowEveryone},
+	{method: "POST", path: "/auth/mfa/totp", allow: allowEveryone},
+	{method: "POST", path: "/auth/mfa/totp/confirm", allow: allowEveryone},
+	{method: "POST", path: "/auth/mfa/disable", allow: allowEveryone},
+	{method: "POST", path: "/auth/mfa/recovery-codes", allow: allowEveryone},
+	{method: "POST", path: "/auth/logout-all", allow: allowEveryone},
+	{method: "GET", path: "/auth/profile", allow: allowEveryone},
+	{method: "GET", path: "/auth/sessions", allow: allowEveryone},
+	{method: "DELETE", path: "/auth/sessions/:session_id", allow: allowEveryone},
+
+	{method: "GET", path: "/api/v1/users", kind: services.ResourceSystem, action: services.ActionRead, permission: models.PermissionUsersRead, allow: allowUserAdmin},
+	{method: "GET", path: "/api/v1/users/search", kind: services.ResourceSystem, action: services.ActionRead, permission: models.PermissionUsersRead, allow: allowUserAdmin},
+	{method: "GET", path: "/api/v1/users/:id", kind: services.ResourceUser, action: services.ActionRead, allow: allowSelf},
+	{method: "PUT", path: "/api/v1/users/:id", kind: services.ResourceUser, action: services.ActionWrite, allow: allowSelf},
+	{method: "DELETE", path: "/api/v1/users/:id", kind: services.ResourceUser, action: services.ActionDelete, allow: allowSelf},
+	{method: "POST", path: "/api/v1/users/:id/activate", kind: services.ResourceUser, action: services.ActionManage, allow: allowUserAdmin},
+	{method: "POST", path: "/api/v1/users/:id/deactivate", kind: services.ResourceUser, action: services.ActionManage, allow: allowUserAdmin},
+	{method: "GET", path: "/api/v1/users/:id/projects", kind: services.ResourceUser, action: services.ActionRead, allow: allowSelf},
+	{method: "GET", path: "/api/v1/users/:id/chat-sessions", kind: services.ResourceUser, action: services.ActionRead, allow: allowSelf},
+	{method: "GET", path: "/api/v1/users/:id/chat-sessions/recent", kind: services.ResourceUser, action: services.ActionRead, allow: allowSelf},
+	{method: "POST", path: "/api/v1/users/:id/projects", kind: services.ResourceUser, action: services.ActionWrite, allow: allowSelf},
+	{method: "POST", path: "/api/v1/users/:id/projects/import", kind: services.ResourceUser, action: services.ActionWrite, allow: allowSelf},
+	{method: "GET", path: "/api/v1/users/:id/projects/slug/:slug", kind: services.ResourceProject, action: services.ActionRead, allow: allowProjectRead},
+
+	{method: "GET", path: "/api/v1/projects", allow: allowEveryone},
+	{method: "GET", path: "/api/v1/projects/search", allow: allowEveryone},
+	{method: "GET", path: "/api/v1/projects/:id", kind: services.ResourceProject, action: services.ActionRead, allow: allowProjectRead},
+	{method: "PUT", path: "/api/v1/projects/:id", kind: services.ResourceProject, action: services.ActionManage, allow: allowProjectManage},
+	{method: "DELETE", path: "/api/v1/projects/:id", kind: services.ResourceProject, action: services.ActionDelete, allow: allowProjectDelete},
+	{method: "PUT", path: "/api/v1/projects/:id/visibility", kind: services.ResourceProject, action: services.ActionManage, allow: allowProjectManage},
+	{method: "PUT", path: "/api/v1/projects/:id/storage-quota", kind: services.ResourceSystem, action: services.ActionManage, permission: models.PermissionQuotasManage, allow: allowSiteAdmin},
+	{method: "GET", path: "/api/v1/projects/:id/storage-usage", kind: services.ResourceProject, action: services.ActionRead, allow: allowProjectRead},
+	{method: "POST", path: "/api/v1/projects/:id/fork", kind: services.ResourceProject, action: services.ActionRead, allow: allowPrivateFork},
+	{method: "GET", path: "/api/v1/projects/:id/chat-sessions", kind: services.ResourceProject, action: services.ActionRead, allow: allowProjectRead},
+	{method: "GET", path: "/api/v1/projects/:id/export", kind: services.ResourceProject, action: services.ActionRead, allow: allowProjectRead},
+	{method: "POST", path: "/api/v1/projects/:id/chat", kind: services.ResourceProject, action: services.ActionWrite, allow: allowProjectWrite},
+	{method: "POST", path: "/api/v1/projects/:id/preview", kind: services.ResourceProject, action: services.ActionWrite, allow: allowProjectWrite},
+	{method: "POST", path: "/api/v1/projects/:id/preview/link", kind: services.ResourceProject, action: services.ActionRead, allow: allowProjectRead},
+	{method: "POST", path: "/api/v1/projects/:id/preview/live", kind: services.ResourceProject, action: services.ActionWrite, allow: allowProjectWrite},
+	{method: "GET", path: "/api/v1/projects/:id/preview/live", kind: services.ResourceProject, action: services.ActionRead, allow: allowProjectRead},
+	{method: "DELETE", path: "/api/v1/projects/:id/preview/live", kind: services.ResourceProject, action: services.ActionWrite, allow: allowProjectWrite},
+	{method: "GET", path: "/api/v1/projects/:id/preview/deployments", kind: services.ResourceProject, action: services.ActionRead, allow: allowProjectRead},
+	{method: "POST", path: "/api/v1/projects/:id/preview/deployments/:deployment_id/rollback", kind: services.ResourceProject, action: services.ActionWrite, allow: allowProjectWrite},
+
+	{method: "GET", path: "/api/v1/projects/:id/files", kind: services.ResourceProject, action: services.ActionRead, allow: allowProjectRead},
+	{method: "GET", path: "/api/v1/projects/:id/files/content", kind: services.ResourceProject, action: services.ActionRead, allow: allowProjectRead},
+	{method: "PUT", path: "/api/v1/projects/:id/files/content", kind: services.ResourceProject, action: services.ActionWrite, allow: allowProjectWrite},
+	{method: "DELETE", path: "/api/v1/projects/:id/files", kind: services.ResourceProject, action: services.ActionWrite, allow: allowProjectWrite},
+	{method: "POST", path: "/api/v1/projects/:id/files/directories", kind: services.ResourceProject, action: services.ActionWrite, allow: allowProjectWrite},
+	{method: "POST", path: "/api/v1/projects/:id/files/move", kind: services.ResourceProject, action: services.ActionWrite, allow: allowProjectWrite},
+
+	{method: "GET", path: "/api/v1/projects/:id/members", kind: services.ResourceProjectMember, action: services.ActionRead, allow: allowProjectRead},
+	{method: "POST", path: "/api/v1/projects/:id/members", kind: services.ResourceProjectMember, action: services.ActionWrite, allow: allowProjectManage},
+	{method: "PUT", path: "/api/v1/projects/:id/members/:user_id", kind: services.ResourceProjectMember, action: services.ActionWrite, allow: allowProjectManage},
+	{method: "DELETE", path: "/api/v1/projects/:id/members/:user_id", kind: services.ResourceProjectMember, action: services.ActionDelete, allow: allowLeaveProject},
+	{method: "POST", path: "/api/v1/projects/:id/members/accept", allow: allowEveryone},
+	{method: "GET", path: "/api/v1/project-invitations", allow: allowEveryone},
+
+	{method: "GET", path: "/api/v1/templates", allow: allowEveryone},
+	{method: "GET", path: "/api/v1/templates/:id", allow: allowEveryone},
+	{method: "POST", path: "/api/v1/templates", kind: services.ResourceSystem, action: services.ActionManage, permission: models.PermissionTemplatesManage, allow: allowSiteAdmin},
+	{method: "PUT", path: "/api/v1/templates/:id", kind: services.ResourceSystem, action: services.ActionManage, permission: models.PermissionTemplatesManage, allow: allowSiteAdmin},
+	{method: "PUT", path: "/api/v1/templates/:id/archive", kind: services.ResourceSystem, action: services.ActionManage, permission: models.PermissionTemplatesManage, allow: allowSiteAdmin},
+	{method: "DELETE", path: "/api/v1/templates/:id", kind: services.ResourceSystem, action: services.ActionManage, permission: models.PermissionTemplatesManage, allow: allowSiteAdmin},
+
+	{method: "GET", path: "/api/v1/admin/permissions", kind: services.ResourceSystem, action: services.ActionRead, permission: models.PermissionRolesManage, allow: allowSiteAdmin},
+	{method: "GET", path: "/api/v1/admin/roles", kind: services.ResourceSystem, action: services.ActionRead, permission: models.PermissionRolesManage, allow: allowSiteAdmin},
+	{method: "POST", path: "/api/v1/admin/roles", kind: services.ResourceSystem, action: services.ActionManage, permission: models.PermissionRolesManage, allow: allowSiteAdmin},
+	{method: "DELETE", path: "/api/v1/admin/roles/:id", kind: services.ResourceSystem, action: services.ActionManage, permission: models.PermissionRolesManage, allow: allowSiteAdmin},
+	{method: "GET", path: "/api/v1/admin/users/:id/roles", kind: services.ResourceSystem, action: services.ActionRead, permission: models.PermissionRolesManage, allow: allowSiteAdmin},
+	{method: "POST", path: "/api/v1/admin/users/:id/roles", kind: services.ResourceSystem, action: services.ActionManage, permission: models.PermissionRolesManage, allow: allowSiteAdmin},
+	{method: "DELETE", path: "/api/v1/admin/users/:id/roles/:role", kind: services.ResourceSystem, action: services.ActionManage, permission: models.PermissionRolesManage, allow: allowSiteAdmin},
+	{method: "GET", path: "/api/v1/admin/mfa-policies", kind: services.ResourceSystem, action: services.ActionRead, permission: models.PermissionSecurityManage, allow: allowSiteAdmin},
+	{method: "PUT", path: "/api/v1/admin/mfa-policies/:level", kind: services.ResourceSystem, action: services.ActionManage, permission: models.PermissionSecurityManage, allow: allowSiteAdmin},
+
+	// Chat sessions and messages are authorized against their project
+	{method: "POST", path: "/api/v1/chat-sessions", kind: services.ResourceProject, action: services.ActionWrite, allow: allowProjectWrite},
+	{method: "GET", path: "/api/v1/chat-sessions/:id", kind: services.ResourceProject, action: services.ActionRead, allow: allowProjectRead},
+	{method: "PUT", path: "/api/v1/chat-sessions/:id", kind: services.ResourceProject, action: services.ActionWrite, allow: allowProjectWrite},
+	{method: "DELETE", path: "/api/v1/chat-sessions/:id", kind: services.ResourceProject, action: services.ActionManage, allow: allowProjectManage},
+	{method: "POST", path: "/api/v1/chat-sessions/:id/archive", kind: services.ResourceProject, action: services.ActionWrite, allow: allowProjectWrite},
+	{method: "POST", path: "/api/v1/chat-sessions/:id/unarchive", kind: services.ResourceProject, action: services.ActionWrite, allow: allowProjectWrite},
+	{method: "GET", path: "/api/v1/chat-sessions/:id/messages", kind: services.ResourceProject, action: services.ActionRead, allow: allowProjectRead},
+	{method: "GET", path: "/api/v1/chat-sessions/:id/with-messages", kind: services.ResourceProject, action: services.ActionRead, allow: allowProjectRead},
+	{method: "POST", path: "/api/v1/chat-messages", kind: services.ResourceProject, action: services.ActionWrite, allow: allowProjectWrite},
+	{method: "GET", path: "/api/v1/chat-messages/:id", kind: services.ResourceProject, action: services.ActionRead, allow: allowProjectRead},
+	{method: "PUT", path: "/api/v1/chat-messages/:id", kind: services.ResourceProject, action: services.ActionWrite, allow: allowProjectWrite},
+	{method: "DELETE", path: "/api/v1/chat-messages/:id", kind: services.ResourceProject, action: services.ActionWrite, allow: allowProjectWrite},
+
+	// Builds are authorized against their project
+	{method: "GET", path: "/api/v1/builds", allow: allowEveryone},
+	{method: "POST", path: "/api/v1/builds", kind: services.ResourceProject, action: services.ActionWrite, allow: allowProjectWrite},
+	{method: "POST", path: "/api/v1/builds/claude", kind: services.ResourceProject, action: services.ActionWrite, allow: allowProjectWrite},
+	{method: "GET", path: "/api/v1/builds/:id", kind: services.ResourceProject, action: services.ActionRead, allow: allowProjectRead},
+	{method: "DELETE", path: "/api/v1/builds/:id", kind: services.ResourceProject, action: services.ActionWrite, allow: allowProjectWrite},
+	{method: "GET", path: "/api/v1/builds/:id/logs", kind: services.ResourceProject, action: services.ActionRead, allow: allowProjectRead},
+	{method: "GET", path: "/api/v1/builds/:id/stream", kind: services.ResourceProject, action: services.ActionRead, allow: allowProjectRead},
+	{method: "GET", path: "/api/v1/projects/:id/builds", kind: services.ResourceProject, action: services.ActionRead, allow: allowProjectRead},
+	{method: "POST", path: "/api/v1/projects/:id/builds", kind: services.ResourceProject, action: services.ActionWrite, allow: allowProjectWrite},
+	{method: "POST", path: "/api/v1/projects/:id/builds/claude", kind: services.ResourceProject, action: services.ActionWrite, allow: allowProjectWrite},
+}
+
+func newTestRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	setupRoutes(router, &handlers.HealthHandler{}, &handlers.UserHandler{}, &handlers.ProjectHandler{}, &handlers.ChatHandler{},
+		&handlers.AuthHandler{}, &handlers.BuildHandler{}, &handlers.FileHandler{}, &handlers.TemplateHandler{}, &handlers.MemberHandler{},
+		&handlers.RoleHandler{}, &handlers.PreviewHandler{}, nil, nil, nil, &config.Config{})
+	return router
+}
+
+func TestEveryRouteHasPolicy(t *testing.T) {
+	policies := make(map[string]bool)
+	for _, policy := range routePolicies {
+		key := policy.method + " " + policy.path
+		if policies[key] {
+			t.Errorf("duplicate policy for %s", key)
+		}
+		policies[key] = true
+	}
+
+	registered := make(map[string]bool)
+	for _, route := range newTestRouter().Routes() {
+		key := route.Method + " " + route.Path
+		registered[key] = true
+		if !policies[key] {
+			t.Errorf("route %s has no authorization policy", key)
+		}
+	}
+	for key := range policies {
+		if !registered[key] {
+			t.Errorf("policy for unknown route %s", key)
+		}
+	}
+}
+
+// routeFixture is the data authorization requests run against: a private project the
+// subjects hold their roles on, with a chat session, message, build and deployment, and the
+// admin role held by "site_admin" and one other user
+type routeFixture struct {
+	router     *gin.Engine
+	db         *testDatabase
+	roles      *services.RoleService
+	tokens     map[string]string
+	project    uuid.UUID
+	session    uuid.UUID
+	message    uuid.UUID
+	build      uuid.UUID
+	deployment uuid.UUID
+}
+
+// newRouteFixture serves the routes with the services main wires up, on a test database
+// holding the fixture. The database turns read-only once the fixture is loaded.
+func newRouteFixture(t *testing.T) *routeFixture {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	testDB, db, err := newTestDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := database.DB
+	database.DB = db
+	t.Cleanup(func() { database.DB = previous })
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	jwtService := services.NewJWTService(services.SigningAlgorithmEdDSA, services.KeyRotationPolicy{Interval: time.Hour}, logger)
+	if err := jwtService.RotateKeys(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	f := &routeFixture{
+		tokens:     make(map[string]string),
+		project:    uuid.New(),
+		session:    uuid.New(),
+		message:    uuid.New(),
+		build:      uuid.New(),
+		deployment: uuid.New(),
+	}
+	owner := testSubjects["owner"].subject.UserID
+	rows := []interface{}{
+		&models.Project{ID: f.project, OwnerID: owner, Name: "App", Slug: "app", Visibility: models.ProjectVisibilityPrivate, Version: 1},
+		&models.ChatSession{ID: f.session, UserID: owner, ProjectID: f.project},
+		&models.ChatMessage{ID: f.message, SessionID: f.session, Sender: models.ChatSenderUser},
+		&models.Build{ID: f.build, UserID: owner, ProjectID: f.project},
+		&models.PreviewDeployment{ID: f.deployment, ProjectID: f.project, Version: 1},
+	}
+	adminRole := uuid.New()
+	rows = append(rows,
+		&models.Role{ID: adminRole, Name: models.RoleAdmin, IsSystem: true},
+		&models.UserRole{UserID: testSubjects["site_admin"].subject.UserID, RoleID: adminRole},
+		&models.UserRole{UserID: uuid.New(), RoleID: adminRole},
+	)
+	for name, caller := range testSubjects {
+		if caller.subject.UserID == uuid.Nil {
+			continue
+		}
+		rows = append(rows, &models.User{ID: caller.subject.UserID, IsActive: true})
+		if caller.role != "" && caller.role != models.ProjectRoleOwner {
+			rows = append(rows, &models.ProjectMember{ProjectID: f.project, UserID: caller.subject.UserID, Role: caller.role, Status: models.ProjectMemberStatusAccepted})
+		}
+		token, err := jwtService.GenerateAccessToken(caller.subject.UserID, uuid.New(), &services.UserAccess{
+			Roles:       caller.subject.Roles,
+			Permissions: caller.subject.Permissions,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.tokens[name] = token
+	}
+	if err := testDB.insert(db, rows...); err != nil {
+		t.Fatal(err)
+	}
+	testDB.setReadOnly(true)
+	f.db = testDB
+
+	authorizer := services.NewAuthorizer()
+	projectService := services.NewProjectService(authorizer)
+	revocationService := services.NewTokenRevocationService(logger)
+	roleService := services.NewRoleService(revocationService, logger)
+	f.roles = roleService
+	authService := services.NewAuthService("", "", "", nil, services.NewDBCredentialStore(),
+		services.NewPasswordHasher(services.Argon2Params{Memory: 64, Iterations: 1, Parallelism: 1}), nil, nil)
+	buildService := services.NewBuildService("", logger)
+	quotaService := services.NewQuotaService(t.TempDir(), logger)
+	templateService := services.NewTemplateService("test", "", logger)
+	workspaceService := services.NewWorkspaceService(t.TempDir(), "test", templateService, quotaService, logger)
+	previewService := services.NewPreviewService(buildService, workspaceService, templateService, quotaService, "test-link-secret", logger)
+	devServerService := services.NewDevServerService(buildService, workspaceService, templateService, time.Minute, logger)
+
+	f.router = gin.New()
+	f.router.Use(gin.RecoveryWithWriter(io.Discard))
+	setupRoutes(f.router,
+		handlers.NewHealthHandler(logger),
+		handlers.NewUserHandler(services.NewUserService(), authService, authorizer, logger),
+		handlers.NewProjectHandler(projectService, workspaceService, quotaService, templateService, previewService, authorizer, logger),
+		handlers.NewChatHandler(services.NewChatService(), projectService, workspaceService, authorizer, logger),
+		handlers.NewAuthHandler(authService, jwtService, roleService, logger),
+		handlers.NewBuildHandler(buildService, projectService, logger),
+		handlers.NewFileHandler(projectService, workspaceService, quotaService, logger),
+		handlers.NewTemplateHandler(templateService, logger),
+		handlers.NewMemberHandler(projectService, authorizer, logger),
+		handlers.NewRoleHandler(roleService, logger),
+		handlers.NewPreviewHandler(projectService, previewService, devServerService, logger),
+		jwtService, roleService, revocationService, &config.Config{})
+	return f
+}
+
+// path fills in a route's parameters with the fixture. User routes address "self", apart
+// from the project slug route, which is addressed by the project's owner.
+func (f *routeFixture) path(route string) string {
+	segments := strings.Split(route, "/")
+	for i, segment := range segments {
+		switch segment {
+		case ":id":
+			switch segments[i-1] {
+			case "users":
+				segments[i] = testSubjects["self"].subject.UserID.String()
+				if strings.Contains(route, "/slug/") {
+					segments[i] = testSubjects["owner"].subject.UserID.String()
+				}
+			case "projects":
+				segments[i] = f.project.String()
+			case "chat-sessions":
+				segments[i] = f.session.String()
+			case "chat-messages":
+				segments[i] = f.message.String()
+			case "builds":
+				segments[i] = f.build.String()
+			default:
+				segments[i] = uuid.NewString()
+			}
+		case ":user_id":
+			segments[i] = testSubjects["viewer"].subject.UserID.String()
+		case ":deployment_id":
+			segments[i] = f.deployment.String()
+		case ":slug":
+			segments[i] = "app"
+		case ":role":
+			segments[i] = models.RoleAdmin
+		case ":level":
+			segments[i] = "free"
+		case ":provider":
+			segments[i] = "keycloak"
+		default:
+			if strings.HasPrefix(segment, ":") {
+				segments[i] = uuid.NewString()
+			}
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// routeRequest is the query and body a route is sent, for routes that validate them before
+// authorizing. In both, %[1]s is the project, %[2]s the chat session and %[3]s the caller.
+type routeRequest struct {
+	query string
+	body  string
+}
+
+var routeRequests = map[string]routeRequest{
+	"POST /api/v1/chat-sessions":                  {body: `{"project_id":"%[1]s","user_id":"%[3]s"}`},
+	"POST /api/v1/chat-messages":                  {body: `{"session_id":"%[2]s","sender":"user","content":{}}`},
+	"POST /api/v1/builds":                         {query: "project_id=%[1]s", body: `{"command":"true"}`},
+	"POST /api/v1/builds/claude":                  {query: "project_id=%[1]s", body: `{"prompt":"hello"}`},
+	"POST /api/v1/projects/:id/builds":            {body: `{"command":"true"}`},
+	"GET /api/v1/projects/:id/files/content":      {query: "path=index.html"},
+	"PUT /api/v1/projects/:id/files/content":      {query: "path=index.html&version=1", body: `{"content":""}`},
+	"DELETE /api/v1/projects/:id/files":           {query: "path=index.html&version=1"},
+	"POST /api/v1/projects/:id/files/directories": {body: `{"path":"src","version":1}`},
+	"POST /api/v1/projects/:id/files/move":        {body: `{"from":"index.html","to":"main.html","version":1}`},
+	"POST /api/v1/projects/:id/members":           {body: `{"email":"new@example.com","role":"editor"}`},
+	"PUT /api/v1/projects/:id/members/:user_id":   {body: `{"role":"editor"}`},
+	"PUT /api/v1/projects/:id/storage-quota":      {body: `{"storage_quota_bytes":1048576}`},
+	"PUT /api/v1/projects/:id/visibility":         {body: `{"visibility":"public"}`},
+	"POST /api/v1/users/:id/projects":             {body: `{"name":"Another app"}`},
+	"POST /api/v1/admin/users/:id/roles":          {body: `{"role":"admin"}`},
+	"PUT /api/v1/admin/mfa-policies/:level":       {body: `{"required":false}`},
+	"GET /api/v1/chat-sessions/:id/messages":      {query: "limit=10"},
+	"GET /api/v1/users/:id/chat-sessions/recent":  {query: "limit=10"},
+}
+
+// request sends a request to a route as the named subject. Streaming responses are cut off
+// after a moment.
+func (f *routeFixture) request(policy routePolicy, name string) *httptest.ResponseRecorder {
+	route := routeRequests[policy.method+" "+policy.path]
+	fill := func(template string) string {
+		if !strings.Contains(template, "%") {
+			return template
+		}
+		return fmt.Sprintf(template, f.project, f.session, testSubjects[name].subject.UserID)
+	}
+	body := "{}"
+	if route.body != "" {
+		body = fill(route.body)
+	}
+	target := f.path(policy.path)
+	if route.query != "" {
+		target += "?" + fill(route.query)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest(policy.method, target, strings.NewReader(body)).WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if token, ok := f.tokens[name]; ok {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	f.router.ServeHTTP(w, req)
+	return w
+}
+
+// deniedStatus is the response a subject a route's policy does not allow gets: 404 for
+// projects it cannot see, 403 otherwise
+func deniedStatus(policy routePolicy, caller testSubject) int {
+	switch {
+	case caller.subject.UserID == uuid.Nil:
+		return http.StatusUnauthorized
+	case caller.role != "", caller.subject.IsAdmin():
+		// Members and site admins can see the project
+		return http.StatusForbidden
+	case policy.kind == services.ResourceProject || policy.kind == services.ResourceProjectMember,
+		strings.HasPrefix(policy.path, "/api/v1/projects/:id"):
+		return http.StatusNotFound
+	}
+	return http.StatusForbidden
+}
+
+// isDenial reports whether a response comes from authentication or authorization
+func isDenial(w *httptest.ResponseRecorder) bool {
+	switch w.Code {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return true
+	case http.StatusNotFound:
+		return strings.Contains(w.Body.String(), "Project not found")
+	}
+	return false
+}
+
+// TestRouteAuthorization sends every subject to every protected route and checks that the
+// subjects a route's policy does not allow are refused, and that the others get past
+// authorization
+func TestRouteAuthorization(t *testing.T) {
+	f := newRouteFixture(t)
+
+	names := make([]string, 0, len(testSubjects))
+	for name := range testSubjects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, policy := range routePolicies {
+		if policy.public {
+			continue
+		}
+		policy := policy
+		t.Run(policy.method+" "+policy.path, func(t *testing.T) {
+			allowed := make(map[string]bool)
+			for _, name := range policy.allow {
+				allowed[name] = true
+			}
+
+			for _, name := range names {
+				w := f.request(policy, name)
+				if allowed[name] {
+					if isDenial(w) {
+						t.Errorf("%s: status %d %s, want the request to be authorized", name, w.Code, w.Body.String())
+					}
+					continue
+				}
+				if want := deniedStatus(policy, testSubjects[name]); w.Code != want {
+					t.Errorf("%s: status %d %s, want %d", name, w.Code, w.Body.String(), want)
+				}
+			}
+		})
+	}
+}
+
+// TestRevokedRoleStopsWorking checks that access tokens issued before a role was revoked no
+// longer carry it
+func TestRevokedRoleStopsWorking(t *testing.T) {
+	f := newRouteFixture(t)
+	listRoles := routePolicy{method: "GET", path: "/api/v1/admin/roles"}
+	if w := f.request(listRoles, "site_admin"); w.Code != http.StatusOK {
+		t.Fatalf("before revoking: status %d %s, want 200", w.Code, w.Body.String())
+	}
+
+	// Tokens issued in the second of the revocation stay valid, so move past it
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	f.db.setReadOnly(false)
+	admin := testSubjects["site_admin"].subject.UserID
+	if err := f.roles.RevokeRole(context.Background(), services.RoleAuditContext{ActorID: admin}, admin, models.RoleAdmin); err != nil {
+		t.Fatalf("RevokeRole: %v", err)
+	}
+
+	if w := f.request(listRoles, "site_admin"); w.Code != http.StatusUnauthorized {
+		t.Errorf("after revoking: status %d %s, want 401", w.Code, w.Body.String())
+	}
+}
+
+func TestProjectMemberPolicy(t *testing.T) {
+	authorizer := services.NewAuthorizer()
+	maintainer := testSubjects["maintainer"]
+	owner := testSubjects["owner"]
+	member := uuid.New()
+
+	tests := []struct {
+		name   string
+		caller testSubject
+		action services.Action
+		target models.ProjectRole
+		want   bool
+	}{
+		{"maintainer invites editor", maintainer, services.ActionWrite, models.ProjectRoleEditor, true},
+		{"maintainer cannot invite admin", maintainer, services.ActionWrite, models.ProjectRoleAdmin, false},
+		{"maintainer cannot remove admin", maintainer, services.ActionDelete, models.ProjectRoleAdmin, false},
+		{"owner invites admin", owner, services.ActionWrite, models.ProjectRoleAdmin, true},
+		{"owner removes admin", owner, services.ActionDelete, models.ProjectRoleAdmin, true},
+		{"projects.admin overrides", newPermittedSubject(models.PermissionProjectsAdmin), services.ActionWrite, models.ProjectRoleAdmin, true},
+	}
+	for _, tt := range tests {
+		got := authorizer.Can(tt.caller.subject, tt.action, services.ProjectMemberResource(tt.caller.role, member, tt.target))
+		if got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
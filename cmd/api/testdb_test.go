@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// errReadOnly is returned for writes once the test database is read-only, so handlers stop
+// at their first change after authorizing a request
+var errReadOnly = errors.New("test database is read-only")
+
+// conditionPattern matches the "column = ?" and "column IN ?" parts of a WHERE clause
+var conditionPattern = regexp.MustCompile(`^\(?(?:\w+\.)?(\w+) (?:=|IN) \(?\?\)?\)?$`)
+
+// testDatabase is an in-memory stand-in for Postgres with just enough of it for the lookups
+// handlers make before they authorize a request. Queries return the rows of their table that
+// match the "column = ?" and "column IN ?" conditions of their WHERE clause; other conditions,
+// joins and preloads are ignored. Updates of columns given as a map and deletes with such
+// conditions apply to the same rows; inserts are accepted without being stored.
+type testDatabase struct {
+	mu       sync.Mutex
+	rows     map[string][]interface{} // pointers to models, by table
+	readOnly bool
+}
+
+func newTestDatabase() (*testDatabase, *gorm.DB, error) {
+	d := &testDatabase{rows: make(map[string][]interface{})}
+	db, err := gorm.Open(d, &gorm.Config{})
+	return d, db, err
+}
+
+// insert adds rows, given as pointers to models
+func (d *testDatabase) insert(db *gorm.DB, rows ...interface{}) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, row := range rows {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(row); err != nil {
+			return err
+		}
+		d.rows[stmt.Table] = append(d.rows[stmt.Table], row)
+	}
+	return nil
+}
+
+// setReadOnly makes every later write fail, or be accepted again
+func (d *testDatabase) setReadOnly(readOnly bool) {
+	d.mu.Lock()
+	d.readOnly = readOnly
+	d.mu.Unlock()
+}
+
+func (d *testDatabase) Name() string { return "test" }
+
+func (d *testDatabase) Initialize(db *gorm.DB) error {
+	db.ConnPool = testConnPool{}
+	callbacks := []error{
+		db.Callback().Query().Register("test:query", d.query),
+		db.Callback().Create().Register("test:create", d.write),
+		db.Callback().Update().Register("test:update", d.update),
+		db.Callback().Delete().Register("test:delete", d.delete),
+		db.Callback().Raw().Register("test:raw", d.write),
+		db.Callback().Row().Register("test:row", d.write),
+	}
+	return errors.Join(callbacks...)
+}
+
+func (d *testDatabase) Migrator(*gorm.DB) gorm.Migrator          { return nil }
+func (d *testDatabase) DataTypeOf(*schema.Field) string          { return "" }
+func (d *testDatabase) QuoteTo(writer clause.Writer, str string) { _, _ = writer.WriteString(str) }
+func (d *testDatabase) Explain(sql string, _ ...interface{}) string {
+	return sql
+}
+
+func (d *testDatabase) DefaultValueOf(*schema.Field) clause.Expression {
+	return clause.Expr{SQL: "DEFAULT"}
+}
+
+func (d *testDatabase) BindVarTo(writer clause.Writer, _ *gorm.Statement, _ interface{}) {
+	_ = writer.WriteByte('?')
+}
+
+// SavePoint and RollbackTo let nested transactions run
+func (d *testDatabase) SavePoint(*gorm.DB, string) error  { return nil }
+func (d *testDatabase) RollbackTo(*gorm.DB, string) error { return nil }
+
+// write accepts writes without storing them until the database is read-only
+func (d *testDatabase) write(db *gorm.DB) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.readOnly {
+		_ = db.AddError(errReadOnly)
+	}
+}
+
+// update sets the columns of a map update, e.g. from Update("column", value), on the
+// matching rows
+func (d *testDatabase) update(db *gorm.DB) {
+	d.write(db)
+	stmt := db.Statement
+	columns, ok := stmt.Dest.(map[string]interface{})
+	if db.Error != nil || stmt.Schema == nil || !ok {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	rows := d.match(stmt)
+	for _, row := range rows {
+		for column, value := range columns {
+			field := stmt.Schema.LookUpField(column)
+			if field == nil {
+				_ = db.AddError(fmt.Errorf("test database: unknown column %s", column))
+				return
+			}
+			if err := field.Set(stmt.Context, reflect.ValueOf(row).Elem(), value); err != nil {
+				_ = db.AddError(err)
+				return
+			}
+		}
+	}
+	db.RowsAffected = int64(len(rows))
+}
+
+// delete removes the matching rows. Deletes without conditions are refused, like gorm does,
+// and deletes without equality conditions remove nothing.
+func (d *testDatabase) delete(db *gorm.DB) {
+	d.write(db)
+	stmt := db.Statement
+	if db.Error != nil || stmt.Schema == nil {
+		return
+	}
+	if _, ok := stmt.Clauses["WHERE"]; !ok {
+		_ = db.AddError(gorm.ErrMissingWhereClause)
+		return
+	}
+	if len(conditionsOf(stmt)) == 0 {
+		// Only equality conditions are understood, so keep rows rather than drop too many
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	deleted := make(map[interface{}]bool)
+	for _, row := range d.match(stmt) {
+		deleted[row] = true
+	}
+	kept := d.rows[stmt.Table][:0]
+	for _, row := range d.rows[stmt.Table] {
+		if !deleted[row] {
+			kept = append(kept, row)
+		}
+	}
+	d.rows[stmt.Table] = kept
+	db.RowsAffected = int64(len(deleted))
+}
+
+// query scans the matching rows into the destination: a model, a slice of models or a count
+func (d *testDatabase) query(db *gorm.DB) {
+	stmt := db.Statement
+	if db.Error != nil || stmt.Schema == nil || stmt.SQL.Len() > 0 {
+		return
+	}
+
+	d.mu.Lock()
+	matches := d.match(stmt)
+	d.mu.Unlock()
+
+	dest := stmt.ReflectValue
+	rowType := stmt.Schema.ModelType
+	found := 0
+	switch {
+	case dest.Kind() == reflect.Int64:
+		dest.SetInt(int64(len(matches)))
+		found = 1
+	case dest.Kind() == reflect.Slice && dest.Type().Elem() == rowType:
+		for _, row := range matches {
+			dest.Set(reflect.Append(dest, reflect.ValueOf(row).Elem()))
+		}
+		found = len(matches)
+	case dest.Kind() == reflect.Slice && dest.Type().Elem() == reflect.PointerTo(rowType):
+		for _, row := range matches {
+			dest.Set(reflect.Append(dest, reflect.ValueOf(row)))
+		}
+		found = len(matches)
+	case dest.Type() == rowType && len(matches) > 0:
+		dest.Set(reflect.ValueOf(matches[0]).Elem())
+		found = 1
+	}
+
+	db.RowsAffected = int64(found)
+	if found == 0 && stmt.RaiseErrorOnNotFound {
+		_ = db.AddError(gorm.ErrRecordNotFound)
+	}
+}
+
+// match returns the rows of the statement's table that satisfy its conditions
+func (d *testDatabase) match(stmt *gorm.Statement) []interface{} {
+	conditions := conditionsOf(stmt)
+	var matches []interface{}
+	for _, row := range d.rows[stmt.Table] {
+		if reflect.TypeOf(row).Elem() != stmt.Schema.ModelType {
+			continue
+		}
+		matched := true
+		for column, want := range conditions {
+			field := stmt.Schema.LookUpField(column)
+			if field == nil {
+				continue
+			}
+			got, _ := field.ValueOf(stmt.Context, reflect.ValueOf(row).Elem())
+			if !valueIn(got, want) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			matches = append(matches, row)
+		}
+	}
+	return matches
+}
+
+// conditionsOf collects the values each column must have from the WHERE clause. Expressions
+// with OR are skipped, so queries only return too many rows, never too few.
+func conditionsOf(stmt *gorm.Statement) map[string]interface{} {
+	conditions := make(map[string]interface{})
+	where, ok := stmt.Clauses["WHERE"].Expression.(clause.Where)
+	if !ok {
+		return conditions
+	}
+
+	column := func(c interface{}) string {
+		switch c := c.(type) {
+		case string:
+			return c
+		case clause.Column:
+			if c.Name == clause.PrimaryKey && stmt.Schema.PrioritizedPrimaryField != nil {
+				return stmt.Schema.PrioritizedPrimaryField.DBName
+			}
+			return c.Name
+		}
+		return ""
+	}
+
+	for _, expression := range where.Exprs {
+		switch e := expression.(type) {
+		case clause.Eq:
+			conditions[column(e.Column)] = e.Value
+		case clause.IN:
+			conditions[column(e.Column)] = e.Values
+		case clause.Expr:
+			if strings.Contains(strings.ToUpper(e.SQL), " OR ") {
+				continue
+			}
+			vars := e.Vars
+			for _, part := range strings.Split(e.SQL, " AND ") {
+				n := strings.Count(part, "?")
+				if n > len(vars) {
+					break
+				}
+				if m := conditionPattern.FindStringSubmatch(strings.TrimSpace(part)); m != nil && n == 1 {
+					conditions[m[1]] = vars[0]
+				}
+				vars = vars[n:]
+			}
+		}
+	}
+	return conditions
+}
+
+// valueIn reports whether a column value equals want, or one of want's elements if it is a slice
+func valueIn(got, want interface{}) bool {
+	wanted := reflect.ValueOf(want)
+	if wanted.Kind() == reflect.Slice && wanted.Type().Elem().Kind() != reflect.Uint8 {
+		for i := 0; i < wanted.Len(); i++ {
+			if valueIn(got, wanted.Index(i).Interface()) {
+				return true
+			}
+		}
+		return false
+	}
+	return fmt.Sprint(indirect(got)) == fmt.Sprint(indirect(want))
+}
+
+func indirect(v interface{}) interface{} {
+	value := reflect.ValueOf(v)
+	for value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			return nil
+		}
+		value = value.Elem()
+	}
+	if !value.IsValid() {
+		return nil
+	}
+	return value.Interface()
+}
+
+// testConnPool stands in for the connection, which the test callbacks never use
+type testConnPool struct{}
+
+var errNoConnection = errors.New("test database has no connection")
+
+func (testConnPool) PrepareContext(context.Context, string) (*sql.Stmt, error) {
+	return nil, errNoConnection
+}
+
+func (testConnPool) ExecContext(context.Context, string, ...interface{}) (sql.Result, error) {
+	return nil, errNoConnection
+}
+
+func (testConnPool) QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error) {
+	return nil, errNoConnection
+}
+
+func (testConnPool) QueryRowContext(context.Context, string, ...interface{}) *sql.Row {
+	return nil
+}
+
+func (p testConnPool) BeginTx(context.Context, *sql.TxOptions) (gorm.ConnPool, error) {
+	return &testTx{p}, nil
+}
+
+// testTx is a transaction on the test database; writes are never rolled back
+type testTx struct{ testConnPool }
+
+func (*testTx) Commit() error   { return nil }
+func (*testTx) Rollback() error { return nil }
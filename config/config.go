@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -40,12 +41,19 @@ type Config struct {
 	// JWT
 	JWTSecret     string
 	JWTExpiration string
+	// Access tokens are signed with rotating RS256 or EdDSA keys
+	JWTSigningAlgorithm    string
+	JWTKeyRotationInterval time.Duration
+	JWTKeyOverlap          time.Duration
 
 	// Google OAuth
 	GoogleClientID     string
 	GoogleClientSecret string
 	GoogleRedirectURL  string
 
+	// OpenID Connect providers users can sign in with, from OIDC_PROVIDERS
+	OIDCProviders []OIDCProviderConfig
+
 	// Claude CLI Configuration
 	ClaudeCLIPath string
 
@@ -53,6 +61,11 @@ type Config struct {
 	PasswordEncPublicKey  string
 	PasswordEncPrivateKey string
 
+	// Argon2id cost of new password hashes
+	Argon2Memory      int // KiB
+	Argon2Iterations  int
+	Argon2Parallelism int
+
 	// local storage
 	LocalStoragePath string
 
@@ -61,6 +74,40 @@ type Config struct {
 
 	// Static preview folder root (where built assets will be served from)
 	StaticFolderPath string
+
+	// Secret signing preview links of private projects; generated and stored in the database
+	// when unset
+	PreviewLinkSecret string
+
+	// Live preview dev servers are stopped after this long without requests
+	DevServerIdleTimeout time.Duration
+
+	// Maximum uncompressed size of an imported project (zip upload or git clone)
+	MaxImportBytes int64
+
+	// Email: "smtp", or "file" to write emails to MailFileDir for local testing
+	Mailer       string
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+	MailFrom     string
+	MailFileDir  string
+
+	// Base URL of the web app that email links point to
+	AppBaseURL string
+}
+
+// OIDCProviderConfig configures an OpenID Connect provider. Its endpoints and keys are found
+// through the issuer's discovery document.
+type OIDCProviderConfig struct {
+	Name         string // used in URLs and stored on linked identities, e.g. "gitlab"
+	DisplayName  string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
 }
 
 func LoadConfig() *Config {
@@ -101,6 +148,10 @@ func LoadConfig() *Config {
 		JWTSecret:     getEnv("JWT_SECRET", "your-secret-key-here"),
 		JWTExpiration: getEnv("JWT_EXPIRATION", "24h"),
 
+		JWTSigningAlgorithm:    getEnv("JWT_SIGNING_ALGORITHM", "EdDSA"),
+		JWTKeyRotationInterval: getEnvAsDuration("JWT_KEY_ROTATION_INTERVAL", 30*24*time.Hour),
+		JWTKeyOverlap:          getEnvAsDuration("JWT_KEY_OVERLAP", time.Hour),
+
 		// Google OAuth
 		GoogleClientID:     getEnv("GOOGLE_CLIENT_ID", ""),
 		GoogleClientSecret: getEnv("GOOGLE_CLIENT_SECRET", ""),
@@ -113,14 +164,38 @@ func LoadConfig() *Config {
 		PasswordEncPublicKey:  loadPublicKey(),
 		PasswordEncPrivateKey: loadPrivateKey(),
 
+		// Password hashing
+		Argon2Memory:      getEnvAsInt("ARGON2_MEMORY_KIB", 64*1024),
+		Argon2Iterations:  getEnvAsInt("ARGON2_ITERATIONS", 3),
+		Argon2Parallelism: getEnvAsInt("ARGON2_PARALLELISM", 2),
+
 		// local storage
 		LocalStoragePath:   getEnv("LOCAL_STORAGE_PATH", "workspaces"),
 		ProjectTemplateZip: getEnv("PROJECT_TEMPLATE_ZIP", "project_template.zip"),
 
 		// static folder path
-		StaticFolderPath: getEnv("STATIC_FOLDER_PATH", "./static_previews"),
+		StaticFolderPath:  getEnv("STATIC_FOLDER_PATH", "./static_previews"),
+		PreviewLinkSecret: os.Getenv("PREVIEW_LINK_SECRET"),
+
+		// live preview dev servers
+		DevServerIdleTimeout: getEnvAsDuration("DEV_SERVER_IDLE_TIMEOUT", 15*time.Minute),
+
+		// project import
+		MaxImportBytes: getEnvAsInt64("MAX_IMPORT_BYTES", 200<<20),
+
+		// email
+		Mailer:       getEnv("MAILER", "file"),
+		SMTPHost:     getEnv("SMTP_HOST", ""),
+		SMTPPort:     getEnvAsInt("SMTP_PORT", 587),
+		SMTPUsername: getEnv("SMTP_USERNAME", ""),
+		SMTPPassword: getEnv("SMTP_PASSWORD", ""),
+		MailFrom:     getEnv("MAIL_FROM", "Borderless Coding <no-reply@localhost>"),
+		MailFileDir:  getEnv("MAIL_FILE_DIR", "./mail"),
+		AppBaseURL:   getEnv("APP_BASE_URL", "http://localhost:3000"),
 	}
 
+	config.OIDCProviders = loadOIDCProviders(config.AppBaseURL)
+
 	return config
 }
 
@@ -161,23 +236,68 @@ func (c Config) String() string {
 			"  JWT:\n"+
 			"    Secret: %s\n"+
 			"    Expiration: %s\n"+
+			"    SigningAlgorithm: %s\n"+
+			"    KeyRotationInterval: %s\n"+
 			"  Google:\n"+
 			"    ClientID: %s\n"+
 			"    ClientSecret: %s\n"+
 			"    RedirectURL: %s\n"+
+			"  OIDC:\n"+
+			"    Providers: %s\n"+
 			"  ClaudeCLI:\n"+
 			"    Path: %s\n"+
+			"  Mail:\n"+
+			"    Mailer: %s\n"+
+			"    SMTPHost: %s\n"+
+			"    SMTPPassword: %s\n"+
+			"    From: %s\n"+
 			"  LocalStoragePath:%s",
 		c.Port, c.GinMode,
 		c.DBHost, c.DBPort, c.DBUser, redact(c.DBPassword), c.DBName, c.DBSSLMode,
 		c.RedisHost, c.RedisPort, redact(c.RedisPassword), c.RedisDB,
 		c.MinIOEndpoint, redact(c.MinIOAccessKey), redact(c.MinIOSecretKey), c.MinIOUseSSL, c.MinIOBucketName,
-		redact(c.JWTSecret), c.JWTExpiration,
+		redact(c.JWTSecret), c.JWTExpiration, c.JWTSigningAlgorithm, c.JWTKeyRotationInterval,
 		c.GoogleClientID, redact(c.GoogleClientSecret), c.GoogleRedirectURL,
-		c.ClaudeCLIPath, c.LocalStoragePath,
+		c.oidcProviderNames(),
+		c.ClaudeCLIPath,
+		c.Mailer, c.SMTPHost, redact(c.SMTPPassword), c.MailFrom,
+		c.LocalStoragePath,
 	)
 }
 
+// loadOIDCProviders reads the providers named in OIDC_PROVIDERS (comma separated). Each one
+// is configured with OIDC_<NAME>_ISSUER, _CLIENT_ID, _CLIENT_SECRET, and optionally
+// _DISPLAY_NAME, _SCOPES (space separated) and _REDIRECT_URL.
+func loadOIDCProviders(appBaseURL string) []OIDCProviderConfig {
+	var providers []OIDCProviderConfig
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		providers = append(providers, OIDCProviderConfig{
+			Name:         name,
+			DisplayName:  getEnv(prefix+"DISPLAY_NAME", name),
+			Issuer:       getEnv(prefix+"ISSUER", ""),
+			ClientID:     getEnv(prefix+"CLIENT_ID", ""),
+			ClientSecret: getEnv(prefix+"CLIENT_SECRET", ""),
+			RedirectURL:  getEnv(prefix+"REDIRECT_URL", strings.TrimRight(appBaseURL, "/")+"/login/oidc/"+name),
+			Scopes:       strings.Fields(getEnv(prefix+"SCOPES", "openid email profile")),
+		})
+	}
+	return providers
+}
+
+// oidcProviderNames lists the configured OIDC providers with their issuers
+func (c Config) oidcProviderNames() string {
+	names := make([]string, len(c.OIDCProviders))
+	for i, provider := range c.OIDCProviders {
+		names[i] = provider.Name + " (" + provider.Issuer + ")"
+	}
+	return strings.Join(names, ", ")
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -194,6 +314,24 @@ func getEnvAsInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
+func getEnvAsInt64(key string, defaultValue int64) int64 {
+	if value := os.Getenv(key); value != "" {
+		if intValue, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return intValue
+		}
+	}
+	return defaultValue
+}
+
+func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if duration, err := time.ParseDuration(value); err == nil {
+			return duration
+		}
+	}
+	return defaultValue
+}
+
 func getEnvAsBool(key string, defaultValue bool) bool {
 	if value := os.Getenv(key); value != "" {
 		if boolValue, err := strconv.ParseBool(value); err == nil {
@@ -5,12 +5,11 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base64"
-	"encoding/hex"
 	"encoding/pem"
 	"errors"
 	"net/http"
+	"strconv"
 	"strings"
-	"time"
 
 	"borderless_coding_server/internal/models"
 	"borderless_coding_server/internal/services"
@@ -22,145 +21,201 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
-	"gorm.io/gorm"
 )
 
 type AuthHandler struct {
 	authService *services.AuthService
 	jwtService  *services.JWTService
+	roleService *services.RoleService
 	logger      *logrus.Logger
 }
 
-func NewAuthHandler(authService *services.AuthService, jwtService *services.JWTService, logger *logrus.Logger) *AuthHandler {
+func NewAuthHandler(authService *services.AuthService, jwtService *services.JWTService, roleService *services.RoleService, logger *logrus.Logger) *AuthHandler {
 	return &AuthHandler{
 		authService: authService,
 		jwtService:  jwtService,
+		roleService: roleService,
 		logger:      logger,
 	}
 }
 
-// RegisterRequest represents the payload to register a new user
+// generateAccessToken issues an access token embedding the user's current roles and permissions
+func (h *AuthHandler) generateAccessToken(c *gin.Context, userID, sessionID uuid.UUID) (string, error) {
+	access, err := h.roleService.GetUserAccess(c.Request.Context(), userID)
+	if err != nil {
+		return "", err
+	}
+	return h.jwtService.GenerateAccessToken(userID, sessionID, access)
+}
+
+// RegisterRequest represents the payload to register a new user. The password is sent either
+// in plain text (over TLS) or, for existing clients, in the RSA envelope as cipher.
 type RegisterRequest struct {
 	Email       string  `json:"email" binding:"required"`
-	Cipher      string  `json:"cipher" binding:"required"` // base64 or raw PEM-block encoded from client
+	Password    string  `json:"password"`
+	Cipher      string  `json:"cipher"` // base64 RSA-OAEP(SHA-256) of random || SHA-256(password)
 	DisplayName *string `json:"display_name"`
 }
 
-// LoginRequest represents the payload to login with email + encrypted password
+// LoginRequest represents the payload to login with email + password or encrypted password
 type LoginRequest struct {
-	Email  string `json:"email" binding:"required"`
-	Cipher string `json:"cipher" binding:"required"`
+	Email    string `json:"email" binding:"required"`
+	Password string `json:"password"`
+	Cipher   string `json:"cipher"`
 }
 
-// Register registers a new user account (email + password)
-func (h *AuthHandler) Register(c *gin.Context) {
-	var req RegisterRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+// EmailTokenRequest represents the payload carrying the token from an emailed link
+type EmailTokenRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// MagicLinkRequest represents the payload to ask for a sign-in link
+type MagicLinkRequest struct {
+	Email string `json:"email" binding:"required"`
+}
+
+// PhoneRequest represents the payload naming a phone number in E.164 format
+type PhoneRequest struct {
+	Phone string `json:"phone" binding:"required"`
+}
+
+// PhoneCodeRequest represents the payload carrying a code texted to a phone
+type PhoneCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// PhoneLoginRequest represents the payload to log in with a code texted to a phone
+type PhoneLoginRequest struct {
+	Phone string `json:"phone" binding:"required"`
+	Code  string `json:"code" binding:"required"`
+}
+
+// MFACodeRequest represents the payload carrying a TOTP code or a recovery code
+type MFACodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// MFAChallengeRequest represents the payload to finish a login that needs a second factor
+type MFAChallengeRequest struct {
+	MFAToken string `json:"mfa_token" binding:"required"`
+	Code     string `json:"code" binding:"required"`
+}
+
+// MFAEnrollChallengeRequest represents the payload to set up MFA during a login that requires it
+type MFAEnrollChallengeRequest struct {
+	MFAToken string `json:"mfa_token" binding:"required"`
+}
+
+// MFAPolicyRequest represents the payload to set whether a user level requires MFA
+type MFAPolicyRequest struct {
+	Required *bool `json:"required" binding:"required"`
+}
+
+// ForgotPasswordRequest represents the payload to ask for a password reset link
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required"`
+}
+
+// ResetPasswordRequest represents the payload to set a new password with a reset token
+type ResetPasswordRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password"`
+	Cipher   string `json:"cipher"`
+}
+
+// ChangePasswordRequest represents the payload to change the password of the logged in user.
+// Each password is sent in plain text or in the RSA envelope, as for login.
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	CurrentCipher   string `json:"current_cipher"`
+	NewPassword     string `json:"new_password"`
+	NewCipher       string `json:"new_cipher"`
+}
+
+// minPasswordLength applies to new passwords sent in plain text; the RSA envelope only
+// carries a digest
+const minPasswordLength = 8
+
+// newPasswordDigest is passwordDigest for a password being set, which must be long enough
+func newPasswordDigest(c *gin.Context, password, cipher string) ([]byte, bool) {
+	if cipher == "" && password != "" && len([]rune(password)) < minPasswordLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "password must be at least " + strconv.Itoa(minPasswordLength) + " characters"})
+		return nil, false
+	}
+	return passwordDigest(c, password, cipher)
+}
+
+// passwordDigest returns the SHA-256 digest of the request's password, decrypting the RSA
+// envelope if one was sent, writing an error if there is none
+func passwordDigest(c *gin.Context, password, cipher string) ([]byte, bool) {
+	if cipher == "" {
+		if password == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "password or cipher is required"})
+			return nil, false
+		}
+		return services.PasswordDigest(password), true
 	}
-	h.logger.Info("register request is ...", req)
 
-	// 1) Server loads RSA private key
 	cfg := config.LoadConfig()
 	if cfg.PasswordEncPrivateKey == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "encryption not configured"})
-		return
+		return nil, false
 	}
-
-	// 2) Decrypt client cipher → random || passwordHash (client-side hashed), discard random
-	//    Expect base64 string from client
-	cipherBytes, decErr := base64.StdEncoding.DecodeString(req.Cipher)
-	if decErr != nil {
+	cipherBytes, err := base64.StdEncoding.DecodeString(cipher)
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "cipher must be base64"})
-		return
+		return nil, false
 	}
 	plain, err := decryptWithRSAPrivateKey([]byte(cfg.PasswordEncPrivateKey), cipherBytes)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cipher"})
-		return
+		return nil, false
 	}
-	h.logger.Info("plain is ...", plain)
-
 	if len(plain) < 33 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "cipher payload too short"})
-		return
+		return nil, false
 	}
-	// Suppose first 16 bytes = random, following 32 bytes = SHA-256(password) (example)
-	// Adjust to your client protocol as needed
-	baseHash := plain[len(plain)-32:]
+	// The payload is random bytes followed by SHA-256(password)
+	return plain[len(plain)-32:], true
+}
 
-	// Check if email already exists
-	var existing models.User
-	if err := database.DB.Where("email = ? AND deleted_at IS NULL", req.Email).First(&existing).Error; err == nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "email already registered"})
-		return
-	} else if err != nil && err != gorm.ErrRecordNotFound {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+// Register registers a new user account (email + password)
+func (h *AuthHandler) Register(c *gin.Context) {
+	var req RegisterRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// 3) Server-side salt + hash: H2 = sha256( salt || baseHash ) and store {salt, H2}
-	salt := uuid.New().String()
-	combined := append([]byte(salt), baseHash...)
-	h2 := sha256.Sum256(combined)
-
-	// Create user + credentials in a transaction
-	var user models.User
-	if err := database.DB.Transaction(func(tx *gorm.DB) error {
-		email := req.Email
-		user = models.User{
-			Email:       &email,
-			DisplayName: req.DisplayName,
-			IsActive:    true,
-			Metadata:    make(models.JSONB),
-		}
-		if err := tx.Create(&user).Error; err != nil {
-			return err
-		}
-
-		now := time.Now()
-		hashedStr := hex.EncodeToString(h2[:])
-		saltCopy := salt
-		cred := models.UserCredential{
-			UserID:        user.ID,
-			PasswordHash:  &hashedStr,
-			Salt:          &saltCopy,
-			PasswordSetAt: &now,
-		}
-		if err := tx.Create(&cred).Error; err != nil {
-			return err
-		}
+	digest, ok := newPasswordDigest(c, req.Password, req.Cipher)
+	if !ok {
+		return
+	}
 
-		// Audit
-		event := "register_success"
-		provider := models.AuthProviderPassword
-		ip := c.ClientIP()
-		ua := c.Request.UserAgent()
-		audit := models.AuthAudit{
-			UserID:    &user.ID,
-			Event:     event,
-			Provider:  &provider,
-			IPNet:     &ip,
-			UserAgent: &ua,
-			Details:   models.JSONB{"email": req.Email},
+	user, err := h.authService.RegisterWithPassword(c.Request.Context(), req.Email, req.DisplayName, digest, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		if errors.Is(err, services.ErrEmailTaken) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "email already registered"})
+			return
 		}
-		_ = tx.Create(&audit).Error
-
-		return nil
-	}); err != nil {
 		h.logger.WithError(err).Error("failed to register user")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to register"})
 		return
 	}
 
+	// Best-effort; the user can ask for another link from their profile
+	if err := h.authService.RequestEmailVerification(c.Request.Context(), user.ID, c.Request.UserAgent(), c.ClientIP()); err != nil {
+		h.logger.WithError(err).Warn("Failed to send verification email")
+	}
+
 	c.JSON(http.StatusCreated, gin.H{
 		"message": "registration successful",
 		"user":    user,
 	})
 }
 
-// Login authenticates a user using email + RSA-OAEP(SHA256) encrypted (16||SHA256(password))
+// Login authenticates a user using email + password, or the password in the RSA-OAEP(SHA256)
+// envelope (16||SHA256(password))
 func (h *AuthHandler) Login(c *gin.Context) {
 	var req LoginRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -168,93 +223,38 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		return
 	}
 
-	// Load private key
-	cfg := config.LoadConfig()
-	if cfg.PasswordEncPrivateKey == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "encryption not configured"})
+	digest, ok := passwordDigest(c, req.Password, req.Cipher)
+	if !ok {
 		return
 	}
 
-	// Base64 decode cipher
-	cipherBytes, decErr := base64.StdEncoding.DecodeString(req.Cipher)
-	if decErr != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "cipher must be base64"})
+	user, session, refreshToken, err := h.authService.LoginWithPassword(c.Request.Context(), req.Email, digest, c.Request.UserAgent(), c.ClientIP())
+	if respondMFAChallenge(c, err) {
 		return
 	}
-
-	// Decrypt RSA-OAEP(SHA256)
-	plain, err := decryptWithRSAPrivateKey([]byte(cfg.PasswordEncPrivateKey), cipherBytes)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
-		return
-	}
-	if len(plain) < 33 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "cipher payload too short"})
-		return
-	}
-	baseHash := plain[len(plain)-32:]
-
-	// Find user by email
-	var user models.User
-	if err := database.DB.Where("email = ? AND deleted_at IS NULL", req.Email).First(&user).Error; err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
-		return
-	}
-
-	// Load user credential
-	var cred models.UserCredential
-	if err := database.DB.Where("user_id = ?", user.ID).First(&cred).Error; err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
-		return
-	}
-	if cred.Salt == nil || cred.PasswordHash == nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
-		return
-	}
-
-	// Compute server-side H2 and compare
-	combined := append([]byte(*cred.Salt), baseHash...)
-	h2 := sha256.Sum256(combined)
-	h2hex := hex.EncodeToString(h2[:])
-	if h2hex != *cred.PasswordHash {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
-		return
-	}
-
-	// Create session (random refresh token -> store hash)
-	tokenBytes := make([]byte, 32)
-	if _, err := rand.Read(tokenBytes); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create session"})
-		return
-	}
-	refreshToken := base64.URLEncoding.EncodeToString(tokenBytes)
-	rth := sha256.Sum256([]byte(refreshToken))
-	rthHex := hex.EncodeToString(rth[:])
-
-	ua := c.Request.UserAgent()
-	ip := c.ClientIP()
-	now := time.Now()
-	session := models.Session{
-		UserID:           user.ID,
-		UserAgent:        &ua,
-		IPNet:            &ip,
-		RefreshTokenHash: rthHex,
-		ValidUntil:       now.Add(30 * 24 * time.Hour),
-	}
-	if err := database.DB.Create(&session).Error; err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidCredentials):
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
+			return
+		case errors.Is(err, services.ErrAccountDisabled):
+			c.JSON(http.StatusForbidden, gin.H{"error": "account is disabled"})
+			return
+		}
+		h.logger.WithError(err).Error("failed to log in")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create session"})
 		return
 	}
 
 	// Access token
-	accessToken, err := h.jwtService.GenerateAccessToken(user.ID, session.ID)
+	accessToken, err := h.generateAccessToken(c, user.ID, session.ID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate access token"})
 		return
 	}
 
 	// Initialize an empty project for first-time login (best-effort, async)
-	go initUserDefaultProject(user, h.logger)
+	go initUserDefaultProject(*user, h.logger)
 
 	c.JSON(http.StatusOK, gin.H{
 		"message":        "login successful",
@@ -305,6 +305,14 @@ type GoogleCallbackRequest struct {
 	State string `json:"state"`
 }
 
+// OIDCCallbackRequest represents the code and state an OIDC provider redirected back with,
+// and the flow token from starting the sign-in
+type OIDCCallbackRequest struct {
+	Code      string `json:"code" binding:"required"`
+	State     string `json:"state" binding:"required"`
+	FlowToken string `json:"flow_token" binding:"required"`
+}
+
 // RefreshTokenRequest represents the request to refresh tokens
 type RefreshTokenRequest struct {
 	RefreshToken string `json:"refresh_token" binding:"required"`
@@ -350,7 +358,10 @@ func (h *AuthHandler) GoogleCallback(c *gin.Context) {
 	ipAddress := c.ClientIP()
 
 	// Process Google OIDC flow
-	user, session, err := h.authService.GoogleOIDCFlow(c.Request.Context(), req.Code, userAgent, ipAddress)
+	user, session, refreshToken, err := h.authService.GoogleOIDCFlow(c.Request.Context(), req.Code, userAgent, ipAddress)
+	if respondMFAChallenge(c, err) {
+		return
+	}
 	if err != nil {
 		h.logger.WithError(err).Error("Google OIDC flow failed")
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Authentication failed"})
@@ -358,20 +369,13 @@ func (h *AuthHandler) GoogleCallback(c *gin.Context) {
 	}
 
 	// Generate JWT tokens
-	accessToken, err := h.jwtService.GenerateAccessToken(user.ID, session.ID)
+	accessToken, err := h.generateAccessToken(c, user.ID, session.ID)
 	if err != nil {
 		h.logger.WithError(err).Error("Failed to generate access token")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate access token"})
 		return
 	}
 
-	refreshToken, err := h.jwtService.GenerateRefreshToken(user.ID, session.ID)
-	if err != nil {
-		h.logger.WithError(err).Error("Failed to generate refresh token")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate refresh token"})
-		return
-	}
-
 	// Initialize an empty project for first-time login (best-effort, async)
 	go initUserDefaultProject(*user, h.logger)
 
@@ -410,13 +414,13 @@ func initUserDefaultProject(user models.User, logger *logrus.Logger) {
 	defaultName := base + "-project"
 
 	// Try to create with increasing suffix if needed
-	svc := services.NewProjectService()
+	svc := services.NewProjectService(services.NewAuthorizer())
 	name := defaultName
 	for i := 0; i < 5; i++ {
 		project := &models.Project{OwnerID: user.ID, Name: name}
 		if err := svc.CreateProject(project); err != nil {
 			if strings.Contains(strings.ToLower(err.Error()), "already exists") {
-				name = defaultName + "-" + string('2'+i)
+				name = defaultName + "-" + strconv.Itoa(i+2)
 				continue
 			}
 			return
@@ -436,7 +440,8 @@ func initUserDefaultProject(user models.User, logger *logrus.Logger) {
 	}
 }
 
-// RefreshToken refreshes the access token using a refresh token
+// RefreshToken exchanges a refresh token for a new access and refresh token pair. Each
+// refresh token works once; presenting a used one again revokes the whole session.
 func (h *AuthHandler) RefreshToken(c *gin.Context) {
 	var req RefreshTokenRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -444,17 +449,27 @@ func (h *AuthHandler) RefreshToken(c *gin.Context) {
 		return
 	}
 
-	// Validate the refresh token
-	user, _, err := h.authService.ValidateSession(c.Request.Context(), req.RefreshToken)
+	user, session, refreshToken, err := h.authService.RotateRefreshToken(c.Request.Context(), req.RefreshToken, c.Request.UserAgent(), c.ClientIP())
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		switch {
+		case errors.Is(err, services.ErrRefreshTokenReused):
+			h.logger.WithField("ip", c.ClientIP()).Warn("Refresh token reuse detected, session revoked")
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token already used; session revoked"})
+		case errors.Is(err, services.ErrInvalidRefreshToken):
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		case errors.Is(err, services.ErrAccountDisabled):
+			c.JSON(http.StatusForbidden, gin.H{"error": "Account is disabled"})
+		default:
+			h.logger.WithError(err).Error("Failed to rotate refresh token")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh tokens"})
+		}
 		return
 	}
 
-	// Generate new tokens
-	accessToken, refreshToken, err := h.jwtService.RefreshTokenPair(req.RefreshToken)
+	// The new access token carries the user's current roles
+	accessToken, err := h.generateAccessToken(c, user.ID, session.ID)
 	if err != nil {
-		h.logger.WithError(err).Error("Failed to refresh tokens")
+		h.logger.WithError(err).Error("Failed to generate access token")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh tokens"})
 		return
 	}
@@ -517,6 +532,109 @@ func (h *AuthHandler) LogoutAll(c *gin.Context) {
 	})
 }
 
+// ForgotPassword sends a password reset link to the email's account. The response is the
+// same whether or not the account exists.
+// POST /auth/password/forgot
+func (h *AuthHandler) ForgotPassword(c *gin.Context) {
+	var req ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.authService.RequestPasswordReset(c.Request.Context(), req.Email, c.Request.UserAgent(), c.ClientIP()); err != nil {
+		// Failing here would tell which emails have an account
+		h.logger.WithError(err).Error("Failed to request password reset")
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message": "If the email belongs to an account, a password reset link has been sent",
+	})
+}
+
+// ResetPassword sets a new password with a reset token and logs out every session
+// POST /auth/password/reset
+func (h *AuthHandler) ResetPassword(c *gin.Context) {
+	var req ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	digest, ok := newPasswordDigest(c, req.Password, req.Cipher)
+	if !ok {
+		return
+	}
+
+	err := h.authService.ResetPassword(c.Request.Context(), req.Token, digest, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidVerificationToken):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset token"})
+			return
+		case errors.Is(err, services.ErrTooManyAttempts):
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many attempts; request a new reset link"})
+			return
+		}
+		h.logger.WithError(err).Error("Failed to reset password")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Password reset successfully",
+	})
+}
+
+// ChangePassword changes the current user's password and logs out their other sessions
+// POST /auth/password/change
+func (h *AuthHandler) ChangePassword(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	// The login this request was made with stays signed in
+	sessionID, _ := c.Get("session_id")
+	currentSession, _ := sessionID.(uuid.UUID)
+
+	var req ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	currentDigest, ok := passwordDigest(c, req.CurrentPassword, req.CurrentCipher)
+	if !ok {
+		return
+	}
+	newDigest, ok := newPasswordDigest(c, req.NewPassword, req.NewCipher)
+	if !ok {
+		return
+	}
+
+	err := h.authService.ChangePassword(c.Request.Context(), userID, currentSession, currentDigest, newDigest, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidCredentials):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Current password is incorrect"})
+			return
+		case errors.Is(err, services.ErrNoPassword):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Account has no password; use a password reset link to set one"})
+			return
+		case errors.Is(err, services.ErrTooManyAttempts):
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many attempts; try again later"})
+			return
+		}
+		h.logger.WithError(err).Error("Failed to change password")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change password"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Password changed successfully",
+	})
+}
+
 // GetProfile returns the current user's profile
 func (h *AuthHandler) GetProfile(c *gin.Context) {
 	// Get user ID from context (set by auth middleware)
@@ -542,7 +660,141 @@ func (h *AuthHandler) GetProfile(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"user": user,
+		"user":           user,
+		"email_verified": user.IsEmailVerified(),
+	})
+}
+
+// RequestEmailVerification emails the current user a link to verify their email
+// POST /auth/email/verification
+func (h *AuthHandler) RequestEmailVerification(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	err := h.authService.RequestEmailVerification(c.Request.Context(), userID, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrNoEmail):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Account has no email"})
+			return
+		case errors.Is(err, services.ErrEmailAlreadyVerified):
+			c.JSON(http.StatusConflict, gin.H{"error": "Email is already verified"})
+			return
+		case errors.Is(err, services.ErrTooManyAttempts):
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many verification emails; try again later"})
+			return
+		case errors.Is(err, services.ErrAccountNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		h.logger.WithError(err).Error("Failed to send verification email")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send verification email"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message": "Verification email sent",
+	})
+}
+
+// ConfirmEmailVerification verifies an email with the token from the emailed link
+// POST /auth/email/verification/confirm
+func (h *AuthHandler) ConfirmEmailVerification(c *gin.Context) {
+	var req EmailTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := h.authService.ConfirmEmailVerification(c.Request.Context(), req.Token, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidVerificationToken):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired verification token"})
+			return
+		case errors.Is(err, services.ErrTooManyAttempts):
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many attempts; request a new verification email"})
+			return
+		}
+		h.logger.WithError(err).Error("Failed to verify email")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify email"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Email verified successfully",
+		"user":    user,
+	})
+}
+
+// RequestMagicLink emails a sign-in link to the email's account. The response is the same
+// whether or not the account exists.
+// POST /auth/magic-link
+func (h *AuthHandler) RequestMagicLink(c *gin.Context) {
+	var req MagicLinkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.authService.RequestMagicLink(c.Request.Context(), req.Email, c.Request.UserAgent(), c.ClientIP()); err != nil {
+		// Failing here would tell which emails have an account
+		h.logger.WithError(err).Error("Failed to send magic link")
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message": "If the email belongs to an account, a sign-in link has been sent",
+	})
+}
+
+// MagicLinkLogin logs in with the token from an emailed sign-in link
+// POST /auth/magic-link/login
+func (h *AuthHandler) MagicLinkLogin(c *gin.Context) {
+	var req EmailTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, session, refreshToken, err := h.authService.LoginWithMagicLink(c.Request.Context(), req.Token, c.Request.UserAgent(), c.ClientIP())
+	if respondMFAChallenge(c, err) {
+		return
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidVerificationToken):
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired sign-in link"})
+			return
+		case errors.Is(err, services.ErrTooManyAttempts):
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many attempts; request a new sign-in link"})
+			return
+		case errors.Is(err, services.ErrAccountDisabled):
+			c.JSON(http.StatusForbidden, gin.H{"error": "Account is disabled"})
+			return
+		}
+		h.logger.WithError(err).Error("Magic link login failed")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return
+	}
+
+	accessToken, err := h.generateAccessToken(c, user.ID, session.ID)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to generate access token")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate access token"})
+		return
+	}
+
+	// Initialize an empty project for first-time login (best-effort, async)
+	go initUserDefaultProject(*user, h.logger)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "Authentication successful",
+		"user":          user,
+		"access_token":  accessToken,
+		"refresh_token": refreshToken,
+		"expires_in":    15 * 60, // 15 minutes in seconds
 	})
 }
 
@@ -560,16 +812,28 @@ func (h *AuthHandler) ValidateToken(c *gin.Context) {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
 		return
 	}
+	revoked, err := h.authService.IsAccessTokenRevoked(c.Request.Context(), claims)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to check token revocation")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to validate token"})
+		return
+	}
+	if revoked {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Token has been revoked"})
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"valid":      true,
-		"user_id":    claims.UserID,
-		"session_id": claims.SessionID,
-		"expires_at": claims.ExpiresAt.Time,
+		"valid":       true,
+		"user_id":     claims.UserID,
+		"session_id":  claims.SessionID,
+		"roles":       claims.Roles,
+		"permissions": claims.Permissions,
+		"expires_at":  claims.ExpiresAt.Time,
 	})
 }
 
-// GetSessions returns all active sessions for the current user
+// GetSessions returns the current user's active sessions, one per login
 func (h *AuthHandler) GetSessions(c *gin.Context) {
 	// Get user ID from context (set by auth middleware)
 	userIDInterface, exists := c.Get("user_id")
@@ -584,11 +848,7 @@ func (h *AuthHandler) GetSessions(c *gin.Context) {
 		return
 	}
 
-	// Get sessions from database
-	var sessions []models.Session
-	err := database.DB.Where("user_id = ? AND revoked_at IS NULL", userID).
-		Order("created_at DESC").
-		Find(&sessions).Error
+	sessions, err := h.authService.ListActiveSessions(c.Request.Context(), userID)
 	if err != nil {
 		h.logger.WithError(err).Error("Failed to get user sessions")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get sessions"})
@@ -622,12 +882,13 @@ func (h *AuthHandler) RevokeSession(c *gin.Context) {
 		return
 	}
 
-	// Revoke the session
-	now := time.Now()
-	err = database.DB.Model(&models.Session{}).
-		Where("id = ? AND user_id = ?", sessionID, userID).
-		Update("revoked_at", &now).Error
+	// Revoke the session along with the rest of its family
+	err = h.authService.RevokeSessionByID(c.Request.Context(), userID, sessionID)
 	if err != nil {
+		if errors.Is(err, services.ErrSessionNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+			return
+		}
 		h.logger.WithError(err).Error("Failed to revoke session")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
 		return
@@ -638,6 +899,691 @@ func (h *AuthHandler) RevokeSession(c *gin.Context) {
 	})
 }
 
+// ListPhones returns the current user's phone numbers
+// GET /auth/phones
+func (h *AuthHandler) ListPhones(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	phones, err := h.authService.ListPhones(c.Request.Context(), userID)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to list phones")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list phones"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"phones": phones,
+	})
+}
+
+// AddPhone adds a phone number to the current user and texts it a verification code
+// POST /auth/phones
+func (h *AuthHandler) AddPhone(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var req PhoneRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	phone, err := h.authService.AddPhone(c.Request.Context(), userID, req.Phone, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidPhoneNumber):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		case errors.Is(err, services.ErrPhoneTaken):
+			c.JSON(http.StatusConflict, gin.H{"error": "Phone number already registered"})
+			return
+		case errors.Is(err, services.ErrTooManyAttempts):
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many codes sent to this number; try again later"})
+			return
+		}
+		h.logger.WithError(err).Error("Failed to add phone")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add phone"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Verification code sent",
+		"phone":   phone,
+	})
+}
+
+// VerifyPhone verifies one of the current user's phones with the code texted to it
+// POST /auth/phones/:phone_id/verify
+func (h *AuthHandler) VerifyPhone(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	phoneID, err := uuid.Parse(c.Param("phone_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid phone ID"})
+		return
+	}
+
+	var req PhoneCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	phone, err := h.authService.VerifyPhone(c.Request.Context(), userID, phoneID, req.Code, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrPhoneNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Phone not found"})
+			return
+		case errors.Is(err, services.ErrInvalidVerificationToken):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired code"})
+			return
+		case errors.Is(err, services.ErrTooManyAttempts):
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many attempts; request a new code"})
+			return
+		}
+		h.logger.WithError(err).Error("Failed to verify phone")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify phone"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Phone verified successfully",
+		"phone":   phone,
+	})
+}
+
+// RemovePhone removes one of the current user's phones
+// DELETE /auth/phones/:phone_id
+func (h *AuthHandler) RemovePhone(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	phoneID, err := uuid.Parse(c.Param("phone_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid phone ID"})
+		return
+	}
+
+	err = h.authService.RemovePhone(c.Request.Context(), userID, phoneID, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrPhoneNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Phone not found"})
+			return
+		case errors.Is(err, services.ErrLastSignInMethod):
+			c.JSON(http.StatusConflict, gin.H{"error": "Cannot remove the only way to sign in"})
+			return
+		}
+		h.logger.WithError(err).Error("Failed to remove phone")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove phone"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Phone removed successfully",
+	})
+}
+
+// RequestPhoneLoginCode texts a sign-in code to a verified phone. The response is the same
+// whether or not the number belongs to an account.
+// POST /auth/phone/code
+func (h *AuthHandler) RequestPhoneLoginCode(c *gin.Context) {
+	var req PhoneRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := h.authService.RequestPhoneLoginCode(c.Request.Context(), req.Phone, c.Request.UserAgent(), c.ClientIP())
+	if errors.Is(err, services.ErrInvalidPhoneNumber) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		// Failing here would tell which numbers have an account
+		h.logger.WithError(err).Error("Failed to send phone login code")
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message": "If the number belongs to an account, a sign-in code has been sent",
+	})
+}
+
+// PhoneLogin logs in with a code texted to a verified phone
+// POST /auth/phone/login
+func (h *AuthHandler) PhoneLogin(c *gin.Context) {
+	var req PhoneLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, session, refreshToken, err := h.authService.LoginWithPhone(c.Request.Context(), req.Phone, req.Code, c.Request.UserAgent(), c.ClientIP())
+	if respondMFAChallenge(c, err) {
+		return
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidPhoneNumber):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		case errors.Is(err, services.ErrInvalidVerificationToken):
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired code"})
+			return
+		case errors.Is(err, services.ErrTooManyAttempts):
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many attempts; request a new code"})
+			return
+		case errors.Is(err, services.ErrAccountDisabled):
+			c.JSON(http.StatusForbidden, gin.H{"error": "Account is disabled"})
+			return
+		}
+		h.logger.WithError(err).Error("Phone login failed")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return
+	}
+
+	accessToken, err := h.generateAccessToken(c, user.ID, session.ID)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to generate access token")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate access token"})
+		return
+	}
+
+	// Initialize an empty project for first-time login (best-effort, async)
+	go initUserDefaultProject(*user, h.logger)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "Authentication successful",
+		"user":          user,
+		"access_token":  accessToken,
+		"refresh_token": refreshToken,
+		"expires_in":    15 * 60, // 15 minutes in seconds
+	})
+}
+
+// respondMFAChallenge answers a login that needs a second factor with its challenge,
+// reporting whether it did
+func respondMFAChallenge(c *gin.Context, err error) bool {
+	var challenge *services.MFAChallengeError
+	if !errors.As(err, &challenge) {
+		return false
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Two-factor authentication required",
+		"mfa_required": true,
+		"mfa_token":    challenge.Token,
+		"mfa_enroll":   challenge.Enroll,
+		"expires_at":   challenge.ExpiresAt,
+	})
+	return true
+}
+
+// respondMFAError answers the errors shared by the MFA endpoints
+func (h *AuthHandler) respondMFAError(c *gin.Context, err error, action string) {
+	switch {
+	case errors.Is(err, services.ErrInvalidMFACode):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid two-factor code"})
+	case errors.Is(err, services.ErrInvalidMFAChallenge):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired MFA token; log in again"})
+	case errors.Is(err, services.ErrTooManyAttempts):
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many wrong codes; try again later"})
+	case errors.Is(err, services.ErrMFAAlreadyEnabled), errors.Is(err, services.ErrMFANotEnrolled):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrMFARequired), errors.Is(err, services.ErrAccountDisabled):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrAccountNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	default:
+		h.logger.WithError(err).Error("Failed to " + action)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to " + action})
+	}
+}
+
+// GetMFAStatus returns whether the current user has two-factor authentication enabled
+// GET /auth/mfa
+func (h *AuthHandler) GetMFAStatus(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	status, err := h.authService.GetMFAStatus(c.Request.Context(), userID)
+	if err != nil {
+		h.respondMFAError(c, err, "get MFA status")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":                  status.Enabled,
+		"required":                 status.Required,
+		"recovery_codes_remaining": status.RecoveryCodesRemaining,
+	})
+}
+
+// BeginTOTPEnrollment creates a TOTP secret for the current user to add to an authenticator app
+// POST /auth/mfa/totp
+func (h *AuthHandler) BeginTOTPEnrollment(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	enrollment, err := h.authService.BeginTOTPEnrollment(c.Request.Context(), userID)
+	if err != nil {
+		h.respondMFAError(c, err, "start MFA enrollment")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":      enrollment.Secret,
+		"otpauth_uri": enrollment.URI,
+	})
+}
+
+// ConfirmTOTPEnrollment enables the current user's TOTP secret with a code from it
+// POST /auth/mfa/totp/confirm
+func (h *AuthHandler) ConfirmTOTPEnrollment(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var req MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	recoveryCodes, err := h.authService.ConfirmTOTPEnrollment(c.Request.Context(), userID, req.Code, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		h.respondMFAError(c, err, "enable MFA")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "Two-factor authentication enabled",
+		"recovery_codes": recoveryCodes,
+	})
+}
+
+// DisableMFA removes the current user's second factor with a TOTP or recovery code
+// POST /auth/mfa/disable
+func (h *AuthHandler) DisableMFA(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var req MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.authService.DisableMFA(c.Request.Context(), userID, req.Code, c.Request.UserAgent(), c.ClientIP()); err != nil {
+		h.respondMFAError(c, err, "disable MFA")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Two-factor authentication disabled",
+	})
+}
+
+// RegenerateRecoveryCodes replaces the current user's recovery codes
+// POST /auth/mfa/recovery-codes
+func (h *AuthHandler) RegenerateRecoveryCodes(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var req MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	recoveryCodes, err := h.authService.RegenerateRecoveryCodes(c.Request.Context(), userID, req.Code, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		h.respondMFAError(c, err, "regenerate recovery codes")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"recovery_codes": recoveryCodes,
+	})
+}
+
+// MFAChallengeEnroll creates a TOTP secret during a login whose user level requires MFA
+// POST /auth/mfa/challenge/enroll
+func (h *AuthHandler) MFAChallengeEnroll(c *gin.Context) {
+	var req MFAEnrollChallengeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	enrollment, err := h.authService.BeginChallengeEnrollment(c.Request.Context(), req.MFAToken)
+	if err != nil {
+		h.respondMFAError(c, err, "start MFA enrollment")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":      enrollment.Secret,
+		"otpauth_uri": enrollment.URI,
+	})
+}
+
+// MFAChallenge finishes a login with its MFA token and a TOTP or recovery code
+// POST /auth/mfa/challenge
+func (h *AuthHandler) MFAChallenge(c *gin.Context) {
+	var req MFAChallengeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, session, refreshToken, recoveryCodes, err := h.authService.CompleteMFAChallenge(c.Request.Context(), req.MFAToken, req.Code, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		h.respondMFAError(c, err, "log in")
+		return
+	}
+
+	accessToken, err := h.generateAccessToken(c, user.ID, session.ID)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to generate access token")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate access token"})
+		return
+	}
+
+	// Initialize an empty project for first-time login (best-effort, async)
+	go initUserDefaultProject(*user, h.logger)
+
+	response := gin.H{
+		"message":       "Authentication successful",
+		"user":          user,
+		"access_token":  accessToken,
+		"refresh_token": refreshToken,
+		"expires_in":    15 * 60, // 15 minutes in seconds
+	}
+	if recoveryCodes != nil {
+		response["recovery_codes"] = recoveryCodes
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// ListMFAPolicies returns whether each user level requires MFA
+// GET /api/v1/admin/mfa-policies
+func (h *AuthHandler) ListMFAPolicies(c *gin.Context) {
+	policies, err := h.authService.ListMFAPolicies(c.Request.Context())
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to list MFA policies")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list MFA policies"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"policies": policies,
+	})
+}
+
+// SetMFAPolicy sets whether users of a level must sign in with a second factor
+// PUT /api/v1/admin/mfa-policies/:level
+func (h *AuthHandler) SetMFAPolicy(c *gin.Context) {
+	adminID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var req MFAPolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	level := models.UserLevel(c.Param("level"))
+	policy, err := h.authService.SetMFAPolicy(c.Request.Context(), level, *req.Required, adminID, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidUserLevel) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		h.logger.WithError(err).Error("Failed to set MFA policy")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set MFA policy"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"policy": policy,
+	})
+}
+
+// respondOIDCError answers the errors shared by the OIDC endpoints
+func (h *AuthHandler) respondOIDCError(c *gin.Context, err error, action string) {
+	switch {
+	case errors.Is(err, services.ErrUnknownOIDCProvider):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown sign-in provider"})
+	case errors.Is(err, services.ErrInvalidOIDCFlow):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired sign-in; start again"})
+	case errors.Is(err, services.ErrInvalidIDToken):
+		h.logger.WithError(err).Warn("Rejected OIDC ID token")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication failed"})
+	case errors.Is(err, services.ErrOIDCAccountExists):
+		c.JSON(http.StatusConflict, gin.H{"error": "An account with this email already exists; log in and link the provider from your account"})
+	case errors.Is(err, services.ErrIdentityTaken):
+		c.JSON(http.StatusConflict, gin.H{"error": "This sign-in is linked to another account"})
+	case errors.Is(err, services.ErrAccountDisabled):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is disabled"})
+	default:
+		h.logger.WithError(err).Error("Failed to " + action)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to " + action})
+	}
+}
+
+// respondOIDCAuthorization returns where to send the user to sign in at a provider
+func respondOIDCAuthorization(c *gin.Context, authorization *services.OIDCAuthorization) {
+	c.JSON(http.StatusOK, gin.H{
+		"auth_url":   authorization.URL,
+		"state":      authorization.State,
+		"flow_token": authorization.FlowToken,
+		"expires_at": authorization.ExpiresAt,
+	})
+}
+
+// ListOIDCProviders returns the OpenID Connect providers users can sign in with
+// GET /auth/oidc
+func (h *AuthHandler) ListOIDCProviders(c *gin.Context) {
+	providers := []gin.H{}
+	for _, provider := range h.authService.OIDCProviders() {
+		providers = append(providers, gin.H{
+			"name":         provider.Name,
+			"display_name": provider.DisplayName,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"providers": providers,
+	})
+}
+
+// GetOIDCAuthURL starts signing in with an OIDC provider
+// POST /auth/oidc/:provider/url
+func (h *AuthHandler) GetOIDCAuthURL(c *gin.Context) {
+	authorization, err := h.authService.BeginOIDCLogin(c.Request.Context(), c.Param("provider"))
+	if err != nil {
+		h.respondOIDCError(c, err, "start sign-in")
+		return
+	}
+	respondOIDCAuthorization(c, authorization)
+}
+
+// OIDCCallback finishes signing in with an OIDC provider
+// POST /auth/oidc/:provider/callback
+func (h *AuthHandler) OIDCCallback(c *gin.Context) {
+	var req OIDCCallbackRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, session, refreshToken, err := h.authService.CompleteOIDCLogin(c.Request.Context(), c.Param("provider"), req.FlowToken, req.State, req.Code, c.Request.UserAgent(), c.ClientIP())
+	if respondMFAChallenge(c, err) {
+		return
+	}
+	if err != nil {
+		h.respondOIDCError(c, err, "sign in")
+		return
+	}
+
+	accessToken, err := h.generateAccessToken(c, user.ID, session.ID)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to generate access token")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate access token"})
+		return
+	}
+
+	// Initialize an empty project for first-time login (best-effort, async)
+	go initUserDefaultProject(*user, h.logger)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "Authentication successful",
+		"user":          user,
+		"access_token":  accessToken,
+		"refresh_token": refreshToken,
+		"expires_in":    15 * 60, // 15 minutes in seconds
+	})
+}
+
+// GetOIDCLinkURL starts linking an OIDC provider to the current user's account
+// POST /auth/oidc/:provider/link/url
+func (h *AuthHandler) GetOIDCLinkURL(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	authorization, err := h.authService.BeginOIDCLink(c.Request.Context(), userID, c.Param("provider"))
+	if err != nil {
+		h.respondOIDCError(c, err, "start linking")
+		return
+	}
+	respondOIDCAuthorization(c, authorization)
+}
+
+// LinkOIDCIdentity finishes linking an OIDC provider to the current user's account
+// POST /auth/oidc/:provider/link
+func (h *AuthHandler) LinkOIDCIdentity(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var req OIDCCallbackRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	identity, err := h.authService.CompleteOIDCLink(c.Request.Context(), userID, c.Param("provider"), req.FlowToken, req.State, req.Code, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		h.respondOIDCError(c, err, "link provider")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "Provider linked successfully",
+		"identity": identityResponse(*identity),
+	})
+}
+
+// identityResponse is what users see of a linked identity
+func identityResponse(identity models.AuthIdentity) gin.H {
+	return gin.H{
+		"id":             identity.ID,
+		"provider":       identity.Provider,
+		"email":          identity.EmailAtSignup,
+		"email_verified": identity.EmailVerified,
+		"created_at":     identity.CreatedAt,
+	}
+}
+
+// ListIdentities returns the external identities linked to the current user's account
+// GET /auth/identities
+func (h *AuthHandler) ListIdentities(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	identities, err := h.authService.ListIdentities(c.Request.Context(), userID)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to list identities")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list identities"})
+		return
+	}
+
+	response := make([]gin.H, len(identities))
+	for i, identity := range identities {
+		response[i] = identityResponse(identity)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"identities": response,
+	})
+}
+
+// UnlinkIdentity removes one of the current user's linked identities
+// DELETE /auth/identities/:identity_id
+func (h *AuthHandler) UnlinkIdentity(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	identityID, err := uuid.Parse(c.Param("identity_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid identity ID"})
+		return
+	}
+
+	err = h.authService.UnlinkIdentity(c.Request.Context(), userID, identityID, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrIdentityNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Identity not found"})
+			return
+		case errors.Is(err, services.ErrLastSignInMethod):
+			c.JSON(http.StatusConflict, gin.H{"error": "Cannot remove the only way to sign in"})
+			return
+		}
+		h.logger.WithError(err).Error("Failed to unlink identity")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlink identity"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Identity unlinked successfully",
+	})
+}
+
+// JWKS publishes the public keys access tokens are signed with, so other services can verify
+// tokens without calling this server
+// GET /.well-known/jwks.json
+func (h *AuthHandler) JWKS(c *gin.Context) {
+	// Verifiers may cache the set; new keys are published well before they sign
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, h.jwtService.JWKS())
+}
+
 func (h *AuthHandler) ObtainPublicKey(c *gin.Context) {
 	cfg := config.LoadConfig()
 	if cfg.PasswordEncPublicKey == "" {
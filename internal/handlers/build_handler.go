@@ -19,14 +19,16 @@ import (
 )
 
 type BuildHandler struct {
-	buildService *services.BuildService
-	logger       *logrus.Logger
+	buildService   *services.BuildService
+	projectService *services.ProjectService
+	logger         *logrus.Logger
 }
 
-func NewBuildHandler(buildService *services.BuildService, logger *logrus.Logger) *BuildHandler {
+func NewBuildHandler(buildService *services.BuildService, projectService *services.ProjectService, logger *logrus.Logger) *BuildHandler {
 	return &BuildHandler{
-		buildService: buildService,
-		logger:       logger,
+		buildService:   buildService,
+		projectService: projectService,
+		logger:         logger,
 	}
 }
 
@@ -44,25 +46,17 @@ type StartBuildWithClaudeRequest struct {
 // StartBuild starts a new build
 func (h *BuildHandler) StartBuild(c *gin.Context) {
 	// Get user ID from context
-	userIDInterface, exists := c.Get("user_id")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
-		return
-	}
-
-	userID, ok := userIDInterface.(uuid.UUID)
+	userID, ok := currentUserID(c)
 	if !ok {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
 		return
 	}
 
-	// Get project ID from URL
-	projectIDStr := c.Param("project_id")
-	projectID, err := uuid.Parse(projectIDStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+	// Starting a build runs commands in the project, so it requires the editor role
+	project, ok := h.authorizeBuildProject(c, services.ActionWrite)
+	if !ok {
 		return
 	}
+	projectID := project.ID
 
 	// Get session ID (optional)
 	var sessionID *uuid.UUID
@@ -95,25 +89,17 @@ func (h *BuildHandler) StartBuild(c *gin.Context) {
 // StartBuildWithClaude starts a build using Claude CLI to process user input
 func (h *BuildHandler) StartBuildWithClaude(c *gin.Context) {
 	// Get user ID from context
-	userIDInterface, exists := c.Get("user_id")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
-		return
-	}
-
-	userID, ok := userIDInterface.(uuid.UUID)
+	userID, ok := currentUserID(c)
 	if !ok {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
 		return
 	}
 
-	// Get project ID from URL
-	projectIDStr := c.Param("project_id")
-	projectID, err := uuid.Parse(projectIDStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+	// Starting a build runs commands in the project, so it requires the editor role
+	project, ok := h.authorizeBuildProject(c, services.ActionWrite)
+	if !ok {
 		return
 	}
+	projectID := project.ID
 
 	// Get session ID (optional)
 	var sessionID *uuid.UUID
@@ -164,9 +150,8 @@ func (h *BuildHandler) GetBuild(c *gin.Context) {
 		return
 	}
 
-	build, err := h.buildService.GetBuild(buildID)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	build, ok := h.authorizeBuild(c, buildID, services.ActionRead)
+	if !ok {
 		return
 	}
 
@@ -181,6 +166,9 @@ func (h *BuildHandler) CancelBuild(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid build ID"})
 		return
 	}
+	if _, ok := h.authorizeBuild(c, buildID, services.ActionWrite); !ok {
+		return
+	}
 
 	err = h.buildService.CancelBuild(buildID)
 	if err != nil {
@@ -225,12 +213,11 @@ func (h *BuildHandler) GetUserBuilds(c *gin.Context) {
 
 // GetProjectBuilds retrieves builds for a project
 func (h *BuildHandler) GetProjectBuilds(c *gin.Context) {
-	projectIDStr := c.Param("project_id")
-	projectID, err := uuid.Parse(projectIDStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+	project, ok := h.authorizeBuildProject(c, services.ActionRead)
+	if !ok {
 		return
 	}
+	projectID := project.ID
 
 	limitStr := c.DefaultQuery("limit", "20")
 	limit, err := strconv.Atoi(limitStr)
@@ -256,6 +243,9 @@ func (h *BuildHandler) GetBuildLogs(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid build ID"})
 		return
 	}
+	if _, ok := h.authorizeBuild(c, buildID, services.ActionRead); !ok {
+		return
+	}
 
 	limitStr := c.DefaultQuery("limit", "100")
 	limit, err := strconv.Atoi(limitStr)
@@ -281,6 +271,9 @@ func (h *BuildHandler) StreamBuildOutput(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid build ID"})
 		return
 	}
+	if _, ok := h.authorizeBuild(c, buildID, services.ActionRead); !ok {
+		return
+	}
 
 	// Set SSE headers
 	c.Header("Content-Type", "text/event-stream")
@@ -289,9 +282,8 @@ func (h *BuildHandler) StreamBuildOutput(c *gin.Context) {
 	c.Header("Access-Control-Allow-Origin", "*")
 	c.Header("Access-Control-Allow-Headers", "Cache-Control")
 
-	// Create a channel for build updates
+	// Create a channel for build updates; monitorBuildLogs closes it when the build completes
 	updateChan := make(chan models.BuildLog, 100)
-	defer close(updateChan)
 
 	// Start goroutine to monitor build logs
 	go h.monitorBuildLogs(c.Request.Context(), buildID, updateChan)
@@ -315,8 +307,12 @@ func (h *BuildHandler) StreamBuildOutput(c *gin.Context) {
 		select {
 		case log, ok := <-updateChan:
 			if !ok {
-				// Channel closed, send final event and exit
-				h.sendSSEEvent(c, "build_complete", nil)
+				// Channel closed, send the final build state and exit
+				if build, err := h.buildService.GetBuild(buildID); err == nil {
+					h.sendSSEEvent(c, "build_complete", build)
+				} else {
+					h.sendSSEEvent(c, "build_complete", nil)
+				}
 				flusher.Flush()
 				return
 			}
@@ -384,10 +380,10 @@ func (h *BuildHandler) monitorBuildLogs(ctx context.Context, buildID uuid.UUID,
 		}
 	}
 
-	// Monitor for new logs
-	lastLogID := uuid.Nil
+	// Monitor for new logs. Log IDs are random, so follow the timestamps.
+	var lastTimestamp time.Time
 	if len(logs) > 0 {
-		lastLogID = logs[len(logs)-1].ID
+		lastTimestamp = logs[len(logs)-1].Timestamp
 	}
 
 	ticker := time.NewTicker(1 * time.Second)
@@ -398,14 +394,14 @@ func (h *BuildHandler) monitorBuildLogs(ctx context.Context, buildID uuid.UUID,
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
+			// Check completion before fetching, so logs written before completion are not missed
+			var build models.Build
+			completed := database.DB.Where("id = ?", buildID).First(&build).Error == nil && build.IsCompleted()
+
 			// Check for new logs
 			var newLogs []models.BuildLog
-			query := database.DB.Where("build_id = ?", buildID).Order("timestamp ASC")
-			if lastLogID != uuid.Nil {
-				query = query.Where("id > ?", lastLogID)
-			}
-
-			if err := query.Find(&newLogs).Error; err != nil {
+			if err := database.DB.Where("build_id = ? AND timestamp > ?", buildID, lastTimestamp).
+				Order("timestamp ASC").Find(&newLogs).Error; err != nil {
 				h.logger.WithError(err).Error("Failed to get new build logs")
 				continue
 			}
@@ -414,20 +410,14 @@ func (h *BuildHandler) monitorBuildLogs(ctx context.Context, buildID uuid.UUID,
 			for _, log := range newLogs {
 				select {
 				case updateChan <- log:
-					lastLogID = log.ID
+					lastTimestamp = log.Timestamp
 				case <-ctx.Done():
 					return
 				}
 			}
 
-			// Check if build is completed
-			var build models.Build
-			if err := database.DB.Where("id = ?", buildID).First(&build).Error; err == nil {
-				if build.IsCompleted() {
-					// Build completed, close channel after a short delay
-					time.Sleep(2 * time.Second)
-					return
-				}
+			if completed {
+				return
 			}
 		}
 	}
@@ -448,3 +438,32 @@ func (h *BuildHandler) sendSSEEvent(c *gin.Context, eventType string, data inter
 		c.Writer.WriteString("data: {}\n\n")
 	}
 }
+
+// authorizeBuildProject checks the caller's role on the project a build request targets: the
+// :id parameter on /projects/:id/builds routes, else the project_id query parameter
+func (h *BuildHandler) authorizeBuildProject(c *gin.Context, action services.Action) (*models.Project, bool) {
+	projectIDStr := c.Param("id")
+	if projectIDStr == "" {
+		projectIDStr = c.Query("project_id")
+	}
+	projectID, err := uuid.Parse(projectIDStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+		return nil, false
+	}
+	project, _, ok := authorizeProjectID(c, h.projectService, projectID, action)
+	return project, ok
+}
+
+// authorizeBuild loads a build and checks the caller's role on its project
+func (h *BuildHandler) authorizeBuild(c *gin.Context, buildID uuid.UUID, action services.Action) (*models.Build, bool) {
+	build, err := h.buildService.GetBuild(buildID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if _, _, ok := authorizeProjectID(c, h.projectService, build.ProjectID, action); !ok {
+		return nil, false
+	}
+	return build, true
+}
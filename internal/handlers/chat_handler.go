@@ -3,10 +3,9 @@ package handlers
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"net/http"
-	"os"
 	"os/exec"
-	"path/filepath"
 	"strconv"
 	"time"
 
@@ -14,7 +13,6 @@ import (
 	"borderless_coding_server/internal/models"
 	"borderless_coding_server/internal/services"
 	"borderless_coding_server/pkg/database"
-	"borderless_coding_server/pkg/storage"
 	"borderless_coding_server/pkg/utils"
 
 	"github.com/gin-gonic/gin"
@@ -23,14 +21,20 @@ import (
 )
 
 type ChatHandler struct {
-	chatService *services.ChatService
-	logger      *logrus.Logger
+	chatService      *services.ChatService
+	projectService   *services.ProjectService
+	workspaceService *services.WorkspaceService
+	authorizer       *services.Authorizer
+	logger           *logrus.Logger
 }
 
-func NewChatHandler(chatService *services.ChatService, logger *logrus.Logger) *ChatHandler {
+func NewChatHandler(chatService *services.ChatService, projectService *services.ProjectService, workspaceService *services.WorkspaceService, authorizer *services.Authorizer, logger *logrus.Logger) *ChatHandler {
 	return &ChatHandler{
-		chatService: chatService,
-		logger:      logger,
+		chatService:      chatService,
+		projectService:   projectService,
+		workspaceService: workspaceService,
+		authorizer:       authorizer,
+		logger:           logger,
 	}
 }
 
@@ -81,6 +85,13 @@ func (h *ChatHandler) CreateChatSession(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "project_id is required"})
 		return
 	}
+	if _, _, ok := authorizeProjectID(c, h.projectService, *req.ProjectID, services.ActionWrite); !ok {
+		return
+	}
+	// Sessions can only be opened on behalf of another user by admins
+	if _, ok := authorize(c, h.authorizer, services.ActionWrite, services.UserResource(req.UserID)); !ok {
+		return
+	}
 
 	session := &models.ChatSession{
 		UserID:    req.UserID,
@@ -114,6 +125,9 @@ func (h *ChatHandler) GetChatSession(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
 		return
 	}
+	if _, ok := h.authorizeSession(c, sessionID, services.ActionRead); !ok {
+		return
+	}
 
 	session, err := h.chatService.GetChatSessionByID(sessionID)
 	if err != nil {
@@ -132,6 +146,9 @@ func (h *ChatHandler) UpdateChatSession(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
 		return
 	}
+	if _, ok := h.authorizeSession(c, sessionID, services.ActionWrite); !ok {
+		return
+	}
 
 	var req UpdateChatSessionRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -177,6 +194,9 @@ func (h *ChatHandler) DeleteChatSession(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
 		return
 	}
+	if _, ok := h.authorizeSession(c, sessionID, services.ActionManage); !ok {
+		return
+	}
 
 	if err := h.chatService.DeleteChatSession(sessionID); err != nil {
 		h.logger.WithError(err).Error("Failed to delete chat session")
@@ -195,6 +215,9 @@ func (h *ChatHandler) ArchiveChatSession(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
 		return
 	}
+	if _, ok := h.authorizeSession(c, sessionID, services.ActionWrite); !ok {
+		return
+	}
 
 	if err := h.chatService.ArchiveChatSession(sessionID); err != nil {
 		h.logger.WithError(err).Error("Failed to archive chat session")
@@ -213,6 +236,9 @@ func (h *ChatHandler) UnarchiveChatSession(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
 		return
 	}
+	if _, ok := h.authorizeSession(c, sessionID, services.ActionWrite); !ok {
+		return
+	}
 
 	if err := h.chatService.UnarchiveChatSession(sessionID); err != nil {
 		h.logger.WithError(err).Error("Failed to unarchive chat session")
@@ -225,10 +251,8 @@ func (h *ChatHandler) UnarchiveChatSession(c *gin.Context) {
 
 // ListChatSessions retrieves chat sessions for a user
 func (h *ChatHandler) ListChatSessions(c *gin.Context) {
-	userIDStr := c.Param("user_id")
-	userID, err := uuid.Parse(userIDStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+	userID, ok := authorizeUserParam(c, h.authorizer, services.ActionRead)
+	if !ok {
 		return
 	}
 
@@ -279,6 +303,9 @@ func (h *ChatHandler) GetProjectChatSessions(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
 		return
 	}
+	if _, _, ok := authorizeProjectID(c, h.projectService, projectID, services.ActionRead); !ok {
+		return
+	}
 
 	includeArchived := c.Query("include_archived") == "true"
 
@@ -300,6 +327,10 @@ func (h *ChatHandler) CreateChatMessage(c *gin.Context) {
 		return
 	}
 
+	if _, ok := h.authorizeSession(c, req.SessionID, services.ActionWrite); !ok {
+		return
+	}
+
 	message := &models.ChatMessage{
 		SessionID:  req.SessionID,
 		Sender:     req.Sender,
@@ -333,6 +364,9 @@ func (h *ChatHandler) GetChatMessage(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
 		return
 	}
+	if _, ok := h.authorizeMessage(c, messageID, services.ActionRead); !ok {
+		return
+	}
 
 	message, err := h.chatService.GetChatMessageByID(messageID)
 	if err != nil {
@@ -345,12 +379,15 @@ func (h *ChatHandler) GetChatMessage(c *gin.Context) {
 
 // GetChatMessages retrieves messages for a chat session
 func (h *ChatHandler) GetChatMessages(c *gin.Context) {
-	sessionIDStr := c.Param("session_id")
+	sessionIDStr := c.Param("id")
 	sessionID, err := uuid.Parse(sessionIDStr)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
 		return
 	}
+	if _, ok := h.authorizeSession(c, sessionID, services.ActionRead); !ok {
+		return
+	}
 
 	offsetStr := c.DefaultQuery("offset", "0")
 	limitStr := c.DefaultQuery("limit", "50")
@@ -400,6 +437,9 @@ func (h *ChatHandler) UpdateChatMessage(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
 		return
 	}
+	if _, ok := h.authorizeMessage(c, messageID, services.ActionWrite); !ok {
+		return
+	}
 
 	var req UpdateChatMessageRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -448,6 +488,9 @@ func (h *ChatHandler) DeleteChatMessage(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
 		return
 	}
+	if _, ok := h.authorizeMessage(c, messageID, services.ActionWrite); !ok {
+		return
+	}
 
 	if err := h.chatService.DeleteChatMessage(messageID); err != nil {
 		h.logger.WithError(err).Error("Failed to delete chat message")
@@ -466,6 +509,9 @@ func (h *ChatHandler) GetChatSessionWithMessages(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
 		return
 	}
+	if _, ok := h.authorizeSession(c, sessionID, services.ActionRead); !ok {
+		return
+	}
 
 	messageLimitStr := c.DefaultQuery("message_limit", "50")
 	messageLimit, err := strconv.Atoi(messageLimitStr)
@@ -488,10 +534,8 @@ func (h *ChatHandler) GetChatSessionWithMessages(c *gin.Context) {
 
 // GetRecentChatSessions retrieves recent chat sessions for a user
 func (h *ChatHandler) GetRecentChatSessions(c *gin.Context) {
-	userIDStr := c.Param("user_id")
-	userID, err := uuid.Parse(userIDStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+	userID, ok := authorizeUserParam(c, h.authorizer, services.ActionRead)
+	if !ok {
 		return
 	}
 
@@ -513,37 +557,25 @@ func (h *ChatHandler) GetRecentChatSessions(c *gin.Context) {
 
 // StreamClaudeChatRequest represents the chat streaming request
 type StreamClaudeChatRequest struct {
-	Message string `json:"message" binding:"required"`
+	Message     string `json:"message" binding:"required"`
+	IncludeDiff bool   `json:"include_diff"` // attach the unified diff to the changes event
 }
 
+// maxTurnDiffBytes caps the unified diff attached to a turn's change summary
+const maxTurnDiffBytes = 256 * 1024
+
 // StreamClaudeChat streams Claude CLI output for a project's single chat session (SSE)
 func (h *ChatHandler) StreamClaudeChat(c *gin.Context) {
-	// Auth user
-	userIDInterface, exists := c.Get("user_id")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
-		return
-	}
-	userID, ok := userIDInterface.(uuid.UUID)
+	// Chatting changes project files, so it requires the editor role
+	userID, ok := currentUserID(c)
 	if !ok {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
 		return
 	}
-
-	// Project ID
-	projectIDStr := c.Param("id")
-	projectID, err := uuid.Parse(projectIDStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
-		return
-	}
-
-	// Ownership check
-	var project models.Project
-	if err := database.DB.Where("id = ? AND owner_id = ? AND deleted_at IS NULL", projectID, userID).First(&project).Error; err != nil {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Project not found or not owned by user"})
+	project, _, ok := authorizeProject(c, h.projectService, services.ActionWrite)
+	if !ok {
 		return
 	}
+	projectID := project.ID
 
 	// Get or create one-to-one chat session for project
 	var session models.ChatSession
@@ -570,56 +602,19 @@ func (h *ChatHandler) StreamClaudeChat(c *gin.Context) {
 		return
 	}
 
-	// Determine working directory from StorageLocation (local_fs) or fallback
-	var storageLoc models.StorageLocation
-	workDir := ""
-	if err := database.DB.Where("project_id = ?", projectID).First(&storageLoc).Error; err == nil && storageLoc.LocalPath != nil {
-		workDir = *storageLoc.LocalPath
-		// Ensure directory exists for local filesystem storage
-		if storageLoc.Type == models.StorageTypeLocalFS {
-			_ = os.MkdirAll(workDir, 0755)
-		}
-	}
-	if workDir == "" {
-		// fallback temp path
-		workDir = "/tmp/borderless-coding/chat/" + userID.String() + "/" + projectID.String()
-		_ = os.MkdirAll(workDir, 0755)
-	}
-
-	// Sync from MinIO if network path exists; otherwise initialize from template
-	if storageLoc.NetworkPath != nil && *storageLoc.NetworkPath != "" {
-		// Download zip to temp, unzip into workDir
-		tmpZip := workDir + "/.remote.zip"
-		// NetworkPath format: bucket/objectKey
-		bucket, object := parseMinIOPath(*storageLoc.NetworkPath)
-		if bucket == "" || object == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid network path"})
-			return
-		}
-		// Download to tmp and unzip
-		if err := storage.DownloadFile(c.Request.Context(), bucket, object, tmpZip); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "failed to download remote archive"})
-			return
-		}
-		if err := utils.UnZipFile(tmpZip, workDir); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid zip archive"})
-			os.Remove(tmpZip)
-			return
-		}
-		_ = os.Remove(tmpZip)
-	} else {
-		// New user: copy project_template.zip into workDir and unzip
-		templateZip := config.LoadConfig().ProjectTemplateZip
-		if templateZip == "" {
-			templateZip = "project_template.zip"
-		}
-		if _, err := os.Stat(templateZip); err == nil {
-			if err := utils.UnZipFile(templateZip, workDir); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to initialize template"})
-				return
-			}
+	// Check out the project workspace: synced from MinIO, or initialized from the template
+	ws, err := h.workspaceService.Checkout(c.Request.Context(), project)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to prepare workspace")
+		status := http.StatusInternalServerError
+		if errors.Is(err, services.ErrWorkspaceBusy) {
+			status = http.StatusConflict
 		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
 	}
+	defer h.workspaceService.Release(ws)
+	workDir := ws.Dir
 
 	h.logger.Info("workDir is ...", workDir)
 
@@ -721,42 +716,50 @@ func (h *ChatHandler) StreamClaudeChat(c *gin.Context) {
 			if readersClosed >= 2 {
 				// All readers done; wait for process
 				_ = cmd.Wait()
-				// Persist assistant message
-				if assistantAccum != "" {
-					content := models.JSONB{"text": assistantAccum}
+				// Git commit changes with chat message and summarize the turn (best effort)
+				changes := &utils.GitDiffSummary{Files: []utils.GitFileChange{}}
+				if commit, err := utils.GitCommitAll(workDir, req.Message); err != nil {
+					h.logger.WithError(err).Warn("git commit failed")
+				} else if commit != "" {
+					if summary, err := utils.GitCommitDiff(workDir, commit, req.IncludeDiff, maxTurnDiffBytes); err != nil {
+						h.logger.WithError(err).Warn("failed to compute turn diff")
+					} else {
+						changes = summary
+					}
+				}
+				// Persist assistant message along with the turn's change summary
+				var assistantMsgID *uuid.UUID
+				if assistantAccum != "" || len(changes.Files) > 0 {
+					content := models.JSONB{"text": assistantAccum, "changes": changes}
 					msg := models.ChatMessage{SessionID: session.ID, Sender: models.ChatSenderAssistant, Text: &assistantAccum, Content: content}
-					_ = database.DB.Create(&msg).Error
+					if err := database.DB.Create(&msg).Error; err == nil {
+						assistantMsgID = &msg.ID
+					}
 				}
-				// Git commit changes with chat message (best effort)
-				_ = runGitCommit(workDir, req.Message)
-				// Zip and upload back to MinIO (compose path if empty)
-				composedPath := getOrComposeNetworkPath(&storageLoc, userID, projectID, session.ID)
-				bucket, object := parseMinIOPath(composedPath)
-				tmpZip := filepath.Join(os.TempDir(), "upload-"+projectID.String()+".zip")
-				if err := utils.ZipFolder(workDir, tmpZip); err != nil {
-					h.logger.WithError(err).Error("zip failed")
+				c.Writer.WriteString("event: changes\n")
+				b, _ := json.Marshal(gin.H{"message_id": assistantMsgID, "changes": changes})
+				c.Writer.WriteString("data: " + string(b) + "\n\n")
+				flusher.Flush()
+				// Zip and upload back to MinIO, then advance the project version
+				if err := h.workspaceService.Publish(c.Request.Context(), ws); err != nil {
+					h.logger.WithError(err).Error("upload failed")
 					c.Writer.WriteString("event: upload_error\n")
-					b, _ := json.Marshal(gin.H{"error": "zip failed"})
-					c.Writer.WriteString("data: " + string(b) + "\n\n")
-					flusher.Flush()
-				} else {
-					if err := storage.UploadFile(c.Request.Context(), bucket, object, tmpZip); err != nil {
-						h.logger.WithError(err).Error("upload failed")
-						c.Writer.WriteString("event: upload_error\n")
-						b, _ := json.Marshal(gin.H{"error": "upload failed"})
-						c.Writer.WriteString("data: " + string(b) + "\n\n")
-						flusher.Flush()
-					} else {
-						// Persist composed network path if it was empty before
-						if storageLoc.NetworkPath == nil || *storageLoc.NetworkPath == "" {
-							np := composedPath
-							_ = database.DB.Model(&models.StorageLocation{}).Where("id = ?", storageLoc.ID).Update("network_path", np).Error
+					payload := gin.H{"error": "upload failed"}
+					var quotaErr *services.QuotaExceededError
+					if errors.As(err, &quotaErr) {
+						payload = gin.H{
+							"error":           services.ErrQuotaExceeded.Error(),
+							"used_bytes":      quotaErr.UsedBytes,
+							"requested_bytes": quotaErr.RequestedBytes,
+							"quota_bytes":     quotaErr.QuotaBytes,
 						}
 					}
-					_ = os.Remove(tmpZip)
+					b, _ := json.Marshal(payload)
+					c.Writer.WriteString("data: " + string(b) + "\n\n")
+					flusher.Flush()
+				} else if _, err := h.projectService.BumpVersion(projectID); err != nil {
+					h.logger.WithError(err).Warn("Failed to bump project version")
 				}
-				// Cleanup local folder
-				_ = os.RemoveAll(workDir)
 				c.Writer.WriteString("event: complete\n")
 				c.Writer.WriteString("data: {}\n\n")
 				flusher.Flush()
@@ -774,47 +777,28 @@ func (h *ChatHandler) StreamClaudeChat(c *gin.Context) {
 	}
 }
 
-// parseMinIOPath expects "bucket/objectKey"
-func parseMinIOPath(p string) (string, string) {
-	for i := 0; i < len(p); i++ {
-		if p[i] == '/' {
-			return p[:i], p[i+1:]
-		}
+// authorizeSession loads a chat session and checks the caller's role on its project
+func (h *ChatHandler) authorizeSession(c *gin.Context, sessionID uuid.UUID, action services.Action) (*models.ChatSession, bool) {
+	session, err := h.chatService.GetChatSessionByID(sessionID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Chat session not found"})
+		return nil, false
 	}
-	return "", ""
-}
-
-func getOrComposeNetworkPath(loc *models.StorageLocation, userID, projectID, sessionID uuid.UUID) string {
-	if loc != nil && loc.NetworkPath != nil && *loc.NetworkPath != "" {
-		return *loc.NetworkPath
+	if _, _, ok := authorizeProjectID(c, h.projectService, session.ProjectID, action); !ok {
+		return nil, false
 	}
-	// Default bucket from config, path composed
-	cfg := config.LoadConfig()
-	bucket := cfg.MinIOBucketName
-	object := "users/" + userID.String() + "/projects/" + projectID.String() + "/sessions/" + sessionID.String() + ".zip"
-	np := bucket + "/" + object
-	return np
+	return session, true
 }
 
-func runGitCommit(dir, message string) error {
-	// Initialize repo if needed
-	if _, err := os.Stat(dir + "/.git"); os.IsNotExist(err) {
-		cmd := exec.Command("git", "init")
-		cmd.Dir = dir
-		_ = cmd.Run()
-	}
-	// Add all
-	cmdAdd := exec.Command("git", "add", ".")
-	cmdAdd.Dir = dir
-	if err := cmdAdd.Run(); err != nil {
-		return err
-	}
-	// Commit
-	if message == "" {
-		message = "update via chat"
-	}
-	cmdCommit := exec.Command("git", "commit", "-m", message)
-	cmdCommit.Dir = dir
-	_ = cmdCommit.Run() // best effort
-	return nil
+// authorizeMessage loads a chat message and checks the caller's role on its session's project
+func (h *ChatHandler) authorizeMessage(c *gin.Context, messageID uuid.UUID, action services.Action) (*models.ChatMessage, bool) {
+	message, err := h.chatService.GetChatMessageByID(messageID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Chat message not found"})
+		return nil, false
+	}
+	if _, ok := h.authorizeSession(c, message.SessionID, action); !ok {
+		return nil, false
+	}
+	return message, true
 }
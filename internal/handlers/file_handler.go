@@ -0,0 +1,526 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"borderless_coding_server/internal/services"
+	"borderless_coding_server/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// maxFileWriteBytes caps the body of a single file write
+const maxFileWriteBytes = 10 << 20
+
+type FileHandler struct {
+	projectService   *services.ProjectService
+	workspaceService *services.WorkspaceService
+	quotaService     *services.QuotaService
+	logger           *logrus.Logger
+}
+
+func NewFileHandler(projectService *services.ProjectService, workspaceService *services.WorkspaceService, quotaService *services.QuotaService, logger *logrus.Logger) *FileHandler {
+	return &FileHandler{
+		projectService:   projectService,
+		workspaceService: workspaceService,
+		quotaService:     quotaService,
+		logger:           logger,
+	}
+}
+
+// CreateDirectoryRequest represents the request payload for creating a directory
+type CreateDirectoryRequest struct {
+	Path    string `json:"path" binding:"required"`
+	Version *int   `json:"version"`
+}
+
+// MoveFileRequest represents the request payload for moving or renaming a file or directory
+type MoveFileRequest struct {
+	From      string `json:"from" binding:"required"`
+	To        string `json:"to" binding:"required"`
+	Overwrite bool   `json:"overwrite"`
+	Version   *int   `json:"version"`
+}
+
+// ListFiles lists the project file tree
+// GET /api/v1/projects/:id/files?path=&recursive=
+func (h *FileHandler) ListFiles(c *gin.Context) {
+	ws, ok := h.snapshot(c)
+	if !ok {
+		return
+	}
+	defer h.workspaceService.Release(ws)
+
+	dir := c.DefaultQuery("path", ".")
+	recursive := c.DefaultQuery("recursive", "true") == "true"
+
+	entries, err := ws.ListFiles(dir, recursive)
+	if err != nil {
+		h.respondFileError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"path":    services.CleanWorkspacePath(dir),
+		"version": ws.Project.Version,
+		"entries": entries,
+	})
+}
+
+// ReadFile returns the content of a file, honoring HTTP Range requests
+// GET /api/v1/projects/:id/files/content?path=
+func (h *FileHandler) ReadFile(c *gin.Context) {
+	path := c.Query("path")
+	if path == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "path is required"})
+		return
+	}
+
+	ws, ok := h.snapshot(c)
+	if !ok {
+		return
+	}
+	defer h.workspaceService.Release(ws)
+
+	abs, err := ws.ResolvePath(path)
+	if err != nil {
+		h.respondFileError(c, err)
+		return
+	}
+	f, err := os.Open(abs)
+	if err != nil {
+		h.respondFileError(c, err)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		h.respondFileError(c, err)
+		return
+	}
+	if info.IsDir() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "path is a directory"})
+		return
+	}
+
+	c.Header("ETag", versionETag(ws.Project.Version))
+	c.Header("X-Project-Version", strconv.Itoa(ws.Project.Version))
+	http.ServeContent(c.Writer, c.Request, info.Name(), info.ModTime(), f)
+}
+
+// WriteFile creates or replaces a file with the raw request body
+// PUT /api/v1/projects/:id/files/content?path=
+func (h *FileHandler) WriteFile(c *gin.Context) {
+	path := c.Query("path")
+	if path == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "path is required"})
+		return
+	}
+	version, ok := expectedVersion(c, nil)
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxFileWriteBytes+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read request body"})
+		return
+	}
+	if len(body) > maxFileWriteBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "file exceeds the maximum size"})
+		return
+	}
+
+	cleaned := services.CleanWorkspacePath(path)
+	h.mutate(c, version, "Update "+cleaned, func(ws *services.Workspace) error {
+		abs, err := ws.ResolvePath(path)
+		if err != nil {
+			return err
+		}
+		var existing int64
+		if info, err := os.Stat(abs); err == nil {
+			if info.IsDir() {
+				return errPathIsDirectory
+			}
+			existing = info.Size()
+		}
+		if err := h.quotaService.CheckGrowth(ws.Project.ID, services.UsageWorkspace, int64(len(body))-existing); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(abs), 0755); err != nil {
+			return err
+		}
+		return os.WriteFile(abs, body, 0644)
+	})
+}
+
+// CreateDirectory creates a directory (and any missing parents)
+// POST /api/v1/projects/:id/files/directories
+func (h *FileHandler) CreateDirectory(c *gin.Context) {
+	var req CreateDirectoryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	version, ok := expectedVersion(c, req.Version)
+	if !ok {
+		return
+	}
+
+	cleaned := services.CleanWorkspacePath(req.Path)
+	h.mutate(c, version, "Create directory "+cleaned, func(ws *services.Workspace) error {
+		abs, err := ws.ResolvePath(req.Path)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(abs, 0755); err != nil {
+			return err
+		}
+		// Git does not track empty directories; keep the new directory in the snapshot
+		entries, err := os.ReadDir(abs)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			return os.WriteFile(filepath.Join(abs, ".gitkeep"), nil, 0644)
+		}
+		return nil
+	})
+}
+
+// DeleteFile deletes a file or directory
+// DELETE /api/v1/projects/:id/files?path=
+func (h *FileHandler) DeleteFile(c *gin.Context) {
+	path := c.Query("path")
+	if path == "" || services.CleanWorkspacePath(path) == "." {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "path is required"})
+		return
+	}
+	version, ok := expectedVersion(c, nil)
+	if !ok {
+		return
+	}
+
+	cleaned := services.CleanWorkspacePath(path)
+	h.mutate(c, version, "Delete "+cleaned, func(ws *services.Workspace) error {
+		abs, err := ws.ResolvePath(path)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Lstat(abs); err != nil {
+			return err
+		}
+		return os.RemoveAll(abs)
+	})
+}
+
+// MoveFile moves or renames a file or directory
+// POST /api/v1/projects/:id/files/move
+func (h *FileHandler) MoveFile(c *gin.Context) {
+	var req MoveFileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	version, ok := expectedVersion(c, req.Version)
+	if !ok {
+		return
+	}
+
+	from := services.CleanWorkspacePath(req.From)
+	to := services.CleanWorkspacePath(req.To)
+	if from == "." || to == "." {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cannot move the workspace root"})
+		return
+	}
+	if from == to {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "source and destination are the same"})
+		return
+	}
+	if strings.HasPrefix(to, from+"/") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cannot move a directory into itself"})
+		return
+	}
+
+	h.mutate(c, version, "Move "+from+" to "+to, func(ws *services.Workspace) error {
+		src, err := ws.ResolvePath(req.From)
+		if err != nil {
+			return err
+		}
+		dst, err := ws.ResolvePath(req.To)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Lstat(src); err != nil {
+			return err
+		}
+		if _, err := os.Lstat(dst); err == nil {
+			if !req.Overwrite {
+				return errDestinationExists
+			}
+			if err := os.RemoveAll(dst); err != nil {
+				return err
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		return os.Rename(src, dst)
+	})
+}
+
+// exportExclusions maps the values accepted by ExportProject's exclude parameter to file names
+var exportExclusions = map[string][]string{
+	"node_modules": {"node_modules"},
+	"build":        {"dist", "build", ".next", ".nuxt", ".output"},
+	"git":          {".git"},
+}
+
+// ExportProject streams the project workspace as a zip, tar.gz or git bundle
+// GET /api/v1/projects/:id/export?format=zip|tar.gz|bundle&exclude=node_modules,build,git
+func (h *FileHandler) ExportProject(c *gin.Context) {
+	format := c.DefaultQuery("format", "zip")
+	var ext, contentType string
+	switch format {
+	case "zip":
+		ext, contentType = ".zip", "application/zip"
+	case "tar.gz", "tgz":
+		format, ext, contentType = "tar.gz", ".tar.gz", "application/gzip"
+	case "bundle":
+		ext, contentType = ".bundle", "application/x-git-bundle"
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be one of zip, tar.gz, bundle"})
+		return
+	}
+
+	var opts utils.ArchiveOptions
+	if raw := c.Query("exclude"); raw != "" {
+		for _, item := range strings.Split(raw, ",") {
+			names, ok := exportExclusions[strings.TrimSpace(item)]
+			if !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "exclude must be a list of node_modules, build, git"})
+				return
+			}
+			opts.Exclude = append(opts.Exclude, names...)
+		}
+	}
+
+	ws, ok := h.snapshot(c)
+	if !ok {
+		return
+	}
+	defer h.workspaceService.Release(ws)
+
+	if format == "bundle" && utils.GitHead(ws.Dir) == "" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Project has no commit history yet"})
+		return
+	}
+
+	name := ws.Project.Slug
+	if name == "" {
+		name = ws.Project.ID.String()
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s%s"`, name, ext))
+	c.Header("X-Project-Version", strconv.Itoa(ws.Project.Version))
+	c.Status(http.StatusOK)
+
+	// The response is streamed, so failures past this point can only be logged
+	var err error
+	switch format {
+	case "zip":
+		err = utils.WriteZip(c.Writer, ws.Dir, opts)
+	case "tar.gz":
+		err = utils.WriteTarGz(c.Writer, ws.Dir, opts)
+	case "bundle":
+		err = utils.GitBundle(c.Request.Context(), ws.Dir, c.Writer)
+	}
+	if err != nil {
+		h.logger.WithError(err).WithField("project_id", ws.Project.ID).Error("Failed to export project")
+	}
+}
+
+var (
+	errPathIsDirectory   = errors.New("path is a directory")
+	errDestinationExists = errors.New("destination already exists")
+)
+
+// snapshot loads the project and a read-only copy of its workspace
+func (h *FileHandler) snapshot(c *gin.Context) (*services.Workspace, bool) {
+	project, _, ok := authorizeProject(c, h.projectService, services.ActionRead)
+	if !ok {
+		return nil, false
+	}
+
+	ws, err := h.workspaceService.Snapshot(c.Request.Context(), project)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to load project workspace")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load project workspace"})
+		return nil, false
+	}
+	return ws, true
+}
+
+// mutate applies op to a locked checkout of the project, commits and publishes the result and
+// then advances the project version (if it still matches the client's version). A change whose
+// version cannot be advanced is rolled back, so the stored snapshot always matches the version.
+func (h *FileHandler) mutate(c *gin.Context, version int, message string, op func(ws *services.Workspace) error) {
+	project, _, ok := authorizeProject(c, h.projectService, services.ActionWrite)
+	if !ok {
+		return
+	}
+	projectID := project.ID
+
+	ws, err := h.workspaceService.Checkout(c.Request.Context(), project)
+	if err != nil {
+		if errors.Is(err, services.ErrWorkspaceBusy) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		h.logger.WithError(err).Error("Failed to check out project workspace")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load project workspace"})
+		return
+	}
+	defer h.workspaceService.Release(ws)
+
+	// Re-read the version now that the workspace is locked
+	current, err := h.projectService.GetProjectByID(projectID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if current.Version != version {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":   services.ErrVersionConflict.Error(),
+			"version": current.Version,
+		})
+		return
+	}
+
+	base, err := h.workspaceService.Base(ws)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to read workspace history")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load project workspace"})
+		return
+	}
+
+	if err := op(ws); err != nil {
+		h.respondFileError(c, err)
+		return
+	}
+
+	commit, err := h.workspaceService.Commit(ws, message)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to commit workspace change")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit change"})
+		return
+	}
+	if commit == "" {
+		// Nothing changed; the client's version is still current
+		c.JSON(http.StatusOK, gin.H{"message": "No changes", "version": current.Version})
+		return
+	}
+
+	// Publish before advancing the version, so a failed upload leaves both untouched
+	if err := h.workspaceService.Publish(c.Request.Context(), ws); err != nil {
+		if respondQuotaExceeded(c, err) {
+			return
+		}
+		h.logger.WithError(err).Error("Failed to publish workspace")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save project files"})
+		return
+	}
+
+	newVersion, err := h.projectService.CompareAndBumpVersion(projectID, version)
+	if err != nil {
+		if rollbackErr := h.workspaceService.Rollback(c.Request.Context(), ws, base); rollbackErr != nil {
+			h.logger.WithError(rollbackErr).WithField("project_id", projectID).Error("Failed to roll back unversioned change")
+		}
+		if errors.Is(err, services.ErrVersionConflict) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		h.logger.WithError(err).Error("Failed to update project version")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update project version"})
+		return
+	}
+
+	c.Header("ETag", versionETag(newVersion))
+	c.JSON(http.StatusOK, gin.H{
+		"message": message,
+		"commit":  commit,
+		"version": newVersion,
+	})
+}
+
+// respondFileError maps filesystem errors to HTTP responses
+func (h *FileHandler) respondFileError(c *gin.Context, err error) {
+	if respondQuotaExceeded(c, err) {
+		return
+	}
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+	case errors.Is(err, errDestinationExists):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, errPathIsDirectory),
+		errors.Is(err, utils.ErrPathEscapesRoot),
+		errors.Is(err, services.ErrGitPathForbidden),
+		errors.Is(err, services.ErrNotDirectory):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		h.logger.WithError(err).Error("File operation failed")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "File operation failed"})
+	}
+}
+
+// respondQuotaExceeded writes a 413 response if err is a storage quota violation
+func respondQuotaExceeded(c *gin.Context, err error) bool {
+	var quotaErr *services.QuotaExceededError
+	if !errors.As(err, &quotaErr) {
+		return false
+	}
+	c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+		"error":           services.ErrQuotaExceeded.Error(),
+		"used_bytes":      quotaErr.UsedBytes,
+		"requested_bytes": quotaErr.RequestedBytes,
+		"quota_bytes":     quotaErr.QuotaBytes,
+	})
+	return true
+}
+
+// expectedVersion reads the project version the client based its change on, from the JSON body,
+// the If-Match header or the version query parameter
+func expectedVersion(c *gin.Context, fromBody *int) (int, bool) {
+	if fromBody != nil {
+		return *fromBody, true
+	}
+	raw := strings.Trim(strings.TrimPrefix(c.GetHeader("If-Match"), "W/"), `"`)
+	raw = strings.TrimPrefix(raw, "v")
+	if raw == "" {
+		raw = c.Query("version")
+	}
+	if raw == "" {
+		c.JSON(http.StatusPreconditionRequired, gin.H{"error": "project version is required (If-Match header or version parameter)"})
+		return 0, false
+	}
+	version, err := strconv.Atoi(raw)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid project version"})
+		return 0, false
+	}
+	return version, true
+}
+
+func versionETag(version int) string {
+	return fmt.Sprintf(`"v%d"`, version)
+}
@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"net/http"
+
+	"borderless_coding_server/internal/models"
+	"borderless_coding_server/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+type MemberHandler struct {
+	projectService *services.ProjectService
+	authorizer     *services.Authorizer
+	logger         *logrus.Logger
+}
+
+func NewMemberHandler(projectService *services.ProjectService, authorizer *services.Authorizer, logger *logrus.Logger) *MemberHandler {
+	return &MemberHandler{
+		projectService: projectService,
+		authorizer:     authorizer,
+		logger:         logger,
+	}
+}
+
+// InviteMemberRequest represents the request payload for inviting a user to a project
+type InviteMemberRequest struct {
+	UserID *uuid.UUID         `json:"user_id"`
+	Email  string             `json:"email"`
+	Role   models.ProjectRole `json:"role" binding:"required"`
+}
+
+// UpdateMemberRequest represents the request payload for changing a member's role
+type UpdateMemberRequest struct {
+	Role models.ProjectRole `json:"role" binding:"required"`
+}
+
+// ListMembers lists the owner, members and pending invitations of a project
+// GET /api/v1/projects/:id/members
+func (h *MemberHandler) ListMembers(c *gin.Context) {
+	project, _, ok := authorizeProject(c, h.projectService, services.ActionRead)
+	if !ok {
+		return
+	}
+
+	members, err := h.projectService.ListMembers(project.ID)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to list project members")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve project members"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"owner_id": project.OwnerID,
+		"members":  members,
+	})
+}
+
+// InviteMember invites a user to a project (admin role required; only the owner can invite admins)
+// POST /api/v1/projects/:id/members
+func (h *MemberHandler) InviteMember(c *gin.Context) {
+	project, role, ok := authorizeProject(c, h.projectService, services.ActionRead)
+	if !ok {
+		return
+	}
+
+	var req InviteMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	subject, ok := authorize(c, h.authorizer, services.ActionWrite, services.ProjectMemberResource(role, uuid.Nil, req.Role))
+	if !ok {
+		return
+	}
+
+	member, err := h.projectService.InviteMember(project, subject.UserID, req.UserID, req.Email, req.Role)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to invite project member")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Invitation sent successfully",
+		"member":  member,
+	})
+}
+
+// AcceptInvitation accepts the caller's pending invitation to a project
+// POST /api/v1/projects/:id/members/accept
+func (h *MemberHandler) AcceptInvitation(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	projectID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+		return
+	}
+
+	member, err := h.projectService.AcceptInvitation(projectID, userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Invitation accepted successfully",
+		"member":  member,
+	})
+}
+
+// UpdateMember changes a member's role; only the owner can grant or revoke the admin role
+// PUT /api/v1/projects/:id/members/:user_id
+func (h *MemberHandler) UpdateMember(c *gin.Context) {
+	project, role, ok := authorizeProject(c, h.projectService, services.ActionRead)
+	if !ok {
+		return
+	}
+	member, ok := h.loadMember(c, project.ID)
+	if !ok {
+		return
+	}
+
+	var req UpdateMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// Both the current and the new role must be manageable by the caller
+	if _, ok := authorize(c, h.authorizer, services.ActionWrite, services.ProjectMemberResource(role, member.UserID, member.Role)); !ok {
+		return
+	}
+	if _, ok := authorize(c, h.authorizer, services.ActionWrite, services.ProjectMemberResource(role, member.UserID, req.Role)); !ok {
+		return
+	}
+
+	if err := h.projectService.UpdateMemberRole(project.ID, member.UserID, req.Role); err != nil {
+		h.logger.WithError(err).Error("Failed to update project member")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Project member updated successfully"})
+}
+
+// RemoveMember removes a member or revokes an invitation. Members may always remove
+// themselves, which also declines a pending invitation.
+// DELETE /api/v1/projects/:id/members/:user_id
+func (h *MemberHandler) RemoveMember(c *gin.Context) {
+	subject, ok := currentSubject(c)
+	if !ok {
+		return
+	}
+	projectID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+		return
+	}
+
+	// Invitees cannot see the project yet, but may still decline
+	var role models.ProjectRole
+	if c.Param("user_id") != subject.UserID.String() {
+		if _, role, ok = authorizeProjectID(c, h.projectService, projectID, services.ActionRead); !ok {
+			return
+		}
+	}
+	member, ok := h.loadMember(c, projectID)
+	if !ok {
+		return
+	}
+	if _, ok := authorize(c, h.authorizer, services.ActionDelete, services.ProjectMemberResource(role, member.UserID, member.Role)); !ok {
+		return
+	}
+
+	if err := h.projectService.RemoveMember(projectID, member.UserID); err != nil {
+		h.logger.WithError(err).Error("Failed to remove project member")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Project member removed successfully"})
+}
+
+// ListInvitations lists the caller's pending project invitations
+// GET /api/v1/project-invitations
+func (h *MemberHandler) ListInvitations(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	invitations, err := h.projectService.GetPendingInvitations(userID)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to list project invitations")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve invitations"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"invitations": invitations})
+}
+
+// loadMember loads the membership named by the :user_id URL parameter
+func (h *MemberHandler) loadMember(c *gin.Context, projectID uuid.UUID) (*models.ProjectMember, bool) {
+	memberUserID, err := uuid.Parse(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return nil, false
+	}
+	member, err := h.projectService.GetMember(projectID, memberUserID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project member not found"})
+		return nil, false
+	}
+	return member, true
+}
@@ -0,0 +1,302 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"borderless_coding_server/internal/models"
+	"borderless_coding_server/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// previewTokenParam is the query parameter carrying a signed preview link token
+	previewTokenParam = "token"
+	// previewTokenCookie keeps a signed link's access for the assets the preview loads
+	previewTokenCookie = "preview_token"
+	// defaultPreviewLinkTTL and maxPreviewLinkTTL bound how long signed links stay valid
+	defaultPreviewLinkTTL = time.Hour
+	maxPreviewLinkTTL     = 7 * 24 * time.Hour
+)
+
+// fingerprintPattern matches the content hash bundlers put in asset names, as in
+// app.3f9a1c2b.js or index-B4xY7_k2.css
+var fingerprintPattern = regexp.MustCompile(`[.-]([A-Za-z0-9_]{8,})\.[A-Za-z0-9]+$`)
+
+type PreviewHandler struct {
+	projectService   *services.ProjectService
+	previewService   *services.PreviewService
+	devServerService *services.DevServerService
+	logger           *logrus.Logger
+}
+
+func NewPreviewHandler(projectService *services.ProjectService, previewService *services.PreviewService, devServerService *services.DevServerService, logger *logrus.Logger) *PreviewHandler {
+	return &PreviewHandler{
+		projectService:   projectService,
+		previewService:   previewService,
+		devServerService: devServerService,
+		logger:           logger,
+	}
+}
+
+// CreatePreviewLinkRequest represents the request payload for creating a signed preview link
+type CreatePreviewLinkRequest struct {
+	ExpiresIn int `json:"expires_in"` // seconds
+}
+
+// ServePreview serves a file of a project's live preview from local disk or MinIO, or proxies
+// the request to the project's dev server while one is running. Public and
+// unlisted previews are open to anyone; private previews need read access to the project,
+// either through the Authorization header or a signed preview link. Unknown paths without a
+// file extension fall back to the entry point so client-side routing works.
+// GET /preview/:project_id/*filepath
+func (h *PreviewHandler) ServePreview(c *gin.Context) {
+	projectID, err := uuid.Parse(c.Param("project_id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Preview not found"})
+		return
+	}
+
+	project, err := h.projectService.GetProjectByID(projectID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Preview not found"})
+		return
+	}
+	private := project.Visibility == models.ProjectVisibilityPrivate
+	if private && !h.canViewPrivate(c, project) {
+		// Private previews are not revealed to callers without access
+		c.JSON(http.StatusNotFound, gin.H{"error": "Preview not found"})
+		return
+	}
+
+	// A running live preview takes over from the deployed one
+	if dev, ok := h.devServerService.Get(project.ID); ok {
+		if dev.Status != services.DevServerStatusReady {
+			c.Header("Retry-After", "2")
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Live preview is starting", "build_id": dev.BuildID})
+			return
+		}
+		if h.devServerService.Proxy(c.Writer, c.Request, project.ID) {
+			return
+		}
+	}
+
+	file, err := h.previewService.OpenPreview(c.Request.Context(), project, c.Param("filepath"))
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrPreviewNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Preview not found"})
+		case errors.Is(err, services.ErrPreviewFileNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		default:
+			h.logger.WithError(err).Error("Failed to open preview file")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load preview"})
+		}
+		return
+	}
+	defer file.Close()
+
+	c.Header("Cache-Control", previewCacheControl(file.Name, private))
+	c.Header("ETag", previewETag(file))
+	c.Header("X-Content-Type-Options", "nosniff")
+	http.ServeContent(c.Writer, c.Request, file.Name, file.ModTime, file)
+}
+
+// RedirectLegacyPreview redirects preview URLs from before previews had their own route
+// GET /static/:project_id/*filepath
+func (h *PreviewHandler) RedirectLegacyPreview(c *gin.Context) {
+	target := "/preview/" + c.Param("project_id") + c.Param("filepath")
+	if c.Request.URL.RawQuery != "" {
+		target += "?" + c.Request.URL.RawQuery
+	}
+	c.Redirect(http.StatusMovedPermanently, target)
+}
+
+// CreatePreviewLink creates an expiring link to a project's preview that works without
+// logging in, for sharing private previews
+// POST /api/v1/projects/:id/preview/link
+func (h *PreviewHandler) CreatePreviewLink(c *gin.Context) {
+	project, _, ok := authorizeProject(c, h.projectService, services.ActionRead)
+	if !ok {
+		return
+	}
+
+	var req CreatePreviewLinkRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	ttl := defaultPreviewLinkTTL
+	if req.ExpiresIn > 0 {
+		ttl = time.Duration(req.ExpiresIn) * time.Second
+	}
+	if ttl > maxPreviewLinkTTL {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("expires_in cannot exceed %d seconds", int(maxPreviewLinkTTL.Seconds()))})
+		return
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	token := h.previewService.SignPreviewLink(project.ID, expiresAt)
+	c.JSON(http.StatusCreated, gin.H{
+		"url":        fmt.Sprintf("/preview/%s/?%s=%s", project.ID, previewTokenParam, token),
+		"expires_at": expiresAt.UTC(),
+	})
+}
+
+// StartLivePreview starts the project template's dev server and proxies the project preview
+// to it until it is stopped or idles out. Follow startup with GET /api/v1/builds/:id/stream.
+// POST /api/v1/projects/:id/preview/live
+func (h *PreviewHandler) StartLivePreview(c *gin.Context) {
+	// Running project code requires the same role as building a preview
+	project, _, ok := authorizeProject(c, h.projectService, services.ActionWrite)
+	if !ok {
+		return
+	}
+	subject, ok := currentSubject(c)
+	if !ok {
+		return
+	}
+
+	dev, started, err := h.devServerService.Start(subject.UserID, project)
+	if err != nil {
+		if errors.Is(err, services.ErrDevServerUnsupported) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		h.logger.WithError(err).Error("Failed to start dev server")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start live preview"})
+		return
+	}
+	if !started {
+		c.JSON(http.StatusOK, gin.H{
+			"message":    "Live preview is already running",
+			"dev_server": dev,
+		})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":    "Live preview starting",
+		"dev_server": dev,
+		"stream_url": fmt.Sprintf("/api/v1/builds/%s/stream", dev.BuildID),
+	})
+}
+
+// GetLivePreview returns the project's running dev server
+// GET /api/v1/projects/:id/preview/live
+func (h *PreviewHandler) GetLivePreview(c *gin.Context) {
+	project, _, ok := authorizeProject(c, h.projectService, services.ActionRead)
+	if !ok {
+		return
+	}
+
+	dev, ok := h.devServerService.Get(project.ID)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Live preview is not running"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"dev_server": dev})
+}
+
+// StopLivePreview stops the project's dev server; the deployed preview is served again
+// DELETE /api/v1/projects/:id/preview/live
+func (h *PreviewHandler) StopLivePreview(c *gin.Context) {
+	project, _, ok := authorizeProject(c, h.projectService, services.ActionWrite)
+	if !ok {
+		return
+	}
+
+	stopped, err := h.devServerService.Stop(project.ID)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to stop dev server")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to stop live preview"})
+		return
+	}
+	if !stopped {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Live preview is not running"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Live preview stopped"})
+}
+
+// canViewPrivate reports whether the caller may view a private preview. A valid signed link
+// token is remembered in a cookie scoped to the project's preview path.
+func (h *PreviewHandler) canViewPrivate(c *gin.Context, project *models.Project) bool {
+	if token := c.Query(previewTokenParam); token != "" {
+		expiresAt, err := h.previewService.VerifyPreviewToken(project.ID, token)
+		if err != nil {
+			return false
+		}
+		http.SetCookie(c.Writer, &http.Cookie{
+			Name:     previewTokenCookie,
+			Value:    token,
+			Path:     "/preview/" + project.ID.String() + "/",
+			Expires:  expiresAt,
+			HttpOnly: true,
+			Secure:   c.Request.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+		return true
+	}
+	if token, err := c.Cookie(previewTokenCookie); err == nil {
+		if _, err := h.previewService.VerifyPreviewToken(project.ID, token); err == nil {
+			return true
+		}
+	}
+
+	// Set by OptionalAuthMiddleware when the request carries a valid access token
+	if _, exists := c.Get("user_id"); !exists {
+		return false
+	}
+	subject, ok := currentSubject(c)
+	if !ok {
+		return false
+	}
+	_, _, err := h.projectService.AuthorizeProject(project.ID, subject, services.ActionRead)
+	return err == nil
+}
+
+// previewETag identifies a preview file's content. Files of a deployment never change, so the
+// version is used rather than modification times, which differ between disk and MinIO.
+func previewETag(file *services.PreviewFile) string {
+	if file.Version == 0 {
+		return fmt.Sprintf(`"%x-%x"`, file.ModTime.UnixNano(), file.Size)
+	}
+	return fmt.Sprintf(`"v%d-%x"`, file.Version, file.Size)
+}
+
+// previewCacheControl returns the Cache-Control header for a preview file. HTML is
+// revalidated on every load so a new deployment shows up at once, fingerprinted assets are
+// cached for good, and private previews stay out of shared caches.
+func previewCacheControl(name string, private bool) string {
+	scope := "public"
+	if private {
+		scope = "private"
+	}
+	switch {
+	case strings.HasSuffix(name, ".html"):
+		return scope + ", no-cache"
+	case isFingerprinted(name):
+		return scope + ", max-age=31536000, immutable"
+	default:
+		return scope + ", max-age=300"
+	}
+}
+
+// isFingerprinted reports whether a file name carries a content hash. Hashes contain a digit,
+// which tells them apart from names like jquery-validation.js.
+func isFingerprinted(name string) bool {
+	match := fingerprintPattern.FindStringSubmatch(name)
+	return match != nil && strings.ContainsAny(match[1], "0123456789")
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"borderless_coding_server/internal/models"
+	"borderless_coding_server/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// currentUserID returns the authenticated user's ID, writing 401 if there is none
+func currentUserID(c *gin.Context) (uuid.UUID, bool) {
+	userIDInterface, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return uuid.Nil, false
+	}
+	userID, ok := userIDInterface.(uuid.UUID)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+		return uuid.Nil, false
+	}
+	return userID, true
+}
+
+// currentSubject returns the authenticated user with the roles and permissions set by AuthMiddleware
+func currentSubject(c *gin.Context) (services.Subject, bool) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return services.Subject{}, false
+	}
+	return services.Subject{
+		UserID:      userID,
+		Roles:       c.GetStringSlice("user_roles"),
+		Permissions: c.GetStringSlice("user_permissions"),
+	}, true
+}
+
+// authorize checks that the caller may perform action on resource, writing 403 if not
+func authorize(c *gin.Context, authorizer *services.Authorizer, action services.Action, resource services.Resource) (services.Subject, bool) {
+	subject, ok := currentSubject(c)
+	if !ok {
+		return subject, false
+	}
+	if !authorizer.Can(subject, action, resource) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+		return subject, false
+	}
+	return subject, true
+}
+
+// authorizeUserParam parses the user ID from the :id URL parameter and checks that the caller
+// may perform action on that account
+func authorizeUserParam(c *gin.Context, authorizer *services.Authorizer, action services.Action) (uuid.UUID, bool) {
+	userID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return uuid.Nil, false
+	}
+	if _, ok := authorize(c, authorizer, action, services.UserResource(userID)); !ok {
+		return uuid.Nil, false
+	}
+	return userID, true
+}
+
+// authorizeProject loads the project named by the :id URL parameter and checks that the
+// caller may perform action on it
+func authorizeProject(c *gin.Context, projectService *services.ProjectService, action services.Action) (*models.Project, models.ProjectRole, bool) {
+	projectID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+		return nil, "", false
+	}
+	return authorizeProjectID(c, projectService, projectID, action)
+}
+
+// authorizeProjectID checks that the caller may perform action on a project. Projects the
+// caller cannot see are reported as 404, insufficient roles as 403.
+func authorizeProjectID(c *gin.Context, projectService *services.ProjectService, projectID uuid.UUID, action services.Action) (*models.Project, models.ProjectRole, bool) {
+	subject, ok := currentSubject(c)
+	if !ok {
+		return nil, "", false
+	}
+
+	project, role, err := projectService.AuthorizeProject(projectID, subject, action)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrProjectNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		case errors.Is(err, services.ErrProjectForbidden):
+			c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions on this project"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load project"})
+		}
+		return nil, "", false
+	}
+	return project, role, true
+}
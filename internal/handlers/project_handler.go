@@ -2,18 +2,20 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"mime/multipart"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"borderless_coding_server/config"
 	"borderless_coding_server/internal/models"
 	"borderless_coding_server/internal/services"
 	"borderless_coding_server/pkg/database"
-	"borderless_coding_server/pkg/storage"
 	"borderless_coding_server/pkg/utils"
 
 	"github.com/gin-gonic/gin"
@@ -22,14 +24,24 @@ import (
 )
 
 type ProjectHandler struct {
-	projectService *services.ProjectService
-	logger         *logrus.Logger
+	projectService   *services.ProjectService
+	workspaceService *services.WorkspaceService
+	quotaService     *services.QuotaService
+	templateService  *services.TemplateService
+	previewService   *services.PreviewService
+	authorizer       *services.Authorizer
+	logger           *logrus.Logger
 }
 
-func NewProjectHandler(projectService *services.ProjectService, logger *logrus.Logger) *ProjectHandler {
+func NewProjectHandler(projectService *services.ProjectService, workspaceService *services.WorkspaceService, quotaService *services.QuotaService, templateService *services.TemplateService, previewService *services.PreviewService, authorizer *services.Authorizer, logger *logrus.Logger) *ProjectHandler {
 	return &ProjectHandler{
-		projectService: projectService,
-		logger:         logger,
+		projectService:   projectService,
+		workspaceService: workspaceService,
+		quotaService:     quotaService,
+		templateService:  templateService,
+		previewService:   previewService,
+		authorizer:       authorizer,
+		logger:           logger,
 	}
 }
 
@@ -42,6 +54,7 @@ type CreateProjectRequest struct {
 	RootPrefix        string                   `json:"root_prefix"`
 	StorageQuotaBytes int64                    `json:"storage_quota_bytes"`
 	Meta              models.JSONB             `json:"meta"`
+	Template          string                   `json:"template"` // template ID or slug; the default template if empty
 }
 
 // UpdateProjectRequest represents the request payload for updating a project
@@ -55,10 +68,9 @@ type UpdateProjectRequest struct {
 
 // CreateProject creates a new project
 func (h *ProjectHandler) CreateProject(c *gin.Context) {
-	ownerIDStr := c.Param("id")
-	ownerID, err := uuid.Parse(ownerIDStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid owner ID"})
+	// Projects are created in the caller's own account unless the caller is an admin
+	ownerID, ok := authorizeUserParam(c, h.authorizer, services.ActionWrite)
+	if !ok {
 		return
 	}
 
@@ -67,6 +79,9 @@ func (h *ProjectHandler) CreateProject(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if req.StorageQuotaBytes != 0 && !h.authorizeQuota(c) {
+		return
+	}
 
 	project := &models.Project{
 		OwnerID:           ownerID,
@@ -83,6 +98,13 @@ func (h *ProjectHandler) CreateProject(c *gin.Context) {
 		project.Visibility = models.ProjectVisibilityPrivate
 	}
 
+	templateID, err := h.resolveTemplateID(req.Template)
+	if err != nil {
+		h.respondTemplateError(c, err)
+		return
+	}
+	project.TemplateID = templateID
+
 	if err := h.projectService.CreateProject(project); err != nil {
 		h.logger.WithError(err).Error("Failed to create project")
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -95,18 +117,268 @@ func (h *ProjectHandler) CreateProject(c *gin.Context) {
 	})
 }
 
-// GetProject retrieves a project by ID
-func (h *ProjectHandler) GetProject(c *gin.Context) {
-	projectIDStr := c.Param("id")
-	projectID, err := uuid.Parse(projectIDStr)
+// ImportProjectRequest represents the request payload for importing a project, either as
+// multipart form fields next to a "file" zip upload or as JSON with a git URL
+type ImportProjectRequest struct {
+	Name              string                   `json:"name" form:"name" binding:"required"`
+	Description       *string                  `json:"description" form:"description"`
+	Visibility        models.ProjectVisibility `json:"visibility" form:"visibility"`
+	StorageQuotaBytes int64                    `json:"storage_quota_bytes" form:"storage_quota_bytes"`
+	GitURL            string                   `json:"git_url" form:"git_url"`
+	GitBranch         string                   `json:"git_branch" form:"git_branch"`
+	Template          string                   `json:"template" form:"template"` // template whose build settings apply
+}
+
+// gitImportTimeout bounds how long cloning a repository for import may take
+const gitImportTimeout = 5 * time.Minute
+
+// errInvalidImport marks import failures caused by the uploaded archive or repository
+var errInvalidImport = errors.New("invalid import source")
+
+// ImportProject creates a project from an uploaded zip archive or a git repository
+// POST /api/v1/users/:id/projects/import
+func (h *ProjectHandler) ImportProject(c *gin.Context) {
+	// Projects are created in the caller's own account unless the caller is an admin
+	ownerID, ok := authorizeUserParam(c, h.authorizer, services.ActionWrite)
+	if !ok {
+		return
+	}
+
+	cfg := config.LoadConfig()
+
+	var req ImportProjectRequest
+	var upload *multipart.FileHeader
+	if strings.HasPrefix(c.ContentType(), "multipart/form-data") {
+		if err := c.ShouldBind(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		upload, _ = c.FormFile("file")
+	} else if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.StorageQuotaBytes != 0 && !h.authorizeQuota(c) {
+		return
+	}
+	if (upload == nil) == (req.GitURL == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Provide either a zip file or a git_url"})
+		return
+	}
+	if upload != nil && cfg.MaxImportBytes > 0 && upload.Size > cfg.MaxImportBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": utils.ErrArchiveTooLarge.Error(), "max_bytes": cfg.MaxImportBytes})
+		return
+	}
+	if req.GitURL != "" {
+		if err := utils.ValidateGitURL(req.GitURL); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	// Keep the upload on disk before the project exists so a broken request creates nothing
+	var populate func(dir string) error
+	if upload != nil {
+		tmpZip := filepath.Join(os.TempDir(), "import-"+uuid.New().String()+".zip")
+		defer os.Remove(tmpZip)
+		if err := c.SaveUploadedFile(upload, tmpZip); err != nil {
+			h.logger.WithError(err).Error("Failed to save uploaded archive")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save uploaded archive"})
+			return
+		}
+		populate = func(dir string) error {
+			if err := utils.UnZipFileLimited(tmpZip, dir, cfg.MaxImportBytes); err != nil {
+				if errors.Is(err, utils.ErrArchiveTooLarge) {
+					return err
+				}
+				return fmt.Errorf("%w: %v", errInvalidImport, err)
+			}
+			return nil
+		}
+	} else {
+		populate = func(dir string) error {
+			ctx, cancel := context.WithTimeout(c.Request.Context(), gitImportTimeout)
+			defer cancel()
+			if err := utils.GitClone(ctx, req.GitURL, req.GitBranch, dir); err != nil {
+				return fmt.Errorf("%w: %v", errInvalidImport, err)
+			}
+			if err := os.RemoveAll(filepath.Join(dir, ".git")); err != nil {
+				return err
+			}
+			size, err := utils.DirSize(dir)
+			if err != nil {
+				return err
+			}
+			if cfg.MaxImportBytes > 0 && size > cfg.MaxImportBytes {
+				return utils.ErrArchiveTooLarge
+			}
+			return nil
+		}
+	}
+
+	project := &models.Project{
+		ID:                uuid.New(),
+		OwnerID:           ownerID,
+		Name:              req.Name,
+		Description:       req.Description,
+		Visibility:        req.Visibility,
+		StorageQuotaBytes: req.StorageQuotaBytes,
+	}
+	if project.Visibility == "" {
+		project.Visibility = models.ProjectVisibilityPrivate
+	}
+	templateID, err := h.resolveTemplateID(req.Template)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+		h.respondTemplateError(c, err)
+		return
+	}
+	project.TemplateID = templateID
+	if err := h.projectService.CreateProject(project); err != nil {
+		h.logger.WithError(err).Error("Failed to create project")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	project, err := h.projectService.GetProjectByID(projectID)
+	commit, err := h.importWorkspace(c.Request.Context(), project, req, populate)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		if purgeErr := h.projectService.PurgeProject(project.ID); purgeErr != nil {
+			h.logger.WithError(purgeErr).Warn("Failed to remove project after failed import")
+		}
+		switch {
+		case errors.Is(err, utils.ErrArchiveTooLarge):
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error(), "max_bytes": cfg.MaxImportBytes})
+		case errors.Is(err, errInvalidImport):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case respondQuotaExceeded(c, err):
+		default:
+			h.logger.WithError(err).Error("Failed to import project")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to import project"})
+		}
+		return
+	}
+
+	imported, err := h.projectService.GetProjectByID(project.ID)
+	if err != nil {
+		imported = project
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Project imported successfully",
+		"project": imported,
+		"commit":  commit,
+	})
+}
+
+// importWorkspace records where an imported project came from and stores its initial snapshot
+func (h *ProjectHandler) importWorkspace(ctx context.Context, project *models.Project, req ImportProjectRequest, populate func(dir string) error) (string, error) {
+	if req.GitURL != "" {
+		loc := &models.StorageLocation{
+			ProjectID: project.ID,
+			Type:      models.StorageTypeGitRemote,
+			GitURL:    &req.GitURL,
+		}
+		if req.GitBranch != "" {
+			loc.GitBranch = &req.GitBranch
+		}
+		if err := database.DB.Create(loc).Error; err != nil {
+			return "", err
+		}
+	}
+	return h.workspaceService.Initialize(ctx, project, "Initial import", populate)
+}
+
+// resolveTemplateID returns the ID of the named template, or of the default template if ref is empty
+func (h *ProjectHandler) resolveTemplateID(ref string) (*uuid.UUID, error) {
+	var template *models.ProjectTemplate
+	var err error
+	if ref != "" {
+		template, err = h.templateService.GetTemplate(ref)
+	} else {
+		template, err = h.templateService.GetDefaultTemplate()
+	}
+	if err != nil || template == nil {
+		return nil, err
+	}
+	return &template.ID, nil
+}
+
+func (h *ProjectHandler) respondTemplateError(c *gin.Context, err error) {
+	if errors.Is(err, services.ErrTemplateNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	h.logger.WithError(err).Error("Failed to resolve project template")
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resolve project template"})
+}
+
+// ForkProjectRequest represents the request payload for forking a project
+type ForkProjectRequest struct {
+	Name       string                   `json:"name"`
+	Visibility models.ProjectVisibility `json:"visibility"`
+}
+
+// ForkProject copies a project's files, storage location and metadata into a new project owned
+// by the caller. Private projects can only be forked by their owner.
+// POST /api/v1/projects/:id/fork
+func (h *ProjectHandler) ForkProject(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var req ForkProjectRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	source, _, ok := authorizeProject(c, h.projectService, services.ActionRead)
+	if !ok {
+		return
+	}
+	// Members can read a private project but not take a copy of it
+	if source.Visibility == models.ProjectVisibilityPrivate && source.OwnerID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner can fork a private project"})
+		return
+	}
+
+	fork, err := h.projectService.ForkProject(source, userID, req.Name, req.Visibility)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to fork project")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.workspaceService.CopySnapshot(c.Request.Context(), source, fork); err != nil {
+		if purgeErr := h.projectService.PurgeProject(fork.ID); purgeErr != nil {
+			h.logger.WithError(purgeErr).Warn("Failed to remove project after failed fork")
+		}
+		if respondQuotaExceeded(c, err) {
+			return
+		}
+		h.logger.WithError(err).Error("Failed to copy project files")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to copy project files"})
+		return
+	}
+
+	forked, err := h.projectService.GetProjectByID(fork.ID)
+	if err != nil {
+		forked = fork
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Project forked successfully",
+		"project": forked,
+	})
+}
+
+// GetProject retrieves a project by ID
+func (h *ProjectHandler) GetProject(c *gin.Context) {
+	project, role, ok := authorizeProject(c, h.projectService, services.ActionRead)
+	if !ok {
 		return
 	}
 
@@ -137,6 +409,7 @@ func (h *ProjectHandler) GetProject(c *gin.Context) {
 
 	c.JSON(http.StatusOK, gin.H{
 		"project":          project,
+		"role":             role,
 		"chat_session_id":  chatSessionID,
 		"storage_location": storage,
 		"build_result":     build,
@@ -163,18 +436,20 @@ func (h *ProjectHandler) GetProjectBySlug(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 		return
 	}
+	if _, _, ok := authorizeProjectID(c, h.projectService, project.ID, services.ActionRead); !ok {
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{"project": project})
 }
 
 // UpdateProject updates an existing project
 func (h *ProjectHandler) UpdateProject(c *gin.Context) {
-	projectIDStr := c.Param("id")
-	projectID, err := uuid.Parse(projectIDStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+	current, _, ok := authorizeProject(c, h.projectService, services.ActionManage)
+	if !ok {
 		return
 	}
+	projectID := current.ID
 
 	var req UpdateProjectRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -193,6 +468,9 @@ func (h *ProjectHandler) UpdateProject(c *gin.Context) {
 		updates["visibility"] = *req.Visibility
 	}
 	if req.StorageQuotaBytes != nil {
+		if !h.authorizeQuota(c) {
+			return
+		}
 		updates["storage_quota_bytes"] = *req.StorageQuotaBytes
 	}
 	if req.Meta != nil {
@@ -220,12 +498,11 @@ func (h *ProjectHandler) UpdateProject(c *gin.Context) {
 
 // DeleteProject deletes a project
 func (h *ProjectHandler) DeleteProject(c *gin.Context) {
-	projectIDStr := c.Param("id")
-	projectID, err := uuid.Parse(projectIDStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+	project, _, ok := authorizeProject(c, h.projectService, services.ActionDelete)
+	if !ok {
 		return
 	}
+	projectID := project.ID
 
 	if err := h.projectService.DeleteProject(projectID); err != nil {
 		h.logger.WithError(err).Error("Failed to delete project")
@@ -342,12 +619,11 @@ func (h *ProjectHandler) GetUserProjects(c *gin.Context) {
 
 // UpdateProjectVisibility updates project visibility
 func (h *ProjectHandler) UpdateProjectVisibility(c *gin.Context) {
-	projectIDStr := c.Param("id")
-	projectID, err := uuid.Parse(projectIDStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+	project, _, ok := authorizeProject(c, h.projectService, services.ActionManage)
+	if !ok {
 		return
 	}
+	projectID := project.ID
 
 	var req struct {
 		Visibility models.ProjectVisibility `json:"visibility" binding:"required"`
@@ -369,12 +645,14 @@ func (h *ProjectHandler) UpdateProjectVisibility(c *gin.Context) {
 
 // UpdateProjectStorageQuota updates project storage quota
 func (h *ProjectHandler) UpdateProjectStorageQuota(c *gin.Context) {
-	projectIDStr := c.Param("id")
-	projectID, err := uuid.Parse(projectIDStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+	project, _, ok := authorizeProject(c, h.projectService, services.ActionRead)
+	if !ok {
 		return
 	}
+	if !h.authorizeQuota(c) {
+		return
+	}
+	projectID := project.ID
 
 	var req struct {
 		StorageQuotaBytes int64 `json:"storage_quota_bytes" binding:"required"`
@@ -394,7 +672,38 @@ func (h *ProjectHandler) UpdateProjectStorageQuota(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "Project storage quota updated successfully"})
 }
 
-// SearchProjects searches projects by name or description
+// authorizeQuota checks that the caller holds the quotas.manage permission
+func (h *ProjectHandler) authorizeQuota(c *gin.Context) bool {
+	_, ok := authorize(c, h.authorizer, services.ActionManage, services.SystemResource(models.PermissionQuotasManage))
+	return ok
+}
+
+// GetProjectStorageUsage returns the storage accounted to a project against its quota
+// GET /api/v1/projects/:id/storage-usage?refresh=true
+func (h *ProjectHandler) GetProjectStorageUsage(c *gin.Context) {
+	project, _, ok := authorizeProject(c, h.projectService, services.ActionRead)
+	if !ok {
+		return
+	}
+	projectID := project.ID
+
+	var usage *services.StorageUsage
+	var err error
+	if c.Query("refresh") == "true" {
+		usage, err = h.quotaService.Measure(c.Request.Context(), project)
+	} else {
+		usage, err = h.quotaService.Usage(projectID)
+	}
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to get project storage usage")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get project storage usage"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"storage_usage": usage})
+}
+
+// SearchProjects searches the projects visible to the caller by name or description
 func (h *ProjectHandler) SearchProjects(c *gin.Context) {
 	query := c.Query("q")
 	if query == "" {
@@ -421,7 +730,12 @@ func (h *ProjectHandler) SearchProjects(c *gin.Context) {
 		visibility = &vis
 	}
 
-	projects, err := h.projectService.SearchProjects(query, ownerID, visibility, limit)
+	subject, ok := currentSubject(c)
+	if !ok {
+		return
+	}
+
+	projects, err := h.projectService.SearchProjects(subject, query, ownerID, visibility, limit)
 	if err != nil {
 		h.logger.WithError(err).Error("Failed to search projects")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search projects"})
@@ -433,12 +747,11 @@ func (h *ProjectHandler) SearchProjects(c *gin.Context) {
 
 // GetProjectChatSessions retrieves all chat sessions for a project
 func (h *ProjectHandler) GetProjectChatSessions(c *gin.Context) {
-	projectIDStr := c.Param("id")
-	projectID, err := uuid.Parse(projectIDStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+	project, _, ok := authorizeProject(c, h.projectService, services.ActionRead)
+	if !ok {
 		return
 	}
+	projectID := project.ID
 
 	sessions, err := h.projectService.GetProjectChatSessions(projectID)
 	if err != nil {
@@ -450,165 +763,88 @@ func (h *ProjectHandler) GetProjectChatSessions(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"chat_sessions": sessions})
 }
 
-// BuildPreview builds the project and deploys it to static preview folder
+// BuildPreview starts a background build of the project preview. Follow it with
+// GET /api/v1/builds/:id/stream; preview_url is updated only when the build succeeds.
+// The preview is served by PreviewHandler.ServePreview.
 // POST /api/v1/projects/:id/preview
 func (h *ProjectHandler) BuildPreview(c *gin.Context) {
-	// 1. Authenticate user and parse project ID
-	userIDInterface, exists := c.Get("user_id")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
-		return
-	}
-	userID, ok := userIDInterface.(uuid.UUID)
+	// Building a preview requires the editor role
+	project, _, ok := authorizeProject(c, h.projectService, services.ActionWrite)
 	if !ok {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
 		return
 	}
-
-	projectIDStr := c.Param("id")
-	projectID, err := uuid.Parse(projectIDStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+	subject, ok := currentSubject(c)
+	if !ok {
 		return
 	}
 
-	// 2. Get project and check ownership
-	project, err := h.projectService.GetProjectByID(projectID)
+	build, err := h.previewService.StartPreviewBuild(subject.UserID, project)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
-		return
-	}
-	if project.OwnerID != userID {
-		c.JSON(http.StatusForbidden, gin.H{"error": "You do not own this project"})
-		return
-	}
-
-	// 3. Check if StorageLocation.NetworkPath exists
-	if project.StorageLocation == nil || project.StorageLocation.NetworkPath == nil || *project.StorageLocation.NetworkPath == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "No network path available for this project (project not saved to MinIO yet)"})
-		return
-	}
-	networkPath := *project.StorageLocation.NetworkPath
-
-	// 4. Get working directory from StorageLocation.LocalPath
-	var workDir string
-	if project.StorageLocation.LocalPath != nil && *project.StorageLocation.LocalPath != "" {
-		workDir = *project.StorageLocation.LocalPath
-	} else {
-		// Fallback: use config-based path
-		cfg := config.LoadConfig()
-		workDir = filepath.Join(cfg.LocalStoragePath, userID.String(), projectID.String())
-	}
-
-	// Create working directory if it doesn't exist
-	if err := os.MkdirAll(workDir, 0755); err != nil {
-		h.logger.WithError(err).Error("Failed to create working directory")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create working directory"})
-		return
-	}
-
-	// 5. Parse MinIO path (bucket/object)
-	bucket, objectName := parseMinIOPathLocal(networkPath)
-	if bucket == "" || objectName == "" {
-		h.logger.Error("Failed to parse network path: empty bucket or object")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid network path format"})
-		return
-	}
-
-	// 6. Download zip from MinIO to project's local path
-	zipPath := filepath.Join(workDir, "project.zip")
-	h.logger.Infof("Downloading from MinIO: bucket=%s, object=%s to %s", bucket, objectName, zipPath)
-	if err := storage.DownloadFile(context.Background(), bucket, objectName, zipPath); err != nil {
-		h.logger.WithError(err).Error("Failed to download zip from MinIO")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to download project from MinIO"})
-		return
-	}
-	defer os.Remove(zipPath) // Clean up zip after unzipping
-
-	// 7. Unzip the file in the working directory
-	h.logger.Infof("Unzipping %s to %s", zipPath, workDir)
-	if err := utils.UnZipFile(zipPath, workDir); err != nil {
-		h.logger.WithError(err).Error("Failed to unzip project")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unzip project"})
+		if errors.Is(err, services.ErrPreviewBuildInProgress) {
+			buildID, _ := h.previewService.RunningPreviewBuild(project.ID)
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "build_id": buildID})
+			return
+		}
+		h.logger.WithError(err).Error("Failed to start preview build")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start preview build"})
 		return
 	}
 
-	// 8. Enter the project-template directory
-	projectTemplateDir := filepath.Join(workDir, "project-template")
-	if _, err := os.Stat(projectTemplateDir); os.IsNotExist(err) {
-		h.logger.WithError(err).Error("project-template directory not found after unzip")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "project-template directory not found after unzip"})
-		return
-	}
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":    "Preview build started",
+		"build":      build,
+		"stream_url": fmt.Sprintf("/api/v1/builds/%s/stream", build.ID),
+	})
+}
 
-	// 9. Run npm install && npm run build in project-template directory
-	h.logger.Infof("Running npm install in %s", projectTemplateDir)
-	installCmd := exec.Command("npm", "install")
-	installCmd.Dir = projectTemplateDir
-	installCmd.Stdout = os.Stdout
-	installCmd.Stderr = os.Stderr
-	if err := installCmd.Run(); err != nil {
-		h.logger.WithError(err).Error("npm install failed")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "npm install failed"})
+// ListPreviewDeployments lists the preview deployments of a project, newest first
+// GET /api/v1/projects/:id/preview/deployments
+func (h *ProjectHandler) ListPreviewDeployments(c *gin.Context) {
+	project, _, ok := authorizeProject(c, h.projectService, services.ActionRead)
+	if !ok {
 		return
 	}
 
-	h.logger.Infof("Running npm run build in %s", projectTemplateDir)
-	buildCmd := exec.Command("npm", "run", "build")
-	buildCmd.Dir = projectTemplateDir
-	buildCmd.Stdout = os.Stdout
-	buildCmd.Stderr = os.Stderr
-	if err := buildCmd.Run(); err != nil {
-		h.logger.WithError(err).Error("npm run build failed")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "npm run build failed"})
+	deployments, err := h.previewService.ListDeployments(project.ID)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to list preview deployments")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve preview deployments"})
 		return
 	}
 
-	// 10. Copy dist folder to StaticFolderPath/<project-id>/
-	cfg := config.LoadConfig()
-	staticDest := filepath.Join(cfg.StaticFolderPath, projectID.String())
-	distSrc := filepath.Join(projectTemplateDir, "dist")
+	c.JSON(http.StatusOK, gin.H{"deployments": deployments})
+}
 
-	if _, err := os.Stat(distSrc); os.IsNotExist(err) {
-		h.logger.WithError(err).Error("dist folder not found after build")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Build succeeded but dist folder not found"})
+// RollbackPreviewDeployment makes a previous preview deployment live again
+// POST /api/v1/projects/:id/preview/deployments/:deployment_id/rollback
+func (h *ProjectHandler) RollbackPreviewDeployment(c *gin.Context) {
+	// Changing the live preview requires the same role as building one
+	project, _, ok := authorizeProject(c, h.projectService, services.ActionWrite)
+	if !ok {
 		return
 	}
-
-	// Remove old static files if they exist
-	if err := os.RemoveAll(staticDest); err != nil && !os.IsNotExist(err) {
-		h.logger.WithError(err).Warn("Failed to remove old static files")
-	}
-
-	h.logger.Infof("Copying dist from %s to %s", distSrc, staticDest)
-	if err := utils.CopyDir(distSrc, staticDest); err != nil {
-		h.logger.WithError(err).Error("Failed to copy dist folder")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to copy built files"})
+	deploymentID, err := uuid.Parse(c.Param("deployment_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid deployment ID"})
 		return
 	}
 
-	// 11. Update project.preview_url in database
-	previewURL := fmt.Sprintf("/static/%s/index.html", projectID.String())
-	if err := database.DB.Model(&models.Project{}).Where("id = ?", projectID).Update("preview_url", previewURL).Error; err != nil {
-		h.logger.WithError(err).Error("Failed to update preview_url")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update preview URL"})
+	deployment, err := h.previewService.Rollback(project.ID, deploymentID)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrDeploymentNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrDeploymentPruned):
+			c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+		default:
+			h.logger.WithError(err).Error("Failed to roll back preview deployment")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to roll back preview deployment"})
+		}
 		return
 	}
 
-	h.logger.Infof("Preview built successfully for project %s", projectID)
 	c.JSON(http.StatusOK, gin.H{
-		"message":     "Preview built successfully",
-		"preview_url": previewURL,
+		"message":    "Preview rolled back successfully",
+		"deployment": deployment,
 	})
 }
-
-// parseMinIOPathLocal parses a path like "bucket/path/to/object.zip" into bucket and object
-// Returns empty strings if invalid
-func parseMinIOPathLocal(p string) (string, string) {
-	for i := 0; i < len(p); i++ {
-		if p[i] == '/' {
-			return p[:i], p[i+1:]
-		}
-	}
-	return "", ""
-}
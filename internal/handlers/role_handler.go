@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"borderless_coding_server/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+type RoleHandler struct {
+	roleService *services.RoleService
+	logger      *logrus.Logger
+}
+
+func NewRoleHandler(roleService *services.RoleService, logger *logrus.Logger) *RoleHandler {
+	return &RoleHandler{
+		roleService: roleService,
+		logger:      logger,
+	}
+}
+
+// CreateRoleRequest represents the request payload for creating a role
+type CreateRoleRequest struct {
+	Name        string   `json:"name" binding:"required"`
+	Description *string  `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+// GrantRoleRequest represents the request payload for granting a role to a user
+type GrantRoleRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+// ListPermissions lists every permission that can be put in a role
+// GET /api/v1/admin/permissions
+func (h *RoleHandler) ListPermissions(c *gin.Context) {
+	permissions, err := h.roleService.ListPermissions()
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to list permissions")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve permissions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"permissions": permissions})
+}
+
+// ListRoles lists all roles with their permissions
+// GET /api/v1/admin/roles
+func (h *RoleHandler) ListRoles(c *gin.Context) {
+	roles, err := h.roleService.ListRoles()
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to list roles")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve roles"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"roles": roles})
+}
+
+// CreateRole creates a custom role
+// POST /api/v1/admin/roles
+func (h *RoleHandler) CreateRole(c *gin.Context) {
+	var req CreateRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	role, err := h.roleService.CreateRole(req.Name, req.Description, req.Permissions)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to create role")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Role created successfully",
+		"role":    role,
+	})
+}
+
+// DeleteRole deletes a custom role and revokes it from every user
+// DELETE /api/v1/admin/roles/:id
+func (h *RoleHandler) DeleteRole(c *gin.Context) {
+	roleID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role ID"})
+		return
+	}
+
+	if err := h.roleService.DeleteRole(c.Request.Context(), roleID); err != nil {
+		h.respondRoleError(c, err, "Failed to delete role")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Role deleted successfully"})
+}
+
+// GetUserRoles lists the roles and permissions of a user
+// GET /api/v1/admin/users/:id/roles
+func (h *RoleHandler) GetUserRoles(c *gin.Context) {
+	userID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	access, err := h.roleService.GetUserAccess(c.Request.Context(), userID)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to load user roles")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user roles"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user_id":     userID,
+		"roles":       access.Roles,
+		"permissions": access.Permissions,
+	})
+}
+
+// GrantUserRole grants a role to a user
+// POST /api/v1/admin/users/:id/roles
+func (h *RoleHandler) GrantUserRole(c *gin.Context) {
+	audit, userID, ok := h.roleChange(c)
+	if !ok {
+		return
+	}
+
+	var req GrantRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.roleService.GrantRole(c.Request.Context(), audit, userID, req.Role); err != nil {
+		h.respondRoleError(c, err, "Failed to grant role")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Role granted successfully"})
+}
+
+// RevokeUserRole revokes a role from a user
+// DELETE /api/v1/admin/users/:id/roles/:role
+func (h *RoleHandler) RevokeUserRole(c *gin.Context) {
+	audit, userID, ok := h.roleChange(c)
+	if !ok {
+		return
+	}
+
+	if err := h.roleService.RevokeRole(c.Request.Context(), audit, userID, c.Param("role")); err != nil {
+		h.respondRoleError(c, err, "Failed to revoke role")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Role revoked successfully"})
+}
+
+// roleChange parses the target user and collects the audit details of a role change
+func (h *RoleHandler) roleChange(c *gin.Context) (services.RoleAuditContext, uuid.UUID, bool) {
+	actorID, ok := currentUserID(c)
+	if !ok {
+		return services.RoleAuditContext{}, uuid.Nil, false
+	}
+	userID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return services.RoleAuditContext{}, uuid.Nil, false
+	}
+
+	return services.RoleAuditContext{
+		ActorID:   actorID,
+		IPAddress: c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+	}, userID, true
+}
+
+// respondRoleError maps role service errors to HTTP responses
+func (h *RoleHandler) respondRoleError(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, services.ErrRoleNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrSystemRole), errors.Is(err, services.ErrLastAdmin):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		h.logger.WithError(err).Error(message)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
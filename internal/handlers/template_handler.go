@@ -0,0 +1,257 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"borderless_coding_server/internal/models"
+	"borderless_coding_server/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+type TemplateHandler struct {
+	templateService *services.TemplateService
+	logger          *logrus.Logger
+}
+
+func NewTemplateHandler(templateService *services.TemplateService, logger *logrus.Logger) *TemplateHandler {
+	return &TemplateHandler{
+		templateService: templateService,
+		logger:          logger,
+	}
+}
+
+// CreateTemplateRequest represents the form fields sent next to the "archive" zip when creating a template
+type CreateTemplateRequest struct {
+	Slug              string  `form:"slug" binding:"required"`
+	Name              string  `form:"name" binding:"required"`
+	Description       *string `form:"description"`
+	Framework         string  `form:"framework"`
+	RootDir           string  `form:"root_dir"`
+	InstallCommand    string  `form:"install_command"`
+	BuildCommand      string  `form:"build_command"`
+	DevCommand        string  `form:"dev_command"`
+	OutputDir         string  `form:"output_dir"`
+	PreviewEntrypoint string  `form:"preview_entrypoint"`
+	IsDefault         bool    `form:"is_default"`
+}
+
+// UpdateTemplateRequest represents the request payload for updating template metadata
+type UpdateTemplateRequest struct {
+	Slug              *string      `json:"slug"`
+	Name              *string      `json:"name"`
+	Description       *string      `json:"description"`
+	Framework         *string      `json:"framework"`
+	RootDir           *string      `json:"root_dir"`
+	InstallCommand    *string      `json:"install_command"`
+	BuildCommand      *string      `json:"build_command"`
+	DevCommand        *string      `json:"dev_command"`
+	OutputDir         *string      `json:"output_dir"`
+	PreviewEntrypoint *string      `json:"preview_entrypoint"`
+	IsDefault         *bool        `json:"is_default"`
+	Meta              models.JSONB `json:"meta"`
+}
+
+// ListTemplates lists the available project templates
+// GET /api/v1/templates
+func (h *TemplateHandler) ListTemplates(c *gin.Context) {
+	templates, err := h.templateService.ListTemplates()
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to list templates")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list templates"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"templates": templates})
+}
+
+// GetTemplate retrieves a template by ID or slug
+// GET /api/v1/templates/:id
+func (h *TemplateHandler) GetTemplate(c *gin.Context) {
+	template, err := h.templateService.GetTemplate(c.Param("id"))
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"template": template})
+}
+
+// CreateTemplate registers a template from a multipart form with an "archive" zip (admin only)
+// POST /api/v1/templates
+func (h *TemplateHandler) CreateTemplate(c *gin.Context) {
+	var req CreateTemplateRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	archivePath, ok := h.saveArchive(c)
+	if !ok {
+		return
+	}
+	defer os.Remove(archivePath)
+
+	template := &models.ProjectTemplate{
+		Slug:              req.Slug,
+		Name:              req.Name,
+		Description:       req.Description,
+		Framework:         req.Framework,
+		RootDir:           req.RootDir,
+		InstallCommand:    req.InstallCommand,
+		BuildCommand:      req.BuildCommand,
+		DevCommand:        req.DevCommand,
+		OutputDir:         req.OutputDir,
+		PreviewEntrypoint: req.PreviewEntrypoint,
+		IsDefault:         req.IsDefault,
+	}
+
+	if err := h.templateService.CreateTemplate(c.Request.Context(), template, archivePath); err != nil {
+		h.logger.WithError(err).Error("Failed to create template")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":  "Template created successfully",
+		"template": template,
+	})
+}
+
+// UpdateTemplate updates template metadata (admin only)
+// PUT /api/v1/templates/:id
+func (h *TemplateHandler) UpdateTemplate(c *gin.Context) {
+	templateID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid template ID"})
+		return
+	}
+
+	var req UpdateTemplateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	updates := make(map[string]interface{})
+	if req.Slug != nil {
+		updates["slug"] = *req.Slug
+	}
+	if req.Name != nil {
+		updates["name"] = *req.Name
+	}
+	if req.Description != nil {
+		updates["description"] = *req.Description
+	}
+	if req.Framework != nil {
+		updates["framework"] = *req.Framework
+	}
+	if req.RootDir != nil {
+		updates["root_dir"] = *req.RootDir
+	}
+	if req.InstallCommand != nil {
+		updates["install_command"] = *req.InstallCommand
+	}
+	if req.BuildCommand != nil {
+		updates["build_command"] = *req.BuildCommand
+	}
+	if req.DevCommand != nil {
+		updates["dev_command"] = *req.DevCommand
+	}
+	if req.OutputDir != nil {
+		updates["output_dir"] = *req.OutputDir
+	}
+	if req.PreviewEntrypoint != nil {
+		updates["preview_entrypoint"] = *req.PreviewEntrypoint
+	}
+	if req.IsDefault != nil {
+		updates["is_default"] = *req.IsDefault
+	}
+	if req.Meta != nil {
+		updates["meta"] = req.Meta
+	}
+
+	if len(updates) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No fields to update"})
+		return
+	}
+
+	if err := h.templateService.UpdateTemplate(templateID, updates); err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Template updated successfully"})
+}
+
+// UploadTemplateArchive replaces the archive of a template (admin only)
+// PUT /api/v1/templates/:id/archive
+func (h *TemplateHandler) UploadTemplateArchive(c *gin.Context) {
+	template, err := h.templateService.GetTemplate(c.Param("id"))
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	archivePath, ok := h.saveArchive(c)
+	if !ok {
+		return
+	}
+	defer os.Remove(archivePath)
+
+	if err := h.templateService.ReplaceArchive(c.Request.Context(), template, archivePath); err != nil {
+		h.logger.WithError(err).Error("Failed to upload template archive")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload template archive"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Template archive updated successfully"})
+}
+
+// DeleteTemplate deletes a template (admin only)
+// DELETE /api/v1/templates/:id
+func (h *TemplateHandler) DeleteTemplate(c *gin.Context) {
+	templateID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid template ID"})
+		return
+	}
+
+	if err := h.templateService.DeleteTemplate(templateID); err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Template deleted successfully"})
+}
+
+// saveArchive stores the uploaded "archive" zip in a temporary file
+func (h *TemplateHandler) saveArchive(c *gin.Context) (string, bool) {
+	upload, err := c.FormFile("archive")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "archive zip file is required"})
+		return "", false
+	}
+
+	archivePath := filepath.Join(os.TempDir(), "template-upload-"+uuid.New().String()+".zip")
+	if err := c.SaveUploadedFile(upload, archivePath); err != nil {
+		h.logger.WithError(err).Error("Failed to save uploaded template archive")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save uploaded archive"})
+		return "", false
+	}
+	return archivePath, true
+}
+
+func (h *TemplateHandler) respondError(c *gin.Context, err error) {
+	if errors.Is(err, services.ErrTemplateNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	h.logger.WithError(err).Error("Template operation failed")
+	c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+}
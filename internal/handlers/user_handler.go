@@ -14,12 +14,16 @@ import (
 
 type UserHandler struct {
 	userService *services.UserService
+	authService *services.AuthService
+	authorizer  *services.Authorizer
 	logger      *logrus.Logger
 }
 
-func NewUserHandler(userService *services.UserService, logger *logrus.Logger) *UserHandler {
+func NewUserHandler(userService *services.UserService, authService *services.AuthService, authorizer *services.Authorizer, logger *logrus.Logger) *UserHandler {
 	return &UserHandler{
 		userService: userService,
+		authService: authService,
+		authorizer:  authorizer,
 		logger:      logger,
 	}
 }
@@ -70,10 +74,8 @@ func (h *UserHandler) CreateUser(c *gin.Context) {
 
 // GetUser retrieves a user by ID
 func (h *UserHandler) GetUser(c *gin.Context) {
-	userIDStr := c.Param("id")
-	userID, err := uuid.Parse(userIDStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+	userID, ok := authorizeUserParam(c, h.authorizer, services.ActionRead)
+	if !ok {
 		return
 	}
 
@@ -88,10 +90,8 @@ func (h *UserHandler) GetUser(c *gin.Context) {
 
 // UpdateUser updates an existing user
 func (h *UserHandler) UpdateUser(c *gin.Context) {
-	userIDStr := c.Param("id")
-	userID, err := uuid.Parse(userIDStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+	userID, ok := authorizeUserParam(c, h.authorizer, services.ActionWrite)
+	if !ok {
 		return
 	}
 
@@ -101,6 +101,17 @@ func (h *UserHandler) UpdateUser(c *gin.Context) {
 		return
 	}
 
+	// Account status can only be changed by user managers; roles are granted via /admin
+	if _, setsRoles := req.Metadata["roles"]; setsRoles {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Roles are managed via /api/v1/admin/users/:id/roles"})
+		return
+	}
+	if req.IsActive != nil {
+		if _, ok := authorize(c, h.authorizer, services.ActionManage, services.UserResource(userID)); !ok {
+			return
+		}
+	}
+
 	updates := make(map[string]interface{})
 	if req.Email != nil {
 		updates["email"] = *req.Email
@@ -120,6 +131,9 @@ func (h *UserHandler) UpdateUser(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if req.IsActive != nil && !*req.IsActive {
+		h.revokeUserSessions(c, userID)
+	}
 
 	// Get updated user
 	user, err := h.userService.GetUserByID(userID)
@@ -136,10 +150,8 @@ func (h *UserHandler) UpdateUser(c *gin.Context) {
 
 // DeleteUser deletes a user
 func (h *UserHandler) DeleteUser(c *gin.Context) {
-	userIDStr := c.Param("id")
-	userID, err := uuid.Parse(userIDStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+	userID, ok := authorizeUserParam(c, h.authorizer, services.ActionDelete)
+	if !ok {
 		return
 	}
 
@@ -148,12 +160,17 @@ func (h *UserHandler) DeleteUser(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	h.revokeUserSessions(c, userID)
 
 	c.JSON(http.StatusOK, gin.H{"message": "User deleted successfully"})
 }
 
-// ListUsers retrieves a paginated list of users
+// ListUsers retrieves a paginated list of users (admin only)
 func (h *UserHandler) ListUsers(c *gin.Context) {
+	if _, ok := authorize(c, h.authorizer, services.ActionRead, services.SystemResource(models.PermissionUsersRead)); !ok {
+		return
+	}
+
 	offsetStr := c.DefaultQuery("offset", "0")
 	limitStr := c.DefaultQuery("limit", "10")
 
@@ -186,10 +203,8 @@ func (h *UserHandler) ListUsers(c *gin.Context) {
 
 // GetUserProjects retrieves all projects for a user
 func (h *UserHandler) GetUserProjects(c *gin.Context) {
-	userIDStr := c.Param("id")
-	userID, err := uuid.Parse(userIDStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+	userID, ok := authorizeUserParam(c, h.authorizer, services.ActionRead)
+	if !ok {
 		return
 	}
 
@@ -205,10 +220,8 @@ func (h *UserHandler) GetUserProjects(c *gin.Context) {
 
 // GetUserChatSessions retrieves all chat sessions for a user
 func (h *UserHandler) GetUserChatSessions(c *gin.Context) {
-	userIDStr := c.Param("id")
-	userID, err := uuid.Parse(userIDStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+	userID, ok := authorizeUserParam(c, h.authorizer, services.ActionRead)
+	if !ok {
 		return
 	}
 
@@ -222,8 +235,12 @@ func (h *UserHandler) GetUserChatSessions(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"chat_sessions": sessions})
 }
 
-// SearchUsers searches users by email or display name
+// SearchUsers searches users by email or display name (admin only)
 func (h *UserHandler) SearchUsers(c *gin.Context) {
+	if _, ok := authorize(c, h.authorizer, services.ActionRead, services.SystemResource(models.PermissionUsersRead)); !ok {
+		return
+	}
+
 	query := c.Query("q")
 	if query == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Search query is required"})
@@ -248,10 +265,8 @@ func (h *UserHandler) SearchUsers(c *gin.Context) {
 
 // ActivateUser activates a user account
 func (h *UserHandler) ActivateUser(c *gin.Context) {
-	userIDStr := c.Param("id")
-	userID, err := uuid.Parse(userIDStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+	userID, ok := authorizeUserParam(c, h.authorizer, services.ActionManage)
+	if !ok {
 		return
 	}
 
@@ -266,10 +281,8 @@ func (h *UserHandler) ActivateUser(c *gin.Context) {
 
 // DeactivateUser deactivates a user account
 func (h *UserHandler) DeactivateUser(c *gin.Context) {
-	userIDStr := c.Param("id")
-	userID, err := uuid.Parse(userIDStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+	userID, ok := authorizeUserParam(c, h.authorizer, services.ActionManage)
+	if !ok {
 		return
 	}
 
@@ -278,6 +291,15 @@ func (h *UserHandler) DeactivateUser(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	h.revokeUserSessions(c, userID)
 
 	c.JSON(http.StatusOK, gin.H{"message": "User deactivated successfully"})
 }
+
+// revokeUserSessions logs a deactivated or deleted user out everywhere, so their access
+// tokens stop working at once rather than when they expire
+func (h *UserHandler) revokeUserSessions(c *gin.Context, userID uuid.UUID) {
+	if err := h.authService.RevokeAllUserSessions(c.Request.Context(), userID); err != nil {
+		h.logger.WithError(err).WithField("user_id", userID).Error("Failed to revoke user sessions")
+	}
+}
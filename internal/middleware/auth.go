@@ -13,8 +13,11 @@ import (
 	"github.com/google/uuid"
 )
 
-// AuthMiddleware creates authentication middleware
-func AuthMiddleware(jwtService *services.JWTService) gin.HandlerFunc {
+// AuthMiddleware creates authentication middleware. Roles and permissions come from the
+// access token; tokens issued before roles were embedded fall back to a cached lookup.
+// Tokens of revoked sessions, and tokens issued before the user's tokens were invalidated,
+// are rejected.
+func AuthMiddleware(jwtService *services.JWTService, roleService *services.RoleService, revocationService *services.TokenRevocationService) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
@@ -37,17 +40,35 @@ func AuthMiddleware(jwtService *services.JWTService) gin.HandlerFunc {
 			return
 		}
 
+		revoked, err := isTokenRevoked(c, revocationService, claims)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check token revocation"})
+			c.Abort()
+			return
+		}
+		if revoked {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Token has been revoked"})
+			c.Abort()
+			return
+		}
+
 		// Set user information in context
 		c.Set("user_id", claims.UserID)
 		c.Set("session_id", claims.SessionID)
 		c.Set("claims", claims)
+		if err := setUserAccess(c, roleService, claims); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user roles"})
+			c.Abort()
+			return
+		}
 
 		c.Next()
 	}
 }
 
-// OptionalAuthMiddleware creates optional authentication middleware
-func OptionalAuthMiddleware(jwtService *services.JWTService) gin.HandlerFunc {
+// OptionalAuthMiddleware creates optional authentication middleware. Requests with revoked
+// tokens are treated as anonymous.
+func OptionalAuthMiddleware(jwtService *services.JWTService, roleService *services.RoleService, revocationService *services.TokenRevocationService) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
@@ -66,65 +87,97 @@ func OptionalAuthMiddleware(jwtService *services.JWTService) gin.HandlerFunc {
 			c.Next()
 			return
 		}
+		if revoked, err := isTokenRevoked(c, revocationService, claims); err != nil || revoked {
+			c.Next()
+			return
+		}
 
 		// Set user information in context if token is valid
 		c.Set("user_id", claims.UserID)
 		c.Set("session_id", claims.SessionID)
 		c.Set("claims", claims)
+		_ = setUserAccess(c, roleService, claims)
 
 		c.Next()
 	}
 }
 
+// isTokenRevoked checks the token against the revoked sessions and the user's
+// "tokens invalid before" time
+func isTokenRevoked(c *gin.Context, revocationService *services.TokenRevocationService, claims *services.Claims) (bool, error) {
+	if revocationService == nil {
+		return false, nil
+	}
+	return revocationService.IsRevoked(c.Request.Context(), claims)
+}
+
+// setUserAccess exposes the roles and permissions of the token's user to later handlers
+func setUserAccess(c *gin.Context, roleService *services.RoleService, claims *services.Claims) error {
+	roles, permissions := claims.Roles, claims.Permissions
+	if roles == nil && roleService != nil {
+		access, err := roleService.GetUserAccess(c.Request.Context(), claims.UserID)
+		if err != nil {
+			return err
+		}
+		roles, permissions = access.Roles, access.Permissions
+	}
+	c.Set("user_roles", roles)
+	c.Set("user_permissions", permissions)
+	return nil
+}
+
+// contextSubject returns the authenticated user with the roles set by AuthMiddleware,
+// writing an error and aborting if there is none
+func contextSubject(c *gin.Context) (services.Subject, bool) {
+	userIDInterface, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		c.Abort()
+		return services.Subject{}, false
+	}
+
+	userID, ok := userIDInterface.(uuid.UUID)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+		c.Abort()
+		return services.Subject{}, false
+	}
+
+	return services.Subject{
+		UserID:      userID,
+		Roles:       c.GetStringSlice("user_roles"),
+		Permissions: c.GetStringSlice("user_permissions"),
+	}, true
+}
+
 // RequireRole creates middleware that requires specific roles
 func RequireRole(roles ...string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		userIDInterface, exists := c.Get("user_id")
-		if !exists {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
-			c.Abort()
-			return
-		}
-
-		userID, ok := userIDInterface.(uuid.UUID)
+		subject, ok := contextSubject(c)
 		if !ok {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
-			c.Abort()
 			return
 		}
 
-		// Get user from database to check roles
-		// This is a simplified implementation - you might want to cache user roles
-		var user models.User
-		err := database.DB.Where("id = ? AND deleted_at IS NULL", userID).First(&user).Error
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		if !subject.HasRole(roles...) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
 			c.Abort()
 			return
 		}
 
-		// Check if user has required role
-		userRoles, ok := user.Metadata["roles"].([]interface{})
+		c.Next()
+	}
+}
+
+// RequirePermission creates middleware that requires any of the given permissions.
+// Site admins hold every permission.
+func RequirePermission(permissions ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		subject, ok := contextSubject(c)
 		if !ok {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
-			c.Abort()
 			return
 		}
 
-		hasRole := false
-		for _, role := range roles {
-			for _, userRole := range userRoles {
-				if roleStr, ok := userRole.(string); ok && roleStr == role {
-					hasRole = true
-					break
-				}
-			}
-			if hasRole {
-				break
-			}
-		}
-
-		if !hasRole {
+		if !subject.IsAdmin() && !subject.HasPermission(permissions...) {
 			c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
 			c.Abort()
 			return
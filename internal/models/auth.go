@@ -7,7 +7,8 @@ import (
 	"gorm.io/gorm"
 )
 
-// AuthProvider represents the authentication provider type
+// AuthProvider represents the authentication provider type: a password, Google, or the name
+// of a configured OpenID Connect provider
 type AuthProvider string
 
 const (
@@ -63,8 +64,8 @@ func (up *UserPhone) IsVerified() bool {
 type AuthIdentity struct {
 	ID                    uuid.UUID    `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
 	UserID                uuid.UUID    `json:"user_id" gorm:"type:uuid;not null"`
-	Provider              AuthProvider `json:"provider" gorm:"type:auth_provider;not null"`
-	ProviderUID           string       `json:"provider_uid" gorm:"not null"`
+	Provider              AuthProvider `json:"provider" gorm:"type:text;not null;uniqueIndex:auth_identities_provider_provider_uid_key,priority:1"`
+	ProviderUID           string       `json:"provider_uid" gorm:"not null;uniqueIndex:auth_identities_provider_provider_uid_key,priority:2"` // OIDC sub
 	EmailAtSignup         *string      `json:"email_at_signup" gorm:"type:citext"`
 	EmailVerified         *bool        `json:"email_verified"`
 	RefreshTokenEncrypted []byte       `json:"-"` // Hidden from JSON
@@ -79,6 +80,36 @@ func (AuthIdentity) TableName() string {
 	return "auth_identities"
 }
 
+// OIDCFlow is a sign-in at an OIDC provider between its start and the provider's callback.
+// The client holds a random token for it; only the token's hash is stored, and the flow is
+// consumed by its callback.
+type OIDCFlow struct {
+	ID         uuid.UUID  `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	TokenHash  string     `json:"-" gorm:"not null;uniqueIndex"`
+	Provider   string     `json:"provider" gorm:"not null"`
+	State      string     `json:"-" gorm:"not null"`
+	Nonce      string     `json:"-" gorm:"not null"`
+	Verifier   string     `json:"-" gorm:"not null"`             // PKCE code verifier
+	LinkUserID *uuid.UUID `json:"link_user_id" gorm:"type:uuid"` // set for flows that link the provider to an account
+	ExpiresAt  time.Time  `json:"expires_at" gorm:"not null"`
+	ConsumedAt *time.Time `json:"consumed_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// TableName returns the table name for the OIDCFlow model
+func (OIDCFlow) TableName() string {
+	return "oidc_flows"
+}
+
+// BeforeCreate hook to set timestamps
+func (f *OIDCFlow) BeforeCreate(tx *gorm.DB) error {
+	if f.ID == uuid.Nil {
+		f.ID = uuid.New()
+	}
+	f.CreatedAt = time.Now()
+	return nil
+}
+
 // BeforeCreate hook to set timestamps
 func (ai *AuthIdentity) BeforeCreate(tx *gorm.DB) error {
 	if ai.ID == uuid.Nil {
@@ -92,8 +123,8 @@ func (ai *AuthIdentity) BeforeCreate(tx *gorm.DB) error {
 // UserCredential represents user credentials for password authentication
 type UserCredential struct {
 	UserID        uuid.UUID  `json:"user_id" gorm:"type:uuid;primary_key"`
-	PasswordHash  *string    `json:"-"` // Hidden from JSON (server-side H2)
-	Salt          *string    `json:"-"` // Server-generated salt used in H2
+	PasswordHash  *string    `json:"-"` // Argon2id PHC string, or hex SHA-256 of legacy credentials
+	Salt          *string    `json:"-"` // Salt of legacy SHA-256 hashes; cleared on upgrade
 	PasswordSetAt *time.Time `json:"password_set_at"`
 
 	// Relationships
@@ -157,15 +188,19 @@ func (vt *VerificationToken) IsValid() bool {
 	return !vt.IsExpired() && !vt.IsConsumed()
 }
 
-// Session represents a user session
+// Session represents a user session. Every use of a refresh token rotates it into a new
+// session of the same family; the family is the login the sessions descend from.
 type Session struct {
 	ID               uuid.UUID  `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
 	UserID           uuid.UUID  `json:"user_id" gorm:"type:uuid;not null"`
+	FamilyID         uuid.UUID  `json:"family_id" gorm:"type:uuid;index"`
+	ParentID         *uuid.UUID `json:"-" gorm:"type:uuid"` // session whose refresh token was rotated into this one
 	UserAgent        *string    `json:"user_agent"`
 	IPNet            *string    `json:"ip_net" gorm:"type:inet"`
-	RefreshTokenHash string     `json:"-" gorm:"not null"` // Hidden from JSON
+	RefreshTokenHash string     `json:"-" gorm:"not null;index"` // Hidden from JSON
 	ValidUntil       time.Time  `json:"valid_until" gorm:"not null"`
 	CreatedAt        time.Time  `json:"created_at"`
+	RotatedAt        *time.Time `json:"-"`
 	RevokedAt        *time.Time `json:"revoked_at"`
 
 	// Relationships
@@ -182,14 +217,22 @@ func (s *Session) BeforeCreate(tx *gorm.DB) error {
 	if s.ID == uuid.Nil {
 		s.ID = uuid.New()
 	}
+	if s.FamilyID == uuid.Nil {
+		s.FamilyID = s.ID
+	}
 	now := time.Now()
 	s.CreatedAt = now
 	return nil
 }
 
-// IsValid checks if the session is valid (not expired and not revoked)
+// IsValid checks if the session is valid (not expired, rotated or revoked)
 func (s *Session) IsValid() bool {
-	return time.Now().Before(s.ValidUntil) && s.RevokedAt == nil
+	return time.Now().Before(s.ValidUntil) && s.RevokedAt == nil && s.RotatedAt == nil
+}
+
+// IsRotated checks if the session's refresh token has already been exchanged
+func (s *Session) IsRotated() bool {
+	return s.RotatedAt != nil
 }
 
 // IsExpired checks if the session is expired
@@ -211,13 +254,13 @@ func (s *Session) Revoke() {
 // AuthAudit represents an authentication audit log entry
 type AuthAudit struct {
 	ID        uuid.UUID     `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
-	UserID    *uuid.UUID    `json:"user_id" gorm:"type:uuid"`
-	Event     string        `json:"event" gorm:"not null"` // 'login_success','otp_sent','logout', etc.
-	Provider  *AuthProvider `json:"provider" gorm:"type:auth_provider"`
+	UserID    *uuid.UUID    `json:"user_id" gorm:"type:uuid;index:idx_auth_audit_user_event,priority:1"`
+	Event     string        `json:"event" gorm:"not null;index:idx_auth_audit_user_event,priority:2"` // 'login_success','otp_sent','logout', etc.
+	Provider  *AuthProvider `json:"provider" gorm:"type:text"`
 	IPNet     *string       `json:"ip_net" gorm:"type:inet"`
 	UserAgent *string       `json:"user_agent"`
 	Details   JSONB         `json:"details" gorm:"type:jsonb;default:'{}'"`
-	CreatedAt time.Time     `json:"created_at"`
+	CreatedAt time.Time     `json:"created_at" gorm:"index:idx_auth_audit_user_event,priority:3"`
 
 	// Relationships
 	User *User `json:"user,omitempty" gorm:"foreignKey:UserID"`
@@ -237,3 +280,61 @@ func (aa *AuthAudit) BeforeCreate(tx *gorm.DB) error {
 	aa.CreatedAt = now
 	return nil
 }
+
+// SigningKey is a key access tokens are signed with. Keys are published before they start
+// signing and stay published until the tokens they signed have expired.
+type SigningKey struct {
+	KID         string     `json:"kid" gorm:"primaryKey"` // RFC 7638 thumbprint of the public key
+	Algorithm   string     `json:"algorithm" gorm:"not null"`
+	PrivateKey  string     `json:"-" gorm:"not null"` // PKCS #8 PEM
+	ActivatesAt time.Time  `json:"activates_at" gorm:"not null"`
+	ExpiresAt   *time.Time `json:"expires_at"` // set once a newer key replaces it
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// TableName returns the table name for the SigningKey model
+func (SigningKey) TableName() string {
+	return "signing_keys"
+}
+
+// AuthAttempt counts a user's attempts at a guarded action, e.g. 'password_change', in the
+// window that started with the first of them
+type AuthAttempt struct {
+	UserID      uuid.UUID `json:"user_id" gorm:"type:uuid;primaryKey"`
+	Action      string    `json:"action" gorm:"primaryKey"`
+	Count       int       `json:"count" gorm:"not null;default:0"`
+	WindowStart time.Time `json:"window_start" gorm:"not null"`
+}
+
+// TableName returns the table name for the AuthAttempt model
+func (AuthAttempt) TableName() string {
+	return "auth_attempts"
+}
+
+// VerificationSend counts the verification tokens of a purpose sent to an address in the
+// window that started with the first of them, and when the last one was sent
+type VerificationSend struct {
+	Purpose     TokenPurpose `json:"purpose" gorm:"primaryKey"`
+	SentTo      string       `json:"sent_to" gorm:"primaryKey"`
+	Count       int          `json:"count" gorm:"not null;default:0"`
+	WindowStart time.Time    `json:"window_start" gorm:"not null"`
+	LastSentAt  time.Time    `json:"last_sent_at" gorm:"not null"`
+}
+
+// TableName returns the table name for the VerificationSend model
+func (VerificationSend) TableName() string {
+	return "verification_sends"
+}
+
+// AppSecret is a random secret generated by the first server instance that needs it and
+// shared with the others
+type AppSecret struct {
+	Name      string    `json:"name" gorm:"primaryKey"`
+	Value     string    `json:"-" gorm:"not null"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName returns the table name for the AppSecret model
+func (AppSecret) TableName() string {
+	return "app_secrets"
+}
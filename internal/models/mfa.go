@@ -0,0 +1,98 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// UserMFA is a user's TOTP second factor. It stays pending until a code from the
+// authenticator app confirms it.
+type UserMFA struct {
+	UserID       uuid.UUID  `json:"user_id" gorm:"type:uuid;primary_key"`
+	TOTPSecret   string     `json:"-" gorm:"not null"` // base32, as shown to the authenticator app
+	EnabledAt    *time.Time `json:"enabled_at"`
+	LastUsedStep int64      `json:"-" gorm:"not null;default:0"` // time step of the last accepted code; codes cannot be replayed
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+
+	// Relationships
+	User User `json:"user,omitempty" gorm:"foreignKey:UserID"`
+}
+
+// TableName returns the table name for the UserMFA model
+func (UserMFA) TableName() string {
+	return "user_mfa"
+}
+
+// IsEnabled checks if the second factor was confirmed
+func (m *UserMFA) IsEnabled() bool {
+	return m.EnabledAt != nil
+}
+
+// MFARecoveryCode is a one-time code that stands in for a TOTP code, e.g. when the
+// authenticator app is lost. Only its hash is stored.
+type MFARecoveryCode struct {
+	ID        uuid.UUID  `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	UserID    uuid.UUID  `json:"user_id" gorm:"type:uuid;not null;index"`
+	CodeHash  string     `json:"-" gorm:"not null"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// TableName returns the table name for the MFARecoveryCode model
+func (MFARecoveryCode) TableName() string {
+	return "mfa_recovery_codes"
+}
+
+// BeforeCreate hook to set timestamps
+func (rc *MFARecoveryCode) BeforeCreate(tx *gorm.DB) error {
+	if rc.ID == uuid.Nil {
+		rc.ID = uuid.New()
+	}
+	rc.CreatedAt = time.Now()
+	return nil
+}
+
+// MFAChallenge is a login waiting for its second factor. The client holds a random token
+// for it; only the token's hash is stored, and the challenge is consumed when the login
+// completes.
+type MFAChallenge struct {
+	ID         uuid.UUID  `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	TokenHash  string     `json:"-" gorm:"not null;uniqueIndex"`
+	UserID     uuid.UUID  `json:"user_id" gorm:"type:uuid;not null"`
+	Method     string     `json:"method" gorm:"not null"` // first factor, as in login_success audits
+	Enroll     bool       `json:"enroll" gorm:"not null;default:false"`
+	ExpiresAt  time.Time  `json:"expires_at" gorm:"not null"`
+	ConsumedAt *time.Time `json:"consumed_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// TableName returns the table name for the MFAChallenge model
+func (MFAChallenge) TableName() string {
+	return "mfa_challenges"
+}
+
+// BeforeCreate hook to set timestamps
+func (c *MFAChallenge) BeforeCreate(tx *gorm.DB) error {
+	if c.ID == uuid.Nil {
+		c.ID = uuid.New()
+	}
+	c.CreatedAt = time.Now()
+	return nil
+}
+
+// MFAPolicy says whether users of a level must sign in with a second factor. Levels
+// without a policy do not require one.
+type MFAPolicy struct {
+	Level     UserLevel  `json:"level" gorm:"type:user_level;primary_key"`
+	Required  bool       `json:"required" gorm:"not null;default:false"`
+	UpdatedBy *uuid.UUID `json:"updated_by" gorm:"type:uuid"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// TableName returns the table name for the MFAPolicy model
+func (MFAPolicy) TableName() string {
+	return "mfa_policies"
+}
@@ -0,0 +1,54 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// PreviewDeploymentStatus represents the state of a preview deployment
+type PreviewDeploymentStatus string
+
+const (
+	// PreviewDeploymentStatusActive is the deployment currently served as the project preview
+	PreviewDeploymentStatusActive PreviewDeploymentStatus = "active"
+	// PreviewDeploymentStatusInactive deployments are kept on disk and can be rolled back to
+	PreviewDeploymentStatusInactive PreviewDeploymentStatus = "inactive"
+	// PreviewDeploymentStatusPruned deployments had their files removed by retention
+	PreviewDeploymentStatusPruned PreviewDeploymentStatus = "pruned"
+)
+
+// PreviewDeployment is one published version of a project's preview
+type PreviewDeployment struct {
+	ID         uuid.UUID               `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	ProjectID  uuid.UUID               `json:"project_id" gorm:"type:uuid;not null;uniqueIndex:idx_preview_deployments_project_version"`
+	Version    int                     `json:"version" gorm:"not null;uniqueIndex:idx_preview_deployments_project_version"`
+	BuildID    *uuid.UUID              `json:"build_id" gorm:"type:uuid"`
+	Status     PreviewDeploymentStatus `json:"status" gorm:"type:preview_deployment_status;not null;default:'inactive'"`
+	EntryPoint string                  `json:"entry_point" gorm:"not null;default:'index.html'"`
+	SizeBytes  int64                   `json:"size_bytes" gorm:"not null;default:0"`
+	// ObjectPrefix is where the deployment's files are stored in MinIO ("bucket/prefix/")
+	ObjectPrefix *string    `json:"object_prefix"`
+	CreatedBy    *uuid.UUID `json:"created_by" gorm:"type:uuid"`
+	ActivatedAt  *time.Time `json:"activated_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+
+	// Relationships
+	Project *Project `json:"project,omitempty" gorm:"foreignKey:ProjectID;constraint:OnDelete:CASCADE"`
+	Build   *Build   `json:"build,omitempty" gorm:"foreignKey:BuildID;constraint:OnDelete:SET NULL"`
+}
+
+// TableName returns the table name for the PreviewDeployment model
+func (PreviewDeployment) TableName() string {
+	return "preview_deployments"
+}
+
+// BeforeCreate hook to set timestamps
+func (d *PreviewDeployment) BeforeCreate(tx *gorm.DB) error {
+	if d.ID == uuid.Nil {
+		d.ID = uuid.New()
+	}
+	d.CreatedAt = time.Now()
+	return nil
+}
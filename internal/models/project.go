@@ -27,8 +27,11 @@ type Project struct {
 	RootBucket        string            `json:"root_bucket" gorm:"not null"`
 	RootPrefix        string            `json:"root_prefix" gorm:"not null"`
 	StorageQuotaBytes int64             `json:"storage_quota_bytes" gorm:"default:0"`
+	StorageUsedBytes  int64             `json:"storage_used_bytes" gorm:"default:0"`
+	StorageUsage      JSONB             `json:"storage_usage" gorm:"type:jsonb;default:'{}'"` // per-component breakdown
 	Meta              JSONB             `json:"meta" gorm:"type:jsonb;default:'{}'"`
 	PreviewURL        *string           `json:"preview_url"`
+	TemplateID        *uuid.UUID        `json:"template_id" gorm:"type:uuid"`
 	Version           int               `json:"version" gorm:"default:1"`
 	CreatedAt         time.Time         `json:"created_at"`
 	UpdatedAt         time.Time         `json:"updated_at"`
@@ -39,6 +42,7 @@ type Project struct {
 	ChatSession     *ChatSession     `json:"chat_session,omitempty" gorm:"foreignKey:ProjectID;constraint:OnDelete:CASCADE"`
 	StorageLocation *StorageLocation `json:"storage_location,omitempty" gorm:"foreignKey:ProjectID;constraint:OnDelete:CASCADE"`
 	BuildResult     *BuildResult     `json:"build_result,omitempty" gorm:"foreignKey:ProjectID;constraint:OnDelete:CASCADE"`
+	Template        *ProjectTemplate `json:"template,omitempty" gorm:"foreignKey:TemplateID;constraint:OnDelete:SET NULL"`
 }
 
 // TableName returns the table name for the Project model
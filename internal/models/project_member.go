@@ -0,0 +1,91 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// ProjectRole is the access level a user has on a project
+type ProjectRole string
+
+const (
+	ProjectRoleViewer ProjectRole = "viewer"
+	ProjectRoleEditor ProjectRole = "editor"
+	ProjectRoleAdmin  ProjectRole = "admin"
+	// ProjectRoleOwner is implied by Project.OwnerID and never stored on a membership
+	ProjectRoleOwner ProjectRole = "owner"
+)
+
+// Rank orders roles so that a higher rank grants everything a lower rank does
+func (r ProjectRole) Rank() int {
+	switch r {
+	case ProjectRoleViewer:
+		return 1
+	case ProjectRoleEditor:
+		return 2
+	case ProjectRoleAdmin:
+		return 3
+	case ProjectRoleOwner:
+		return 4
+	}
+	return 0
+}
+
+// Allows reports whether r grants at least the required role
+func (r ProjectRole) Allows(required ProjectRole) bool {
+	return r.Rank() > 0 && r.Rank() >= required.Rank()
+}
+
+// IsMemberRole reports whether r can be granted to a project member
+func (r ProjectRole) IsMemberRole() bool {
+	return r == ProjectRoleViewer || r == ProjectRoleEditor || r == ProjectRoleAdmin
+}
+
+// ProjectMemberStatus represents the state of a project invitation
+type ProjectMemberStatus string
+
+const (
+	ProjectMemberStatusPending  ProjectMemberStatus = "pending"
+	ProjectMemberStatusAccepted ProjectMemberStatus = "accepted"
+)
+
+// ProjectMember grants a user a role on a project they do not own
+type ProjectMember struct {
+	ID         uuid.UUID           `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	ProjectID  uuid.UUID           `json:"project_id" gorm:"type:uuid;not null;uniqueIndex:idx_project_members_project_user"`
+	UserID     uuid.UUID           `json:"user_id" gorm:"type:uuid;not null;uniqueIndex:idx_project_members_project_user;index"`
+	Role       ProjectRole         `json:"role" gorm:"type:project_role;not null"`
+	Status     ProjectMemberStatus `json:"status" gorm:"type:project_member_status;not null;default:'pending'"`
+	InvitedBy  *uuid.UUID          `json:"invited_by" gorm:"type:uuid"`
+	AcceptedAt *time.Time          `json:"accepted_at"`
+	CreatedAt  time.Time           `json:"created_at"`
+	UpdatedAt  time.Time           `json:"updated_at"`
+
+	// Relationships
+	Project *Project `json:"project,omitempty" gorm:"foreignKey:ProjectID;constraint:OnDelete:CASCADE"`
+	User    *User    `json:"user,omitempty" gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE"`
+}
+
+// TableName returns the table name for the ProjectMember model
+func (ProjectMember) TableName() string {
+	return "project_members"
+}
+
+// BeforeCreate hook to set timestamps
+func (m *ProjectMember) BeforeCreate(tx *gorm.DB) error {
+	if m.ID == uuid.Nil {
+		m.ID = uuid.New()
+	}
+	now := time.Now()
+	m.CreatedAt = now
+	m.UpdatedAt = now
+	return nil
+}
+
+// BeforeUpdate hook to update timestamp
+func (m *ProjectMember) BeforeUpdate(tx *gorm.DB) error {
+	m.UpdatedAt = time.Now()
+	return nil
+}
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// ProjectTemplate describes a starter codebase new projects can be created from, and how
+// projects created from it are built and previewed
+type ProjectTemplate struct {
+	ID          uuid.UUID `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	Slug        string    `json:"slug" gorm:"not null;uniqueIndex"`
+	Name        string    `json:"name" gorm:"not null"`
+	Description *string   `json:"description"`
+	Framework   string    `json:"framework"` // e.g. react-vite, vue, next, static
+
+	// Archive holding the template files in MinIO
+	ArchiveBucket string `json:"archive_bucket" gorm:"not null"`
+	ArchiveObject string `json:"archive_object" gorm:"not null"`
+
+	// Directory inside the workspace that contains the app (empty = workspace root)
+	RootDir           string `json:"root_dir"`
+	InstallCommand    string `json:"install_command"`
+	BuildCommand      string `json:"build_command"`
+	DevCommand        string `json:"dev_command"`
+	OutputDir         string `json:"output_dir"`         // build output, relative to RootDir
+	PreviewEntrypoint string `json:"preview_entrypoint"` // file served as the preview start page, relative to OutputDir
+
+	IsDefault bool           `json:"is_default" gorm:"default:false"`
+	Meta      JSONB          `json:"meta" gorm:"type:jsonb;default:'{}'"`
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	DeletedAt gorm.DeletedAt `json:"-" gorm:"index"`
+}
+
+// TableName returns the table name for the ProjectTemplate model
+func (ProjectTemplate) TableName() string {
+	return "project_templates"
+}
+
+// BeforeCreate hook to set timestamps
+func (t *ProjectTemplate) BeforeCreate(tx *gorm.DB) error {
+	if t.ID == uuid.Nil {
+		t.ID = uuid.New()
+	}
+	now := time.Now()
+	t.CreatedAt = now
+	t.UpdatedAt = now
+	return nil
+}
+
+// BeforeUpdate hook to update timestamp
+func (t *ProjectTemplate) BeforeUpdate(tx *gorm.DB) error {
+	t.UpdatedAt = time.Now()
+	return nil
+}
@@ -0,0 +1,113 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Permission names checked by the API
+const (
+	PermissionUsersRead       = "users.read"       // list, search and view any user
+	PermissionUsersManage     = "users.manage"     // edit, delete, activate and deactivate any user
+	PermissionRolesManage     = "roles.manage"     // create roles and grant or revoke them
+	PermissionTemplatesManage = "templates.manage" // manage the project template registry
+	PermissionQuotasManage    = "quotas.manage"    // set project storage quotas
+	PermissionProjectsAdmin   = "projects.admin"   // full access to every project
+	PermissionSecurityManage  = "security.manage"  // set sign-in security policies, such as required MFA
+)
+
+// AllPermissions lists every permission, with its description
+var AllPermissions = map[string]string{
+	PermissionUsersRead:       "List, search and view any user",
+	PermissionUsersManage:     "Edit, delete, activate and deactivate any user",
+	PermissionRolesManage:     "Create roles and grant or revoke them",
+	PermissionTemplatesManage: "Manage the project template registry",
+	PermissionQuotasManage:    "Set project storage quotas",
+	PermissionProjectsAdmin:   "Full access to every project",
+	PermissionSecurityManage:  "Set sign-in security policies, such as required MFA",
+}
+
+// RoleAdmin is the built-in role holding every permission
+const RoleAdmin = "admin"
+
+// Role is a named set of permissions that can be granted to users
+type Role struct {
+	ID          uuid.UUID `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	Name        string    `json:"name" gorm:"not null;uniqueIndex"`
+	Description *string   `json:"description"`
+	IsSystem    bool      `json:"is_system" gorm:"default:false"` // built-in roles cannot be changed
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+
+	// Relationships
+	Permissions []Permission `json:"permissions,omitempty" gorm:"many2many:role_permissions;constraint:OnDelete:CASCADE"`
+}
+
+// TableName returns the table name for the Role model
+func (Role) TableName() string {
+	return "roles"
+}
+
+// BeforeCreate hook to set timestamps
+func (r *Role) BeforeCreate(tx *gorm.DB) error {
+	if r.ID == uuid.Nil {
+		r.ID = uuid.New()
+	}
+	now := time.Now()
+	r.CreatedAt = now
+	r.UpdatedAt = now
+	return nil
+}
+
+// BeforeUpdate hook to update timestamp
+func (r *Role) BeforeUpdate(tx *gorm.DB) error {
+	r.UpdatedAt = time.Now()
+	return nil
+}
+
+// Permission is a capability checked by the API
+type Permission struct {
+	ID          uuid.UUID `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	Name        string    `json:"name" gorm:"not null;uniqueIndex"`
+	Description *string   `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// TableName returns the table name for the Permission model
+func (Permission) TableName() string {
+	return "permissions"
+}
+
+// BeforeCreate hook to set timestamps
+func (p *Permission) BeforeCreate(tx *gorm.DB) error {
+	if p.ID == uuid.Nil {
+		p.ID = uuid.New()
+	}
+	p.CreatedAt = time.Now()
+	return nil
+}
+
+// UserRole grants a role to a user
+type UserRole struct {
+	UserID    uuid.UUID  `json:"user_id" gorm:"type:uuid;primaryKey"`
+	RoleID    uuid.UUID  `json:"role_id" gorm:"type:uuid;primaryKey;index"`
+	GrantedBy *uuid.UUID `json:"granted_by" gorm:"type:uuid"`
+	CreatedAt time.Time  `json:"created_at"`
+
+	// Relationships
+	User *User `json:"user,omitempty" gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE"`
+	Role *Role `json:"role,omitempty" gorm:"foreignKey:RoleID;constraint:OnDelete:CASCADE"`
+}
+
+// TableName returns the table name for the UserRole model
+func (UserRole) TableName() string {
+	return "user_roles"
+}
+
+// BeforeCreate hook to set timestamps
+func (ur *UserRole) BeforeCreate(tx *gorm.DB) error {
+	ur.CreatedAt = time.Now()
+	return nil
+}
@@ -20,6 +20,19 @@ const (
 	UserLevelPrincipal UserLevel = "principal"
 )
 
+// UserLevels lists every level, lowest first
+var UserLevels = []UserLevel{UserLevelFree, UserLevelEntry, UserLevelSenior, UserLevelStaff, UserLevelPrincipal}
+
+// IsValid checks if the level is one of UserLevels
+func (l UserLevel) IsValid() bool {
+	for _, level := range UserLevels {
+		if l == level {
+			return true
+		}
+	}
+	return false
+}
+
 // User represents a user in the system
 type User struct {
 	ID           uuid.UUID      `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
@@ -33,6 +46,11 @@ type User struct {
 	UpdatedAt    time.Time      `json:"updated_at"`
 	DeletedAt    gorm.DeletedAt `json:"-" gorm:"index"`
 
+	// TokensInvalidBefore rejects access tokens issued before it, e.g. after logging out everywhere
+	TokensInvalidBefore *time.Time `json:"-"`
+	// EmailVerifiedAt is when the user proved they own Email; changing the email clears it
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+
 	// Relationships
 	Projects           []Project           `json:"projects,omitempty" gorm:"foreignKey:OwnerID"`
 	ChatSessions       []ChatSession       `json:"chat_sessions,omitempty" gorm:"foreignKey:UserID"`
@@ -63,6 +81,11 @@ func (u *User) BeforeCreate(tx *gorm.DB) error {
 	return nil
 }
 
+// IsEmailVerified reports whether the user proved they own their email
+func (u *User) IsEmailVerified() bool {
+	return u.Email != nil && u.EmailVerifiedAt != nil
+}
+
 // BeforeUpdate hook to update timestamp
 func (u *User) BeforeUpdate(tx *gorm.DB) error {
 	u.UpdatedAt = time.Now()
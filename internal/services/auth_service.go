@@ -4,12 +4,15 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math/big"
 	"net/http"
+	"strings"
 	"time"
 
 	"borderless_coding_server/internal/models"
@@ -21,12 +24,71 @@ import (
 	"gorm.io/gorm"
 )
 
+// sessionLifetime is how long a session family lasts; rotation does not extend it
+const sessionLifetime = 30 * 24 * time.Hour
+
+const (
+	// maxVerificationAttempts is how many times a verification token can be checked
+	maxVerificationAttempts = 5
+	// maxPasswordChangeFailures wrong current passwords are accepted per passwordChangeWindow
+	maxPasswordChangeFailures = 5
+	passwordChangeWindow      = 15 * time.Minute
+	passwordChangeAttempt     = "password_change"
+)
+
+// tokenPolicy is how long a verification token works, and how many can be sent to one
+// address per window. Phone tokens are 6-digit codes, and resending one waits resendAfter.
+type tokenPolicy struct {
+	lifetime    time.Duration
+	maxSends    int
+	window      time.Duration
+	resendAfter time.Duration
+	otp         bool
+}
+
+var tokenPolicies = map[models.TokenPurpose]tokenPolicy{
+	models.TokenPurposeEmailVerify:   {lifetime: 24 * time.Hour, maxSends: 3, window: time.Hour},
+	models.TokenPurposeEmailLogin:    {lifetime: 15 * time.Minute, maxSends: 5, window: time.Hour},
+	models.TokenPurposeResetPassword: {lifetime: time.Hour, maxSends: 3, window: time.Hour},
+	models.TokenPurposePhoneVerify:   {lifetime: 10 * time.Minute, maxSends: 5, window: time.Hour, resendAfter: time.Minute, otp: true},
+	models.TokenPurposePhoneLogin:    {lifetime: 10 * time.Minute, maxSends: 5, window: time.Hour, resendAfter: time.Minute, otp: true},
+}
+
+var (
+	// ErrInvalidRefreshToken is returned for unknown, expired or revoked refresh tokens
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	// ErrRefreshTokenReused is returned when an already rotated refresh token is presented
+	ErrRefreshTokenReused = errors.New("refresh token reuse detected")
+	// ErrSessionNotFound is returned when a session does not exist or belongs to another user
+	ErrSessionNotFound = errors.New("session not found")
+	// ErrInvalidCredentials is returned when an email and password do not match an account
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrEmailTaken is returned when registering an email that already has an account
+	ErrEmailTaken = errors.New("email already registered")
+	// ErrAccountDisabled is returned when a deactivated user logs in with the right password
+	ErrAccountDisabled = errors.New("account is disabled")
+	// ErrInvalidVerificationToken is returned for unknown, expired or used verification tokens
+	ErrInvalidVerificationToken = errors.New("invalid or expired token")
+	// ErrTooManyAttempts is returned when an action was tried too often in a short time
+	ErrTooManyAttempts = errors.New("too many attempts")
+	// ErrNoPassword is returned when changing the password of an account that has none
+	ErrNoPassword = errors.New("account has no password")
+	// ErrNoEmail is returned when verifying the email of an account that has none
+	ErrNoEmail = errors.New("account has no email")
+	// ErrEmailAlreadyVerified is returned when verifying an email that is already verified
+	ErrEmailAlreadyVerified = errors.New("email already verified")
+)
+
 type AuthService struct {
 	googleConfig *oauth2.Config
-	jwtSecret    string
+	revocation   *TokenRevocationService
+	credentials  CredentialStore
+	verifier     CredentialVerifier
+	sender       VerificationSender
+	oidc         *OIDCRegistry
 }
 
-func NewAuthService(googleClientID, googleClientSecret, redirectURL, jwtSecret string) *AuthService {
+func NewAuthService(googleClientID, googleClientSecret, redirectURL string, revocation *TokenRevocationService, credentials CredentialStore, verifier CredentialVerifier, sender VerificationSender, oidc *OIDCRegistry) *AuthService {
 	config := &oauth2.Config{
 		ClientID:     googleClientID,
 		ClientSecret: googleClientSecret,
@@ -41,28 +103,33 @@ func NewAuthService(googleClientID, googleClientSecret, redirectURL, jwtSecret s
 
 	return &AuthService{
 		googleConfig: config,
-		jwtSecret:    jwtSecret,
+		revocation:   revocation,
+		credentials:  credentials,
+		verifier:     verifier,
+		sender:       sender,
+		oidc:         oidc,
 	}
 }
 
-// GoogleOIDCFlow handles the Google OIDC authentication flow
-func (s *AuthService) GoogleOIDCFlow(ctx context.Context, code string, userAgent, ipAddress string) (*models.User, *models.Session, error) {
+// GoogleOIDCFlow handles the Google OIDC authentication flow and returns the new session
+// with its refresh token, or an *MFAChallengeError for users who need a second factor
+func (s *AuthService) GoogleOIDCFlow(ctx context.Context, code string, userAgent, ipAddress string) (*models.User, *models.Session, string, error) {
 	// Exchange code for token
 	token, err := s.googleConfig.Exchange(ctx, code)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to exchange code for token: %w", err)
+		return nil, nil, "", fmt.Errorf("failed to exchange code for token: %w", err)
 	}
 
 	// Get user info from Google
 	client := s.googleConfig.Client(ctx, token)
 	resp, err := client.Get("https://www.googleapis.com/oauth2/v2/userinfo")
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to get user info: %w", err)
+		return nil, nil, "", fmt.Errorf("failed to get user info: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, nil, fmt.Errorf("failed to get user info: status %d", resp.StatusCode)
+		return nil, nil, "", fmt.Errorf("failed to get user info: status %d", resp.StatusCode)
 	}
 
 	var googleUser struct {
@@ -76,25 +143,29 @@ func (s *AuthService) GoogleOIDCFlow(ctx context.Context, code string, userAgent
 	}
 
 	if err := json.NewDecoder(resp.Body).Decode(&googleUser); err != nil {
-		return nil, nil, fmt.Errorf("failed to decode user info: %w", err)
+		return nil, nil, "", fmt.Errorf("failed to decode user info: %w", err)
 	}
 
 	// Find or create auth identity
 	authIdentity, err := s.findOrCreateAuthIdentity(ctx, googleUser.ID, googleUser.Email, googleUser.VerifiedEmail)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to find or create auth identity: %w", err)
+		return nil, nil, "", fmt.Errorf("failed to find or create auth identity: %w", err)
 	}
 
 	// Get or create user
 	user, err := s.getOrCreateUser(ctx, authIdentity, googleUser)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to get or create user: %w", err)
+		return nil, nil, "", fmt.Errorf("failed to get or create user: %w", err)
+	}
+
+	if err := s.requireMFA(ctx, user, string(models.AuthProviderGoogle), userAgent, ipAddress); err != nil {
+		return nil, nil, "", err
 	}
 
 	// Create session
-	session, err := s.createSession(ctx, user.ID, userAgent, ipAddress)
+	session, refreshToken, err := s.CreateSession(ctx, user.ID, userAgent, ipAddress)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create session: %w", err)
+		return nil, nil, "", fmt.Errorf("failed to create session: %w", err)
 	}
 
 	// Log authentication event
@@ -104,7 +175,7 @@ func (s *AuthService) GoogleOIDCFlow(ctx context.Context, code string, userAgent
 		"email":          googleUser.Email,
 	})
 
-	return user, session, nil
+	return user, session, refreshToken, nil
 }
 
 // findOrCreateAuthIdentity finds an existing auth identity or creates a new one
@@ -192,6 +263,10 @@ func (s *AuthService) getOrCreateUser(ctx context.Context, authIdentity *models.
 			"family_name": googleUser.FamilyName,
 		},
 	}
+	if googleUser.VerifiedEmail {
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+	}
 
 	if err := database.DB.Create(&user).Error; err != nil {
 		return nil, err
@@ -206,31 +281,376 @@ func (s *AuthService) getOrCreateUser(ctx context.Context, authIdentity *models.
 	return &user, nil
 }
 
-// createSession creates a new session for the user
-func (s *AuthService) createSession(ctx context.Context, userID uuid.UUID, userAgent, ipAddress string) (*models.Session, error) {
-	// Generate refresh token
-	refreshToken, err := s.generateRefreshToken()
+// RegisterWithPassword creates an account with a password. digest is PasswordDigest of the
+// password, or the digest from the client's RSA envelope.
+func (s *AuthService) RegisterWithPassword(ctx context.Context, email string, displayName *string, digest []byte, userAgent, ipAddress string) (*models.User, error) {
+	if _, err := s.credentials.FindUserByEmail(ctx, email); err == nil {
+		return nil, ErrEmailTaken
+	} else if !errors.Is(err, ErrAccountNotFound) {
+		return nil, err
+	}
+
+	passwordHash, err := s.verifier.Hash(digest)
 	if err != nil {
+		return nil, fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	now := time.Now()
+	user := models.User{
+		Email:       &email,
+		DisplayName: displayName,
+		IsActive:    true,
+		Metadata:    make(models.JSONB),
+	}
+	cred := models.UserCredential{
+		PasswordHash:  &passwordHash,
+		PasswordSetAt: &now,
+	}
+	if err := s.credentials.CreateUser(ctx, &user, &cred); err != nil {
 		return nil, err
 	}
 
-	// Hash the refresh token
-	refreshTokenHash := s.hashToken(refreshToken)
+	provider := models.AuthProviderPassword
+	s.logAuthEvent(ctx, user.ID, "register_success", &provider, ipAddress, userAgent, map[string]interface{}{
+		"email": email,
+	})
+	return &user, nil
+}
+
+// LoginWithPassword checks an email and password digest and starts a session, returning it
+// with its refresh token. Hashes from older schemes or parameters are upgraded on success.
+// Users who need a second factor get an *MFAChallengeError instead of a session.
+func (s *AuthService) LoginWithPassword(ctx context.Context, email string, digest []byte, userAgent, ipAddress string) (*models.User, *models.Session, string, error) {
+	provider := models.AuthProviderPassword
+
+	user, err := s.credentials.FindUserByEmail(ctx, email)
+	if err != nil && !errors.Is(err, ErrAccountNotFound) {
+		return nil, nil, "", err
+	}
+	var cred *models.UserCredential
+	if user != nil {
+		cred, err = s.credentials.GetCredential(ctx, user.ID)
+		if err != nil && !errors.Is(err, ErrAccountNotFound) {
+			return nil, nil, "", err
+		}
+	}
+	if cred == nil || !cred.HasPassword() {
+		// Spend the time a password check takes so unknown emails cannot be told apart
+		_, _ = s.verifier.Hash(digest)
+		return nil, nil, "", ErrInvalidCredentials
+	}
+
+	ok, needsRehash, err := s.verifier.Verify(digest, cred)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to verify password: %w", err)
+	}
+	if !ok {
+		s.logAuthEvent(ctx, user.ID, "login_failed", &provider, ipAddress, userAgent, map[string]interface{}{
+			"reason": "wrong_password",
+		})
+		return nil, nil, "", ErrInvalidCredentials
+	}
+	if !user.IsActive {
+		return nil, nil, "", ErrAccountDisabled
+	}
+	if needsRehash {
+		// Best-effort; the old hash keeps working until the next login
+		if passwordHash, err := s.verifier.Hash(digest); err == nil {
+			if err := s.credentials.UpdatePasswordHash(ctx, user.ID, passwordHash); err == nil {
+				s.logAuthEvent(ctx, user.ID, "password_rehashed", &provider, ipAddress, userAgent, nil)
+			}
+		}
+	}
+	if err := s.requireMFA(ctx, user, string(provider), userAgent, ipAddress); err != nil {
+		return nil, nil, "", err
+	}
+
+	session, refreshToken, err := s.CreateSession(ctx, user.ID, userAgent, ipAddress)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to create session: %w", err)
+	}
+
+	s.logAuthEvent(ctx, user.ID, "login_success", &provider, ipAddress, userAgent, nil)
+	return user, session, refreshToken, nil
+}
+
+// RequestPasswordReset sends a password reset link to the email's account. Unknown emails,
+// deactivated accounts and addresses that were sent too many links are ignored without an
+// error, so callers cannot tell them apart.
+func (s *AuthService) RequestPasswordReset(ctx context.Context, email, userAgent, ipAddress string) error {
+	user, err := s.credentials.FindUserByEmail(ctx, email)
+	if err != nil {
+		if errors.Is(err, ErrAccountNotFound) {
+			return nil
+		}
+		return err
+	}
+	if !user.IsActive || user.Email == nil {
+		return nil
+	}
+
+	provider := models.AuthProviderPassword
+	err = s.sendVerificationToken(ctx, user.ID, models.TokenPurposeResetPassword, *user.Email)
+	if errors.Is(err, ErrTooManyAttempts) {
+		s.logAuthEvent(ctx, user.ID, "password_reset_throttled", &provider, ipAddress, userAgent, nil)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	s.logAuthEvent(ctx, user.ID, "password_reset_requested", &provider, ipAddress, userAgent, nil)
+	return nil
+}
+
+// ResetPassword sets a new password with a token from RequestPasswordReset. The token works
+// once, and every session and access token of the user is revoked.
+func (s *AuthService) ResetPassword(ctx context.Context, token string, digest []byte, userAgent, ipAddress string) error {
+	verificationToken, err := s.ValidateVerificationToken(ctx, token, models.TokenPurposeResetPassword)
+	if err != nil {
+		return err
+	}
+	if verificationToken.UserID == nil {
+		return ErrInvalidVerificationToken
+	}
+	userID := *verificationToken.UserID
+
+	passwordHash, err := s.verifier.Hash(digest)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+	if err := s.ConsumeVerificationToken(ctx, verificationToken.ID); err != nil {
+		return err
+	}
+	if err := s.credentials.SetPassword(ctx, userID, passwordHash); err != nil {
+		return err
+	}
+	if err := s.RevokeAllUserSessions(ctx, userID); err != nil {
+		return fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+
+	provider := models.AuthProviderPassword
+	s.logAuthEvent(ctx, userID, "password_reset", &provider, ipAddress, userAgent, nil)
+	return nil
+}
+
+// ChangePassword replaces the user's password after checking the current one, and revokes
+// every session except the login sessionID belongs to. After maxPasswordChangeFailures wrong
+// current passwords in passwordChangeWindow, ErrTooManyAttempts is returned.
+func (s *AuthService) ChangePassword(ctx context.Context, userID, sessionID uuid.UUID, currentDigest, newDigest []byte, userAgent, ipAddress string) error {
+	provider := models.AuthProviderPassword
+
+	cred, err := s.credentials.GetCredential(ctx, userID)
+	if err != nil && !errors.Is(err, ErrAccountNotFound) {
+		return err
+	}
+	if cred == nil || !cred.HasPassword() {
+		return ErrNoPassword
+	}
+
+	// The attempt is counted before the password is checked so concurrent guesses can't
+	// outrun the limit; a correct password clears the count
+	allowed, err := s.credentials.TakeAttempt(ctx, userID, passwordChangeAttempt, maxPasswordChangeFailures, passwordChangeWindow)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return ErrTooManyAttempts
+	}
+	ok, _, err := s.verifier.Verify(currentDigest, cred)
+	if err != nil {
+		return fmt.Errorf("failed to verify password: %w", err)
+	}
+	if !ok {
+		s.logAuthEvent(ctx, userID, "password_change_failed", &provider, ipAddress, userAgent, map[string]interface{}{
+			"reason": "wrong_password",
+		})
+		return ErrInvalidCredentials
+	}
+	if err := s.credentials.ResetAttempts(ctx, userID, passwordChangeAttempt); err != nil {
+		return err
+	}
+
+	passwordHash, err := s.verifier.Hash(newDigest)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+	if err := s.credentials.SetPassword(ctx, userID, passwordHash); err != nil {
+		return err
+	}
+	revoked, err := s.revokeOtherSessions(ctx, userID, sessionID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+
+	s.logAuthEvent(ctx, userID, "password_changed", &provider, ipAddress, userAgent, map[string]interface{}{
+		"revoked_sessions": len(revoked),
+	})
+	return nil
+}
+
+// RequestEmailVerification emails the user a link that proves they own their email
+func (s *AuthService) RequestEmailVerification(ctx context.Context, userID uuid.UUID, userAgent, ipAddress string) error {
+	var user models.User
+	if err := database.DB.WithContext(ctx).Where("id = ? AND deleted_at IS NULL", userID).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrAccountNotFound
+		}
+		return err
+	}
+	if user.Email == nil || *user.Email == "" {
+		return ErrNoEmail
+	}
+	if user.IsEmailVerified() {
+		return ErrEmailAlreadyVerified
+	}
+
+	if err := s.sendVerificationToken(ctx, user.ID, models.TokenPurposeEmailVerify, *user.Email); err != nil {
+		return err
+	}
+	s.logAuthEvent(ctx, user.ID, "email_verification_sent", nil, ipAddress, userAgent, map[string]interface{}{
+		"email": *user.Email,
+	})
+	return nil
+}
+
+// ConfirmEmailVerification marks the email a verification token was sent to as verified
+func (s *AuthService) ConfirmEmailVerification(ctx context.Context, token, userAgent, ipAddress string) (*models.User, error) {
+	user, err := s.consumeEmailToken(ctx, token, models.TokenPurposeEmailVerify)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.markEmailVerified(ctx, user); err != nil {
+		return nil, err
+	}
+
+	s.logAuthEvent(ctx, user.ID, "email_verified", nil, ipAddress, userAgent, map[string]interface{}{
+		"email": *user.Email,
+	})
+	return user, nil
+}
+
+// RequestMagicLink emails a sign-in link to the email's account. Like RequestPasswordReset,
+// unknown emails, deactivated accounts and throttled addresses are ignored without an error.
+func (s *AuthService) RequestMagicLink(ctx context.Context, email, userAgent, ipAddress string) error {
+	user, err := s.credentials.FindUserByEmail(ctx, email)
+	if err != nil {
+		if errors.Is(err, ErrAccountNotFound) {
+			return nil
+		}
+		return err
+	}
+	if !user.IsActive || user.Email == nil {
+		return nil
+	}
+
+	err = s.sendVerificationToken(ctx, user.ID, models.TokenPurposeEmailLogin, *user.Email)
+	if errors.Is(err, ErrTooManyAttempts) {
+		s.logAuthEvent(ctx, user.ID, "magic_link_throttled", nil, ipAddress, userAgent, nil)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	s.logAuthEvent(ctx, user.ID, "magic_link_requested", nil, ipAddress, userAgent, nil)
+	return nil
+}
+
+// LoginWithMagicLink starts a session with a token from RequestMagicLink, returning it with
+// its refresh token. Following the link proves the user owns the email, so it is marked
+// verified. Users who need a second factor get an *MFAChallengeError instead.
+func (s *AuthService) LoginWithMagicLink(ctx context.Context, token, userAgent, ipAddress string) (*models.User, *models.Session, string, error) {
+	user, err := s.consumeEmailToken(ctx, token, models.TokenPurposeEmailLogin)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if !user.IsActive {
+		return nil, nil, "", ErrAccountDisabled
+	}
+	if err := s.markEmailVerified(ctx, user); err != nil {
+		return nil, nil, "", err
+	}
+	if err := s.requireMFA(ctx, user, "magic_link", userAgent, ipAddress); err != nil {
+		return nil, nil, "", err
+	}
+
+	session, refreshToken, err := s.CreateSession(ctx, user.ID, userAgent, ipAddress)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to create session: %w", err)
+	}
+
+	s.logAuthEvent(ctx, user.ID, "login_success", nil, ipAddress, userAgent, map[string]interface{}{
+		"method": "magic_link",
+	})
+	return user, session, refreshToken, nil
+}
+
+// consumeEmailToken uses up an email token and returns the user it was sent to. Tokens sent
+// to an address the user has since changed from are rejected.
+func (s *AuthService) consumeEmailToken(ctx context.Context, token string, purpose models.TokenPurpose) (*models.User, error) {
+	verificationToken, err := s.ValidateVerificationToken(ctx, token, purpose)
+	if err != nil {
+		return nil, err
+	}
+	if verificationToken.UserID == nil {
+		return nil, ErrInvalidVerificationToken
+	}
+	if err := s.ConsumeVerificationToken(ctx, verificationToken.ID); err != nil {
+		return nil, err
+	}
+
+	var user models.User
+	err = database.DB.WithContext(ctx).Where("id = ? AND deleted_at IS NULL", *verificationToken.UserID).First(&user).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidVerificationToken
+		}
+		return nil, err
+	}
+	if user.Email == nil || !strings.EqualFold(*user.Email, verificationToken.SentTo) {
+		return nil, ErrInvalidVerificationToken
+	}
+	return &user, nil
+}
+
+// markEmailVerified records that the user owns their current email
+func (s *AuthService) markEmailVerified(ctx context.Context, user *models.User) error {
+	if user.EmailVerifiedAt != nil {
+		return nil
+	}
+	now := time.Now()
+	err := database.DB.WithContext(ctx).Model(&models.User{}).
+		Where("id = ? AND email = ?", user.ID, *user.Email).
+		Update("email_verified_at", &now).Error
+	if err != nil {
+		return err
+	}
+	user.EmailVerifiedAt = &now
+	return nil
+}
+
+// CreateSession starts a new session family for the user and returns the session with its
+// refresh token. Only the token's hash is stored.
+func (s *AuthService) CreateSession(ctx context.Context, userID uuid.UUID, userAgent, ipAddress string) (*models.Session, string, error) {
+	refreshToken, err := s.generateRefreshToken()
+	if err != nil {
+		return nil, "", err
+	}
 
-	// Create session
 	session := models.Session{
 		UserID:           userID,
 		UserAgent:        &userAgent,
 		IPNet:            &ipAddress,
-		RefreshTokenHash: refreshTokenHash,
-		ValidUntil:       time.Now().Add(30 * 24 * time.Hour), // 30 days
+		RefreshTokenHash: s.hashToken(refreshToken),
+		ValidUntil:       time.Now().Add(sessionLifetime),
 	}
 
-	if err := database.DB.Create(&session).Error; err != nil {
-		return nil, err
+	if err := s.credentials.CreateSession(ctx, &session); err != nil {
+		return nil, "", err
 	}
 
-	return &session, nil
+	return &session, refreshToken, nil
 }
 
 // generateRefreshToken generates a secure random refresh token
@@ -250,6 +670,9 @@ func (s *AuthService) hashToken(token string) string {
 
 // logAuthEvent logs an authentication event
 func (s *AuthService) logAuthEvent(ctx context.Context, userID uuid.UUID, event string, provider *models.AuthProvider, ipAddress, userAgent string, details map[string]interface{}) {
+	if details == nil {
+		details = map[string]interface{}{}
+	}
 	audit := models.AuthAudit{
 		UserID:    &userID,
 		Event:     event,
@@ -259,63 +682,174 @@ func (s *AuthService) logAuthEvent(ctx context.Context, userID uuid.UUID, event
 		Details:   models.JSONB(details),
 	}
 
-	// Log asynchronously to avoid blocking the main flow
+	// Log asynchronously to avoid blocking the main flow; the request may be over by then
+	ctx = context.WithoutCancel(ctx)
 	go func() {
-		database.DB.Create(&audit)
+		_ = s.credentials.RecordAuthEvent(ctx, &audit)
 	}()
 }
 
-// ValidateSession validates a session and returns the user
-func (s *AuthService) ValidateSession(ctx context.Context, refreshToken string) (*models.User, *models.Session, error) {
-	refreshTokenHash := s.hashToken(refreshToken)
+// RefreshTokenReuseError is returned by CredentialStore.RotateSession for a refresh token that
+// was already rotated, after the session's family has been revoked
+type RefreshTokenReuseError struct {
+	Session models.Session // the session the reused token belonged to
+	Revoked []uuid.UUID    // the sessions of its family that were revoked
+}
 
-	var session models.Session
-	err := database.DB.Where("refresh_token_hash = ? AND revoked_at IS NULL", refreshTokenHash).First(&session).Error
+func (e *RefreshTokenReuseError) Error() string {
+	return ErrRefreshTokenReused.Error()
+}
+
+func (e *RefreshTokenReuseError) Unwrap() error {
+	return ErrRefreshTokenReused
+}
+
+// RotateRefreshToken exchanges a refresh token for a new one. The presented token's session is
+// marked rotated and a child session of the same family takes its place, keeping the family's
+// expiry. Presenting a token that was already rotated means it leaked: the whole family is
+// revoked and ErrRefreshTokenReused is returned. Deactivated users get ErrAccountDisabled.
+func (s *AuthService) RotateRefreshToken(ctx context.Context, refreshToken, userAgent, ipAddress string) (*models.User, *models.Session, string, error) {
+	newToken, err := s.generateRefreshToken()
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, nil, errors.New("invalid session")
-		}
-		return nil, nil, err
+		return nil, nil, "", err
 	}
 
-	// Check if session is still valid
-	if !session.IsValid() {
-		return nil, nil, errors.New("session expired")
+	session := models.Session{
+		UserAgent:        &userAgent,
+		IPNet:            &ipAddress,
+		RefreshTokenHash: s.hashToken(newToken),
+	}
+	user, err := s.credentials.RotateSession(ctx, s.hashToken(refreshToken), &session)
+	var reuse *RefreshTokenReuseError
+	if errors.As(err, &reuse) {
+		s.logAuthEvent(ctx, reuse.Session.UserID, "refresh_reuse_detected", nil, ipAddress, userAgent, map[string]interface{}{
+			"session_id": reuse.Session.ID.String(),
+			"family_id":  reuse.Session.FamilyID.String(),
+		})
+		if err := s.revocation.RevokeSessions(ctx, reuse.Revoked...); err != nil {
+			return nil, nil, "", err
+		}
+		return nil, nil, "", ErrRefreshTokenReused
 	}
-
-	// Get user
-	var user models.User
-	err = database.DB.Where("id = ? AND deleted_at IS NULL", session.UserID).First(&user).Error
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, "", err
 	}
-
-	return &user, &session, nil
+	return user, &session, newToken, nil
 }
 
-// RevokeSession revokes a session
+// RevokeSession revokes the session family the refresh token belongs to
 func (s *AuthService) RevokeSession(ctx context.Context, refreshToken string) error {
-	refreshTokenHash := s.hashToken(refreshToken)
+	var session models.Session
+	err := database.DB.Where("refresh_token_hash = ?", s.hashToken(refreshToken)).First(&session).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrSessionNotFound
+		}
+		return err
+	}
 
+	revoked, err := revokeSessionFamily(database.DB, session.FamilyID)
+	if err != nil {
+		return err
+	}
+	return s.revocation.RevokeSessions(ctx, revoked...)
+}
+
+// RevokeSessionByID revokes one of the user's sessions along with the rest of its family
+func (s *AuthService) RevokeSessionByID(ctx context.Context, userID, sessionID uuid.UUID) error {
 	var session models.Session
-	err := database.DB.Where("refresh_token_hash = ?", refreshTokenHash).First(&session).Error
+	err := database.DB.Where("id = ? AND user_id = ?", sessionID, userID).First(&session).Error
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return errors.New("session not found")
+			return ErrSessionNotFound
 		}
 		return err
 	}
 
-	session.Revoke()
-	return database.DB.Save(&session).Error
+	revoked, err := revokeSessionFamily(database.DB, session.FamilyID)
+	if err != nil {
+		return err
+	}
+	return s.revocation.RevokeSessions(ctx, revoked...)
+}
+
+// IsAccessTokenRevoked reports whether an access token was revoked before it expired
+func (s *AuthService) IsAccessTokenRevoked(ctx context.Context, claims *Claims) (bool, error) {
+	return s.revocation.IsRevoked(ctx, claims)
 }
 
-// RevokeAllUserSessions revokes all sessions for a user
+// ListActiveSessions returns the user's sessions whose refresh token can still be used,
+// one per session family
+func (s *AuthService) ListActiveSessions(ctx context.Context, userID uuid.UUID) ([]models.Session, error) {
+	var sessions []models.Session
+	err := database.DB.
+		Where("user_id = ? AND revoked_at IS NULL AND rotated_at IS NULL AND valid_until > ?", userID, time.Now()).
+		Order("created_at DESC").
+		Find(&sessions).Error
+	return sessions, err
+}
+
+// revokeSessionFamily revokes every session descended from the same login and returns their IDs
+func revokeSessionFamily(tx *gorm.DB, familyID uuid.UUID) ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	if err := tx.Model(&models.Session{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Pluck("id", &ids).Error; err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	now := time.Now()
+	err := tx.Model(&models.Session{}).
+		Where("id IN ?", ids).
+		Update("revoked_at", &now).Error
+	return ids, err
+}
+
+// RevokeAllUserSessions revokes all sessions for a user and rejects the access tokens
+// already issued to them
 func (s *AuthService) RevokeAllUserSessions(ctx context.Context, userID uuid.UUID) error {
 	now := time.Now()
-	return database.DB.Model(&models.Session{}).
+	err := database.DB.Model(&models.Session{}).
 		Where("user_id = ? AND revoked_at IS NULL", userID).
 		Update("revoked_at", &now).Error
+	if err != nil {
+		return err
+	}
+	return s.revocation.InvalidateUserTokens(ctx, userID)
+}
+
+// revokeOtherSessions revokes the user's sessions outside the family of keepSessionID and
+// rejects their access tokens, returning the revoked session IDs
+func (s *AuthService) revokeOtherSessions(ctx context.Context, userID, keepSessionID uuid.UUID) ([]uuid.UUID, error) {
+	var keep models.Session
+	err := database.DB.WithContext(ctx).Where("id = ? AND user_id = ?", keepSessionID, userID).First(&keep).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	var ids []uuid.UUID
+	if err := database.DB.WithContext(ctx).Model(&models.Session{}).
+		Where("user_id = ? AND family_id <> ? AND revoked_at IS NULL", userID, keep.FamilyID).
+		Pluck("id", &ids).Error; err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	now := time.Now()
+	if err := database.DB.WithContext(ctx).Model(&models.Session{}).
+		Where("id IN ?", ids).
+		Update("revoked_at", &now).Error; err != nil {
+		return nil, err
+	}
+	if err := s.revocation.RevokeSessions(ctx, ids...); err != nil {
+		return nil, err
+	}
+	return ids, nil
 }
 
 // GetGoogleAuthURL returns the Google OAuth URL
@@ -323,10 +857,16 @@ func (s *AuthService) GetGoogleAuthURL(state string) string {
 	return s.googleConfig.AuthCodeURL(state, oauth2.AccessTypeOffline)
 }
 
-// CreateVerificationToken creates a verification token
+// CreateVerificationToken creates a verification token. Phone tokens are 6-digit codes.
 func (s *AuthService) CreateVerificationToken(ctx context.Context, userID *uuid.UUID, purpose models.TokenPurpose, sentTo string, expiresIn time.Duration) (*models.VerificationToken, string, error) {
 	// Generate token
-	token, err := s.generateRefreshToken()
+	var token string
+	var err error
+	if tokenPolicies[purpose].otp {
+		token, err = generateOTP()
+	} else {
+		token, err = s.generateRefreshToken()
+	}
 	if err != nil {
 		return nil, "", err
 	}
@@ -349,7 +889,111 @@ func (s *AuthService) CreateVerificationToken(ctx context.Context, userID *uuid.
 	return &verificationToken, token, nil
 }
 
-// ValidateVerificationToken validates a verification token
+// sendVerificationToken creates a token for the purpose and sends it to sentTo. Only the
+// newest token sent to an address works. Returns ErrTooManyAttempts when the purpose's
+// tokenPolicy allows no more tokens to sentTo for now.
+func (s *AuthService) sendVerificationToken(ctx context.Context, userID uuid.UUID, purpose models.TokenPurpose, sentTo string) error {
+	policy := tokenPolicies[purpose]
+
+	allowed, err := takeSend(ctx, purpose, sentTo, policy)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return ErrTooManyAttempts
+	}
+
+	now := time.Now()
+	err = database.DB.WithContext(ctx).Model(&models.VerificationToken{}).
+		Where("purpose = ? AND sent_to = ? AND consumed_at IS NULL", purpose, sentTo).
+		Update("consumed_at", &now).Error
+	if err != nil {
+		return err
+	}
+
+	_, token, err := s.CreateVerificationToken(ctx, &userID, purpose, sentTo, policy.lifetime)
+	if err != nil {
+		return fmt.Errorf("failed to create %s token: %w", purpose, err)
+	}
+	if err := s.sender.SendVerification(ctx, purpose, sentTo, token); err != nil {
+		return fmt.Errorf("failed to send %s token: %w", purpose, err)
+	}
+	return nil
+}
+
+// takeSend counts a send of a token of the purpose to an address in one upsert, unless the
+// policy's sends in the window were used up or the last send was less than resendAfter ago.
+// A window that has passed starts over.
+func takeSend(ctx context.Context, purpose models.TokenPurpose, sentTo string, policy tokenPolicy) (bool, error) {
+	now := time.Now()
+	expired := now.Add(-policy.window)
+	var counts []int
+	err := database.DB.WithContext(ctx).Raw(`
+		INSERT INTO verification_sends (purpose, sent_to, count, window_start, last_sent_at) VALUES (?, ?, 1, ?, ?)
+		ON CONFLICT (purpose, sent_to) DO UPDATE SET
+			count = CASE WHEN verification_sends.window_start <= ? THEN 1 ELSE verification_sends.count + 1 END,
+			window_start = CASE WHEN verification_sends.window_start <= ? THEN EXCLUDED.window_start ELSE verification_sends.window_start END,
+			last_sent_at = EXCLUDED.last_sent_at
+		WHERE (verification_sends.window_start <= ? OR verification_sends.count < ?)
+			AND verification_sends.last_sent_at <= ?
+		RETURNING count`,
+		purpose, sentTo, now, now, expired, expired, expired, policy.maxSends, now.Add(-policy.resendAfter)).Scan(&counts).Error
+	if err != nil {
+		return false, err
+	}
+	return len(counts) > 0, nil
+}
+
+// CheckOTP checks a one-time code against the newest code of the purpose sent to a phone
+// number, and uses it up when it matches. Every check counts as an attempt, so after
+// maxVerificationAttempts wrong codes a new one has to be sent. The token is returned along
+// with ErrInvalidVerificationToken for wrong codes, so callers can audit the failure.
+func (s *AuthService) CheckOTP(ctx context.Context, purpose models.TokenPurpose, sentTo, code string) (*models.VerificationToken, error) {
+	var verificationToken models.VerificationToken
+	err := database.DB.WithContext(ctx).
+		Where("purpose = ? AND sent_to = ? AND consumed_at IS NULL AND expires_at > ?", purpose, sentTo, time.Now()).
+		Order("created_at DESC").
+		First(&verificationToken).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidVerificationToken
+		}
+		return nil, err
+	}
+
+	// Counting the attempt and checking the limit in one statement keeps concurrent guesses
+	// within it
+	result := database.DB.WithContext(ctx).Model(&models.VerificationToken{}).
+		Where("id = ? AND attempt_count < ?", verificationToken.ID, maxVerificationAttempts).
+		UpdateColumn("attempt_count", gorm.Expr("attempt_count + 1"))
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrTooManyAttempts
+	}
+	verificationToken.AttemptCount++
+
+	if subtle.ConstantTimeCompare([]byte(s.hashToken(code)), []byte(verificationToken.TokenHash)) != 1 {
+		return &verificationToken, ErrInvalidVerificationToken
+	}
+	if err := s.ConsumeVerificationToken(ctx, verificationToken.ID); err != nil {
+		return nil, err
+	}
+	return &verificationToken, nil
+}
+
+// generateOTP returns a random 6-digit code
+func generateOTP() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// ValidateVerificationToken checks a verification token and counts the attempt. Tokens that
+// were checked maxVerificationAttempts times stop working.
 func (s *AuthService) ValidateVerificationToken(ctx context.Context, token string, purpose models.TokenPurpose) (*models.VerificationToken, error) {
 	tokenHash := s.hashToken(token)
 
@@ -357,27 +1001,42 @@ func (s *AuthService) ValidateVerificationToken(ctx context.Context, token strin
 	err := database.DB.Where("token_hash = ? AND purpose = ?", tokenHash, purpose).First(&verificationToken).Error
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, errors.New("invalid token")
+			return nil, ErrInvalidVerificationToken
 		}
 		return nil, err
 	}
 
 	// Check if token is valid
 	if !verificationToken.IsValid() {
-		return nil, errors.New("token expired or already used")
+		return nil, ErrInvalidVerificationToken
+	}
+	if verificationToken.AttemptCount >= maxVerificationAttempts {
+		return nil, ErrTooManyAttempts
 	}
 
 	// Increment attempt count
+	err = database.DB.Model(&verificationToken).
+		UpdateColumn("attempt_count", gorm.Expr("attempt_count + 1")).Error
+	if err != nil {
+		return nil, err
+	}
 	verificationToken.AttemptCount++
-	database.DB.Save(&verificationToken)
 
 	return &verificationToken, nil
 }
 
-// ConsumeVerificationToken marks a verification token as consumed
+// ConsumeVerificationToken marks a verification token as consumed. Only the first of
+// concurrent calls succeeds; the others get ErrInvalidVerificationToken.
 func (s *AuthService) ConsumeVerificationToken(ctx context.Context, tokenID uuid.UUID) error {
 	now := time.Now()
-	return database.DB.Model(&models.VerificationToken{}).
-		Where("id = ?", tokenID).
-		Update("consumed_at", &now).Error
+	result := database.DB.Model(&models.VerificationToken{}).
+		Where("id = ? AND consumed_at IS NULL", tokenID).
+		Update("consumed_at", &now)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidVerificationToken
+	}
+	return nil
 }
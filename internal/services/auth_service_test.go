@@ -0,0 +1,215 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"borderless_coding_server/internal/models"
+
+	"github.com/google/uuid"
+)
+
+func newTestAuthService(store CredentialStore) *AuthService {
+	return NewAuthService("", "", "", nil, store, NewPasswordHasher(testArgon2Params), nil, nil)
+}
+
+func TestRegisterAndLoginWithPassword(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryCredentialStore()
+	s := newTestAuthService(store)
+
+	user, err := s.RegisterWithPassword(ctx, "ada@example.com", nil, PasswordDigest("correct horse"), "test", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("RegisterWithPassword: %v", err)
+	}
+	if cred := store.credential(user.ID); !strings.HasPrefix(*cred.PasswordHash, "$argon2id$") || cred.Salt != nil {
+		t.Errorf("stored hash %q is not an Argon2id hash", *cred.PasswordHash)
+	}
+	if _, err := s.RegisterWithPassword(ctx, "ADA@example.com", nil, PasswordDigest("other"), "test", "127.0.0.1"); !errors.Is(err, ErrEmailTaken) {
+		t.Errorf("registering a taken email: err = %v, want ErrEmailTaken", err)
+	}
+
+	loggedIn, session, refreshToken, err := s.LoginWithPassword(ctx, "ada@example.com", PasswordDigest("correct horse"), "test", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("LoginWithPassword: %v", err)
+	}
+	if loggedIn.ID != user.ID || session.UserID != user.ID {
+		t.Errorf("logged in as %s with a session of %s, want %s", loggedIn.ID, session.UserID, user.ID)
+	}
+	sum := sha256.Sum256([]byte(refreshToken))
+	if refreshToken == "" || session.RefreshTokenHash != hex.EncodeToString(sum[:]) {
+		t.Error("session does not store the hash of the refresh token")
+	}
+
+	for _, tt := range []struct{ email, password string }{
+		{"ada@example.com", "wrong horse"},
+		{"nobody@example.com", "correct horse"},
+	} {
+		if _, _, _, err := s.LoginWithPassword(ctx, tt.email, PasswordDigest(tt.password), "test", "127.0.0.1"); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("LoginWithPassword(%s, %s): err = %v, want ErrInvalidCredentials", tt.email, tt.password, err)
+		}
+	}
+}
+
+func TestLoginWithPasswordUpgradesLegacyHash(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryCredentialStore()
+	s := newTestAuthService(store)
+
+	email, salt := "grace@example.com", "legacy-salt"
+	sum := sha256.Sum256(append([]byte(salt), PasswordDigest("hunter2")...))
+	legacy := hex.EncodeToString(sum[:])
+	user := &models.User{Email: &email, IsActive: true}
+	if err := store.CreateUser(ctx, user, &models.UserCredential{PasswordHash: &legacy, Salt: &salt}); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+
+	if _, _, _, err := s.LoginWithPassword(ctx, email, PasswordDigest("hunter2"), "test", "127.0.0.1"); err != nil {
+		t.Fatalf("LoginWithPassword with a legacy hash: %v", err)
+	}
+	cred := store.credential(user.ID)
+	if !strings.HasPrefix(*cred.PasswordHash, "$argon2id$") || cred.Salt != nil {
+		t.Fatalf("legacy hash was not upgraded: %q", *cred.PasswordHash)
+	}
+	if _, _, _, err := s.LoginWithPassword(ctx, email, PasswordDigest("hunter2"), "test", "127.0.0.1"); err != nil {
+		t.Errorf("LoginWithPassword after the upgrade: %v", err)
+	}
+}
+
+func TestLoginWithPasswordRejectsDisabledAccount(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryCredentialStore()
+	s := newTestAuthService(store)
+
+	user, err := s.RegisterWithPassword(ctx, "linus@example.com", nil, PasswordDigest("penguin"), "test", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("RegisterWithPassword: %v", err)
+	}
+	store.mu.Lock()
+	store.users[user.ID].IsActive = false
+	store.mu.Unlock()
+
+	if _, _, _, err := s.LoginWithPassword(ctx, "linus@example.com", PasswordDigest("penguin"), "test", "127.0.0.1"); !errors.Is(err, ErrAccountDisabled) {
+		t.Errorf("err = %v, want ErrAccountDisabled", err)
+	}
+	if _, _, _, err := s.LoginWithPassword(ctx, "linus@example.com", PasswordDigest("wrong"), "test", "127.0.0.1"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("wrong password for a disabled account: err = %v, want ErrInvalidCredentials", err)
+	}
+}
+
+func TestChangePasswordChecksCurrentPassword(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryCredentialStore()
+	s := newTestAuthService(store)
+
+	user, err := s.RegisterWithPassword(ctx, "margaret@example.com", nil, PasswordDigest("apollo"), "test", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("RegisterWithPassword: %v", err)
+	}
+	if err := s.ChangePassword(ctx, user.ID, uuid.New(), PasswordDigest("gemini"), PasswordDigest("artemis"), "test", "127.0.0.1"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("wrong current password: err = %v, want ErrInvalidCredentials", err)
+	}
+
+	// Too many recent failures lock the change out, even with the right password
+	for i := 1; i < maxPasswordChangeFailures; i++ {
+		if err := s.ChangePassword(ctx, user.ID, uuid.New(), PasswordDigest("gemini"), PasswordDigest("artemis"), "test", "127.0.0.1"); !errors.Is(err, ErrInvalidCredentials) {
+			t.Fatalf("failure %d: err = %v, want ErrInvalidCredentials", i+1, err)
+		}
+	}
+	if err := s.ChangePassword(ctx, user.ID, uuid.New(), PasswordDigest("apollo"), PasswordDigest("artemis"), "test", "127.0.0.1"); !errors.Is(err, ErrTooManyAttempts) {
+		t.Errorf("after %d failures: err = %v, want ErrTooManyAttempts", maxPasswordChangeFailures, err)
+	}
+
+	email := "katherine@example.com"
+	social := &models.User{Email: &email, IsActive: true}
+	if err := store.CreateUser(ctx, social, &models.UserCredential{}); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	if err := s.ChangePassword(ctx, social.ID, uuid.New(), PasswordDigest(""), PasswordDigest("artemis"), "test", "127.0.0.1"); !errors.Is(err, ErrNoPassword) {
+		t.Errorf("account without a password: err = %v, want ErrNoPassword", err)
+	}
+}
+
+func TestRotateRefreshToken(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryCredentialStore()
+	s := newTestAuthService(store)
+
+	user, err := s.RegisterWithPassword(ctx, "barbara@example.com", nil, PasswordDigest("clu"), "test", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("RegisterWithPassword: %v", err)
+	}
+	_, first, firstToken, err := s.LoginWithPassword(ctx, "barbara@example.com", PasswordDigest("clu"), "test", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("LoginWithPassword: %v", err)
+	}
+
+	rotated, second, secondToken, err := s.RotateRefreshToken(ctx, firstToken, "test", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("RotateRefreshToken: %v", err)
+	}
+	if rotated.ID != user.ID || secondToken == firstToken {
+		t.Fatalf("rotated to user %s with the same token: %v", rotated.ID, secondToken == firstToken)
+	}
+	if second.FamilyID != first.FamilyID || second.ParentID == nil || *second.ParentID != first.ID || !second.ValidUntil.Equal(first.ValidUntil) {
+		t.Errorf("new session is not a child of the first in its family: %+v", second)
+	}
+	if stored := store.session(first.ID); stored.RotatedAt == nil || stored.RevokedAt != nil {
+		t.Errorf("first session is not marked rotated: %+v", stored)
+	}
+	if _, _, thirdToken, err := s.RotateRefreshToken(ctx, secondToken, "test", "127.0.0.1"); err != nil {
+		t.Fatalf("rotating the new token: %v", err)
+	} else {
+		secondToken = thirdToken
+	}
+
+	// Replaying a rotated token revokes the whole family
+	if _, _, _, err := s.RotateRefreshToken(ctx, firstToken, "attacker", "10.0.0.1"); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("reusing a rotated token: err = %v, want ErrRefreshTokenReused", err)
+	}
+	for _, session := range store.family(first.FamilyID) {
+		if session.RevokedAt == nil {
+			t.Errorf("session %s of the family was not revoked", session.ID)
+		}
+	}
+	if _, _, _, err := s.RotateRefreshToken(ctx, secondToken, "test", "127.0.0.1"); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("latest token after reuse: err = %v, want ErrInvalidRefreshToken", err)
+	}
+	if _, _, _, err := s.RotateRefreshToken(ctx, firstToken, "attacker", "10.0.0.1"); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("reused token of a revoked family: err = %v, want ErrInvalidRefreshToken", err)
+	}
+
+	audit := store.awaitEvent(t, "refresh_reuse_detected")
+	if *audit.UserID != user.ID || audit.Details["session_id"] != first.ID.String() || audit.Details["family_id"] != first.FamilyID.String() {
+		t.Errorf("audit does not name the reused session and its family: %+v", audit)
+	}
+}
+
+func TestRotateRefreshTokenRejectsDisabledAccount(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryCredentialStore()
+	s := newTestAuthService(store)
+
+	user, err := s.RegisterWithPassword(ctx, "hedy@example.com", nil, PasswordDigest("torpedo"), "test", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("RegisterWithPassword: %v", err)
+	}
+	_, session, refreshToken, err := s.LoginWithPassword(ctx, "hedy@example.com", PasswordDigest("torpedo"), "test", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("LoginWithPassword: %v", err)
+	}
+	store.mu.Lock()
+	store.users[user.ID].IsActive = false
+	store.mu.Unlock()
+
+	if _, _, _, err := s.RotateRefreshToken(ctx, refreshToken, "test", "127.0.0.1"); !errors.Is(err, ErrAccountDisabled) {
+		t.Errorf("err = %v, want ErrAccountDisabled", err)
+	}
+	if stored := store.session(session.ID); stored.RotatedAt != nil {
+		t.Error("session of a disabled account was rotated")
+	}
+}
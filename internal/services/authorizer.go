@@ -0,0 +1,169 @@
+package services
+
+import (
+	"borderless_coding_server/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// Action is an operation a subject wants to perform on a resource
+type Action string
+
+const (
+	ActionRead   Action = "read"
+	ActionWrite  Action = "write"
+	ActionManage Action = "manage"
+	ActionDelete Action = "delete"
+)
+
+// ResourceKind identifies which policy applies to a resource
+type ResourceKind string
+
+const (
+	// ResourceSystem covers server-wide settings such as templates, storage quotas and roles
+	ResourceSystem ResourceKind = "system"
+	// ResourceUser is a user account
+	ResourceUser ResourceKind = "user"
+	// ResourceProject is a project and everything scoped to it: files, chats, builds, previews
+	ResourceProject ResourceKind = "project"
+	// ResourceProjectMember is a membership or invitation on a project
+	ResourceProjectMember ResourceKind = "project_member"
+)
+
+// projectActionRoles maps actions on project resources to the minimum project role
+var projectActionRoles = map[Action]models.ProjectRole{
+	ActionRead:   models.ProjectRoleViewer,
+	ActionWrite:  models.ProjectRoleEditor,
+	ActionManage: models.ProjectRoleAdmin,
+	ActionDelete: models.ProjectRoleOwner,
+}
+
+// Subject is the authenticated user an authorization decision is made for
+type Subject struct {
+	UserID      uuid.UUID
+	Roles       []string
+	Permissions []string
+}
+
+// HasRole reports whether the subject has any of the given user roles
+func (s Subject) HasRole(roles ...string) bool {
+	for _, role := range roles {
+		for _, userRole := range s.Roles {
+			if userRole == role {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// HasPermission reports whether the subject has any of the given permissions
+func (s Subject) HasPermission(permissions ...string) bool {
+	for _, permission := range permissions {
+		for _, granted := range s.Permissions {
+			if granted == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsAdmin reports whether the subject is a site administrator
+func (s Subject) IsAdmin() bool {
+	return s.HasRole(models.RoleAdmin)
+}
+
+// Resource describes the target of an action, with the facts the policies need about it
+type Resource struct {
+	Kind ResourceKind
+	// Permission is the permission required on a system resource
+	Permission string
+	// OwnerID is the user a user resource or project membership belongs to
+	OwnerID uuid.UUID
+	// Role is the subject's role on the project of a project-scoped resource ("" for none)
+	Role models.ProjectRole
+	// TargetRole is the role held or granted by a project membership
+	TargetRole models.ProjectRole
+}
+
+// SystemResource returns the server-wide resource guarded by permission
+func SystemResource(permission string) Resource {
+	return Resource{Kind: ResourceSystem, Permission: permission}
+}
+
+// UserResource returns the resource for the account of userID
+func UserResource(userID uuid.UUID) Resource {
+	return Resource{Kind: ResourceUser, OwnerID: userID}
+}
+
+// ProjectResource returns the resource for a project the subject has role on
+func ProjectResource(role models.ProjectRole) Resource {
+	return Resource{Kind: ResourceProject, Role: role}
+}
+
+// ProjectMemberResource returns the resource for the membership of memberID holding or being
+// granted targetRole, on a project the subject has role on
+func ProjectMemberResource(role models.ProjectRole, memberID uuid.UUID, targetRole models.ProjectRole) Resource {
+	return Resource{Kind: ResourceProjectMember, Role: role, OwnerID: memberID, TargetRole: targetRole}
+}
+
+// Authorizer decides whether a subject may perform an action on a resource. Decisions are
+// pure: callers resolve the facts (ownership, project role) and pass them in the Resource.
+type Authorizer struct{}
+
+func NewAuthorizer() *Authorizer {
+	return &Authorizer{}
+}
+
+// Can reports whether subject may perform action on resource. Site admins may do anything;
+// other users need the permission guarding system resources and other users' accounts.
+func (a *Authorizer) Can(subject Subject, action Action, resource Resource) bool {
+	if subject.UserID == uuid.Nil {
+		return false
+	}
+	if subject.IsAdmin() {
+		return true
+	}
+
+	switch resource.Kind {
+	case ResourceSystem:
+		return resource.Permission != "" && subject.HasPermission(resource.Permission)
+
+	case ResourceUser:
+		// Activating and deactivating accounts is reserved to user managers
+		if action != ActionManage && resource.OwnerID == subject.UserID {
+			return true
+		}
+		if action == ActionRead {
+			return subject.HasPermission(models.PermissionUsersRead, models.PermissionUsersManage)
+		}
+		return subject.HasPermission(models.PermissionUsersManage)
+
+	case ResourceProject:
+		if subject.HasPermission(models.PermissionProjectsAdmin) {
+			return true
+		}
+		required, ok := projectActionRoles[action]
+		return ok && resource.Role.Allows(required)
+
+	case ResourceProjectMember:
+		if subject.HasPermission(models.PermissionProjectsAdmin) {
+			return true
+		}
+		if action == ActionRead {
+			return resource.Role.Allows(models.ProjectRoleViewer)
+		}
+		// Members can leave a project or decline an invitation
+		if action == ActionDelete && resource.OwnerID == subject.UserID {
+			return true
+		}
+		if !resource.Role.Allows(models.ProjectRoleAdmin) {
+			return false
+		}
+		// Only the owner can grant, change or revoke the admin role
+		return resource.TargetRole != models.ProjectRoleAdmin || resource.Role == models.ProjectRoleOwner
+	}
+
+	return false
+}
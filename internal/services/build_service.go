@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -25,7 +26,7 @@ import (
 type BuildService struct {
 	claudeCLIPath string
 	logger        *logrus.Logger
-	activeBuilds  map[uuid.UUID]*exec.Cmd
+	activeBuilds  map[uuid.UUID]context.CancelFunc
 	buildMutex    sync.RWMutex
 }
 
@@ -58,7 +59,7 @@ func NewBuildService(claudeCLIPath string, logger *logrus.Logger) *BuildService
 	return &BuildService{
 		claudeCLIPath: claudeCLIPath,
 		logger:        logger,
-		activeBuilds:  make(map[uuid.UUID]*exec.Cmd),
+		activeBuilds:  make(map[uuid.UUID]context.CancelFunc),
 	}
 }
 
@@ -115,7 +116,9 @@ func (s *BuildService) executeBuild(ctx context.Context, build *models.Build) {
 	cmdName := parts[0]
 	cmdArgs := parts[1:]
 
-	// Create command
+	// Create command; cancelling the build kills the process
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	cmd := exec.CommandContext(ctx, cmdName, cmdArgs...)
 	cmd.Dir = build.WorkingDir
 
@@ -127,9 +130,8 @@ func (s *BuildService) executeBuild(ctx context.Context, build *models.Build) {
 	)
 
 	// Store active build
-	s.buildMutex.Lock()
-	s.activeBuilds[build.ID] = cmd
-	s.buildMutex.Unlock()
+	s.track(build.ID, cancel)
+	defer s.untrack(build.ID)
 
 	// Create pipes for stdout and stderr
 	stdout, err := cmd.StdoutPipe()
@@ -189,17 +191,15 @@ func (s *BuildService) executeBuild(ctx context.Context, build *models.Build) {
 	wg.Wait()
 	err = cmd.Wait()
 
-	// Remove from active builds
-	s.buildMutex.Lock()
-	delete(s.activeBuilds, build.ID)
-	s.buildMutex.Unlock()
-
 	// Update build status
 	completedAt := time.Now()
 	build.CompletedAt = &completedAt
 	build.Output = outputBuffer.String()
 
-	if err != nil {
+	if ctx.Err() != nil {
+		// Cancelled via CancelBuild
+		build.Status = models.BuildStatusCancelled
+	} else if err != nil {
 		// Command failed
 		exitCode := 1
 		if exitError, ok := err.(*exec.ExitError); ok {
@@ -236,37 +236,37 @@ func (s *BuildService) failBuild(build *models.Build, errorMsg string) {
 	s.logBuildEvent(build.ID, "error", errorMsg, nil)
 }
 
-// CancelBuild cancels a running build
+// CancelBuild cancels a running build. The build's runner kills its process and records
+// the cancelled status.
 func (s *BuildService) CancelBuild(buildID uuid.UUID) error {
-	s.buildMutex.Lock()
-	cmd, exists := s.activeBuilds[buildID]
-	s.buildMutex.Unlock()
+	s.buildMutex.RLock()
+	cancel, exists := s.activeBuilds[buildID]
+	s.buildMutex.RUnlock()
 
 	if !exists {
 		return fmt.Errorf("build not found or not running")
 	}
 
-	// Kill the process
-	if err := cmd.Process.Kill(); err != nil {
-		return fmt.Errorf("failed to kill process: %w", err)
-	}
-
-	// Update build status
-	var build models.Build
-	if err := database.DB.Where("id = ?", buildID).First(&build).Error; err != nil {
-		return err
-	}
-
-	now := time.Now()
-	build.Status = models.BuildStatusCancelled
-	build.CompletedAt = &now
-	database.DB.Save(&build)
-
 	s.logBuildEvent(buildID, "warn", "Build cancelled by user", nil)
+	cancel()
 
 	return nil
 }
 
+// track registers a running build so it can be cancelled
+func (s *BuildService) track(buildID uuid.UUID, cancel context.CancelFunc) {
+	s.buildMutex.Lock()
+	s.activeBuilds[buildID] = cancel
+	s.buildMutex.Unlock()
+}
+
+// untrack removes a finished build from the running builds
+func (s *BuildService) untrack(buildID uuid.UUID) {
+	s.buildMutex.Lock()
+	delete(s.activeBuilds, buildID)
+	s.buildMutex.Unlock()
+}
+
 // GetBuild retrieves a build by ID
 func (s *BuildService) GetBuild(buildID uuid.UUID) (*models.Build, error) {
 	var build models.Build
@@ -398,7 +398,9 @@ func (s *BuildService) executeClaudeCLI(ctx context.Context, build *models.Build
 		"working_dir": build.WorkingDir,
 	}).Info("Spawning Claude CLI")
 
-	// Create command
+	// Create command; cancelling the build kills the process
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	cmd := exec.CommandContext(ctx, claudePath, args...)
 	cmd.Dir = build.WorkingDir
 
@@ -410,9 +412,8 @@ func (s *BuildService) executeClaudeCLI(ctx context.Context, build *models.Build
 	)
 
 	// Store active build
-	s.buildMutex.Lock()
-	s.activeBuilds[build.ID] = cmd
-	s.buildMutex.Unlock()
+	s.track(build.ID, cancel)
+	defer s.untrack(build.ID)
 
 	// Create pipes for stdout and stderr
 	stdout, err := cmd.StdoutPipe()
@@ -486,17 +487,15 @@ func (s *BuildService) executeClaudeCLI(ctx context.Context, build *models.Build
 	wg.Wait()
 	err = cmd.Wait()
 
-	// Remove from active builds
-	s.buildMutex.Lock()
-	delete(s.activeBuilds, build.ID)
-	s.buildMutex.Unlock()
-
 	// Update build status
 	completedAt := time.Now()
 	build.CompletedAt = &completedAt
 	build.Output = outputBuffer.String()
 
-	if err != nil {
+	if ctx.Err() != nil {
+		// Cancelled via CancelBuild
+		build.Status = models.BuildStatusCancelled
+	} else if err != nil {
 		// Command failed
 		exitCode := 1
 		if exitError, ok := err.(*exec.ExitError); ok {
@@ -653,3 +652,164 @@ func (s *BuildService) getMCPConfigPath() string {
 
 	return configPath
 }
+
+// BuildTask is a build whose steps are driven by Go code instead of a single command. Steps
+// run through Run so their output ends up in the build logs, and stop when the build is cancelled.
+type BuildTask struct {
+	Build   *models.Build
+	ctx     context.Context
+	service *BuildService
+	output  bytes.Buffer
+	mu      sync.Mutex
+}
+
+// StartTask creates a build record and runs fn in the background as that build. The build
+// completes when fn returns nil, fails when it returns an error and is cancelled by CancelBuild.
+func (s *BuildService) StartTask(userID, projectID uuid.UUID, command, workingDir string, metadata models.JSONB, fn func(task *BuildTask) error) (*models.Build, error) {
+	if metadata == nil {
+		metadata = make(models.JSONB)
+	}
+	build := &models.Build{
+		UserID:     userID,
+		ProjectID:  projectID,
+		Command:    command,
+		WorkingDir: workingDir,
+		Status:     models.BuildStatusPending,
+		Metadata:   metadata,
+	}
+
+	if err := database.DB.Create(build).Error; err != nil {
+		return nil, fmt.Errorf("failed to create build record: %w", err)
+	}
+
+	// The task outlives the request that started it
+	ctx, cancel := context.WithCancel(context.Background())
+	s.track(build.ID, cancel)
+
+	snapshot := *build
+	go s.executeTask(ctx, cancel, &BuildTask{Build: build, ctx: ctx, service: s}, fn)
+
+	return &snapshot, nil
+}
+
+// executeTask runs a task and records its outcome
+func (s *BuildService) executeTask(ctx context.Context, cancel context.CancelFunc, task *BuildTask, fn func(task *BuildTask) error) {
+	defer cancel()
+	defer s.untrack(task.Build.ID)
+
+	build := task.Build
+	now := time.Now()
+	build.Status = models.BuildStatusRunning
+	build.StartedAt = &now
+	database.DB.Save(build)
+
+	task.Log("info", "Build started")
+
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("build panicked: %v", r)
+			}
+		}()
+		return fn(task)
+	}()
+
+	completedAt := time.Now()
+	build.CompletedAt = &completedAt
+	task.mu.Lock()
+	build.Output = task.output.String()
+	task.mu.Unlock()
+
+	switch {
+	case ctx.Err() != nil:
+		build.Status = models.BuildStatusCancelled
+	case err != nil:
+		exitCode := 1
+		if exitError, ok := errors.Unwrap(err).(*exec.ExitError); ok {
+			exitCode = exitError.ExitCode()
+		}
+		build.Status = models.BuildStatusFailed
+		build.ExitCode = &exitCode
+		errorMsg := err.Error()
+		build.Error = &errorMsg
+		task.Log("error", fmt.Sprintf("Build failed: %v", err))
+	default:
+		exitCode := 0
+		build.Status = models.BuildStatusCompleted
+		build.ExitCode = &exitCode
+		task.Log("info", "Build completed successfully")
+	}
+
+	database.DB.Save(build)
+}
+
+// Context is cancelled when the build is cancelled
+func (t *BuildTask) Context() context.Context {
+	return t.ctx
+}
+
+// Log appends a line to the build logs
+func (t *BuildTask) Log(level, message string) {
+	t.service.logBuildEvent(t.Build.ID, level, message, nil)
+}
+
+// Run runs a command in dir, streaming its output to the build logs
+func (t *BuildTask) Run(dir, command string) error {
+	return t.RunEnv(dir, command, nil)
+}
+
+// RunEnv is Run with extra environment variables in "KEY=value" form
+func (t *BuildTask) RunEnv(dir, command string, env []string) error {
+	parts := strings.Fields(command)
+	if len(parts) == 0 {
+		return nil
+	}
+	if err := t.ctx.Err(); err != nil {
+		return err
+	}
+
+	t.Log("info", fmt.Sprintf("$ %s", command))
+	cmd := exec.CommandContext(t.ctx, parts[0], parts[1:]...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("USER_ID=%s", t.Build.UserID.String()),
+		fmt.Sprintf("PROJECT_ID=%s", t.Build.ProjectID.String()),
+		fmt.Sprintf("WORKING_DIR=%s", dir),
+	)
+	cmd.Env = append(cmd.Env, env...)
+	killProcessGroup(cmd)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create stdout pipe: %w", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create stderr pipe: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %w", parts[0], err)
+	}
+
+	var wg sync.WaitGroup
+	stream := func(r io.Reader, level string) {
+		defer wg.Done()
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			line := scanner.Text()
+			t.mu.Lock()
+			t.output.WriteString(line + "\n")
+			t.mu.Unlock()
+			t.Log(level, line)
+		}
+	}
+	wg.Add(2)
+	go stream(stdout, "info")
+	go stream(stderr, "error")
+	wg.Wait()
+
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("%s failed: %w", command, err)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"borderless_coding_server/internal/models"
+	"borderless_coding_server/pkg/database"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrAccountNotFound is returned by a CredentialStore for unknown users and credentials
+var ErrAccountNotFound = errors.New("account not found")
+
+// CredentialStore persists the accounts, password credentials, linked identities, second
+// factors, sessions and audit entries the login flows work with
+type CredentialStore interface {
+	MFAStore
+	IdentityStore
+
+	// GetUser returns the user that is not deleted with the ID
+	GetUser(ctx context.Context, userID uuid.UUID) (*models.User, error)
+	FindUserByEmail(ctx context.Context, email string) (*models.User, error)
+	GetCredential(ctx context.Context, userID uuid.UUID) (*models.UserCredential, error)
+	// CreateUser creates the user and its credential together
+	CreateUser(ctx context.Context, user *models.User, cred *models.UserCredential) error
+	UpdatePasswordHash(ctx context.Context, userID uuid.UUID, passwordHash string) error
+	// SetPassword sets a new password, creating the credential if the user has none
+	SetPassword(ctx context.Context, userID uuid.UUID, passwordHash string) error
+	CreateSession(ctx context.Context, session *models.Session) error
+	// RotateSession exchanges the session with the refresh token hash for next, which joins its
+	// family and keeps its expiry, and returns the session's user. A session that was rotated
+	// already has its family revoked and a *RefreshTokenReuseError is returned.
+	RotateSession(ctx context.Context, tokenHash string, next *models.Session) (*models.User, error)
+	RecordAuthEvent(ctx context.Context, audit *models.AuthAudit) error
+	// TakeAttempt counts an attempt at the action unless the user made limit attempts in the
+	// current window, in which case it returns false. The check and count are atomic.
+	TakeAttempt(ctx context.Context, userID uuid.UUID, action string, limit int, window time.Duration) (bool, error)
+	// ResetAttempts forgets the user's attempts at the action
+	ResetAttempts(ctx context.Context, userID uuid.UUID, action string) error
+}
+
+// CredentialVerifier hashes password digests and checks them against stored credentials
+type CredentialVerifier interface {
+	Hash(digest []byte) (string, error)
+	Verify(digest []byte, cred *models.UserCredential) (ok, needsRehash bool, err error)
+}
+
+// DBCredentialStore is the CredentialStore backed by the database
+type DBCredentialStore struct{}
+
+func NewDBCredentialStore() *DBCredentialStore {
+	return &DBCredentialStore{}
+}
+
+// GetUser returns the user that is not deleted with the ID
+func (s *DBCredentialStore) GetUser(ctx context.Context, userID uuid.UUID) (*models.User, error) {
+	var user models.User
+	err := database.DB.WithContext(ctx).Where("id = ? AND deleted_at IS NULL", userID).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrAccountNotFound
+	}
+	return &user, err
+}
+
+// FindUserByEmail returns the user that is not deleted with the email
+func (s *DBCredentialStore) FindUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	var user models.User
+	err := database.DB.WithContext(ctx).Where("email = ? AND deleted_at IS NULL", email).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrAccountNotFound
+	}
+	return &user, err
+}
+
+// GetCredential returns the user's password credential
+func (s *DBCredentialStore) GetCredential(ctx context.Context, userID uuid.UUID) (*models.UserCredential, error) {
+	var cred models.UserCredential
+	err := database.DB.WithContext(ctx).Where("user_id = ?", userID).First(&cred).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrAccountNotFound
+	}
+	return &cred, err
+}
+
+// CreateUser creates the user and its credential in one transaction
+func (s *DBCredentialStore) CreateUser(ctx context.Context, user *models.User, cred *models.UserCredential) error {
+	return database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(user).Error; err != nil {
+			return err
+		}
+		cred.UserID = user.ID
+		return tx.Create(cred).Error
+	})
+}
+
+// UpdatePasswordHash replaces the user's password hash, dropping the salt of legacy hashes
+func (s *DBCredentialStore) UpdatePasswordHash(ctx context.Context, userID uuid.UUID, passwordHash string) error {
+	return database.DB.WithContext(ctx).Model(&models.UserCredential{}).
+		Where("user_id = ?", userID).
+		Updates(map[string]interface{}{"password_hash": passwordHash, "salt": nil}).Error
+}
+
+// SetPassword stores a new password hash and when it was set, creating the credential of
+// users who have only signed in with other providers
+func (s *DBCredentialStore) SetPassword(ctx context.Context, userID uuid.UUID, passwordHash string) error {
+	now := time.Now()
+	cred := models.UserCredential{UserID: userID, PasswordHash: &passwordHash, PasswordSetAt: &now}
+	return database.DB.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"password_hash": passwordHash, "salt": nil, "password_set_at": now}),
+	}).Create(&cred).Error
+}
+
+// CreateSession stores a new session
+func (s *DBCredentialStore) CreateSession(ctx context.Context, session *models.Session) error {
+	return database.DB.WithContext(ctx).Create(session).Error
+}
+
+// RotateSession marks the session rotated and stores next in its place. The session row is
+// locked so concurrent refreshes with the same token are serialized.
+func (s *DBCredentialStore) RotateSession(ctx context.Context, tokenHash string, next *models.Session) (*models.User, error) {
+	var (
+		user  models.User
+		reuse *RefreshTokenReuseError
+	)
+	err := database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var current models.Session
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("refresh_token_hash = ?", tokenHash).
+			First(&current).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrInvalidRefreshToken
+			}
+			return err
+		}
+
+		if current.IsRotated() {
+			if current.RevokedAt != nil {
+				return ErrInvalidRefreshToken
+			}
+			revoked, err := revokeSessionFamily(tx, current.FamilyID)
+			if err != nil {
+				return err
+			}
+			// Commit the revocation; the reuse is reported afterwards
+			reuse = &RefreshTokenReuseError{Session: current, Revoked: revoked}
+			return nil
+		}
+		if !current.IsValid() {
+			return ErrInvalidRefreshToken
+		}
+
+		if err := tx.Where("id = ? AND deleted_at IS NULL", current.UserID).First(&user).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrInvalidRefreshToken
+			}
+			return err
+		}
+		if !user.IsActive {
+			return ErrAccountDisabled
+		}
+
+		now := time.Now()
+		if err := tx.Model(&current).Update("rotated_at", &now).Error; err != nil {
+			return err
+		}
+		parentID := current.ID
+		next.UserID = current.UserID
+		next.FamilyID = current.FamilyID
+		next.ParentID = &parentID
+		next.ValidUntil = current.ValidUntil
+		return tx.Create(next).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reuse != nil {
+		return nil, reuse
+	}
+	return &user, nil
+}
+
+// RecordAuthEvent stores an audit entry
+func (s *DBCredentialStore) RecordAuthEvent(ctx context.Context, audit *models.AuthAudit) error {
+	return database.DB.WithContext(ctx).Create(audit).Error
+}
+
+// TakeAttempt counts the attempt in one upsert. A window that has passed starts over; a full
+// window leaves the row alone, so no count is returned.
+func (s *DBCredentialStore) TakeAttempt(ctx context.Context, userID uuid.UUID, action string, limit int, window time.Duration) (bool, error) {
+	now := time.Now()
+	expired := now.Add(-window)
+	var counts []int
+	err := database.DB.WithContext(ctx).Raw(`
+		INSERT INTO auth_attempts (user_id, action, count, window_start) VALUES (?, ?, 1, ?)
+		ON CONFLICT (user_id, action) DO UPDATE SET
+			count = CASE WHEN auth_attempts.window_start <= ? THEN 1 ELSE auth_attempts.count + 1 END,
+			window_start = CASE WHEN auth_attempts.window_start <= ? THEN EXCLUDED.window_start ELSE auth_attempts.window_start END
+		WHERE auth_attempts.window_start <= ? OR auth_attempts.count < ?
+		RETURNING count`,
+		userID, action, now, expired, expired, expired, limit).Scan(&counts).Error
+	if err != nil {
+		return false, err
+	}
+	return len(counts) > 0, nil
+}
+
+// ResetAttempts deletes the user's attempt count for the action
+func (s *DBCredentialStore) ResetAttempts(ctx context.Context, userID uuid.UUID, action string) error {
+	return database.DB.WithContext(ctx).
+		Where("user_id = ? AND action = ?", userID, action).
+		Delete(&models.AuthAttempt{}).Error
+}
@@ -0,0 +1,407 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"borderless_coding_server/internal/models"
+	"borderless_coding_server/pkg/utils"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// BuildKindDevServer marks live preview dev servers in Build.Metadata["kind"]
+const BuildKindDevServer = "dev_server"
+
+const (
+	// devServerStartTimeout bounds how long a dev server may take to accept connections
+	devServerStartTimeout = 3 * time.Minute
+	// devServerReapInterval is how often idle dev servers are looked for
+	devServerReapInterval = time.Minute
+)
+
+// devServerKeep lists dependency and cache directories a dev server creates in its workspace,
+// kept when the workspace is refreshed from a new snapshot
+var devServerKeep = []string{"node_modules", ".git", ".vite", ".next", ".nuxt", ".svelte-kit", ".cache", ".turbo"}
+
+// ErrDevServerUnsupported is returned when the project template has no dev command
+var ErrDevServerUnsupported = errors.New("the project template has no dev server command")
+
+// DevServerStatus represents the state of a live preview dev server
+type DevServerStatus string
+
+const (
+	DevServerStatusStarting DevServerStatus = "starting"
+	DevServerStatusReady    DevServerStatus = "ready"
+)
+
+// DevServer describes a running live preview dev server
+type DevServer struct {
+	ProjectID    uuid.UUID       `json:"project_id"`
+	BuildID      uuid.UUID       `json:"build_id"`
+	Status       DevServerStatus `json:"status"`
+	URL          string          `json:"url"`
+	StartedAt    time.Time       `json:"started_at"`
+	LastActiveAt time.Time       `json:"last_active_at"`
+}
+
+// devServer is a dev server process with its proxy and workspace
+type devServer struct {
+	DevServer
+
+	port      int
+	workspace *Workspace // set once the snapshot is materialized
+	proxy     *httputil.ReverseProxy
+	requests  int        // proxied requests in flight, including open WebSockets
+	refreshMu sync.Mutex // serializes workspace refreshes
+}
+
+// DevServerService runs a project's template dev server (e.g. `npm run dev`) as a live
+// preview. Each dev server is a background build, so its output ends up in the build logs and
+// DELETE /builds/:id stops it. Requests to the project's preview are reverse-proxied to it,
+// WebSockets included, and servers without requests for idleTimeout are stopped.
+type DevServerService struct {
+	buildService     *BuildService
+	workspaceService *WorkspaceService
+	templateService  *TemplateService
+	idleTimeout      time.Duration
+	logger           *logrus.Logger
+
+	mu      sync.Mutex
+	servers map[uuid.UUID]*devServer // project ID -> dev server
+	reaper  sync.Once
+}
+
+func NewDevServerService(buildService *BuildService, workspaceService *WorkspaceService, templateService *TemplateService, idleTimeout time.Duration, logger *logrus.Logger) *DevServerService {
+	return &DevServerService{
+		buildService:     buildService,
+		workspaceService: workspaceService,
+		templateService:  templateService,
+		idleTimeout:      idleTimeout,
+		logger:           logger,
+		servers:          make(map[uuid.UUID]*devServer),
+	}
+}
+
+// Start starts the dev server of a project on the latest snapshot. If one is already running
+// it is returned with started false.
+func (s *DevServerService) Start(userID uuid.UUID, project *models.Project) (server DevServer, started bool, err error) {
+	template, err := s.templateService.ForProject(project)
+	if err != nil {
+		return DevServer{}, false, fmt.Errorf("failed to resolve project template: %w", err)
+	}
+	if strings.TrimSpace(template.DevCommand) == "" {
+		return DevServer{}, false, ErrDevServerUnsupported
+	}
+	s.reaper.Do(func() { go s.reapIdle() })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if running, ok := s.servers[project.ID]; ok {
+		return running.DevServer, false, nil
+	}
+
+	port, err := freePort()
+	if err != nil {
+		return DevServer{}, false, fmt.Errorf("failed to allocate a port: %w", err)
+	}
+	target := &url.URL{Scheme: "http", Host: net.JoinHostPort("127.0.0.1", strconv.Itoa(port))}
+	now := time.Now()
+	dev := &devServer{
+		DevServer: DevServer{
+			ProjectID:    project.ID,
+			Status:       DevServerStatusStarting,
+			URL:          previewURL(project.ID, ""),
+			StartedAt:    now,
+			LastActiveAt: now,
+		},
+		port:  port,
+		proxy: newDevServerProxy(target, s.logger),
+	}
+
+	// Dev servers read the port and the path they are served under from the command line
+	// ($PORT, $BASE_PATH) or the environment
+	basePath := previewURL(project.ID, "")
+	command := strings.NewReplacer("$PORT", strconv.Itoa(port), "$BASE_PATH", basePath).Replace(template.DevCommand)
+	env := []string{"PORT=" + strconv.Itoa(port), "HOST=127.0.0.1", "BASE_PATH=" + basePath}
+
+	// Registered before the task starts so a task that fails at once still finds it to remove
+	s.servers[project.ID] = dev
+	metadata := models.JSONB{"kind": BuildKindDevServer, "template": template.Slug, "port": port}
+	build, err := s.buildService.StartTask(userID, project.ID, command, "", metadata, func(task *BuildTask) error {
+		defer s.finish(dev)
+		return s.run(task, dev, project, template, command, env)
+	})
+	if err != nil {
+		delete(s.servers, project.ID)
+		return DevServer{}, false, err
+	}
+	dev.BuildID = build.ID
+	return dev.DevServer, true, nil
+}
+
+// run installs dependencies and runs the dev server until the build is cancelled
+func (s *DevServerService) run(task *BuildTask, dev *devServer, project *models.Project, template *models.ProjectTemplate, command string, env []string) error {
+	ctx := task.Context()
+
+	task.Log("info", "Loading project snapshot")
+	ws, err := s.workspaceService.Snapshot(ctx, project)
+	if err != nil {
+		return fmt.Errorf("failed to load project workspace: %w", err)
+	}
+	appDir, err := ws.ResolvePath(template.RootDir)
+	if err != nil {
+		s.workspaceService.Release(ws)
+		return fmt.Errorf("invalid template root directory: %w", err)
+	}
+	s.mu.Lock()
+	dev.workspace = ws
+	s.mu.Unlock()
+
+	if template.InstallCommand != "" {
+		if err := task.Run(appDir, template.InstallCommand); err != nil {
+			return err
+		}
+	}
+
+	go s.waitReady(task, dev)
+	return task.RunEnv(appDir, command, env)
+}
+
+// waitReady marks a dev server ready once it accepts connections, and stops it if it never does
+func (s *DevServerService) waitReady(task *BuildTask, dev *devServer) {
+	ctx := task.Context()
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(dev.port))
+	deadline := time.Now().Add(devServerStartTimeout)
+
+	for time.Now().Before(deadline) {
+		conn, err := net.DialTimeout("tcp", address, time.Second)
+		if err == nil {
+			conn.Close()
+			s.mu.Lock()
+			dev.Status = DevServerStatusReady
+			s.mu.Unlock()
+			task.Log("info", fmt.Sprintf("Dev server ready at %s", dev.URL))
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+
+	task.Log("error", fmt.Sprintf("Dev server did not accept connections within %s", devServerStartTimeout))
+	if err := s.buildService.CancelBuild(task.Build.ID); err != nil {
+		s.logger.WithError(err).Warn("Failed to stop dev server")
+	}
+}
+
+// finish forgets a dev server whose process ended and removes its workspace
+func (s *DevServerService) finish(dev *devServer) {
+	s.mu.Lock()
+	if s.servers[dev.ProjectID] == dev {
+		delete(s.servers, dev.ProjectID)
+	}
+	ws := dev.workspace
+	s.mu.Unlock()
+
+	dev.refreshMu.Lock()
+	defer dev.refreshMu.Unlock()
+	s.workspaceService.Release(ws)
+}
+
+// Get returns the dev server running for a project
+func (s *DevServerService) Get(projectID uuid.UUID) (DevServer, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dev, ok := s.servers[projectID]
+	if !ok {
+		return DevServer{}, false
+	}
+	return dev.DevServer, true
+}
+
+// Stop stops the dev server of a project. It returns false if none was running.
+func (s *DevServerService) Stop(projectID uuid.UUID) (bool, error) {
+	s.mu.Lock()
+	dev, ok := s.servers[projectID]
+	var buildID uuid.UUID
+	if ok {
+		buildID = dev.BuildID
+	}
+	s.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	return true, s.buildService.CancelBuild(buildID)
+}
+
+// StopAll stops every dev server and waits up to timeout for their processes to exit, for shutdown
+func (s *DevServerService) StopAll(timeout time.Duration) {
+	s.mu.Lock()
+	buildIDs := make([]uuid.UUID, 0, len(s.servers))
+	for _, dev := range s.servers {
+		buildIDs = append(buildIDs, dev.BuildID)
+	}
+	s.mu.Unlock()
+
+	for _, buildID := range buildIDs {
+		if err := s.buildService.CancelBuild(buildID); err != nil {
+			s.logger.WithError(err).Warn("Failed to stop dev server")
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		remaining := len(s.servers)
+		s.mu.Unlock()
+		if remaining == 0 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Proxy forwards a preview request to the project's dev server. It returns false without
+// writing a response when the project has no ready dev server.
+func (s *DevServerService) Proxy(w http.ResponseWriter, r *http.Request, projectID uuid.UUID) bool {
+	s.mu.Lock()
+	dev, ok := s.servers[projectID]
+	if !ok || dev.Status != DevServerStatusReady {
+		s.mu.Unlock()
+		return false
+	}
+	dev.requests++
+	dev.LastActiveAt = time.Now()
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		dev.requests--
+		dev.LastActiveAt = time.Now()
+		s.mu.Unlock()
+	}()
+	dev.proxy.ServeHTTP(w, r)
+	return true
+}
+
+// Refresh brings the dev server workspace of a project up to date with its latest snapshot,
+// so the dev server's file watcher picks up the change. It runs in the background and is a
+// no-op when the project has no dev server.
+func (s *DevServerService) Refresh(project *models.Project) {
+	s.mu.Lock()
+	dev, ok := s.servers[project.ID]
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	go func() {
+		dev.refreshMu.Lock()
+		defer dev.refreshMu.Unlock()
+
+		s.mu.Lock()
+		ws, current := dev.workspace, s.servers[project.ID] == dev
+		s.mu.Unlock()
+		if ws == nil || !current {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+		defer cancel()
+		snapshot, err := s.workspaceService.Snapshot(ctx, project)
+		if err != nil {
+			s.logger.WithError(err).Warn("Failed to load project snapshot for dev server")
+			return
+		}
+		defer s.workspaceService.Release(snapshot)
+
+		if err := utils.SyncDir(snapshot.Dir, ws.Dir, devServerKeep...); err != nil {
+			s.logger.WithError(err).Warn("Failed to refresh dev server workspace")
+			return
+		}
+		s.buildService.logBuildEvent(dev.BuildID, "info", "Workspace refreshed from the latest snapshot", nil)
+	}()
+}
+
+// reapIdle periodically stops dev servers that have not served a request for idleTimeout
+func (s *DevServerService) reapIdle() {
+	ticker := time.NewTicker(devServerReapInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var idle []uuid.UUID
+		s.mu.Lock()
+		for _, dev := range s.servers {
+			if dev.requests == 0 && time.Since(dev.LastActiveAt) > s.idleTimeout {
+				idle = append(idle, dev.BuildID)
+			}
+		}
+		s.mu.Unlock()
+
+		for _, buildID := range idle {
+			s.buildService.logBuildEvent(buildID, "info", "Stopping idle dev server", nil)
+			if err := s.buildService.CancelBuild(buildID); err != nil {
+				s.logger.WithError(err).Warn("Failed to stop idle dev server")
+			}
+		}
+	}
+}
+
+// newDevServerProxy returns a reverse proxy to a dev server. Credentials meant for this API
+// are not forwarded to project code.
+func newDevServerProxy(target *url.URL, logger *logrus.Logger) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			// Dev servers such as Vite reject requests for hosts they do not know
+			r.Out.Host = target.Host
+			r.Out.Header.Del("Authorization")
+			query := r.Out.URL.Query()
+			if query.Has("token") {
+				query.Del("token")
+				r.Out.URL.RawQuery = query.Encode()
+			}
+			stripCookie(r.Out, "preview_token")
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logger.WithError(err).Debug("Dev server request failed")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(`{"error":"Live preview is not responding"}`))
+		},
+	}
+}
+
+// stripCookie removes a cookie from a request
+func stripCookie(r *http.Request, name string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != name {
+			r.AddCookie(cookie)
+		}
+	}
+}
+
+// freePort returns a local TCP port that is currently free
+func freePort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
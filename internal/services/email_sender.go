@@ -0,0 +1,91 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"net/url"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"borderless_coding_server/internal/models"
+	"borderless_coding_server/pkg/mailer"
+)
+
+//go:embed email_templates
+var emailTemplates embed.FS
+
+// verificationEmail describes the email sent for a token purpose. The link opens path in the
+// web app with the token as a query parameter.
+type verificationEmail struct {
+	subject  string
+	template string
+	path     string
+}
+
+var verificationEmails = map[models.TokenPurpose]verificationEmail{
+	models.TokenPurposeEmailVerify:   {"Verify your email address", "verify_email", "/verify-email"},
+	models.TokenPurposeEmailLogin:    {"Your sign-in link", "magic_link", "/login/magic-link"},
+	models.TokenPurposeResetPassword: {"Reset your password", "reset_password", "/reset-password"},
+}
+
+// EmailSender delivers verification tokens as links in templated emails
+type EmailSender struct {
+	mailer  mailer.Mailer
+	baseURL string
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+func NewEmailSender(m mailer.Mailer, baseURL string) *EmailSender {
+	return &EmailSender{
+		mailer:  m,
+		baseURL: strings.TrimRight(baseURL, "/"),
+		text:    texttemplate.Must(texttemplate.ParseFS(emailTemplates, "email_templates/*.txt")),
+		html:    htmltemplate.Must(htmltemplate.ParseFS(emailTemplates, "email_templates/*.html")),
+	}
+}
+
+// SendVerification emails the link for the token to sentTo
+func (s *EmailSender) SendVerification(ctx context.Context, purpose models.TokenPurpose, sentTo, token string) error {
+	email, ok := verificationEmails[purpose]
+	if !ok {
+		return fmt.Errorf("no email for %s tokens", purpose)
+	}
+	data := struct {
+		Link      string
+		ExpiresIn string
+	}{
+		Link:      s.baseURL + email.path + "?token=" + url.QueryEscape(token),
+		ExpiresIn: formatLifetime(tokenPolicies[purpose].lifetime),
+	}
+
+	var text, html bytes.Buffer
+	if err := s.text.ExecuteTemplate(&text, email.template+".txt", data); err != nil {
+		return err
+	}
+	if err := s.html.ExecuteTemplate(&html, email.template+".html", data); err != nil {
+		return err
+	}
+	return s.mailer.Send(ctx, mailer.Message{
+		To:      sentTo,
+		Subject: email.subject,
+		Text:    text.String(),
+		HTML:    html.String(),
+	})
+}
+
+// formatLifetime writes a token lifetime for humans, as in "1 hour" or "15 minutes"
+func formatLifetime(d time.Duration) string {
+	unit, n := "minute", int(d/time.Minute)
+	if d >= time.Hour && d%time.Hour == 0 {
+		unit, n = "hour", int(d/time.Hour)
+	}
+	if n != 1 {
+		unit += "s"
+	}
+	return fmt.Sprintf("%d %s", n, unit)
+}
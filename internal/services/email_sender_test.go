@@ -0,0 +1,55 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"borderless_coding_server/internal/models"
+	"borderless_coding_server/pkg/mailer"
+)
+
+// recordingMailer keeps the messages it is asked to send
+type recordingMailer struct {
+	sent []mailer.Message
+}
+
+func (m *recordingMailer) Send(ctx context.Context, msg mailer.Message) error {
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+func TestEmailSenderRendersLinks(t *testing.T) {
+	m := &recordingMailer{}
+	s := NewEmailSender(m, "https://app.example.com/")
+
+	tests := []struct {
+		purpose models.TokenPurpose
+		link    string
+		expires string
+	}{
+		{models.TokenPurposeEmailVerify, "https://app.example.com/verify-email?token=a%2Bb%3D", "24 hours"},
+		{models.TokenPurposeEmailLogin, "https://app.example.com/login/magic-link?token=a%2Bb%3D", "15 minutes"},
+		{models.TokenPurposeResetPassword, "https://app.example.com/reset-password?token=a%2Bb%3D", "1 hour"},
+	}
+	for _, tt := range tests {
+		if err := s.SendVerification(context.Background(), tt.purpose, "ada@example.com", "a+b="); err != nil {
+			t.Fatalf("SendVerification(%s): %v", tt.purpose, err)
+		}
+		msg := m.sent[len(m.sent)-1]
+		if msg.To != "ada@example.com" || msg.Subject == "" {
+			t.Errorf("%s: To = %q, Subject = %q", tt.purpose, msg.To, msg.Subject)
+		}
+		if !strings.Contains(msg.Text, tt.link) || !strings.Contains(msg.Text, tt.expires) {
+			t.Errorf("%s: text body %q lacks %q or %q", tt.purpose, msg.Text, tt.link, tt.expires)
+		}
+		// html/template escapes & and friends, but the query here needs none
+		if !strings.Contains(msg.HTML, `href="`+tt.link+`"`) {
+			t.Errorf("%s: html body %q lacks the link", tt.purpose, msg.HTML)
+		}
+	}
+
+	if err := s.SendVerification(context.Background(), models.TokenPurposePhoneLogin, "+15555550100", "123456"); err == nil {
+		t.Error("sent an email for a phone token")
+	}
+}
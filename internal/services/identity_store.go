@@ -0,0 +1,124 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"borderless_coding_server/internal/models"
+	"borderless_coding_server/pkg/database"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrIdentityNotFound is returned for identities that do not exist or belong to another user
+	ErrIdentityNotFound = errors.New("identity not found")
+	// ErrIdentityTaken is returned when linking an identity another account is linked to
+	ErrIdentityTaken = errors.New("identity is linked to another account")
+)
+
+// IdentityStore persists the external identities users sign in with
+type IdentityStore interface {
+	// FindIdentity returns the identity of a provider's subject, or ErrIdentityNotFound
+	FindIdentity(ctx context.Context, provider models.AuthProvider, subject string) (*models.AuthIdentity, error)
+	// LinkIdentity adds an identity to an existing user, or returns ErrIdentityTaken if the
+	// subject is linked already
+	LinkIdentity(ctx context.Context, identity *models.AuthIdentity) error
+	// CreateUserWithIdentity creates a user together with the identity they signed up with
+	CreateUserWithIdentity(ctx context.Context, user *models.User, identity *models.AuthIdentity) error
+	ListIdentities(ctx context.Context, userID uuid.UUID) ([]models.AuthIdentity, error)
+	// DeleteIdentity removes one of the user's identities, or returns ErrIdentityNotFound
+	DeleteIdentity(ctx context.Context, userID, identityID uuid.UUID) error
+	CreateOIDCFlow(ctx context.Context, flow *models.OIDCFlow) error
+	// GetOIDCFlow returns the unconsumed, unexpired flow with the token hash, or
+	// ErrInvalidOIDCFlow
+	GetOIDCFlow(ctx context.Context, tokenHash string) (*models.OIDCFlow, error)
+	// ConsumeOIDCFlow marks the flow consumed, reporting false if it already was
+	ConsumeOIDCFlow(ctx context.Context, id uuid.UUID) (bool, error)
+}
+
+// FindIdentity returns the identity of a provider's subject
+func (s *DBCredentialStore) FindIdentity(ctx context.Context, provider models.AuthProvider, subject string) (*models.AuthIdentity, error) {
+	var identity models.AuthIdentity
+	err := database.DB.WithContext(ctx).Where("provider = ? AND provider_uid = ?", provider, subject).First(&identity).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrIdentityNotFound
+	}
+	return &identity, err
+}
+
+// LinkIdentity adds an identity to an existing user
+func (s *DBCredentialStore) LinkIdentity(ctx context.Context, identity *models.AuthIdentity) error {
+	return database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var taken int64
+		if err := tx.Model(&models.AuthIdentity{}).
+			Where("provider = ? AND provider_uid = ?", identity.Provider, identity.ProviderUID).
+			Count(&taken).Error; err != nil {
+			return err
+		}
+		if taken > 0 {
+			return ErrIdentityTaken
+		}
+		return tx.Create(identity).Error
+	})
+}
+
+// CreateUserWithIdentity creates the user and its identity in one transaction
+func (s *DBCredentialStore) CreateUserWithIdentity(ctx context.Context, user *models.User, identity *models.AuthIdentity) error {
+	return database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(user).Error; err != nil {
+			return err
+		}
+		identity.UserID = user.ID
+		return tx.Create(identity).Error
+	})
+}
+
+// ListIdentities returns the user's identities, oldest first
+func (s *DBCredentialStore) ListIdentities(ctx context.Context, userID uuid.UUID) ([]models.AuthIdentity, error) {
+	var identities []models.AuthIdentity
+	err := database.DB.WithContext(ctx).Where("user_id = ?", userID).Order("created_at").Find(&identities).Error
+	return identities, err
+}
+
+// DeleteIdentity removes one of the user's identities
+func (s *DBCredentialStore) DeleteIdentity(ctx context.Context, userID, identityID uuid.UUID) error {
+	result := database.DB.WithContext(ctx).Where("id = ? AND user_id = ?", identityID, userID).Delete(&models.AuthIdentity{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrIdentityNotFound
+	}
+	return nil
+}
+
+// CreateOIDCFlow stores a new flow
+func (s *DBCredentialStore) CreateOIDCFlow(ctx context.Context, flow *models.OIDCFlow) error {
+	return database.DB.WithContext(ctx).Create(flow).Error
+}
+
+// GetOIDCFlow returns the unconsumed, unexpired flow with the token hash
+func (s *DBCredentialStore) GetOIDCFlow(ctx context.Context, tokenHash string) (*models.OIDCFlow, error) {
+	var flow models.OIDCFlow
+	err := database.DB.WithContext(ctx).
+		Where("token_hash = ? AND consumed_at IS NULL AND expires_at > ?", tokenHash, time.Now()).
+		First(&flow).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidOIDCFlow
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &flow, nil
+}
+
+// ConsumeOIDCFlow marks the flow consumed unless it already was
+func (s *DBCredentialStore) ConsumeOIDCFlow(ctx context.Context, id uuid.UUID) (bool, error) {
+	result := database.DB.WithContext(ctx).Model(&models.OIDCFlow{}).
+		Where("id = ? AND consumed_at IS NULL", id).
+		Update("consumed_at", time.Now())
+	return result.RowsAffected > 0, result.Error
+}
@@ -1,55 +1,81 @@
 package services
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 
+	"borderless_coding_server/internal/models"
+	"borderless_coding_server/pkg/database"
+
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// accessTokenLifetime is how long an access token is accepted unless it is revoked
+const accessTokenLifetime = 15 * time.Minute
+
+const (
+	// signingKeyRefreshInterval is how often keys created by other server instances are picked up
+	signingKeyRefreshInterval = time.Minute
+	// signingKeyLockID serializes key rotation between server instances
+	signingKeyLockID = 0x6a77746b // "jwtk"
 )
 
+// JWTService issues and verifies access tokens. Tokens are signed with asymmetric keys
+// identified by the kid header, which rotate on a schedule and are published as a JWKS so
+// other services can verify tokens without sharing a secret.
 type JWTService struct {
-	secretKey []byte
+	algorithm string
+	policy    KeyRotationPolicy
+	logger    *logrus.Logger
+
+	mu   sync.RWMutex
+	keys []*SigningKey // by ActivatesAt
+	once sync.Once
 }
 
 type Claims struct {
 	UserID    uuid.UUID `json:"user_id"`
 	SessionID uuid.UUID `json:"session_id"`
+	// Roles and Permissions are embedded in access tokens; they are nil in access tokens
+	// issued before roles were added
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
 	jwt.RegisteredClaims
 }
 
-func NewJWTService(secretKey string) *JWTService {
+func NewJWTService(algorithm string, policy KeyRotationPolicy, logger *logrus.Logger) *JWTService {
 	return &JWTService{
-		secretKey: []byte(secretKey),
+		algorithm: algorithm,
+		policy:    policy,
+		logger:    logger,
 	}
 }
 
-// GenerateAccessToken generates a short-lived access token
-func (j *JWTService) GenerateAccessToken(userID, sessionID uuid.UUID) (string, error) {
-	claims := Claims{
-		UserID:    userID,
-		SessionID: sessionID,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(15 * time.Minute)), // 15 minutes
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			NotBefore: jwt.NewNumericDate(time.Now()),
-			Issuer:    "borderless-coding-server",
-			Subject:   userID.String(),
-		},
+// GenerateAccessToken generates a short-lived access token carrying the user's roles and
+// permissions, so role changes take effect once the token expires
+func (j *JWTService) GenerateAccessToken(userID, sessionID uuid.UUID, access *UserAccess) (string, error) {
+	if access == nil {
+		access = &UserAccess{}
+	}
+	key, err := j.signingKey(time.Now())
+	if err != nil {
+		return "", err
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(j.secretKey)
-}
-
-// GenerateRefreshToken generates a long-lived refresh token
-func (j *JWTService) GenerateRefreshToken(userID, sessionID uuid.UUID) (string, error) {
 	claims := Claims{
-		UserID:    userID,
-		SessionID: sessionID,
+		UserID:      userID,
+		SessionID:   sessionID,
+		Roles:       nonNil(access.Roles),
+		Permissions: nonNil(access.Permissions),
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(30 * 24 * time.Hour)), // 30 days
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(accessTokenLifetime)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			NotBefore: jwt.NewNumericDate(time.Now()),
 			Issuer:    "borderless-coding-server",
@@ -57,19 +83,15 @@ func (j *JWTService) GenerateRefreshToken(userID, sessionID uuid.UUID) (string,
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(j.secretKey)
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.private)
 }
 
-// ValidateToken validates and parses a JWT token
+// ValidateToken validates and parses a JWT token, verifying it with the key named by its kid
 func (j *JWTService) ValidateToken(tokenString string) (*Claims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return j.secretKey, nil
-	})
-
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, j.verificationKey,
+		jwt.WithValidMethods([]string{SigningAlgorithmRS256, SigningAlgorithmEdDSA}))
 	if err != nil {
 		return nil, err
 	}
@@ -81,40 +103,181 @@ func (j *JWTService) ValidateToken(tokenString string) (*Claims, error) {
 	return nil, errors.New("invalid token")
 }
 
-// ExtractTokenFromHeader extracts token from Authorization header
-func (j *JWTService) ExtractTokenFromHeader(authHeader string) (string, error) {
-	if authHeader == "" {
-		return "", errors.New("authorization header is required")
+// verificationKey returns the public key of the published key the token names
+func (j *JWTService) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	now := time.Now()
+
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	for _, key := range j.keys {
+		if key.ID != kid || key.expired(now) {
+			continue
+		}
+		if token.Method.Alg() != key.Algorithm {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return key.PublicKey(), nil
 	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
 
-	const bearerPrefix = "Bearer "
-	if len(authHeader) < len(bearerPrefix) || authHeader[:len(bearerPrefix)] != bearerPrefix {
-		return "", errors.New("authorization header must start with 'Bearer '")
+// signingKey returns the most recently activated key
+func (j *JWTService) signingKey(now time.Time) (*SigningKey, error) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	for i := len(j.keys) - 1; i >= 0; i-- {
+		if key := j.keys[i]; !key.ActivatesAt.After(now) && !key.expired(now) {
+			return key, nil
+		}
 	}
+	return nil, errors.New("no active signing key")
+}
 
-	return authHeader[len(bearerPrefix):], nil
+// JWKS returns the published public keys: the signing key, the next key if it was already
+// created, and replaced keys whose tokens may not have expired yet
+func (j *JWTService) JWKS() JWKS {
+	now := time.Now()
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	jwks := JWKS{Keys: []JWK{}}
+	for _, key := range j.keys {
+		if !key.expired(now) {
+			jwks.Keys = append(jwks.Keys, key.JWK())
+		}
+	}
+	return jwks
 }
 
-// RefreshTokenPair generates a new access token using a refresh token
-func (j *JWTService) RefreshTokenPair(refreshTokenString string) (string, string, error) {
-	claims, err := j.ValidateToken(refreshTokenString)
+// RotateKeys loads the signing keys from the database. It creates the first key, publishes
+// the next one when the rotation policy calls for it and deletes keys that have expired.
+func (j *JWTService) RotateKeys(ctx context.Context) error {
+	now := time.Now()
+	var rows []models.SigningKey
+	err := database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", signingKeyLockID).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("expires_at <= ?", now).Delete(&models.SigningKey{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Order("activates_at").Find(&rows).Error; err != nil {
+			return err
+		}
+
+		var newest *models.SigningKey
+		if len(rows) > 0 {
+			newest = &rows[len(rows)-1]
+		}
+		activatesAt, due := j.successorDue(newest, now)
+		if !due {
+			return nil
+		}
+
+		key, err := GenerateSigningKey(j.algorithm, activatesAt)
+		if err != nil {
+			return err
+		}
+		row, err := key.model()
+		if err != nil {
+			return err
+		}
+		if newest != nil {
+			expiresAt := activatesAt.Add(j.policy.retention())
+			if err := tx.Model(newest).Update("expires_at", expiresAt).Error; err != nil {
+				return err
+			}
+			newest.ExpiresAt = &expiresAt
+		}
+		if err := tx.Create(&row).Error; err != nil {
+			return err
+		}
+		rows = append(rows, row)
+
+		if j.logger != nil {
+			j.logger.WithFields(logrus.Fields{"kid": key.ID, "algorithm": key.Algorithm, "activates_at": activatesAt}).
+				Info("Published new access token signing key")
+		}
+		return nil
+	})
 	if err != nil {
-		return "", "", fmt.Errorf("invalid refresh token: %w", err)
+		return fmt.Errorf("failed to rotate signing keys: %w", err)
 	}
 
-	// Generate new access token
-	newAccessToken, err := j.GenerateAccessToken(claims.UserID, claims.SessionID)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to generate new access token: %w", err)
+	keys := make([]*SigningKey, 0, len(rows))
+	for _, row := range rows {
+		key, err := signingKeyFromModel(row)
+		if err != nil {
+			return fmt.Errorf("failed to load signing key %s: %w", row.KID, err)
+		}
+		keys = append(keys, key)
 	}
+	j.setKeys(keys)
+	return nil
+}
 
-	// Generate new refresh token
-	newRefreshToken, err := j.GenerateRefreshToken(claims.UserID, claims.SessionID)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to generate new refresh token: %w", err)
+// StartKeyRotation keeps the keys up to date in the background, rotating them on schedule
+// and picking up keys created by other server instances
+func (j *JWTService) StartKeyRotation() {
+	j.once.Do(func() {
+		go func() {
+			ticker := time.NewTicker(signingKeyRefreshInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				if err := j.RotateKeys(context.Background()); err != nil && j.logger != nil {
+					j.logger.WithError(err).Error("Failed to refresh signing keys")
+				}
+			}
+		}()
+	})
+}
+
+// successorDue reports whether the key after the newest one should be published now, and
+// when it starts signing. Changing the configured algorithm rotates the key early.
+func (j *JWTService) successorDue(newest *models.SigningKey, now time.Time) (time.Time, bool) {
+	if newest == nil {
+		return now, true
+	}
+	if newest.ActivatesAt.After(now) {
+		// The next key is already published
+		return time.Time{}, false
 	}
 
-	return newAccessToken, newRefreshToken, nil
+	earliest := now.Add(j.policy.Overlap)
+	if newest.Algorithm != j.algorithm {
+		return earliest, true
+	}
+	if newest.ActivatesAt.Add(j.policy.Interval - j.policy.Overlap).After(now) {
+		return time.Time{}, false
+	}
+	activatesAt := newest.ActivatesAt.Add(j.policy.Interval)
+	if activatesAt.Before(earliest) {
+		activatesAt = earliest
+	}
+	return activatesAt, true
+}
+
+// setKeys replaces the keys tokens are signed and verified with
+func (j *JWTService) setKeys(keys []*SigningKey) {
+	sort.SliceStable(keys, func(a, b int) bool { return keys[a].ActivatesAt.Before(keys[b].ActivatesAt) })
+	j.mu.Lock()
+	j.keys = keys
+	j.mu.Unlock()
+}
+
+// ExtractTokenFromHeader extracts token from Authorization header
+func (j *JWTService) ExtractTokenFromHeader(authHeader string) (string, error) {
+	if authHeader == "" {
+		return "", errors.New("authorization header is required")
+	}
+
+	const bearerPrefix = "Bearer "
+	if len(authHeader) < len(bearerPrefix) || authHeader[:len(bearerPrefix)] != bearerPrefix {
+		return "", errors.New("authorization header must start with 'Bearer '")
+	}
+
+	return authHeader[len(bearerPrefix):], nil
 }
 
 // GetTokenExpiration returns the expiration time of a token
@@ -136,3 +299,11 @@ func (j *JWTService) IsTokenExpired(tokenString string) (bool, error) {
 
 	return time.Now().After(expiration), nil
 }
+
+// nonNil returns values, or an empty slice if it is nil, so the claim is always present
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
@@ -0,0 +1,210 @@
+package services
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"testing"
+	"time"
+
+	"borderless_coding_server/internal/models"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+func newTestJWTService(t *testing.T, keys ...*SigningKey) *JWTService {
+	t.Helper()
+	j := NewJWTService(SigningAlgorithmEdDSA, KeyRotationPolicy{Interval: 24 * time.Hour, Overlap: time.Hour}, nil)
+	j.setKeys(keys)
+	return j
+}
+
+func newTestSigningKey(t *testing.T, algorithm string, activatesAt time.Time) *SigningKey {
+	t.Helper()
+	key, err := GenerateSigningKey(algorithm, activatesAt)
+	if err != nil {
+		t.Fatalf("GenerateSigningKey: %v", err)
+	}
+	return key
+}
+
+// publicKeyFromJWK rebuilds a public key the way a service verifying tokens offline would
+func publicKeyFromJWK(t *testing.T, jwk JWK) interface{} {
+	t.Helper()
+	decode := func(s string) []byte {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatalf("decode %q: %v", s, err)
+		}
+		return b
+	}
+	switch jwk.KeyType {
+	case "RSA":
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(decode(jwk.N)), E: int(new(big.Int).SetBytes(decode(jwk.E)).Int64())}
+	case "OKP":
+		return ed25519.PublicKey(decode(jwk.X))
+	}
+	t.Fatalf("unexpected key type %q", jwk.KeyType)
+	return nil
+}
+
+func TestAccessTokenVerifiesWithPublishedKey(t *testing.T) {
+	for _, algorithm := range []string{SigningAlgorithmRS256, SigningAlgorithmEdDSA} {
+		t.Run(algorithm, func(t *testing.T) {
+			key := newTestSigningKey(t, algorithm, time.Now().Add(-time.Minute))
+			j := newTestJWTService(t, key)
+
+			userID, sessionID := uuid.New(), uuid.New()
+			tokenString, err := j.GenerateAccessToken(userID, sessionID, &UserAccess{Roles: []string{"admin"}})
+			if err != nil {
+				t.Fatalf("GenerateAccessToken: %v", err)
+			}
+
+			claims, err := j.ValidateToken(tokenString)
+			if err != nil {
+				t.Fatalf("ValidateToken: %v", err)
+			}
+			if claims.UserID != userID || claims.SessionID != sessionID {
+				t.Fatalf("claims = %s/%s, want %s/%s", claims.UserID, claims.SessionID, userID, sessionID)
+			}
+
+			// Round-trip the JWKS through JSON and verify without the service
+			data, err := json.Marshal(j.JWKS())
+			if err != nil {
+				t.Fatalf("Marshal: %v", err)
+			}
+			var jwks JWKS
+			if err := json.Unmarshal(data, &jwks); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			if len(jwks.Keys) != 1 || jwks.Keys[0].KeyID != key.ID || jwks.Keys[0].Algorithm != algorithm {
+				t.Fatalf("JWKS = %+v, want the %s key %s", jwks.Keys, algorithm, key.ID)
+			}
+			token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+				if token.Header["kid"] != jwks.Keys[0].KeyID {
+					t.Errorf("kid = %v, want %s", token.Header["kid"], jwks.Keys[0].KeyID)
+				}
+				return publicKeyFromJWK(t, jwks.Keys[0]), nil
+			}, jwt.WithValidMethods([]string{algorithm}))
+			if err != nil || !token.Valid {
+				t.Fatalf("offline verification failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateTokenRejectsUnknownKeys(t *testing.T) {
+	now := time.Now()
+	key := newTestSigningKey(t, SigningAlgorithmEdDSA, now.Add(-time.Minute))
+	other := newTestSigningKey(t, SigningAlgorithmEdDSA, now.Add(-time.Minute))
+	j := newTestJWTService(t, key)
+
+	foreign, err := newTestJWTService(t, other).GenerateAccessToken(uuid.New(), uuid.New(), nil)
+	if err != nil {
+		t.Fatalf("GenerateAccessToken: %v", err)
+	}
+	if _, err := j.ValidateToken(foreign); err == nil {
+		t.Error("token signed with an unpublished key was accepted")
+	}
+
+	// An HMAC token claiming a published kid must not be verified with the public key
+	hmac := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute))})
+	hmac.Header["kid"] = key.ID
+	hmacString, err := hmac.SignedString([]byte(key.JWK().X))
+	if err != nil {
+		t.Fatalf("SignedString: %v", err)
+	}
+	if _, err := j.ValidateToken(hmacString); err == nil {
+		t.Error("HS256 token was accepted")
+	}
+
+	expiresAt := now.Add(-time.Second)
+	key.ExpiresAt = &expiresAt
+	tokenString, err := newTestJWTService(t, other, key).GenerateAccessToken(uuid.New(), uuid.New(), nil)
+	if err != nil {
+		t.Fatalf("GenerateAccessToken: %v", err)
+	}
+	if _, err := newTestJWTService(t, key).ValidateToken(tokenString); err == nil {
+		t.Error("token signed with an expired key was accepted")
+	}
+}
+
+func TestKeyRotationOverlap(t *testing.T) {
+	now := time.Now()
+	retiredAt := now.Add(time.Hour)
+	old := newTestSigningKey(t, SigningAlgorithmEdDSA, now.Add(-48*time.Hour))
+	old.ExpiresAt = &retiredAt
+	current := newTestSigningKey(t, SigningAlgorithmEdDSA, now.Add(-time.Minute))
+	next := newTestSigningKey(t, SigningAlgorithmEdDSA, now.Add(time.Hour))
+
+	oldToken, err := newTestJWTService(t, old).GenerateAccessToken(uuid.New(), uuid.New(), nil)
+	if err != nil {
+		t.Fatalf("GenerateAccessToken: %v", err)
+	}
+
+	j := newTestJWTService(t, next, old, current)
+	signing, err := j.signingKey(now)
+	if err != nil || signing.ID != current.ID {
+		t.Fatalf("signing key = %v (%v), want the most recently activated key", signing, err)
+	}
+	if _, err := j.ValidateToken(oldToken); err != nil {
+		t.Errorf("token of the replaced key was rejected during the overlap: %v", err)
+	}
+	if got := len(j.JWKS().Keys); got != 3 {
+		t.Errorf("JWKS has %d keys, want the replaced, current and next key", got)
+	}
+}
+
+func TestSuccessorDue(t *testing.T) {
+	now := time.Now()
+	j := NewJWTService(SigningAlgorithmEdDSA, KeyRotationPolicy{Interval: 24 * time.Hour, Overlap: time.Hour}, nil)
+	key := func(activatesAt time.Time, algorithm string) *models.SigningKey {
+		return &models.SigningKey{ActivatesAt: activatesAt, Algorithm: algorithm}
+	}
+
+	tests := []struct {
+		name        string
+		newest      *models.SigningKey
+		due         bool
+		activatesAt time.Time
+	}{
+		{"first key", nil, true, now},
+		{"fresh key", key(now.Add(-time.Hour), SigningAlgorithmEdDSA), false, time.Time{}},
+		{"next key already published", key(now.Add(30*time.Minute), SigningAlgorithmEdDSA), false, time.Time{}},
+		{"before the overlap", key(now.Add(-22*time.Hour), SigningAlgorithmEdDSA), false, time.Time{}},
+		{"overlap reached", key(now.Add(-23*time.Hour), SigningAlgorithmEdDSA), true, now.Add(time.Hour)},
+		{"overdue", key(now.Add(-72*time.Hour), SigningAlgorithmEdDSA), true, now.Add(time.Hour)},
+		{"algorithm changed", key(now.Add(-time.Hour), SigningAlgorithmRS256), true, now.Add(time.Hour)},
+	}
+	for _, tt := range tests {
+		activatesAt, due := j.successorDue(tt.newest, now)
+		if due != tt.due || !activatesAt.Equal(tt.activatesAt) {
+			t.Errorf("%s: successorDue = %v, %v; want %v, %v", tt.name, activatesAt, due, tt.activatesAt, tt.due)
+		}
+	}
+}
+
+func TestSigningKeyModelRoundTrip(t *testing.T) {
+	for _, algorithm := range []string{SigningAlgorithmRS256, SigningAlgorithmEdDSA} {
+		key := newTestSigningKey(t, algorithm, time.Now())
+		row, err := key.model()
+		if err != nil {
+			t.Fatalf("%s: model: %v", algorithm, err)
+		}
+		loaded, err := signingKeyFromModel(row)
+		if err != nil {
+			t.Fatalf("%s: signingKeyFromModel: %v", algorithm, err)
+		}
+		if loaded.thumbprint() != key.ID {
+			t.Errorf("%s: loaded key has thumbprint %s, want %s", algorithm, loaded.thumbprint(), key.ID)
+		}
+
+		row.Algorithm = map[string]string{SigningAlgorithmRS256: SigningAlgorithmEdDSA, SigningAlgorithmEdDSA: SigningAlgorithmRS256}[algorithm]
+		if _, err := signingKeyFromModel(row); err == nil {
+			t.Errorf("%s: key loaded with the wrong algorithm", algorithm)
+		}
+	}
+}
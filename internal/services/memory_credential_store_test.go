@@ -0,0 +1,460 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"borderless_coding_server/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// memoryCredentialStore is a CredentialStore kept in memory, for tests
+type memoryCredentialStore struct {
+	mu          sync.Mutex
+	users       map[uuid.UUID]*models.User
+	credentials map[uuid.UUID]*models.UserCredential
+	sessions    []*models.Session
+	events      []models.AuthAudit
+	mfa         map[uuid.UUID]*models.UserMFA
+	recovery    map[uuid.UUID]map[string]bool // code hash => used
+	mfaRequired map[models.UserLevel]bool
+	identities  []*models.AuthIdentity
+	attempts    map[string]*models.AuthAttempt // by user ID and action
+	challenges  []*models.MFAChallenge
+	flows       []*models.OIDCFlow
+}
+
+func newMemoryCredentialStore() *memoryCredentialStore {
+	return &memoryCredentialStore{
+		users:       make(map[uuid.UUID]*models.User),
+		credentials: make(map[uuid.UUID]*models.UserCredential),
+		mfa:         make(map[uuid.UUID]*models.UserMFA),
+		recovery:    make(map[uuid.UUID]map[string]bool),
+		mfaRequired: make(map[models.UserLevel]bool),
+		attempts:    make(map[string]*models.AuthAttempt),
+	}
+}
+
+func (s *memoryCredentialStore) GetUser(ctx context.Context, userID uuid.UUID) (*models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[userID]
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+	copied := *user
+	return &copied, nil
+}
+
+func (s *memoryCredentialStore) FindUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, user := range s.users {
+		// Emails are citext in the database
+		if user.Email != nil && strings.EqualFold(*user.Email, email) {
+			copied := *user
+			return &copied, nil
+		}
+	}
+	return nil, ErrAccountNotFound
+}
+
+func (s *memoryCredentialStore) GetCredential(ctx context.Context, userID uuid.UUID) (*models.UserCredential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cred, ok := s.credentials[userID]
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+	copied := *cred
+	return &copied, nil
+}
+
+func (s *memoryCredentialStore) CreateUser(ctx context.Context, user *models.User, cred *models.UserCredential) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_ = user.BeforeCreate(nil)
+	cred.UserID = user.ID
+	storedUser, storedCred := *user, *cred
+	s.users[user.ID] = &storedUser
+	s.credentials[user.ID] = &storedCred
+	return nil
+}
+
+func (s *memoryCredentialStore) UpdatePasswordHash(ctx context.Context, userID uuid.UUID, passwordHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cred, ok := s.credentials[userID]
+	if !ok {
+		return ErrAccountNotFound
+	}
+	cred.PasswordHash = &passwordHash
+	cred.Salt = nil
+	return nil
+}
+
+func (s *memoryCredentialStore) SetPassword(ctx context.Context, userID uuid.UUID, passwordHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.credentials[userID] = &models.UserCredential{UserID: userID, PasswordHash: &passwordHash, PasswordSetAt: &now}
+	return nil
+}
+
+func (s *memoryCredentialStore) CreateSession(ctx context.Context, session *models.Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_ = session.BeforeCreate(nil)
+	stored := *session
+	s.sessions = append(s.sessions, &stored)
+	return nil
+}
+
+func (s *memoryCredentialStore) RotateSession(ctx context.Context, tokenHash string, next *models.Session) (*models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var current *models.Session
+	for _, session := range s.sessions {
+		if session.RefreshTokenHash == tokenHash {
+			current = session
+		}
+	}
+	if current == nil {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	now := time.Now()
+	if current.IsRotated() {
+		if current.RevokedAt != nil {
+			return nil, ErrInvalidRefreshToken
+		}
+		reuse := &RefreshTokenReuseError{Session: *current}
+		for _, session := range s.sessions {
+			if session.FamilyID == current.FamilyID && session.RevokedAt == nil {
+				session.RevokedAt = &now
+				reuse.Revoked = append(reuse.Revoked, session.ID)
+			}
+		}
+		return nil, reuse
+	}
+	if !current.IsValid() {
+		return nil, ErrInvalidRefreshToken
+	}
+	user, ok := s.users[current.UserID]
+	if !ok {
+		return nil, ErrInvalidRefreshToken
+	}
+	if !user.IsActive {
+		return nil, ErrAccountDisabled
+	}
+
+	current.RotatedAt = &now
+	parentID := current.ID
+	next.UserID = current.UserID
+	next.FamilyID = current.FamilyID
+	next.ParentID = &parentID
+	next.ValidUntil = current.ValidUntil
+	_ = next.BeforeCreate(nil)
+	stored := *next
+	s.sessions = append(s.sessions, &stored)
+	copied := *user
+	return &copied, nil
+}
+
+func (s *memoryCredentialStore) RecordAuthEvent(ctx context.Context, audit *models.AuthAudit) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, *audit)
+	return nil
+}
+
+func (s *memoryCredentialStore) TakeAttempt(ctx context.Context, userID uuid.UUID, action string, limit int, window time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	attempt, ok := s.attempts[userID.String()+"/"+action]
+	if !ok || !attempt.WindowStart.After(now.Add(-window)) {
+		s.attempts[userID.String()+"/"+action] = &models.AuthAttempt{UserID: userID, Action: action, Count: 1, WindowStart: now}
+		return true, nil
+	}
+	if attempt.Count >= limit {
+		return false, nil
+	}
+	attempt.Count++
+	return true, nil
+}
+
+func (s *memoryCredentialStore) ResetAttempts(ctx context.Context, userID uuid.UUID, action string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attempts, userID.String()+"/"+action)
+	return nil
+}
+
+func (s *memoryCredentialStore) GetMFA(ctx context.Context, userID uuid.UUID) (*models.UserMFA, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mfa, ok := s.mfa[userID]
+	if !ok {
+		return nil, nil
+	}
+	copied := *mfa
+	return &copied, nil
+}
+
+func (s *memoryCredentialStore) SaveMFA(ctx context.Context, mfa *models.UserMFA) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := *mfa
+	s.mfa[mfa.UserID] = &stored
+	return nil
+}
+
+func (s *memoryCredentialStore) DeleteMFA(ctx context.Context, userID uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.mfa, userID)
+	delete(s.recovery, userID)
+	return nil
+}
+
+func (s *memoryCredentialStore) UseTOTPStep(ctx context.Context, userID uuid.UUID, step int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mfa, ok := s.mfa[userID]
+	if !ok || mfa.LastUsedStep >= step {
+		return false, nil
+	}
+	mfa.LastUsedStep = step
+	return true, nil
+}
+
+func (s *memoryCredentialStore) ReplaceRecoveryCodes(ctx context.Context, userID uuid.UUID, hashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	codes := make(map[string]bool, len(hashes))
+	for _, hash := range hashes {
+		codes[hash] = false
+	}
+	s.recovery[userID] = codes
+	return nil
+}
+
+func (s *memoryCredentialStore) UseRecoveryCode(ctx context.Context, userID uuid.UUID, hash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	used, ok := s.recovery[userID][hash]
+	if !ok || used {
+		return false, nil
+	}
+	s.recovery[userID][hash] = true
+	return true, nil
+}
+
+func (s *memoryCredentialStore) CountRecoveryCodes(ctx context.Context, userID uuid.UUID) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var count int64
+	for _, used := range s.recovery[userID] {
+		if !used {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memoryCredentialStore) IsMFARequired(ctx context.Context, level models.UserLevel) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mfaRequired[level], nil
+}
+
+func (s *memoryCredentialStore) FindIdentity(ctx context.Context, provider models.AuthProvider, subject string) (*models.AuthIdentity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, identity := range s.identities {
+		if identity.Provider == provider && identity.ProviderUID == subject {
+			copied := *identity
+			return &copied, nil
+		}
+	}
+	return nil, ErrIdentityNotFound
+}
+
+func (s *memoryCredentialStore) LinkIdentity(ctx context.Context, identity *models.AuthIdentity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addIdentity(identity)
+}
+
+func (s *memoryCredentialStore) CreateMFAChallenge(ctx context.Context, challenge *models.MFAChallenge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_ = challenge.BeforeCreate(nil)
+	stored := *challenge
+	s.challenges = append(s.challenges, &stored)
+	return nil
+}
+
+func (s *memoryCredentialStore) GetMFAChallenge(ctx context.Context, tokenHash string) (*models.MFAChallenge, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, challenge := range s.challenges {
+		if challenge.TokenHash == tokenHash && challenge.ConsumedAt == nil && challenge.ExpiresAt.After(time.Now()) {
+			copied := *challenge
+			return &copied, nil
+		}
+	}
+	return nil, ErrInvalidMFAChallenge
+}
+
+func (s *memoryCredentialStore) ConsumeMFAChallenge(ctx context.Context, id uuid.UUID) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, challenge := range s.challenges {
+		if challenge.ID == id && challenge.ConsumedAt == nil {
+			now := time.Now()
+			challenge.ConsumedAt = &now
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryCredentialStore) CreateOIDCFlow(ctx context.Context, flow *models.OIDCFlow) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_ = flow.BeforeCreate(nil)
+	stored := *flow
+	s.flows = append(s.flows, &stored)
+	return nil
+}
+
+func (s *memoryCredentialStore) GetOIDCFlow(ctx context.Context, tokenHash string) (*models.OIDCFlow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, flow := range s.flows {
+		if flow.TokenHash == tokenHash && flow.ConsumedAt == nil && flow.ExpiresAt.After(time.Now()) {
+			copied := *flow
+			return &copied, nil
+		}
+	}
+	return nil, ErrInvalidOIDCFlow
+}
+
+func (s *memoryCredentialStore) ConsumeOIDCFlow(ctx context.Context, id uuid.UUID) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, flow := range s.flows {
+		if flow.ID == id && flow.ConsumedAt == nil {
+			now := time.Now()
+			flow.ConsumedAt = &now
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryCredentialStore) CreateUserWithIdentity(ctx context.Context, user *models.User, identity *models.AuthIdentity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_ = user.BeforeCreate(nil)
+	identity.UserID = user.ID
+	if err := s.addIdentity(identity); err != nil {
+		return err
+	}
+	stored := *user
+	s.users[user.ID] = &stored
+	return nil
+}
+
+// addIdentity stores an identity unless its subject is linked already; s.mu must be held
+func (s *memoryCredentialStore) addIdentity(identity *models.AuthIdentity) error {
+	for _, existing := range s.identities {
+		if existing.Provider == identity.Provider && existing.ProviderUID == identity.ProviderUID {
+			return ErrIdentityTaken
+		}
+	}
+	identity.ID = uuid.New()
+	identity.CreatedAt = time.Now()
+	stored := *identity
+	s.identities = append(s.identities, &stored)
+	return nil
+}
+
+func (s *memoryCredentialStore) ListIdentities(ctx context.Context, userID uuid.UUID) ([]models.AuthIdentity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var identities []models.AuthIdentity
+	for _, identity := range s.identities {
+		if identity.UserID == userID {
+			identities = append(identities, *identity)
+		}
+	}
+	return identities, nil
+}
+
+func (s *memoryCredentialStore) DeleteIdentity(ctx context.Context, userID, identityID uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, identity := range s.identities {
+		if identity.ID == identityID && identity.UserID == userID {
+			s.identities = append(s.identities[:i], s.identities[i+1:]...)
+			return nil
+		}
+	}
+	return ErrIdentityNotFound
+}
+
+// credential returns the stored credential of a user
+func (s *memoryCredentialStore) credential(userID uuid.UUID) models.UserCredential {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *s.credentials[userID]
+}
+
+// session returns a copy of the stored session with the ID
+func (s *memoryCredentialStore) session(id uuid.UUID) models.Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, session := range s.sessions {
+		if session.ID == id {
+			return *session
+		}
+	}
+	return models.Session{}
+}
+
+// family returns copies of the stored sessions of a family
+func (s *memoryCredentialStore) family(familyID uuid.UUID) []models.Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var family []models.Session
+	for _, session := range s.sessions {
+		if session.FamilyID == familyID {
+			family = append(family, *session)
+		}
+	}
+	return family
+}
+
+// awaitEvent waits for the audit entry, which the service records in the background
+func (s *memoryCredentialStore) awaitEvent(t *testing.T, event string) models.AuthAudit {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		s.mu.Lock()
+		for _, audit := range s.events {
+			if audit.Event == event {
+				s.mu.Unlock()
+				return audit
+			}
+		}
+		s.mu.Unlock()
+	}
+	t.Fatalf("no %s audit entry was recorded", event)
+	return models.AuthAudit{}
+}
@@ -0,0 +1,492 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"borderless_coding_server/internal/models"
+	"borderless_coding_server/pkg/database"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// totpIssuer names the account in authenticator apps
+	totpIssuer = "Borderless Coding"
+	// mfaChallengeLifetime is how long a login has to pass its second factor
+	mfaChallengeLifetime = 5 * time.Minute
+	recoveryCodeCount    = 10
+	// maxMFAFailures wrong codes are accepted per mfaFailureWindow
+	maxMFAFailures   = 5
+	mfaFailureWindow = 15 * time.Minute
+	mfaAttempt       = "mfa"
+)
+
+// recoveryCodeAlphabet has 32 letters, so every random byte maps to one without bias
+const recoveryCodeAlphabet = "abcdefghijklmnopqrstuvwxyz234567"
+
+var (
+	// ErrMFAAlreadyEnabled is returned when enrolling a user who already has a second factor
+	ErrMFAAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	// ErrMFANotEnrolled is returned when using a second factor the user has not set up
+	ErrMFANotEnrolled = errors.New("two-factor authentication is not set up")
+	// ErrMFARequired is returned when disabling MFA the user's level requires
+	ErrMFARequired = errors.New("two-factor authentication is required for this account")
+	// ErrInvalidMFACode is returned for wrong, reused or expired TOTP and recovery codes
+	ErrInvalidMFACode = errors.New("invalid two-factor code")
+	// ErrInvalidMFAChallenge is returned for unknown or expired MFA challenge tokens
+	ErrInvalidMFAChallenge = errors.New("invalid or expired MFA challenge")
+	// ErrInvalidUserLevel is returned for levels that are not one of models.UserLevels
+	ErrInvalidUserLevel = errors.New("unknown user level")
+)
+
+// MFAChallengeError is returned by the login methods instead of a session when the user must
+// pass a second factor. Token is exchanged for the session with CompleteMFAChallenge; Enroll
+// is set for users whose level requires MFA but who have not set it up yet.
+type MFAChallengeError struct {
+	Token     string
+	ExpiresAt time.Time
+	Enroll    bool
+}
+
+func (e *MFAChallengeError) Error() string {
+	return "two-factor authentication required"
+}
+
+// TOTPEnrollment is the secret to add to an authenticator app, as text and as a URI for a
+// QR code
+type TOTPEnrollment struct {
+	Secret string
+	URI    string
+}
+
+// MFAStatus is whether the user has a second factor, whether their level requires one, and
+// how many recovery codes they have left
+type MFAStatus struct {
+	Enabled                bool
+	Required               bool
+	RecoveryCodesRemaining int64
+}
+
+// GetMFAStatus returns the user's MFA status
+func (s *AuthService) GetMFAStatus(ctx context.Context, userID uuid.UUID) (*MFAStatus, error) {
+	user, err := s.credentials.GetUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	required, err := s.credentials.IsMFARequired(ctx, user.Level)
+	if err != nil {
+		return nil, err
+	}
+	status := &MFAStatus{Required: required}
+
+	mfa, err := s.credentials.GetMFA(ctx, userID)
+	if err != nil || mfa == nil || !mfa.IsEnabled() {
+		return status, err
+	}
+	status.Enabled = true
+	status.RecoveryCodesRemaining, err = s.credentials.CountRecoveryCodes(ctx, userID)
+	return status, err
+}
+
+// BeginTOTPEnrollment creates a new TOTP secret for the user, replacing any pending one. It
+// is not used until ConfirmTOTPEnrollment checks a code from it.
+func (s *AuthService) BeginTOTPEnrollment(ctx context.Context, userID uuid.UUID) (*TOTPEnrollment, error) {
+	user, err := s.credentials.GetUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return s.beginTOTPEnrollment(ctx, user)
+}
+
+func (s *AuthService) beginTOTPEnrollment(ctx context.Context, user *models.User) (*TOTPEnrollment, error) {
+	mfa, err := s.credentials.GetMFA(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if mfa != nil && mfa.IsEnabled() {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.credentials.SaveMFA(ctx, &models.UserMFA{UserID: user.ID, TOTPSecret: secret}); err != nil {
+		return nil, err
+	}
+
+	account := user.ID.String()
+	if user.Email != nil && *user.Email != "" {
+		account = *user.Email
+	}
+	return &TOTPEnrollment{Secret: secret, URI: totpURI(totpIssuer, account, secret)}, nil
+}
+
+// ConfirmTOTPEnrollment enables the pending TOTP secret with a code from it and returns the
+// user's recovery codes. They are only ever shown here and by RegenerateRecoveryCodes.
+func (s *AuthService) ConfirmTOTPEnrollment(ctx context.Context, userID uuid.UUID, code, userAgent, ipAddress string) ([]string, error) {
+	mfa, err := s.credentials.GetMFA(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if mfa == nil {
+		return nil, ErrMFANotEnrolled
+	}
+	if mfa.IsEnabled() {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	return s.enableTOTP(ctx, mfa, code, userAgent, ipAddress)
+}
+
+// enableTOTP checks a code against a pending secret, enables it and issues recovery codes
+func (s *AuthService) enableTOTP(ctx context.Context, mfa *models.UserMFA, code, userAgent, ipAddress string) ([]string, error) {
+	if err := s.takeMFAAttempt(ctx, mfa.UserID); err != nil {
+		return nil, err
+	}
+	step, ok := verifyTOTP(mfa.TOTPSecret, normalizeMFACode(code), time.Now())
+	if !ok {
+		s.logAuthEvent(ctx, mfa.UserID, "mfa_failed", nil, ipAddress, userAgent, map[string]interface{}{
+			"method": "totp",
+			"reason": "enrollment",
+		})
+		return nil, ErrInvalidMFACode
+	}
+	if err := s.credentials.ResetAttempts(ctx, mfa.UserID, mfaAttempt); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	mfa.EnabledAt = &now
+	mfa.LastUsedStep = step
+	if err := s.credentials.SaveMFA(ctx, mfa); err != nil {
+		return nil, err
+	}
+	codes, err := s.newRecoveryCodes(ctx, mfa.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	s.logAuthEvent(ctx, mfa.UserID, "mfa_enabled", nil, ipAddress, userAgent, nil)
+	return codes, nil
+}
+
+// DisableMFA removes the user's second factor after checking a TOTP or recovery code.
+// Users whose level requires MFA cannot disable it.
+func (s *AuthService) DisableMFA(ctx context.Context, userID uuid.UUID, code, userAgent, ipAddress string) error {
+	user, err := s.credentials.GetUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	required, err := s.credentials.IsMFARequired(ctx, user.Level)
+	if err != nil {
+		return err
+	}
+	if required {
+		return ErrMFARequired
+	}
+
+	mfa, err := s.enabledMFA(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if err := s.verifySecondFactor(ctx, mfa, code, userAgent, ipAddress); err != nil {
+		return err
+	}
+	if err := s.credentials.DeleteMFA(ctx, userID); err != nil {
+		return err
+	}
+
+	s.logAuthEvent(ctx, userID, "mfa_disabled", nil, ipAddress, userAgent, nil)
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes after checking a TOTP or
+// recovery code, and returns the new ones
+func (s *AuthService) RegenerateRecoveryCodes(ctx context.Context, userID uuid.UUID, code, userAgent, ipAddress string) ([]string, error) {
+	mfa, err := s.enabledMFA(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.verifySecondFactor(ctx, mfa, code, userAgent, ipAddress); err != nil {
+		return nil, err
+	}
+	codes, err := s.newRecoveryCodes(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	s.logAuthEvent(ctx, userID, "mfa_recovery_codes_regenerated", nil, ipAddress, userAgent, nil)
+	return codes, nil
+}
+
+// requireMFA returns an *MFAChallengeError when the user has MFA enabled or their level
+// requires it, so the login methods hand out a challenge instead of a session
+func (s *AuthService) requireMFA(ctx context.Context, user *models.User, method, userAgent, ipAddress string) error {
+	mfa, err := s.credentials.GetMFA(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	enabled := mfa != nil && mfa.IsEnabled()
+	if !enabled {
+		required, err := s.credentials.IsMFARequired(ctx, user.Level)
+		if err != nil {
+			return err
+		}
+		if !required {
+			return nil
+		}
+	}
+
+	// The token is random and only its hash is stored, so challenges cannot be forged
+	token, err := s.generateRefreshToken()
+	if err != nil {
+		return err
+	}
+	challenge := models.MFAChallenge{
+		TokenHash: s.hashToken(token),
+		UserID:    user.ID,
+		Method:    method,
+		Enroll:    !enabled,
+		ExpiresAt: time.Now().Add(mfaChallengeLifetime),
+	}
+	if err := s.credentials.CreateMFAChallenge(ctx, &challenge); err != nil {
+		return fmt.Errorf("failed to store MFA challenge: %w", err)
+	}
+
+	s.logAuthEvent(ctx, user.ID, "mfa_challenge_issued", nil, ipAddress, userAgent, map[string]interface{}{
+		"method": method,
+		"enroll": !enabled,
+	})
+	return &MFAChallengeError{Token: token, ExpiresAt: challenge.ExpiresAt, Enroll: !enabled}
+}
+
+// BeginChallengeEnrollment starts TOTP enrollment during a login that needs it, for users
+// whose level requires MFA but who have not set it up
+func (s *AuthService) BeginChallengeEnrollment(ctx context.Context, challengeToken string) (*TOTPEnrollment, error) {
+	challenge, user, err := s.getMFAChallenge(ctx, challengeToken)
+	if err != nil {
+		return nil, err
+	}
+	if !challenge.Enroll {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	return s.beginTOTPEnrollment(ctx, user)
+}
+
+// CompleteMFAChallenge finishes a login with its challenge and a TOTP or recovery code,
+// returning the session with its refresh token. Logins that had to enroll confirm the
+// enrollment with the code and also get the new recovery codes. A wrong code leaves the
+// challenge for another try; a right one consumes it.
+func (s *AuthService) CompleteMFAChallenge(ctx context.Context, challengeToken, code, userAgent, ipAddress string) (*models.User, *models.Session, string, []string, error) {
+	challenge, user, err := s.getMFAChallenge(ctx, challengeToken)
+	if err != nil {
+		return nil, nil, "", nil, err
+	}
+	mfa, err := s.credentials.GetMFA(ctx, user.ID)
+	if err != nil {
+		return nil, nil, "", nil, err
+	}
+
+	var recoveryCodes []string
+	switch {
+	case mfa != nil && mfa.IsEnabled():
+		err = s.verifySecondFactor(ctx, mfa, code, userAgent, ipAddress)
+	case mfa != nil && challenge.Enroll:
+		recoveryCodes, err = s.enableTOTP(ctx, mfa, code, userAgent, ipAddress)
+	default:
+		err = ErrMFANotEnrolled
+	}
+	if err != nil {
+		return nil, nil, "", nil, err
+	}
+	consumed, err := s.credentials.ConsumeMFAChallenge(ctx, challenge.ID)
+	if err != nil {
+		return nil, nil, "", nil, err
+	}
+	if !consumed {
+		return nil, nil, "", nil, ErrInvalidMFAChallenge
+	}
+
+	session, refreshToken, err := s.CreateSession(ctx, user.ID, userAgent, ipAddress)
+	if err != nil {
+		return nil, nil, "", nil, fmt.Errorf("failed to create session: %w", err)
+	}
+
+	s.logAuthEvent(ctx, user.ID, "login_success", nil, ipAddress, userAgent, map[string]interface{}{
+		"method": challenge.Method,
+		"mfa":    true,
+	})
+	return user, session, refreshToken, recoveryCodes, nil
+}
+
+// getMFAChallenge looks up a pending challenge by its token and returns it with the still
+// active user it was issued to
+func (s *AuthService) getMFAChallenge(ctx context.Context, challengeToken string) (*models.MFAChallenge, *models.User, error) {
+	challenge, err := s.credentials.GetMFAChallenge(ctx, s.hashToken(challengeToken))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user, err := s.credentials.GetUser(ctx, challenge.UserID)
+	if errors.Is(err, ErrAccountNotFound) {
+		return nil, nil, ErrInvalidMFAChallenge
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if !user.IsActive {
+		return nil, nil, ErrAccountDisabled
+	}
+	return challenge, user, nil
+}
+
+// enabledMFA returns the user's confirmed second factor
+func (s *AuthService) enabledMFA(ctx context.Context, userID uuid.UUID) (*models.UserMFA, error) {
+	mfa, err := s.credentials.GetMFA(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if mfa == nil || !mfa.IsEnabled() {
+		return nil, ErrMFANotEnrolled
+	}
+	return mfa, nil
+}
+
+// verifySecondFactor checks a TOTP code, or uses up a recovery code. A TOTP code is only
+// accepted once.
+func (s *AuthService) verifySecondFactor(ctx context.Context, mfa *models.UserMFA, code, userAgent, ipAddress string) error {
+	if err := s.takeMFAAttempt(ctx, mfa.UserID); err != nil {
+		return err
+	}
+
+	code = normalizeMFACode(code)
+	method := "totp"
+	ok := false
+	var err error
+	if len(code) == totpDigits {
+		if step, matched := verifyTOTP(mfa.TOTPSecret, code, time.Now()); matched {
+			ok, err = s.credentials.UseTOTPStep(ctx, mfa.UserID, step)
+		}
+	} else {
+		method = "recovery_code"
+		ok, err = s.credentials.UseRecoveryCode(ctx, mfa.UserID, s.hashToken(code))
+	}
+	if err != nil {
+		return err
+	}
+	if !ok {
+		s.logAuthEvent(ctx, mfa.UserID, "mfa_failed", nil, ipAddress, userAgent, map[string]interface{}{
+			"method": method,
+		})
+		return ErrInvalidMFACode
+	}
+	if err := s.credentials.ResetAttempts(ctx, mfa.UserID, mfaAttempt); err != nil {
+		return err
+	}
+
+	if method == "recovery_code" {
+		s.logAuthEvent(ctx, mfa.UserID, "mfa_recovery_code_used", nil, ipAddress, userAgent, nil)
+	}
+	return nil
+}
+
+// takeMFAAttempt counts a code check, returning ErrTooManyAttempts after too many recent
+// wrong codes. Counting before the check keeps concurrent guesses within the limit; a right
+// code clears the count.
+func (s *AuthService) takeMFAAttempt(ctx context.Context, userID uuid.UUID) error {
+	allowed, err := s.credentials.TakeAttempt(ctx, userID, mfaAttempt, maxMFAFailures, mfaFailureWindow)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return ErrTooManyAttempts
+	}
+	return nil
+}
+
+// newRecoveryCodes replaces the user's recovery codes and returns the new ones
+func (s *AuthService) newRecoveryCodes(ctx context.Context, userID uuid.UUID) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+		hashes[i] = s.hashToken(normalizeMFACode(code))
+	}
+	if err := s.credentials.ReplaceRecoveryCodes(ctx, userID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// generateRecoveryCode returns a random 50-bit code formatted as xxxxx-xxxxx
+func generateRecoveryCode() (string, error) {
+	random := make([]byte, 10)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	code := make([]byte, len(random))
+	for i, b := range random {
+		code[i] = recoveryCodeAlphabet[int(b)%len(recoveryCodeAlphabet)]
+	}
+	return string(code[:5]) + "-" + string(code[5:]), nil
+}
+
+// normalizeMFACode drops the spaces and dashes users type or paste with codes
+func normalizeMFACode(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(strings.TrimSpace(code)))
+}
+
+// ListMFAPolicies returns the MFA policy of every user level, lowest level first
+func (s *AuthService) ListMFAPolicies(ctx context.Context) ([]models.MFAPolicy, error) {
+	var stored []models.MFAPolicy
+	if err := database.DB.WithContext(ctx).Find(&stored).Error; err != nil {
+		return nil, err
+	}
+	byLevel := make(map[models.UserLevel]models.MFAPolicy, len(stored))
+	for _, policy := range stored {
+		byLevel[policy.Level] = policy
+	}
+
+	policies := make([]models.MFAPolicy, 0, len(models.UserLevels))
+	for _, level := range models.UserLevels {
+		policy, ok := byLevel[level]
+		if !ok {
+			policy = models.MFAPolicy{Level: level}
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+// SetMFAPolicy sets whether users of a level must sign in with a second factor. Users who
+// have not set one up are asked to on their next login; existing sessions are kept.
+func (s *AuthService) SetMFAPolicy(ctx context.Context, level models.UserLevel, required bool, adminID uuid.UUID, userAgent, ipAddress string) (*models.MFAPolicy, error) {
+	if !level.IsValid() {
+		return nil, ErrInvalidUserLevel
+	}
+
+	policy := models.MFAPolicy{Level: level, Required: required, UpdatedBy: &adminID}
+	err := database.DB.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "level"}},
+		DoUpdates: clause.AssignmentColumns([]string{"required", "updated_by", "updated_at"}),
+	}).Create(&policy).Error
+	if err != nil {
+		return nil, err
+	}
+
+	s.logAuthEvent(ctx, adminID, "mfa_policy_changed", nil, ipAddress, userAgent, map[string]interface{}{
+		"level":    string(level),
+		"required": required,
+	})
+	return &policy, nil
+}
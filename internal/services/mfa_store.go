@@ -0,0 +1,148 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"borderless_coding_server/internal/models"
+	"borderless_coding_server/pkg/database"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// MFAStore persists second factors, recovery codes and the per-level MFA policy
+type MFAStore interface {
+	// GetMFA returns the user's TOTP enrollment, or nil if they have none
+	GetMFA(ctx context.Context, userID uuid.UUID) (*models.UserMFA, error)
+	// SaveMFA creates or replaces the user's TOTP enrollment
+	SaveMFA(ctx context.Context, mfa *models.UserMFA) error
+	// DeleteMFA removes the user's TOTP enrollment and recovery codes
+	DeleteMFA(ctx context.Context, userID uuid.UUID) error
+	// UseTOTPStep records the step of an accepted code, reporting false if it or a later
+	// step was already used
+	UseTOTPStep(ctx context.Context, userID uuid.UUID, step int64) (bool, error)
+	// ReplaceRecoveryCodes replaces the user's recovery codes with new hashes
+	ReplaceRecoveryCodes(ctx context.Context, userID uuid.UUID, hashes []string) error
+	// UseRecoveryCode marks an unused recovery code as used, reporting whether there was one
+	UseRecoveryCode(ctx context.Context, userID uuid.UUID, hash string) (bool, error)
+	CountRecoveryCodes(ctx context.Context, userID uuid.UUID) (int64, error)
+	IsMFARequired(ctx context.Context, level models.UserLevel) (bool, error)
+	CreateMFAChallenge(ctx context.Context, challenge *models.MFAChallenge) error
+	// GetMFAChallenge returns the unconsumed, unexpired challenge with the token hash, or
+	// ErrInvalidMFAChallenge
+	GetMFAChallenge(ctx context.Context, tokenHash string) (*models.MFAChallenge, error)
+	// ConsumeMFAChallenge marks the challenge consumed, reporting false if it already was
+	ConsumeMFAChallenge(ctx context.Context, id uuid.UUID) (bool, error)
+}
+
+// GetMFA returns the user's TOTP enrollment, or nil if they have none
+func (s *DBCredentialStore) GetMFA(ctx context.Context, userID uuid.UUID) (*models.UserMFA, error) {
+	var mfa models.UserMFA
+	err := database.DB.WithContext(ctx).Where("user_id = ?", userID).First(&mfa).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &mfa, nil
+}
+
+// SaveMFA creates or replaces the user's TOTP enrollment
+func (s *DBCredentialStore) SaveMFA(ctx context.Context, mfa *models.UserMFA) error {
+	return database.DB.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"totp_secret", "enabled_at", "last_used_step", "updated_at"}),
+	}).Create(mfa).Error
+}
+
+// DeleteMFA removes the user's TOTP enrollment and recovery codes in one transaction
+func (s *DBCredentialStore) DeleteMFA(ctx context.Context, userID uuid.UUID) error {
+	return database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&models.MFARecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).Delete(&models.UserMFA{}).Error
+	})
+}
+
+// UseTOTPStep moves the user's last used step forward; concurrent uses of one code race on
+// the condition and only one wins
+func (s *DBCredentialStore) UseTOTPStep(ctx context.Context, userID uuid.UUID, step int64) (bool, error) {
+	result := database.DB.WithContext(ctx).Model(&models.UserMFA{}).
+		Where("user_id = ? AND last_used_step < ?", userID, step).
+		Update("last_used_step", step)
+	return result.RowsAffected == 1, result.Error
+}
+
+// ReplaceRecoveryCodes deletes the user's recovery codes and stores the new hashes
+func (s *DBCredentialStore) ReplaceRecoveryCodes(ctx context.Context, userID uuid.UUID, hashes []string) error {
+	return database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&models.MFARecoveryCode{}).Error; err != nil {
+			return err
+		}
+		codes := make([]models.MFARecoveryCode, len(hashes))
+		for i, hash := range hashes {
+			codes[i] = models.MFARecoveryCode{UserID: userID, CodeHash: hash}
+		}
+		return tx.Create(&codes).Error
+	})
+}
+
+// UseRecoveryCode marks one of the user's unused recovery codes as used
+func (s *DBCredentialStore) UseRecoveryCode(ctx context.Context, userID uuid.UUID, hash string) (bool, error) {
+	result := database.DB.WithContext(ctx).Model(&models.MFARecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hash).
+		Update("used_at", time.Now())
+	return result.RowsAffected > 0, result.Error
+}
+
+// CountRecoveryCodes counts the user's unused recovery codes
+func (s *DBCredentialStore) CountRecoveryCodes(ctx context.Context, userID uuid.UUID) (int64, error) {
+	var count int64
+	err := database.DB.WithContext(ctx).Model(&models.MFARecoveryCode{}).
+		Where("user_id = ? AND used_at IS NULL", userID).
+		Count(&count).Error
+	return count, err
+}
+
+// IsMFARequired reports whether the level's policy requires a second factor
+func (s *DBCredentialStore) IsMFARequired(ctx context.Context, level models.UserLevel) (bool, error) {
+	var policy models.MFAPolicy
+	err := database.DB.WithContext(ctx).Where("level = ?", level).First(&policy).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	return policy.Required, err
+}
+
+// CreateMFAChallenge stores a new challenge
+func (s *DBCredentialStore) CreateMFAChallenge(ctx context.Context, challenge *models.MFAChallenge) error {
+	return database.DB.WithContext(ctx).Create(challenge).Error
+}
+
+// GetMFAChallenge returns the unconsumed, unexpired challenge with the token hash
+func (s *DBCredentialStore) GetMFAChallenge(ctx context.Context, tokenHash string) (*models.MFAChallenge, error) {
+	var challenge models.MFAChallenge
+	err := database.DB.WithContext(ctx).
+		Where("token_hash = ? AND consumed_at IS NULL AND expires_at > ?", tokenHash, time.Now()).
+		First(&challenge).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidMFAChallenge
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &challenge, nil
+}
+
+// ConsumeMFAChallenge marks the challenge consumed unless it already was
+func (s *DBCredentialStore) ConsumeMFAChallenge(ctx context.Context, id uuid.UUID) (bool, error) {
+	result := database.DB.WithContext(ctx).Model(&models.MFAChallenge{}).
+		Where("id = ? AND consumed_at IS NULL", id).
+		Update("consumed_at", time.Now())
+	return result.RowsAffected > 0, result.Error
+}
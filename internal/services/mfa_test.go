@@ -0,0 +1,199 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"borderless_coding_server/internal/models"
+)
+
+func TestTOTPMatchesRFC6238(t *testing.T) {
+	// RFC 6238 appendix B SHA-1 vectors, truncated to 6 digits
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, code := range vectors {
+		now := time.Unix(unix, 0)
+		step, ok := verifyTOTP(secret, code, now)
+		if !ok || step != totpStep(now) {
+			t.Errorf("code %s at %d: step = %d, ok = %v", code, unix, step, ok)
+		}
+	}
+
+	// One step of drift either way is accepted, two are not
+	now := time.Unix(1111111111, 0)
+	for offset, want := range map[int64]bool{-2: false, -1: true, 1: true, 2: false} {
+		code := hotp([]byte("12345678901234567890"), totpStep(now)+offset)
+		if _, ok := verifyTOTP(secret, code, now); ok != want {
+			t.Errorf("code %d steps away: ok = %v, want %v", offset, ok, want)
+		}
+	}
+
+	uri, err := url.Parse(totpURI("Borderless Coding", "ada@example.com", secret))
+	if err != nil || uri.Scheme != "otpauth" || uri.Host != "totp" || uri.Path != "/Borderless Coding:ada@example.com" || uri.Query().Get("secret") != secret {
+		t.Errorf("otpauth URI = %v, %v", uri, err)
+	}
+}
+
+// currentTOTP returns the code for a step from now
+func currentTOTP(t *testing.T, secret string, steps int64) string {
+	t.Helper()
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hotp(key, totpStep(time.Now())+steps)
+}
+
+func TestLoginWithMFA(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryCredentialStore()
+	s := newTestAuthService(store)
+
+	user, err := s.RegisterWithPassword(ctx, "ada@example.com", nil, PasswordDigest("correct horse"), "test", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("RegisterWithPassword: %v", err)
+	}
+	enrollment, err := s.BeginTOTPEnrollment(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("BeginTOTPEnrollment: %v", err)
+	}
+	code := currentTOTP(t, enrollment.Secret, 0)
+	recoveryCodes, err := s.ConfirmTOTPEnrollment(ctx, user.ID, code, "test", "127.0.0.1")
+	if err != nil || len(recoveryCodes) != recoveryCodeCount {
+		t.Fatalf("ConfirmTOTPEnrollment: %d codes, %v", len(recoveryCodes), err)
+	}
+
+	_, _, _, err = s.LoginWithPassword(ctx, "ada@example.com", PasswordDigest("correct horse"), "test", "127.0.0.1")
+	var challenge *MFAChallengeError
+	if !errors.As(err, &challenge) || challenge.Enroll {
+		t.Fatalf("LoginWithPassword with MFA: err = %v, want an MFA challenge", err)
+	}
+
+	// The code that confirmed the enrollment cannot be replayed
+	if _, _, _, _, err := s.CompleteMFAChallenge(ctx, challenge.Token, code, "test", "127.0.0.1"); !errors.Is(err, ErrInvalidMFACode) {
+		t.Errorf("replayed TOTP code: err = %v, want ErrInvalidMFACode", err)
+	}
+	loggedIn, session, _, _, err := s.CompleteMFAChallenge(ctx, challenge.Token, currentTOTP(t, enrollment.Secret, 1), "test", "127.0.0.1")
+	if err != nil || loggedIn.ID != user.ID || session.UserID != user.ID {
+		t.Fatalf("CompleteMFAChallenge with the next TOTP code: %v", err)
+	}
+	if _, _, _, _, err := s.CompleteMFAChallenge(ctx, challenge.Token, recoveryCodes[1], "test", "127.0.0.1"); !errors.Is(err, ErrInvalidMFAChallenge) {
+		t.Errorf("completed challenge: err = %v, want ErrInvalidMFAChallenge", err)
+	}
+
+	// Recovery codes work once, with or without their dash
+	login := func() string {
+		t.Helper()
+		_, _, _, err := s.LoginWithPassword(ctx, "ada@example.com", PasswordDigest("correct horse"), "test", "127.0.0.1")
+		var challenge *MFAChallengeError
+		if !errors.As(err, &challenge) {
+			t.Fatalf("LoginWithPassword with MFA: err = %v, want an MFA challenge", err)
+		}
+		return challenge.Token
+	}
+	recovery := recoveryCodes[0][:5] + recoveryCodes[0][6:]
+	if _, _, _, _, err := s.CompleteMFAChallenge(ctx, login(), recovery, "test", "127.0.0.1"); err != nil {
+		t.Errorf("CompleteMFAChallenge with a recovery code: %v", err)
+	}
+	token := login()
+	if _, _, _, _, err := s.CompleteMFAChallenge(ctx, token, recoveryCodes[0], "test", "127.0.0.1"); !errors.Is(err, ErrInvalidMFACode) {
+		t.Errorf("reused recovery code: err = %v, want ErrInvalidMFACode", err)
+	}
+	if _, _, _, _, err := s.CompleteMFAChallenge(ctx, token+"x", recoveryCodes[1], "test", "127.0.0.1"); !errors.Is(err, ErrInvalidMFAChallenge) {
+		t.Errorf("tampered challenge: err = %v, want ErrInvalidMFAChallenge", err)
+	}
+	if _, _, _, _, err := s.CompleteMFAChallenge(ctx, token, recoveryCodes[1], "test", "127.0.0.1"); err != nil {
+		t.Errorf("CompleteMFAChallenge after a wrong code: %v", err)
+	}
+}
+
+func TestLoginEnrollsWhenLevelRequiresMFA(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryCredentialStore()
+	s := newTestAuthService(store)
+
+	user, err := s.RegisterWithPassword(ctx, "grace@example.com", nil, PasswordDigest("hunter2"), "test", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("RegisterWithPassword: %v", err)
+	}
+	if _, _, _, err := s.LoginWithPassword(ctx, "grace@example.com", PasswordDigest("hunter2"), "test", "127.0.0.1"); err != nil {
+		t.Fatalf("LoginWithPassword without MFA: %v", err)
+	}
+	store.mfaRequired[models.UserLevelFree] = true
+
+	_, _, _, err = s.LoginWithPassword(ctx, "grace@example.com", PasswordDigest("hunter2"), "test", "127.0.0.1")
+	var challenge *MFAChallengeError
+	if !errors.As(err, &challenge) || !challenge.Enroll {
+		t.Fatalf("LoginWithPassword with MFA required: err = %v, want an enrollment challenge", err)
+	}
+	if _, _, _, _, err := s.CompleteMFAChallenge(ctx, challenge.Token, "123456", "test", "127.0.0.1"); !errors.Is(err, ErrMFANotEnrolled) {
+		t.Errorf("completing before enrolling: err = %v, want ErrMFANotEnrolled", err)
+	}
+
+	enrollment, err := s.BeginChallengeEnrollment(ctx, challenge.Token)
+	if err != nil {
+		t.Fatalf("BeginChallengeEnrollment: %v", err)
+	}
+	_, session, _, recoveryCodes, err := s.CompleteMFAChallenge(ctx, challenge.Token, currentTOTP(t, enrollment.Secret, 0), "test", "127.0.0.1")
+	if err != nil || session.UserID != user.ID || len(recoveryCodes) != recoveryCodeCount {
+		t.Fatalf("CompleteMFAChallenge while enrolling: %d recovery codes, %v", len(recoveryCodes), err)
+	}
+	if err := s.DisableMFA(ctx, user.ID, recoveryCodes[0], "test", "127.0.0.1"); !errors.Is(err, ErrMFARequired) {
+		t.Errorf("DisableMFA with MFA required: err = %v, want ErrMFARequired", err)
+	}
+}
+
+func TestMFAFailureLimit(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryCredentialStore()
+	s := newTestAuthService(store)
+
+	user, err := s.RegisterWithPassword(ctx, "radia@example.com", nil, PasswordDigest("spanning tree"), "test", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("RegisterWithPassword: %v", err)
+	}
+	enrollment, err := s.BeginTOTPEnrollment(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("BeginTOTPEnrollment: %v", err)
+	}
+	recoveryCodes, err := s.ConfirmTOTPEnrollment(ctx, user.ID, currentTOTP(t, enrollment.Secret, 0), "test", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("ConfirmTOTPEnrollment: %v", err)
+	}
+
+	// Wrong codes count against the limit, even when they are checked concurrently
+	var wg sync.WaitGroup
+	results := make(chan error, 2*maxMFAFailures)
+	for i := 0; i < 2*maxMFAFailures; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.RegenerateRecoveryCodes(ctx, user.ID, "aaaaa-aaaaa", "test", "127.0.0.1")
+			results <- err
+		}()
+	}
+	wg.Wait()
+	close(results)
+	limited := 0
+	for err := range results {
+		if errors.Is(err, ErrTooManyAttempts) {
+			limited++
+		}
+	}
+	if limited != maxMFAFailures {
+		t.Errorf("%d of %d concurrent wrong codes were limited, want %d", limited, 2*maxMFAFailures, maxMFAFailures)
+	}
+	if _, err := s.RegenerateRecoveryCodes(ctx, user.ID, recoveryCodes[0], "test", "127.0.0.1"); !errors.Is(err, ErrTooManyAttempts) {
+		t.Errorf("right code after %d failures: err = %v, want ErrTooManyAttempts", maxMFAFailures, err)
+	}
+}
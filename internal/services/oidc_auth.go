@@ -0,0 +1,319 @@
+package services
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"time"
+
+	"borderless_coding_server/internal/models"
+
+	"github.com/google/uuid"
+	"golang.org/x/oauth2"
+)
+
+// oidcFlowLifetime is how long a user has to sign in at the provider and come back
+const oidcFlowLifetime = 10 * time.Minute
+
+var (
+	// ErrInvalidOIDCFlow is returned for unknown or expired flow tokens, and callbacks whose
+	// state does not match the flow
+	ErrInvalidOIDCFlow = errors.New("invalid or expired sign-in flow")
+	// ErrOIDCAccountExists is returned when a provider's email belongs to an account that cannot
+	// be linked automatically; the user has to log in and link the provider themselves
+	ErrOIDCAccountExists = errors.New("an account with this email already exists")
+)
+
+// OIDCAuthorization is where to send the user to sign in at a provider. FlowToken is passed
+// back with the callback's code and state.
+type OIDCAuthorization struct {
+	URL       string
+	State     string
+	FlowToken string
+	ExpiresAt time.Time
+}
+
+// OIDCProviders returns the configured OIDC providers
+func (s *AuthService) OIDCProviders() []*OIDCProvider {
+	return s.oidc.List()
+}
+
+// BeginOIDCLogin starts signing in with a provider
+func (s *AuthService) BeginOIDCLogin(ctx context.Context, providerName string) (*OIDCAuthorization, error) {
+	return s.beginOIDCFlow(ctx, providerName, nil)
+}
+
+// BeginOIDCLink starts linking a provider to the user's account
+func (s *AuthService) BeginOIDCLink(ctx context.Context, userID uuid.UUID, providerName string) (*OIDCAuthorization, error) {
+	return s.beginOIDCFlow(ctx, providerName, &userID)
+}
+
+// beginOIDCFlow creates the state, nonce and PKCE verifier of a flow and stores them under a
+// random flow token. The client holds the token; it never goes to the provider.
+func (s *AuthService) beginOIDCFlow(ctx context.Context, providerName string, linkUserID *uuid.UUID) (*OIDCAuthorization, error) {
+	provider, err := s.oidc.Get(providerName)
+	if err != nil {
+		return nil, err
+	}
+	state, err := s.generateRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := s.generateRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	authURL, err := provider.authCodeURL(ctx, state, nonce, verifier)
+	if err != nil {
+		return nil, err
+	}
+
+	flowToken, err := s.generateRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	flow := models.OIDCFlow{
+		TokenHash:  s.hashToken(flowToken),
+		Provider:   provider.Name,
+		State:      state,
+		Nonce:      nonce,
+		Verifier:   verifier,
+		LinkUserID: linkUserID,
+		ExpiresAt:  time.Now().Add(oidcFlowLifetime),
+	}
+	if err := s.credentials.CreateOIDCFlow(ctx, &flow); err != nil {
+		return nil, fmt.Errorf("failed to store OIDC flow: %w", err)
+	}
+
+	return &OIDCAuthorization{URL: authURL, State: state, FlowToken: flowToken, ExpiresAt: flow.ExpiresAt}, nil
+}
+
+// finishOIDCFlow checks the callback against its flow, consumes the flow and exchanges the
+// code for the provider's verified claims. Login flows pass a nil linkUserID; link flows must
+// have been started by linkUserID, or a link URL could be planted on someone else.
+func (s *AuthService) finishOIDCFlow(ctx context.Context, providerName, flowToken, state, code string, linkUserID *uuid.UUID) (*OIDCProvider, *OIDCIDClaims, error) {
+	provider, err := s.oidc.Get(providerName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	flow, err := s.credentials.GetOIDCFlow(ctx, s.hashToken(flowToken))
+	if err != nil {
+		return nil, nil, err
+	}
+	if flow.Provider != provider.Name || (flow.LinkUserID == nil) != (linkUserID == nil) {
+		return nil, nil, ErrInvalidOIDCFlow
+	}
+	if linkUserID != nil && *flow.LinkUserID != *linkUserID {
+		return nil, nil, ErrInvalidOIDCFlow
+	}
+	if subtle.ConstantTimeCompare([]byte(flow.State), []byte(state)) != 1 {
+		return nil, nil, ErrInvalidOIDCFlow
+	}
+	consumed, err := s.credentials.ConsumeOIDCFlow(ctx, flow.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !consumed {
+		return nil, nil, ErrInvalidOIDCFlow
+	}
+
+	claims, err := provider.exchange(ctx, code, flow.Verifier, flow.Nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	return provider, claims, nil
+}
+
+// CompleteOIDCLogin finishes signing in with a provider and returns the new session with its
+// refresh token, or an *MFAChallengeError for users who need a second factor. New subjects
+// are linked to the account with their email when both the provider and the account have
+// verified it, and get a new account when no account has it.
+func (s *AuthService) CompleteOIDCLogin(ctx context.Context, providerName, flowToken, state, code, userAgent, ipAddress string) (*models.User, *models.Session, string, error) {
+	provider, claims, err := s.finishOIDCFlow(ctx, providerName, flowToken, state, code, nil)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	authProvider := models.AuthProvider(provider.Name)
+
+	user, err := s.oidcUser(ctx, authProvider, claims, userAgent, ipAddress)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if !user.IsActive {
+		return nil, nil, "", ErrAccountDisabled
+	}
+	if err := s.requireMFA(ctx, user, provider.Name, userAgent, ipAddress); err != nil {
+		return nil, nil, "", err
+	}
+
+	session, refreshToken, err := s.CreateSession(ctx, user.ID, userAgent, ipAddress)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to create session: %w", err)
+	}
+
+	s.logAuthEvent(ctx, user.ID, "login_success", &authProvider, ipAddress, userAgent, map[string]interface{}{
+		"subject": claims.Subject,
+		"email":   claims.Email,
+	})
+	return user, session, refreshToken, nil
+}
+
+// oidcUser returns the account of a provider's subject, linking or creating one the first
+// time the subject signs in
+func (s *AuthService) oidcUser(ctx context.Context, provider models.AuthProvider, claims *OIDCIDClaims, userAgent, ipAddress string) (*models.User, error) {
+	identity, err := s.credentials.FindIdentity(ctx, provider, claims.Subject)
+	if err == nil {
+		return s.credentials.GetUser(ctx, identity.UserID)
+	}
+	if !errors.Is(err, ErrIdentityNotFound) {
+		return nil, err
+	}
+
+	emailVerified := bool(claims.EmailVerified)
+	identity = &models.AuthIdentity{
+		Provider:    provider,
+		ProviderUID: claims.Subject,
+	}
+	if claims.Email != "" {
+		identity.EmailAtSignup = &claims.Email
+		identity.EmailVerified = &emailVerified
+
+		existing, err := s.credentials.FindUserByEmail(ctx, claims.Email)
+		if err != nil && !errors.Is(err, ErrAccountNotFound) {
+			return nil, err
+		}
+		if existing != nil {
+			// Only a verified email on both sides shows the provider's user owns the account
+			if !emailVerified || !existing.IsEmailVerified() {
+				return nil, ErrOIDCAccountExists
+			}
+			identity.UserID = existing.ID
+			if err := s.credentials.LinkIdentity(ctx, identity); err != nil {
+				return nil, err
+			}
+			s.logAuthEvent(ctx, existing.ID, "identity_linked", &provider, ipAddress, userAgent, map[string]interface{}{
+				"subject":   claims.Subject,
+				"automatic": true,
+			})
+			return existing, nil
+		}
+	}
+
+	user := &models.User{
+		IsActive: true,
+		Metadata: models.JSONB{
+			"picture":     claims.Picture,
+			"given_name":  claims.GivenName,
+			"family_name": claims.FamilyName,
+		},
+	}
+	// Unverified emails are left off so they cannot block their owner from registering
+	if claims.Email != "" && emailVerified {
+		now := time.Now()
+		user.Email = &claims.Email
+		user.EmailVerifiedAt = &now
+	}
+	if name := claims.Name; name != "" {
+		user.DisplayName = &name
+	} else if name := claims.PreferredUsername; name != "" {
+		user.DisplayName = &name
+	}
+	if err := s.credentials.CreateUserWithIdentity(ctx, user, identity); err != nil {
+		return nil, err
+	}
+
+	s.logAuthEvent(ctx, user.ID, "register_success", &provider, ipAddress, userAgent, map[string]interface{}{
+		"subject": claims.Subject,
+		"email":   claims.Email,
+	})
+	return user, nil
+}
+
+// CompleteOIDCLink finishes linking a provider to the user's account. Linking a subject the
+// user already has is a no-op; one linked to another account fails with ErrIdentityTaken.
+func (s *AuthService) CompleteOIDCLink(ctx context.Context, userID uuid.UUID, providerName, flowToken, state, code, userAgent, ipAddress string) (*models.AuthIdentity, error) {
+	provider, claims, err := s.finishOIDCFlow(ctx, providerName, flowToken, state, code, &userID)
+	if err != nil {
+		return nil, err
+	}
+	authProvider := models.AuthProvider(provider.Name)
+
+	identity, err := s.credentials.FindIdentity(ctx, authProvider, claims.Subject)
+	if err == nil {
+		if identity.UserID != userID {
+			return nil, ErrIdentityTaken
+		}
+		return identity, nil
+	}
+	if !errors.Is(err, ErrIdentityNotFound) {
+		return nil, err
+	}
+
+	emailVerified := bool(claims.EmailVerified)
+	identity = &models.AuthIdentity{
+		UserID:      userID,
+		Provider:    authProvider,
+		ProviderUID: claims.Subject,
+	}
+	if claims.Email != "" {
+		identity.EmailAtSignup = &claims.Email
+		identity.EmailVerified = &emailVerified
+	}
+	if err := s.credentials.LinkIdentity(ctx, identity); err != nil {
+		return nil, err
+	}
+
+	s.logAuthEvent(ctx, userID, "identity_linked", &authProvider, ipAddress, userAgent, map[string]interface{}{
+		"subject": claims.Subject,
+	})
+	return identity, nil
+}
+
+// ListIdentities returns the external identities linked to the user's account
+func (s *AuthService) ListIdentities(ctx context.Context, userID uuid.UUID) ([]models.AuthIdentity, error) {
+	return s.credentials.ListIdentities(ctx, userID)
+}
+
+// UnlinkIdentity removes one of the user's external identities, as long as they can still
+// sign in with another identity, their email or a password
+func (s *AuthService) UnlinkIdentity(ctx context.Context, userID, identityID uuid.UUID, userAgent, ipAddress string) error {
+	identities, err := s.credentials.ListIdentities(ctx, userID)
+	if err != nil {
+		return err
+	}
+	var target *models.AuthIdentity
+	for i := range identities {
+		if identities[i].ID == identityID {
+			target = &identities[i]
+		}
+	}
+	if target == nil {
+		return ErrIdentityNotFound
+	}
+
+	if len(identities) == 1 {
+		user, err := s.credentials.GetUser(ctx, userID)
+		if err != nil {
+			return err
+		}
+		cred, err := s.credentials.GetCredential(ctx, userID)
+		if err != nil && !errors.Is(err, ErrAccountNotFound) {
+			return err
+		}
+		if (user.Email == nil || *user.Email == "") && (cred == nil || !cred.HasPassword()) {
+			return ErrLastSignInMethod
+		}
+	}
+
+	if err := s.credentials.DeleteIdentity(ctx, userID, identityID); err != nil {
+		return err
+	}
+	s.logAuthEvent(ctx, userID, "identity_unlinked", &target.Provider, ipAddress, userAgent, map[string]interface{}{
+		"subject": target.ProviderUID,
+	})
+	return nil
+}
@@ -0,0 +1,403 @@
+package services
+
+import (
+	"context"
+	"crypto"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"borderless_coding_server/config"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// oidcMetadataTTL is how long discovery documents and key sets are cached
+	oidcMetadataTTL = time.Hour
+	// oidcKeyRefetchInterval limits refetching the key set for tokens signed with unknown keys
+	oidcKeyRefetchInterval = time.Minute
+	// oidcClockSkew is tolerated when checking ID token times
+	oidcClockSkew = time.Minute
+	// oidcMaxDocumentBytes bounds discovery, key set and userinfo responses
+	oidcMaxDocumentBytes = 1 << 20
+)
+
+// oidcSigningMethods are the ID token algorithms accepted; never HMAC or none
+var oidcSigningMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// oidcProviderNamePattern is what provider names may look like; they appear in URLs and
+// are stored on identities
+var oidcProviderNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+
+var (
+	// ErrUnknownOIDCProvider is returned for providers that are not configured
+	ErrUnknownOIDCProvider = errors.New("unknown sign-in provider")
+	// ErrInvalidIDToken is returned for ID tokens that fail verification
+	ErrInvalidIDToken = errors.New("invalid ID token")
+)
+
+// OIDCProvider is an OpenID Connect provider users can sign in with. Its endpoints and keys
+// are discovered from the issuer when first needed and cached.
+type OIDCProvider struct {
+	Name        string
+	DisplayName string
+
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	scopes       []string
+	client       *http.Client
+
+	mu         sync.Mutex
+	metadata   *oidcMetadata
+	metadataAt time.Time
+	keys       map[string]crypto.PublicKey
+	keysAt     time.Time
+}
+
+// oidcMetadata is the part of the discovery document the login flow uses
+type oidcMetadata struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	UserinfoEndpoint      string   `json:"userinfo_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	CodeChallengeMethods  []string `json:"code_challenge_methods_supported"`
+}
+
+// OIDCIDClaims are the claims of a verified ID token, completed from the userinfo endpoint
+// when the token leaves out the email
+type OIDCIDClaims struct {
+	Nonce             string   `json:"nonce"`
+	AuthorizedParty   string   `json:"azp"`
+	Email             string   `json:"email"`
+	EmailVerified     oidcBool `json:"email_verified"`
+	Name              string   `json:"name"`
+	PreferredUsername string   `json:"preferred_username"`
+	GivenName         string   `json:"given_name"`
+	FamilyName        string   `json:"family_name"`
+	Picture           string   `json:"picture"`
+	jwt.RegisteredClaims
+}
+
+// oidcBool is a boolean claim some providers send as a string
+type oidcBool bool
+
+func (b *oidcBool) UnmarshalJSON(data []byte) error {
+	switch strings.Trim(string(data), `"`) {
+	case "true":
+		*b = true
+	case "false", "null":
+		*b = false
+	default:
+		return fmt.Errorf("invalid boolean %s", data)
+	}
+	return nil
+}
+
+// OIDCRegistry holds the configured OIDC providers by name
+type OIDCRegistry struct {
+	providers map[string]*OIDCProvider
+	names     []string // in configuration order
+}
+
+// NewOIDCRegistry checks the provider configurations and returns the registry. client is used
+// for discovery, key sets, token exchange and userinfo; nil means a client with a timeout.
+func NewOIDCRegistry(providers []config.OIDCProviderConfig, client *http.Client) (*OIDCRegistry, error) {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	registry := &OIDCRegistry{providers: make(map[string]*OIDCProvider)}
+	for _, cfg := range providers {
+		if !oidcProviderNamePattern.MatchString(cfg.Name) || cfg.Name == "password" {
+			return nil, fmt.Errorf("invalid OIDC provider name %q", cfg.Name)
+		}
+		if _, ok := registry.providers[cfg.Name]; ok {
+			return nil, fmt.Errorf("OIDC provider %q is configured twice", cfg.Name)
+		}
+		if cfg.ClientID == "" || cfg.RedirectURL == "" {
+			return nil, fmt.Errorf("OIDC provider %q needs a client ID and redirect URL", cfg.Name)
+		}
+		if err := checkIssuerURL(cfg.Issuer); err != nil {
+			return nil, fmt.Errorf("OIDC provider %q: %w", cfg.Name, err)
+		}
+		scopes := cfg.Scopes
+		if len(scopes) == 0 {
+			scopes = []string{"openid", "email", "profile"}
+		}
+		displayName := cfg.DisplayName
+		if displayName == "" {
+			displayName = cfg.Name
+		}
+
+		registry.providers[cfg.Name] = &OIDCProvider{
+			Name:         cfg.Name,
+			DisplayName:  displayName,
+			issuer:       cfg.Issuer,
+			clientID:     cfg.ClientID,
+			clientSecret: cfg.ClientSecret,
+			redirectURL:  cfg.RedirectURL,
+			scopes:       scopes,
+			client:       client,
+		}
+		registry.names = append(registry.names, cfg.Name)
+	}
+	return registry, nil
+}
+
+// checkIssuerURL requires HTTPS issuers, except on loopback addresses for local testing
+func checkIssuerURL(issuer string) error {
+	u, err := url.Parse(issuer)
+	if err != nil || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("invalid issuer %q", issuer)
+	}
+	if u.Scheme == "https" {
+		return nil
+	}
+	host := u.Hostname()
+	if ip := net.ParseIP(host); u.Scheme == "http" && (host == "localhost" || (ip != nil && ip.IsLoopback())) {
+		return nil
+	}
+	return fmt.Errorf("issuer %q must use https", issuer)
+}
+
+// Get returns a configured provider
+func (r *OIDCRegistry) Get(name string) (*OIDCProvider, error) {
+	if r != nil {
+		if provider, ok := r.providers[name]; ok {
+			return provider, nil
+		}
+	}
+	return nil, ErrUnknownOIDCProvider
+}
+
+// List returns the configured providers in configuration order
+func (r *OIDCRegistry) List() []*OIDCProvider {
+	if r == nil {
+		return nil
+	}
+	providers := make([]*OIDCProvider, len(r.names))
+	for i, name := range r.names {
+		providers[i] = r.providers[name]
+	}
+	return providers
+}
+
+// discover returns the provider's discovery document, fetching it when the cached one is old
+func (p *OIDCProvider) discover(ctx context.Context) (*oidcMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.metadata != nil && time.Since(p.metadataAt) < oidcMetadataTTL {
+		return p.metadata, nil
+	}
+
+	var metadata oidcMetadata
+	wellKnown := strings.TrimSuffix(p.issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(ctx, wellKnown, "", &metadata); err != nil {
+		return nil, fmt.Errorf("failed to discover %s: %w", p.Name, err)
+	}
+	// The issuer must match exactly, or tokens from another issuer could be accepted (OIDC Discovery 4.3)
+	if metadata.Issuer != p.issuer {
+		return nil, fmt.Errorf("%s discovery document is for issuer %q, not %q", p.Name, metadata.Issuer, p.issuer)
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, fmt.Errorf("%s discovery document lacks an endpoint", p.Name)
+	}
+	// Providers that list their PKCE methods must support S256; the others get it anyway
+	if len(metadata.CodeChallengeMethods) > 0 && !slices.Contains(metadata.CodeChallengeMethods, "S256") {
+		return nil, fmt.Errorf("%s does not support PKCE with S256", p.Name)
+	}
+
+	p.metadata = &metadata
+	p.metadataAt = time.Now()
+	return p.metadata, nil
+}
+
+// key returns the provider's public key with the kid. The key set is refetched when it is
+// old, or when a token names a key it does not have and it was not just fetched.
+func (p *OIDCProvider) key(ctx context.Context, metadata *oidcMetadata, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.lookupKey(kid); ok && time.Since(p.keysAt) < oidcMetadataTTL {
+		return key, nil
+	}
+	if p.keys != nil && time.Since(p.keysAt) < oidcKeyRefetchInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var set JWKS
+	if err := p.getJSON(ctx, metadata.JWKSURI, "", &set); err != nil {
+		return nil, fmt.Errorf("failed to fetch %s keys: %w", p.Name, err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		// Keys that fail to parse, e.g. of unsupported types, are skipped
+		if key, err := jwk.PublicKey(); err == nil {
+			keys[jwk.KeyID] = key
+		}
+	}
+	p.keys = keys
+	p.keysAt = time.Now()
+
+	if key, ok := p.lookupKey(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// lookupKey finds a cached key. Tokens without a kid can only use a set with one key.
+func (p *OIDCProvider) lookupKey(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, ok := p.keys[kid]
+	return key, ok
+}
+
+// oauth2Config returns the OAuth 2.0 client for the discovered endpoints
+func (p *OIDCProvider) oauth2Config(metadata *oidcMetadata) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     p.clientID,
+		ClientSecret: p.clientSecret,
+		RedirectURL:  p.redirectURL,
+		Scopes:       p.scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  metadata.AuthorizationEndpoint,
+			TokenURL: metadata.TokenEndpoint,
+		},
+	}
+}
+
+// authCodeURL returns where to send the user to sign in, with PKCE (S256) and a nonce
+func (p *OIDCProvider) authCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	return p.oauth2Config(metadata).AuthCodeURL(state,
+		oauth2.S256ChallengeOption(verifier),
+		oauth2.SetAuthURLParam("nonce", nonce)), nil
+}
+
+// exchange trades an authorization code for tokens and returns the verified ID token claims
+func (p *OIDCProvider) exchange(ctx context.Context, code, verifier, nonce string) (*OIDCIDClaims, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := p.oauth2Config(metadata).Exchange(context.WithValue(ctx, oauth2.HTTPClient, p.client), code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange code with %s: %w", p.Name, err)
+	}
+	rawIDToken, _ := token.Extra("id_token").(string)
+	if rawIDToken == "" {
+		return nil, fmt.Errorf("%s returned no ID token: %w", p.Name, ErrInvalidIDToken)
+	}
+
+	claims, err := p.verifyIDToken(ctx, metadata, rawIDToken, nonce)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Email == "" && metadata.UserinfoEndpoint != "" {
+		if err := p.fillFromUserinfo(ctx, metadata, token.AccessToken, claims); err != nil {
+			return nil, err
+		}
+	}
+	return claims, nil
+}
+
+// verifyIDToken checks an ID token's signature against the provider's keys, its issuer,
+// audience, times and nonce (OIDC Core 3.1.3.7)
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, metadata *oidcMetadata, rawIDToken, nonce string) (*OIDCIDClaims, error) {
+	claims := &OIDCIDClaims{}
+	_, err := jwt.ParseWithClaims(rawIDToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.key(ctx, metadata, kid)
+	},
+		jwt.WithValidMethods(oidcSigningMethods),
+		jwt.WithIssuer(p.issuer),
+		jwt.WithAudience(p.clientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(oidcClockSkew))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: no subject", ErrInvalidIDToken)
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidIDToken)
+	}
+	if (len(claims.Audience) > 1 || claims.AuthorizedParty != "") && claims.AuthorizedParty != p.clientID {
+		return nil, fmt.Errorf("%w: issued to %q", ErrInvalidIDToken, claims.AuthorizedParty)
+	}
+	return claims, nil
+}
+
+// fillFromUserinfo completes the profile claims the ID token left out from the userinfo
+// endpoint, which must describe the same subject
+func (p *OIDCProvider) fillFromUserinfo(ctx context.Context, metadata *oidcMetadata, accessToken string, claims *OIDCIDClaims) error {
+	var info OIDCIDClaims
+	if err := p.getJSON(ctx, metadata.UserinfoEndpoint, accessToken, &info); err != nil {
+		return fmt.Errorf("failed to get %s userinfo: %w", p.Name, err)
+	}
+	if info.Subject != claims.Subject {
+		return fmt.Errorf("%s userinfo is for another subject", p.Name)
+	}
+
+	claims.Email, claims.EmailVerified = info.Email, info.EmailVerified
+	if claims.Name == "" {
+		claims.Name = info.Name
+	}
+	if claims.PreferredUsername == "" {
+		claims.PreferredUsername = info.PreferredUsername
+	}
+	if claims.Picture == "" {
+		claims.Picture = info.Picture
+	}
+	return nil
+}
+
+// getJSON fetches a JSON document, with a bearer token if one is given
+func (p *OIDCProvider) getJSON(ctx context.Context, endpoint, bearer string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: status %d", endpoint, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, oidcMaxDocumentBytes)).Decode(v)
+}
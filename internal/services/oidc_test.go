@@ -0,0 +1,267 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"borderless_coding_server/config"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// mockOIDCServer is a local OpenID Connect provider. It skips the login page: authorize
+// issues a code for a user straight from the authorization URL.
+type mockOIDCServer struct {
+	*httptest.Server
+	t   *testing.T
+	key *SigningKey
+
+	mu    sync.Mutex
+	codes map[string]mockAuthorization
+}
+
+// mockAuthorization is what a code was issued for, and the ID token claims it returns
+type mockAuthorization struct {
+	challenge string
+	claims    jwt.MapClaims
+}
+
+func newMockOIDCServer(t *testing.T) *mockOIDCServer {
+	key, err := GenerateSigningKey(SigningAlgorithmEdDSA, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockOIDCServer{t: t, key: key, codes: make(map[string]mockAuthorization)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(oidcMetadata{
+			Issuer:                m.URL,
+			AuthorizationEndpoint: m.URL + "/authorize",
+			TokenEndpoint:         m.URL + "/token",
+			JWKSURI:               m.URL + "/jwks",
+			CodeChallengeMethods:  []string{"S256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(JWKS{Keys: []JWK{key.JWK()}})
+	})
+	mux.HandleFunc("/token", m.token)
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// authorize signs a user in at the authorization URL and returns the code and state the
+// provider redirects back with. tamper can change the ID token claims.
+func (m *mockOIDCServer) authorize(authURL, subject, email string, emailVerified bool, tamper func(jwt.MapClaims)) (string, string) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	query := u.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("client_id") != "test-client" {
+		m.t.Fatalf("authorization URL without PKCE or client: %s", authURL)
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":            m.URL,
+		"sub":            subject,
+		"aud":            "test-client",
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          query.Get("nonce"),
+		"email":          email,
+		"email_verified": emailVerified,
+		"name":           "Ada Lovelace",
+	}
+	if tamper != nil {
+		tamper(claims)
+	}
+
+	code := uuid.NewString()
+	m.mu.Lock()
+	m.codes[code] = mockAuthorization{challenge: query.Get("code_challenge"), claims: claims}
+	m.mu.Unlock()
+	return code, query.Get("state")
+}
+
+// token exchanges a code once, for the verifier it was issued with
+func (m *mockOIDCServer) token(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	authorization, ok := m.codes[r.PostFormValue("code")]
+	delete(m.codes, r.PostFormValue("code"))
+	m.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != authorization.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, authorization.claims)
+	token.Header["kid"] = m.key.ID
+	idToken, err := token.SignedString(m.key.private)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+func newOIDCTestAuthService(t *testing.T, store CredentialStore, issuer string) *AuthService {
+	registry, err := NewOIDCRegistry([]config.OIDCProviderConfig{{
+		Name:        "keycloak",
+		Issuer:      issuer,
+		ClientID:    "test-client",
+		RedirectURL: "http://localhost/login/oidc/keycloak",
+	}}, nil)
+	if err != nil {
+		t.Fatalf("NewOIDCRegistry: %v", err)
+	}
+	return NewAuthService("", "", "", nil, store, NewPasswordHasher(testArgon2Params), nil, registry)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	ctx := context.Background()
+	provider := newMockOIDCServer(t)
+	s := newOIDCTestAuthService(t, newMemoryCredentialStore(), provider.URL)
+
+	login := func(subject string, tamper func(jwt.MapClaims), changeState bool) (string, error) {
+		t.Helper()
+		authorization, err := s.BeginOIDCLogin(ctx, "keycloak")
+		if err != nil {
+			t.Fatalf("BeginOIDCLogin: %v", err)
+		}
+		code, state := provider.authorize(authorization.URL, subject, "ada@example.com", true, tamper)
+		if changeState {
+			state += "x"
+		}
+		user, _, _, err := s.CompleteOIDCLogin(ctx, "keycloak", authorization.FlowToken, state, code, "test", "127.0.0.1")
+		if err != nil {
+			return "", err
+		}
+		return user.ID.String(), nil
+	}
+
+	first, err := login("subject-1", nil, false)
+	if err != nil {
+		t.Fatalf("first OIDC login: %v", err)
+	}
+	if again, err := login("subject-1", nil, false); err != nil || again != first {
+		t.Errorf("second OIDC login: user %s, %v; want %s", again, err, first)
+	}
+
+	if _, err := login("subject-1", nil, true); !errors.Is(err, ErrInvalidOIDCFlow) {
+		t.Errorf("mismatched state: err = %v, want ErrInvalidOIDCFlow", err)
+	}
+	for name, tamper := range map[string]func(jwt.MapClaims){
+		"nonce":    func(c jwt.MapClaims) { c["nonce"] = "replayed" },
+		"audience": func(c jwt.MapClaims) { c["aud"] = "another-client" },
+		"issuer":   func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" },
+		"expiry":   func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+	} {
+		if _, err := login("subject-1", tamper, false); !errors.Is(err, ErrInvalidIDToken) {
+			t.Errorf("ID token with wrong %s: err = %v, want ErrInvalidIDToken", name, err)
+		}
+	}
+
+	// A flow token works for one callback
+	used, err := s.BeginOIDCLogin(ctx, "keycloak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, state := provider.authorize(used.URL, "subject-1", "ada@example.com", true, nil)
+	if _, _, _, err := s.CompleteOIDCLogin(ctx, "keycloak", used.FlowToken, state, code, "test", "127.0.0.1"); err != nil {
+		t.Fatalf("CompleteOIDCLogin: %v", err)
+	}
+	code, state = provider.authorize(used.URL, "subject-1", "ada@example.com", true, nil)
+	if _, _, _, err := s.CompleteOIDCLogin(ctx, "keycloak", used.FlowToken, state, code, "test", "127.0.0.1"); !errors.Is(err, ErrInvalidOIDCFlow) {
+		t.Errorf("reused flow token: err = %v, want ErrInvalidOIDCFlow", err)
+	}
+
+	// A code only works with the verifier of the flow it was issued for
+	stolen, err := s.BeginOIDCLogin(ctx, "keycloak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ = provider.authorize(stolen.URL, "subject-1", "ada@example.com", true, nil)
+	other, err := s.BeginOIDCLogin(ctx, "keycloak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := s.CompleteOIDCLogin(ctx, "keycloak", other.FlowToken, other.State, code, "test", "127.0.0.1"); err == nil {
+		t.Error("code exchanged with another flow's PKCE verifier")
+	}
+}
+
+func TestOIDCAccountLinking(t *testing.T) {
+	ctx := context.Background()
+	provider := newMockOIDCServer(t)
+	store := newMemoryCredentialStore()
+	s := newOIDCTestAuthService(t, store, provider.URL)
+
+	user, err := s.RegisterWithPassword(ctx, "ada@example.com", nil, PasswordDigest("correct horse"), "test", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("RegisterWithPassword: %v", err)
+	}
+
+	// The account's email is unverified, so signing in with the provider cannot take it over
+	authorization, err := s.BeginOIDCLogin(ctx, "keycloak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, state := provider.authorize(authorization.URL, "subject-1", "ada@example.com", true, nil)
+	if _, _, _, err := s.CompleteOIDCLogin(ctx, "keycloak", authorization.FlowToken, state, code, "test", "127.0.0.1"); !errors.Is(err, ErrOIDCAccountExists) {
+		t.Fatalf("OIDC login with an unverified account's email: err = %v, want ErrOIDCAccountExists", err)
+	}
+
+	link, err := s.BeginOIDCLink(ctx, user.ID, "keycloak")
+	if err != nil {
+		t.Fatalf("BeginOIDCLink: %v", err)
+	}
+	code, state = provider.authorize(link.URL, "subject-1", "ada@example.com", true, nil)
+	if _, _, _, err := s.CompleteOIDCLogin(ctx, "keycloak", link.FlowToken, state, code, "test", "127.0.0.1"); !errors.Is(err, ErrInvalidOIDCFlow) {
+		t.Errorf("link flow used to log in: err = %v, want ErrInvalidOIDCFlow", err)
+	}
+	code, state = provider.authorize(link.URL, "subject-1", "ada@example.com", true, nil)
+	identity, err := s.CompleteOIDCLink(ctx, user.ID, "keycloak", link.FlowToken, state, code, "test", "127.0.0.1")
+	if err != nil || identity.UserID != user.ID {
+		t.Fatalf("CompleteOIDCLink: %v", err)
+	}
+
+	authorization, err = s.BeginOIDCLogin(ctx, "keycloak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, state = provider.authorize(authorization.URL, "subject-1", "ada@example.com", true, nil)
+	loggedIn, _, _, err := s.CompleteOIDCLogin(ctx, "keycloak", authorization.FlowToken, state, code, "test", "127.0.0.1")
+	if err != nil || loggedIn.ID != user.ID {
+		t.Fatalf("OIDC login after linking: %v", err)
+	}
+
+	if err := s.UnlinkIdentity(ctx, user.ID, identity.ID, "test", "127.0.0.1"); err != nil {
+		t.Errorf("UnlinkIdentity with a password left: %v", err)
+	}
+	if identities, _ := s.ListIdentities(ctx, user.ID); len(identities) != 0 {
+		t.Errorf("identities after unlinking: %d, want 0", len(identities))
+	}
+}
@@ -0,0 +1,114 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"borderless_coding_server/internal/models"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+// ErrInvalidPasswordHash is returned for stored hashes in an unknown format
+var ErrInvalidPasswordHash = errors.New("invalid password hash")
+
+// Argon2Params are the Argon2id cost parameters new password hashes are made with
+type Argon2Params struct {
+	Memory      uint32 // KiB
+	Iterations  uint32
+	Parallelism uint8
+}
+
+// PasswordHasher hashes passwords with Argon2id into PHC strings, as in
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>. Hashes are computed over the SHA-256 digest
+// of the password, which is all that clients using the RSA envelope send.
+type PasswordHasher struct {
+	params Argon2Params
+}
+
+func NewPasswordHasher(params Argon2Params) *PasswordHasher {
+	return &PasswordHasher{params: params}
+}
+
+// PasswordDigest returns the SHA-256 digest of a password that hashes are computed over
+func PasswordDigest(password string) []byte {
+	sum := sha256.Sum256([]byte(password))
+	return sum[:]
+}
+
+// Hash hashes a password digest with a new random salt
+func (h *PasswordHasher) Hash(digest []byte) (string, error) {
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey(digest, salt, h.params.Iterations, h.params.Memory, h.params.Parallelism, argon2KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.params.Memory, h.params.Iterations, h.params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verify checks a password digest against a stored credential. needsRehash is set when the
+// password matched a legacy SHA-256 hash or Argon2id parameters other than the current ones.
+func (h *PasswordHasher) Verify(digest []byte, cred *models.UserCredential) (ok, needsRehash bool, err error) {
+	if !cred.HasPassword() {
+		return false, false, nil
+	}
+	encoded := *cred.PasswordHash
+
+	if !strings.HasPrefix(encoded, "$") {
+		// Legacy scheme: hex(sha256(salt || digest))
+		if cred.Salt == nil {
+			return false, false, ErrInvalidPasswordHash
+		}
+		sum := sha256.Sum256(append([]byte(*cred.Salt), digest...))
+		ok = subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(encoded)) == 1
+		return ok, ok, nil
+	}
+
+	params, salt, key, err := decodeArgon2Hash(encoded)
+	if err != nil {
+		return false, false, err
+	}
+	computed := argon2.IDKey(digest, salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+	ok = subtle.ConstantTimeCompare(computed, key) == 1
+	return ok, ok && params != h.params, nil
+}
+
+// decodeArgon2Hash parses an Argon2id PHC string
+func decodeArgon2Hash(encoded string) (Argon2Params, []byte, []byte, error) {
+	var params Argon2Params
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+	return params, salt, key, nil
+}
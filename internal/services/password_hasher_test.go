@@ -0,0 +1,58 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"borderless_coding_server/internal/models"
+)
+
+// Cheap parameters keep the tests fast
+var testArgon2Params = Argon2Params{Memory: 1024, Iterations: 1, Parallelism: 1}
+
+func TestPasswordHasherArgon2id(t *testing.T) {
+	h := NewPasswordHasher(testArgon2Params)
+	encoded, err := h.Hash(PasswordDigest("correct horse"))
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Fatalf("hash %q is not an Argon2id PHC string", encoded)
+	}
+	cred := &models.UserCredential{PasswordHash: &encoded}
+
+	if ok, rehash, err := h.Verify(PasswordDigest("correct horse"), cred); !ok || rehash || err != nil {
+		t.Errorf("Verify(correct) = %v, %v, %v; want true, false, nil", ok, rehash, err)
+	}
+	if ok, _, err := h.Verify(PasswordDigest("wrong horse"), cred); ok || err != nil {
+		t.Errorf("Verify(wrong) = %v, %v; want false, nil", ok, err)
+	}
+
+	// Hashes made with other parameters still verify, and are flagged for an upgrade
+	stronger := NewPasswordHasher(Argon2Params{Memory: 2048, Iterations: 1, Parallelism: 1})
+	if ok, rehash, err := stronger.Verify(PasswordDigest("correct horse"), cred); !ok || !rehash || err != nil {
+		t.Errorf("Verify with new parameters = %v, %v, %v; want true, true, nil", ok, rehash, err)
+	}
+
+	corrupt := "$argon2id$v=19$m=1024,t=1,p=1$not base64!$"
+	if _, _, err := h.Verify(PasswordDigest("correct horse"), &models.UserCredential{PasswordHash: &corrupt}); err == nil {
+		t.Error("Verify accepted a corrupt hash")
+	}
+}
+
+func TestPasswordHasherLegacySHA256(t *testing.T) {
+	h := NewPasswordHasher(testArgon2Params)
+	salt := "legacy-salt"
+	sum := sha256.Sum256(append([]byte(salt), PasswordDigest("hunter2")...))
+	legacy := hex.EncodeToString(sum[:])
+	cred := &models.UserCredential{PasswordHash: &legacy, Salt: &salt}
+
+	if ok, rehash, err := h.Verify(PasswordDigest("hunter2"), cred); !ok || !rehash || err != nil {
+		t.Errorf("Verify(correct) = %v, %v, %v; want true, true, nil", ok, rehash, err)
+	}
+	if ok, rehash, _ := h.Verify(PasswordDigest("hunter3"), cred); ok || rehash {
+		t.Errorf("Verify(wrong) = %v, %v; want false, false", ok, rehash)
+	}
+}
@@ -0,0 +1,298 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"borderless_coding_server/internal/models"
+	"borderless_coding_server/pkg/database"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrInvalidPhoneNumber is returned for numbers that are not in E.164 format
+	ErrInvalidPhoneNumber = errors.New("phone number must be in E.164 format, as in +14155550100")
+	// ErrPhoneTaken is returned when adding a number another account has verified
+	ErrPhoneTaken = errors.New("phone number already registered")
+	// ErrPhoneNotFound is returned for phones that do not exist or belong to another user
+	ErrPhoneNotFound = errors.New("phone not found")
+	// ErrLastSignInMethod is returned when removing the only way the user can sign in
+	ErrLastSignInMethod = errors.New("cannot remove the last way to sign in")
+)
+
+// e164Pattern is a plus sign and up to 15 digits, without a leading zero
+var e164Pattern = regexp.MustCompile(`^\+[1-9][0-9]{7,14}$`)
+
+// phoneSeparators are dropped from numbers before they are checked
+var phoneSeparators = strings.NewReplacer(" ", "", "-", "", "(", "", ")", "", ".", "")
+
+// NormalizeE164 returns a phone number in E.164 format, ignoring spaces, dashes, dots and
+// parentheses. Numbers must include the + and country code.
+func NormalizeE164(number string) (string, error) {
+	normalized := phoneSeparators.Replace(strings.TrimSpace(number))
+	if !e164Pattern.MatchString(normalized) {
+		return "", ErrInvalidPhoneNumber
+	}
+	return normalized, nil
+}
+
+// ListPhones returns the user's phone numbers, primary first
+func (s *AuthService) ListPhones(ctx context.Context, userID uuid.UUID) ([]models.UserPhone, error) {
+	var phones []models.UserPhone
+	err := database.DB.WithContext(ctx).
+		Where("user_id = ?", userID).
+		Order("is_primary DESC, created_at").
+		Find(&phones).Error
+	return phones, err
+}
+
+// AddPhone adds a phone number to the user and texts it a code to verify it with. Adding a
+// number the user already added sends a new code. Numbers other accounts added but never
+// verified are taken over.
+func (s *AuthService) AddPhone(ctx context.Context, userID uuid.UUID, number, userAgent, ipAddress string) (*models.UserPhone, error) {
+	e164, err := NormalizeE164(number)
+	if err != nil {
+		return nil, err
+	}
+
+	var phone models.UserPhone
+	err = database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("e164 = ?", e164).First(&phone).Error
+		switch {
+		case err == nil && phone.UserID == userID:
+			return nil
+		case err == nil && phone.IsVerified():
+			return ErrPhoneTaken
+		case err == nil:
+			if err := tx.Delete(&phone).Error; err != nil {
+				return err
+			}
+		case !errors.Is(err, gorm.ErrRecordNotFound):
+			return err
+		}
+
+		phone = models.UserPhone{UserID: userID, E164: e164}
+		return tx.Create(&phone).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	if phone.IsVerified() {
+		return &phone, nil
+	}
+
+	if err := s.sendVerificationToken(ctx, userID, models.TokenPurposePhoneVerify, e164); err != nil {
+		return nil, err
+	}
+	s.logAuthEvent(ctx, userID, "phone_otp_sent", nil, ipAddress, userAgent, map[string]interface{}{
+		"phone_id": phone.ID.String(),
+		"purpose":  string(models.TokenPurposePhoneVerify),
+	})
+	return &phone, nil
+}
+
+// VerifyPhone verifies one of the user's phones with the code texted to it. The first verified
+// phone becomes the primary one.
+func (s *AuthService) VerifyPhone(ctx context.Context, userID, phoneID uuid.UUID, code, userAgent, ipAddress string) (*models.UserPhone, error) {
+	phone, err := findUserPhone(ctx, userID, phoneID)
+	if err != nil {
+		return nil, err
+	}
+	if phone.IsVerified() {
+		return phone, nil
+	}
+
+	token, err := s.CheckOTP(ctx, models.TokenPurposePhoneVerify, phone.E164, code)
+	if err == nil && (token.UserID == nil || *token.UserID != userID) {
+		err = ErrInvalidVerificationToken
+	}
+	if err != nil {
+		if token != nil {
+			s.logAuthEvent(ctx, userID, "phone_verify_failed", nil, ipAddress, userAgent, map[string]interface{}{
+				"phone_id": phone.ID.String(),
+			})
+		}
+		return nil, err
+	}
+
+	err = database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var primaries int64
+		if err := tx.Model(&models.UserPhone{}).
+			Where("user_id = ? AND is_primary AND verified_at IS NOT NULL", userID).
+			Count(&primaries).Error; err != nil {
+			return err
+		}
+		now := time.Now()
+		phone.VerifiedAt = &now
+		phone.IsPrimary = primaries == 0
+		return tx.Model(phone).Updates(map[string]interface{}{
+			"verified_at": phone.VerifiedAt,
+			"is_primary":  phone.IsPrimary,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.logAuthEvent(ctx, userID, "phone_verified", nil, ipAddress, userAgent, map[string]interface{}{
+		"phone_id": phone.ID.String(),
+	})
+	return phone, nil
+}
+
+// RemovePhone removes one of the user's phones, promoting another verified phone if it was
+// the primary one. Users without an email or linked account keep their last verified phone.
+func (s *AuthService) RemovePhone(ctx context.Context, userID, phoneID uuid.UUID, userAgent, ipAddress string) error {
+	phone, err := findUserPhone(ctx, userID, phoneID)
+	if err != nil {
+		return err
+	}
+
+	err = database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var others []models.UserPhone
+		if err := tx.Where("user_id = ? AND id <> ? AND verified_at IS NOT NULL", userID, phone.ID).
+			Order("created_at").
+			Find(&others).Error; err != nil {
+			return err
+		}
+
+		if phone.IsVerified() && len(others) == 0 {
+			var user models.User
+			if err := tx.Where("id = ?", userID).First(&user).Error; err != nil {
+				return err
+			}
+			var identities int64
+			if err := tx.Model(&models.AuthIdentity{}).Where("user_id = ?", userID).Count(&identities).Error; err != nil {
+				return err
+			}
+			if (user.Email == nil || *user.Email == "") && identities == 0 {
+				return ErrLastSignInMethod
+			}
+		}
+
+		if err := tx.Delete(phone).Error; err != nil {
+			return err
+		}
+		if phone.IsPrimary && len(others) > 0 {
+			return tx.Model(&others[0]).Update("is_primary", true).Error
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.logAuthEvent(ctx, userID, "phone_removed", nil, ipAddress, userAgent, map[string]interface{}{
+		"phone_id": phone.ID.String(),
+	})
+	return nil
+}
+
+// RequestPhoneLoginCode texts a sign-in code to a verified phone. Like RequestMagicLink,
+// unknown numbers, deactivated accounts and throttled numbers are ignored without an error.
+func (s *AuthService) RequestPhoneLoginCode(ctx context.Context, number, userAgent, ipAddress string) error {
+	e164, err := NormalizeE164(number)
+	if err != nil {
+		return err
+	}
+
+	var phone models.UserPhone
+	err = database.DB.WithContext(ctx).Preload("User").
+		Where("e164 = ? AND verified_at IS NOT NULL", e164).
+		First(&phone).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	if !phone.User.IsActive || phone.User.DeletedAt.Valid {
+		return nil
+	}
+
+	err = s.sendVerificationToken(ctx, phone.UserID, models.TokenPurposePhoneLogin, e164)
+	if errors.Is(err, ErrTooManyAttempts) {
+		s.logAuthEvent(ctx, phone.UserID, "phone_otp_throttled", nil, ipAddress, userAgent, nil)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	s.logAuthEvent(ctx, phone.UserID, "phone_otp_sent", nil, ipAddress, userAgent, map[string]interface{}{
+		"phone_id": phone.ID.String(),
+		"purpose":  string(models.TokenPurposePhoneLogin),
+	})
+	return nil
+}
+
+// LoginWithPhone starts a session with a code from RequestPhoneLoginCode, returning it with
+// its refresh token, or an *MFAChallengeError for users who need a second factor
+func (s *AuthService) LoginWithPhone(ctx context.Context, number, code, userAgent, ipAddress string) (*models.User, *models.Session, string, error) {
+	e164, err := NormalizeE164(number)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	token, err := s.CheckOTP(ctx, models.TokenPurposePhoneLogin, e164, code)
+	if err != nil {
+		if token != nil && token.UserID != nil {
+			s.logAuthEvent(ctx, *token.UserID, "login_failed", nil, ipAddress, userAgent, map[string]interface{}{
+				"method": "phone_otp",
+				"reason": "wrong_code",
+			})
+		}
+		return nil, nil, "", err
+	}
+	if token.UserID == nil {
+		return nil, nil, "", ErrInvalidVerificationToken
+	}
+
+	// The number must still be verified on the account the code was sent for
+	var user models.User
+	err = database.DB.WithContext(ctx).
+		Joins("JOIN user_phones ON user_phones.user_id = users.id").
+		Where("users.id = ? AND users.deleted_at IS NULL AND user_phones.e164 = ? AND user_phones.verified_at IS NOT NULL", *token.UserID, e164).
+		First(&user).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, "", ErrInvalidVerificationToken
+		}
+		return nil, nil, "", err
+	}
+	if !user.IsActive {
+		return nil, nil, "", ErrAccountDisabled
+	}
+	if err := s.requireMFA(ctx, &user, "phone_otp", userAgent, ipAddress); err != nil {
+		return nil, nil, "", err
+	}
+
+	session, refreshToken, err := s.CreateSession(ctx, user.ID, userAgent, ipAddress)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to create session: %w", err)
+	}
+
+	s.logAuthEvent(ctx, user.ID, "login_success", nil, ipAddress, userAgent, map[string]interface{}{
+		"method": "phone_otp",
+	})
+	return &user, session, refreshToken, nil
+}
+
+// findUserPhone returns one of the user's phones
+func findUserPhone(ctx context.Context, userID, phoneID uuid.UUID) (*models.UserPhone, error) {
+	var phone models.UserPhone
+	err := database.DB.WithContext(ctx).Where("id = ? AND user_id = ?", phoneID, userID).First(&phone).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrPhoneNotFound
+		}
+		return nil, err
+	}
+	return &phone, nil
+}
@@ -0,0 +1,76 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+
+	"borderless_coding_server/internal/models"
+)
+
+func TestNormalizeE164(t *testing.T) {
+	valid := map[string]string{
+		"+14155550100":        "+14155550100",
+		" +1 (415) 555-0100 ": "+14155550100",
+		"+886.912.345.678":    "+886912345678",
+		"+441234567890123":    "+441234567890123",
+	}
+	for in, want := range valid {
+		if got, err := NormalizeE164(in); err != nil || got != want {
+			t.Errorf("NormalizeE164(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+
+	for _, in := range []string{"", "4155550100", "+04155550100", "+1415555", "+1234567890123456", "+1 415 555 O100", "++14155550100"} {
+		if _, err := NormalizeE164(in); !errors.Is(err, ErrInvalidPhoneNumber) {
+			t.Errorf("NormalizeE164(%q): err = %v, want ErrInvalidPhoneNumber", in, err)
+		}
+	}
+}
+
+func TestGenerateOTP(t *testing.T) {
+	pattern := regexp.MustCompile(`^[0-9]{6}$`)
+	for i := 0; i < 100; i++ {
+		code, err := generateOTP()
+		if err != nil {
+			t.Fatalf("generateOTP: %v", err)
+		}
+		if !pattern.MatchString(code) {
+			t.Fatalf("code %q is not 6 digits", code)
+		}
+	}
+}
+
+// recordingSMSSender keeps the text messages it is asked to send
+type recordingSMSSender struct {
+	to, body []string
+}
+
+func (s *recordingSMSSender) SendSMS(ctx context.Context, to, body string) error {
+	s.to = append(s.to, to)
+	s.body = append(s.body, body)
+	return nil
+}
+
+func TestRoutingSenderTextsPhoneCodes(t *testing.T) {
+	sms := &recordingSMSSender{}
+	mail := &recordingMailer{}
+	s := NewRoutingSender(NewEmailSender(mail, "https://app.example.com"), NewSMSCodeSender(sms))
+	ctx := context.Background()
+
+	if err := s.SendVerification(ctx, models.TokenPurposePhoneLogin, "+14155550100", "042424"); err != nil {
+		t.Fatalf("SendVerification(phone_login): %v", err)
+	}
+	if len(sms.body) != 1 || sms.to[0] != "+14155550100" || !strings.Contains(sms.body[0], "042424") || !strings.Contains(sms.body[0], "10 minutes") {
+		t.Errorf("texted %q to %q", sms.body, sms.to)
+	}
+
+	if err := s.SendVerification(ctx, models.TokenPurposeEmailLogin, "ada@example.com", "token"); err != nil {
+		t.Fatalf("SendVerification(email_login): %v", err)
+	}
+	if len(mail.sent) != 1 || len(sms.body) != 1 {
+		t.Errorf("email token went to %d mailer and %d SMS sends, want 1 and 1", len(mail.sent), len(sms.body))
+	}
+}
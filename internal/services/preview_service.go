@@ -0,0 +1,688 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"borderless_coding_server/internal/models"
+	"borderless_coding_server/pkg/database"
+	"borderless_coding_server/pkg/storage"
+	"borderless_coding_server/pkg/utils"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// BuildKindPreview marks preview builds in Build.Metadata["kind"]
+const BuildKindPreview = "preview"
+
+// previewDeploymentRetention is how many deployments per project keep their files for rollback
+const previewDeploymentRetention = 5
+
+var (
+	// ErrPreviewBuildInProgress is returned when a project already has a running preview build
+	ErrPreviewBuildInProgress = errors.New("a preview build is already running for this project")
+	// ErrDeploymentNotFound is returned when a preview deployment does not exist
+	ErrDeploymentNotFound = errors.New("preview deployment not found")
+	// ErrDeploymentPruned is returned when rolling back to a deployment whose files were removed
+	ErrDeploymentPruned = errors.New("preview deployment files were pruned and cannot be restored")
+	// ErrPreviewNotFound is returned when a project has no live preview
+	ErrPreviewNotFound = errors.New("preview not found")
+	// ErrPreviewFileNotFound is returned when a file is not part of the live preview
+	ErrPreviewFileNotFound = errors.New("preview file not found")
+	// ErrInvalidPreviewToken is returned for malformed, forged or expired preview link tokens
+	ErrInvalidPreviewToken = errors.New("invalid or expired preview link")
+)
+
+// PreviewService builds project previews as background builds and publishes their output as
+// versioned deployments. Deployments are stored on local disk, where the live preview is a
+// symlink swapped atomically between them, and in MinIO so every replica can serve them.
+type PreviewService struct {
+	buildService     *BuildService
+	workspaceService *WorkspaceService
+	templateService  *TemplateService
+	quotaService     *QuotaService
+	linkSecret       []byte // signs preview links of private projects
+	logger           *logrus.Logger
+
+	mu         sync.Mutex
+	running    map[uuid.UUID]uuid.UUID // project ID -> preview build ID
+	activateMu sync.Mutex              // serializes live preview swaps
+}
+
+// previewLinkSecretName names the generated preview link secret in app_secrets
+const previewLinkSecretName = "preview_link"
+
+// minPreviewLinkSecretLength is the shortest PREVIEW_LINK_SECRET accepted
+const minPreviewLinkSecretLength = 32
+
+// LoadPreviewLinkSecret returns the secret preview links are signed with. A configured secret
+// must be long; without one, a random secret is generated by the first instance and shared
+// with the others through the database.
+func LoadPreviewLinkSecret(ctx context.Context, configured string) (string, error) {
+	if configured != "" {
+		if len(configured) < minPreviewLinkSecretLength {
+			return "", fmt.Errorf("PREVIEW_LINK_SECRET must be at least %d characters", minPreviewLinkSecretLength)
+		}
+		return configured, nil
+	}
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	secret := models.AppSecret{Name: previewLinkSecretName, Value: base64.RawURLEncoding.EncodeToString(random)}
+	if err := database.DB.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&secret).Error; err != nil {
+		return "", err
+	}
+	// Another instance may have stored its secret first
+	if err := database.DB.WithContext(ctx).Where("name = ?", previewLinkSecretName).First(&secret).Error; err != nil {
+		return "", err
+	}
+	return secret.Value, nil
+}
+
+func NewPreviewService(buildService *BuildService, workspaceService *WorkspaceService, templateService *TemplateService, quotaService *QuotaService, linkSecret string, logger *logrus.Logger) *PreviewService {
+	return &PreviewService{
+		buildService:     buildService,
+		workspaceService: workspaceService,
+		templateService:  templateService,
+		quotaService:     quotaService,
+		linkSecret:       []byte(linkSecret),
+		logger:           logger,
+		running:          make(map[uuid.UUID]uuid.UUID),
+	}
+}
+
+// StartPreviewBuild starts building the latest snapshot of a project with its template's
+// install and build commands. The output is published and project.preview_url updated only
+// when the build succeeds; progress is available through the build's logs and stream.
+func (s *PreviewService) StartPreviewBuild(userID uuid.UUID, project *models.Project) (*models.Build, error) {
+	template, err := s.templateService.ForProject(project)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve project template: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.running[project.ID]; ok {
+		return nil, ErrPreviewBuildInProgress
+	}
+
+	command := strings.Join(nonEmpty(template.InstallCommand, template.BuildCommand), " && ")
+	metadata := models.JSONB{"kind": BuildKindPreview, "template": template.Slug}
+	build, err := s.buildService.StartTask(userID, project.ID, command, s.quotaService.PreviewDir(project.ID), metadata,
+		func(task *BuildTask) error {
+			defer s.finish(project.ID)
+			return s.buildPreview(task, project, template)
+		})
+	if err != nil {
+		return nil, err
+	}
+	s.running[project.ID] = build.ID
+	return build, nil
+}
+
+// RunningPreviewBuild returns the ID of the running preview build of a project, if any
+func (s *PreviewService) RunningPreviewBuild(projectID uuid.UUID) (uuid.UUID, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	buildID, ok := s.running[projectID]
+	return buildID, ok
+}
+
+func (s *PreviewService) finish(projectID uuid.UUID) {
+	s.mu.Lock()
+	delete(s.running, projectID)
+	s.mu.Unlock()
+}
+
+// buildPreview runs the build steps of a preview build
+func (s *PreviewService) buildPreview(task *BuildTask, project *models.Project, template *models.ProjectTemplate) error {
+	ctx := task.Context()
+
+	// Materialize the latest project snapshot in a private directory
+	task.Log("info", "Loading project snapshot")
+	ws, err := s.workspaceService.Snapshot(ctx, project)
+	if err != nil {
+		return fmt.Errorf("failed to load project workspace: %w", err)
+	}
+	defer s.workspaceService.Release(ws)
+
+	appDir, err := ws.ResolvePath(template.RootDir)
+	if err != nil {
+		return fmt.Errorf("invalid template root directory: %w", err)
+	}
+	if _, err := os.Stat(appDir); err != nil {
+		return fmt.Errorf("%s directory not found in workspace", template.RootDir)
+	}
+
+	// Run the template's install and build commands
+	for _, command := range nonEmpty(template.InstallCommand, template.BuildCommand) {
+		if err := task.Run(appDir, command); err != nil {
+			return err
+		}
+	}
+
+	distSrc, err := utils.SafeJoin(appDir, template.OutputDir)
+	if err != nil {
+		return fmt.Errorf("invalid template output directory: %w", err)
+	}
+	if _, err := os.Stat(distSrc); err != nil {
+		return fmt.Errorf("build output directory %s not found", template.OutputDir)
+	}
+
+	deployment, err := s.deploy(task, project, distSrc, template.PreviewEntrypoint)
+	if err != nil {
+		return err
+	}
+	task.Build.Metadata["deployment_id"] = deployment.ID.String()
+	task.Build.Metadata["version"] = deployment.Version
+	task.Build.Metadata["preview_url"] = previewURL(project.ID, deployment.EntryPoint)
+	task.Log("info", fmt.Sprintf("Deployment v%d is live at %s", deployment.Version, previewURL(project.ID, deployment.EntryPoint)))
+	return nil
+}
+
+// deploy copies the build output into a new versioned deployment and makes it live
+func (s *PreviewService) deploy(task *BuildTask, project *models.Project, distSrc, entryPoint string) (*models.PreviewDeployment, error) {
+	ctx := task.Context()
+
+	// Preview assets count against the project storage quota; retained deployments included
+	previewBytes, err := utils.DirSize(distSrc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to measure built files: %w", err)
+	}
+	retainedBytes, err := s.quotaService.PreviewSize(project.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to measure preview deployments: %w", err)
+	}
+	if err := s.quotaService.Check(project.ID, map[string]int64{UsagePreview: retainedBytes + previewBytes}); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	buildID := task.Build.ID
+	deployment := &models.PreviewDeployment{
+		ProjectID:  project.ID,
+		BuildID:    &buildID,
+		Status:     models.PreviewDeploymentStatusInactive,
+		EntryPoint: strings.TrimPrefix(entryPoint, "/"),
+		SizeBytes:  previewBytes,
+		CreatedBy:  &task.Build.UserID,
+	}
+	if err := s.reserveDeployment(deployment); err != nil {
+		return nil, fmt.Errorf("failed to record deployment: %w", err)
+	}
+	version := deployment.Version
+	deploymentsDir := s.quotaService.DeploymentsDir(project.ID)
+	stored := false
+	defer func() {
+		if !stored {
+			os.RemoveAll(deploymentDir(deploymentsDir, version))
+			if err := database.DB.Delete(deployment).Error; err != nil {
+				s.logger.WithError(err).Warn("Failed to remove unfinished preview deployment")
+			}
+		}
+	}()
+
+	// Write the deployment next to its final location, then move it into place
+	if err := os.MkdirAll(deploymentsDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create deployments directory: %w", err)
+	}
+	staging, err := os.MkdirTemp(deploymentsDir, ".staging-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	task.Log("info", fmt.Sprintf("Writing deployment v%d (%d bytes)", version, previewBytes))
+	if err := utils.CopyDir(distSrc, staging); err != nil {
+		return nil, fmt.Errorf("failed to copy built files: %w", err)
+	}
+	// Files left behind by an interrupted deployment of the same version are not referenced
+	os.RemoveAll(deploymentDir(deploymentsDir, version))
+	if err := os.Rename(staging, deploymentDir(deploymentsDir, version)); err != nil {
+		return nil, fmt.Errorf("failed to store deployment: %w", err)
+	}
+
+	// Other replicas serve the deployment from object storage
+	objectPrefix := s.deploymentObjectPrefix(project, version)
+	bucket, prefix := ParseNetworkPath(objectPrefix)
+	task.Log("info", "Uploading deployment to object storage")
+	if storage.MinIOClient == nil {
+		return nil, errors.New("object storage is not configured")
+	}
+	count, err := storage.UploadDir(ctx, bucket, prefix, deploymentDir(deploymentsDir, version))
+	if err != nil {
+		s.removeObjects(objectPrefix)
+		return nil, fmt.Errorf("failed to upload deployment: %w", err)
+	}
+	task.Log("info", fmt.Sprintf("Uploaded %d files to %s", count, objectPrefix))
+
+	if err := database.DB.Model(deployment).Update("object_prefix", objectPrefix).Error; err != nil {
+		s.removeObjects(objectPrefix)
+		return nil, fmt.Errorf("failed to record deployment: %w", err)
+	}
+	deployment.ObjectPrefix = &objectPrefix
+	stored = true
+
+	if err := s.activate(project.ID, deployment); err != nil {
+		return nil, err
+	}
+	s.prune(project.ID)
+	return deployment, nil
+}
+
+// reserveDeployment records a deployment, without files yet, under the project's next version.
+// The project row is locked while the version is allocated, so deployments on different
+// replicas never get the same version.
+func (s *PreviewService) reserveDeployment(deployment *models.PreviewDeployment) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := lockProject(tx, deployment.ProjectID); err != nil {
+			return err
+		}
+		var version int
+		if err := tx.Model(&models.PreviewDeployment{}).Where("project_id = ?", deployment.ProjectID).
+			Select("COALESCE(MAX(version), 0)").Scan(&version).Error; err != nil {
+			return err
+		}
+		deployment.Version = version + 1
+		return tx.Create(deployment).Error
+	})
+}
+
+// lockProject locks a project row until the end of the transaction, serializing changes to
+// its deployments between replicas
+func lockProject(tx *gorm.DB, projectID uuid.UUID) error {
+	var project models.Project
+	return tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").
+		Where("id = ?", projectID).First(&project).Error
+}
+
+// ListDeployments lists the preview deployments of a project, newest first
+func (s *PreviewService) ListDeployments(projectID uuid.UUID) ([]models.PreviewDeployment, error) {
+	var deployments []models.PreviewDeployment
+	err := database.DB.Where("project_id = ?", projectID).Order("version DESC").Find(&deployments).Error
+	return deployments, err
+}
+
+// ActiveDeployment returns the deployment currently served as a project's preview
+func (s *PreviewService) ActiveDeployment(projectID uuid.UUID) (*models.PreviewDeployment, error) {
+	var deployment models.PreviewDeployment
+	err := database.DB.Where("project_id = ? AND status = ?", projectID, models.PreviewDeploymentStatusActive).
+		First(&deployment).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrDeploymentNotFound
+		}
+		return nil, err
+	}
+	return &deployment, nil
+}
+
+// SignPreviewLink returns a token granting access to a project's preview until expiresAt.
+// The token has the form "<unix expiry>.<signature>".
+func (s *PreviewService) SignPreviewLink(projectID uuid.UUID, expiresAt time.Time) string {
+	expires := strconv.FormatInt(expiresAt.Unix(), 10)
+	return expires + "." + s.previewSignature(projectID, expires)
+}
+
+// VerifyPreviewToken checks a preview link token for a project and returns its expiry
+func (s *PreviewService) VerifyPreviewToken(projectID uuid.UUID, token string) (time.Time, error) {
+	expires, signature, found := strings.Cut(token, ".")
+	if !found {
+		return time.Time{}, ErrInvalidPreviewToken
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return time.Time{}, ErrInvalidPreviewToken
+	}
+	expected := s.previewSignature(projectID, expires)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return time.Time{}, ErrInvalidPreviewToken
+	}
+	expiresAt := time.Unix(unix, 0)
+	if time.Now().After(expiresAt) {
+		return time.Time{}, ErrInvalidPreviewToken
+	}
+	return expiresAt, nil
+}
+
+// previewSignature signs a project ID and expiry so links cannot be moved between projects
+func (s *PreviewService) previewSignature(projectID uuid.UUID, expires string) string {
+	mac := hmac.New(sha256.New, s.linkSecret)
+	mac.Write([]byte("preview:" + projectID.String() + ":" + expires))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Rollback makes a previous deployment of a project live again
+func (s *PreviewService) Rollback(projectID, deploymentID uuid.UUID) (*models.PreviewDeployment, error) {
+	var deployment models.PreviewDeployment
+	if err := database.DB.Where("id = ? AND project_id = ?", deploymentID, projectID).First(&deployment).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrDeploymentNotFound
+		}
+		return nil, err
+	}
+	switch deployment.Status {
+	case models.PreviewDeploymentStatusPruned:
+		return nil, ErrDeploymentPruned
+	case models.PreviewDeploymentStatusActive:
+		return &deployment, nil
+	}
+
+	if err := s.activate(projectID, &deployment); err != nil {
+		return nil, err
+	}
+	return &deployment, nil
+}
+
+// activate atomically points the live preview at a deployment and records it as active
+func (s *PreviewService) activate(projectID uuid.UUID, deployment *models.PreviewDeployment) error {
+	s.activateMu.Lock()
+	defer s.activateMu.Unlock()
+
+	// Deployments built on another replica are only in object storage and served from there
+	target := deploymentDir(s.quotaService.DeploymentsDir(projectID), deployment.Version)
+	if _, err := os.Stat(target); err == nil {
+		if err := s.linkLivePreview(projectID, target); err != nil {
+			return err
+		}
+	} else if deployment.ObjectPrefix == nil {
+		return fmt.Errorf("deployment files not found: %w", err)
+	}
+
+	now := time.Now()
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := lockProject(tx, projectID); err != nil {
+			return err
+		}
+		if err := tx.Model(&models.PreviewDeployment{}).
+			Where("project_id = ? AND status = ?", projectID, models.PreviewDeploymentStatusActive).
+			Update("status", models.PreviewDeploymentStatusInactive).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(deployment).Updates(map[string]interface{}{
+			"status":       models.PreviewDeploymentStatusActive,
+			"activated_at": now,
+		}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.Project{}).Where("id = ?", projectID).
+			Update("preview_url", previewURL(projectID, deployment.EntryPoint)).Error; err != nil {
+			return err
+		}
+		return saveBuildResult(tx, projectID, deployment, now)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record active deployment: %w", err)
+	}
+	deployment.Status = models.PreviewDeploymentStatusActive
+	deployment.ActivatedAt = &now
+	return nil
+}
+
+// linkLivePreview atomically points the local live preview symlink at a deployment directory
+func (s *PreviewService) linkLivePreview(projectID uuid.UUID, target string) error {
+	livePath := s.quotaService.PreviewDir(projectID)
+
+	// A preview deployed in place before deployments were versioned cannot be renamed over
+	if info, err := os.Lstat(livePath); err == nil && info.Mode()&os.ModeSymlink == 0 {
+		if err := os.RemoveAll(livePath); err != nil {
+			return fmt.Errorf("failed to remove legacy preview: %w", err)
+		}
+	}
+
+	// Create the new link beside the live one and rename it over, so readers always see
+	// either the old or the new deployment
+	relTarget, err := filepath.Rel(filepath.Dir(livePath), target)
+	if err != nil {
+		return err
+	}
+	tmpLink := fmt.Sprintf("%s.%s.tmp", livePath, uuid.NewString())
+	if err := os.Symlink(relTarget, tmpLink); err != nil {
+		return fmt.Errorf("failed to link deployment: %w", err)
+	}
+	if err := os.Rename(tmpLink, livePath); err != nil {
+		os.Remove(tmpLink)
+		return fmt.Errorf("failed to activate deployment: %w", err)
+	}
+
+	return nil
+}
+
+// prune removes the files of deployments beyond the retention limit and records the
+// remaining preview usage. The active deployment is always kept.
+func (s *PreviewService) prune(projectID uuid.UUID) {
+	var stale []models.PreviewDeployment
+	if err := database.DB.Where("project_id = ? AND status = ?", projectID, models.PreviewDeploymentStatusInactive).
+		Order("version DESC").Offset(previewDeploymentRetention - 1).Find(&stale).Error; err != nil {
+		s.logger.WithError(err).Warn("Failed to list stale preview deployments")
+		return
+	}
+
+	deploymentsDir := s.quotaService.DeploymentsDir(projectID)
+	for _, deployment := range stale {
+		if err := os.RemoveAll(deploymentDir(deploymentsDir, deployment.Version)); err != nil {
+			s.logger.WithError(err).Warn("Failed to remove preview deployment")
+			continue
+		}
+		if deployment.ObjectPrefix != nil {
+			s.removeObjects(*deployment.ObjectPrefix)
+		}
+		if err := database.DB.Model(&deployment).Update("status", models.PreviewDeploymentStatusPruned).Error; err != nil {
+			s.logger.WithError(err).Warn("Failed to mark preview deployment pruned")
+		}
+	}
+
+	size, err := s.quotaService.PreviewSize(projectID)
+	if err != nil {
+		s.logger.WithError(err).Warn("Failed to measure preview deployments")
+		return
+	}
+	if err := s.quotaService.Record(projectID, map[string]int64{UsagePreview: size}); err != nil {
+		s.logger.WithError(err).Warn("Failed to record preview storage usage")
+	}
+}
+
+// PreviewFile is an open file of a project's live preview
+type PreviewFile struct {
+	io.ReadSeekCloser
+	Name    string
+	ModTime time.Time
+	Size    int64
+	Version int // deployment version, 0 for a preview deployed before versioning
+}
+
+// previewSource opens the files of one deployment by slash-separated name
+type previewSource interface {
+	open(ctx context.Context, name string) (*PreviewFile, error)
+}
+
+// OpenPreview opens a file of a project's live preview. The active deployment is read from
+// local disk when this server has it and streamed from MinIO otherwise. Directories serve
+// their index.html, and unknown paths without a file extension fall back to the entry point
+// so client-side routing works.
+func (s *PreviewService) OpenPreview(ctx context.Context, project *models.Project, name string) (*PreviewFile, error) {
+	source, entryPoint, version, err := s.livePreviewSource(project)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cleaning a rooted path drops any ".." so requests cannot leave the deployment
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	candidates := []string{path.Join(name, "index.html")}
+	if name != "" {
+		candidates = append([]string{name}, candidates...)
+	}
+	if path.Ext(name) == "" {
+		candidates = append(candidates, strings.TrimPrefix(entryPoint, "/"))
+	}
+
+	for _, candidate := range candidates {
+		file, err := source.open(ctx, candidate)
+		if err == nil {
+			file.Version = version
+			return file, nil
+		}
+		if !errors.Is(err, ErrPreviewFileNotFound) {
+			return nil, err
+		}
+	}
+	return nil, ErrPreviewFileNotFound
+}
+
+// livePreviewSource returns where the files of a project's active deployment are read from
+func (s *PreviewService) livePreviewSource(project *models.Project) (previewSource, string, int, error) {
+	deployment, err := s.ActiveDeployment(project.ID)
+	if errors.Is(err, ErrDeploymentNotFound) {
+		// A preview deployed in place before deployments were versioned
+		dir := s.quotaService.PreviewDir(project.ID)
+		if _, err := os.Stat(dir); err != nil {
+			return nil, "", 0, ErrPreviewNotFound
+		}
+		return localPreviewSource(dir), "index.html", 0, nil
+	}
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	dir := deploymentDir(s.quotaService.DeploymentsDir(project.ID), deployment.Version)
+	if _, err := os.Stat(dir); err == nil {
+		return localPreviewSource(dir), deployment.EntryPoint, deployment.Version, nil
+	}
+	if deployment.ObjectPrefix == nil || storage.MinIOClient == nil {
+		return nil, "", 0, ErrPreviewNotFound
+	}
+	bucket, prefix := ParseNetworkPath(*deployment.ObjectPrefix)
+	return objectPreviewSource{bucket: bucket, prefix: prefix}, deployment.EntryPoint, deployment.Version, nil
+}
+
+// localPreviewSource reads deployment files from a directory on this server
+type localPreviewSource string
+
+func (dir localPreviewSource) open(_ context.Context, name string) (*PreviewFile, error) {
+	file, err := os.Open(filepath.Join(string(dir), filepath.FromSlash(name)))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrPreviewFileNotFound
+		}
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		file.Close()
+		return nil, ErrPreviewFileNotFound
+	}
+	return &PreviewFile{ReadSeekCloser: file, Name: info.Name(), ModTime: info.ModTime(), Size: info.Size()}, nil
+}
+
+// objectPreviewSource streams deployment files from MinIO
+type objectPreviewSource struct {
+	bucket string
+	prefix string
+}
+
+func (src objectPreviewSource) open(ctx context.Context, name string) (*PreviewFile, error) {
+	obj, info, err := storage.OpenObject(ctx, src.bucket, src.prefix+name)
+	if err != nil {
+		if storage.IsNotFound(err) {
+			return nil, ErrPreviewFileNotFound
+		}
+		return nil, err
+	}
+	return &PreviewFile{ReadSeekCloser: obj, Name: path.Base(name), ModTime: info.LastModified, Size: info.Size}, nil
+}
+
+// saveBuildResult records the active deployment as the project's build result
+func saveBuildResult(tx *gorm.DB, projectID uuid.UUID, deployment *models.PreviewDeployment, activatedAt time.Time) error {
+	if deployment.ObjectPrefix == nil {
+		// Deployments from before previews were uploaded only exist on local disk
+		return tx.Where("project_id = ?", projectID).Delete(&models.BuildResult{}).Error
+	}
+	meta := models.JSONB{
+		"deployment_id": deployment.ID.String(),
+		"version":       deployment.Version,
+		"entry_point":   deployment.EntryPoint,
+		"size_bytes":    deployment.SizeBytes,
+		"preview_url":   previewURL(projectID, deployment.EntryPoint),
+		"activated_at":  activatedAt,
+	}
+	if deployment.BuildID != nil {
+		meta["build_id"] = deployment.BuildID.String()
+	}
+	result := &models.BuildResult{
+		ProjectID: projectID,
+		BuiltURL:  *deployment.ObjectPrefix,
+		Meta:      meta,
+	}
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "project_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"built_url": result.BuiltURL, "meta": meta, "updated_at": activatedAt}),
+	}).Create(result).Error
+}
+
+// deploymentObjectPrefix returns the MinIO location ("bucket/prefix/") of a deployment's files,
+// next to the project's workspace archive
+func (s *PreviewService) deploymentObjectPrefix(project *models.Project, version int) string {
+	bucket := project.RootBucket
+	if bucket == "" {
+		bucket = s.workspaceService.bucketName
+	}
+	return fmt.Sprintf("%s/users/%s/projects/%s/previews/v%d/", bucket, project.OwnerID, project.ID, version)
+}
+
+// removeObjects deletes the uploaded files of a deployment, logging failures
+func (s *PreviewService) removeObjects(objectPrefix string) {
+	if storage.MinIOClient == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	bucket, prefix := ParseNetworkPath(objectPrefix)
+	if err := storage.RemovePrefix(ctx, bucket, prefix); err != nil {
+		s.logger.WithError(err).WithField("prefix", objectPrefix).Warn("Failed to remove preview deployment objects")
+	}
+}
+
+// deploymentDir returns the directory holding a deployment version
+func deploymentDir(deploymentsDir string, version int) string {
+	return filepath.Join(deploymentsDir, fmt.Sprintf("v%d", version))
+}
+
+// previewURL returns the URL of a project's live preview
+func previewURL(projectID uuid.UUID, entryPoint string) string {
+	return fmt.Sprintf("/preview/%s/%s", projectID.String(), strings.TrimPrefix(entryPoint, "/"))
+}
+
+// nonEmpty returns the non-blank values
+func nonEmpty(values ...string) []string {
+	out := make([]string, 0, len(values))
+	for _, value := range values {
+		if strings.TrimSpace(value) != "" {
+			out = append(out, value)
+		}
+	}
+	return out
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+
+package services
+
+import (
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// killProcessGroup runs cmd in its own process group and stops the whole group when its
+// context is cancelled, so tools that spawn children (npm, dev servers) do not leave them behind
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	}
+	cmd.WaitDelay = 10 * time.Second
+}
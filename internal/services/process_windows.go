@@ -0,0 +1,14 @@
+//go:build windows
+
+package services
+
+import (
+	"os/exec"
+	"time"
+)
+
+// killProcessGroup only bounds how long a cancelled command may keep its output open; child
+// processes are not tracked on Windows
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.WaitDelay = 10 * time.Second
+}
@@ -4,18 +4,31 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"borderless_coding_server/internal/models"
 	"borderless_coding_server/pkg/database"
 
 	"github.com/google/uuid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
-type ProjectService struct{}
+var (
+	// ErrVersionConflict is returned when a project changed since the version the client last saw
+	ErrVersionConflict = errors.New("project has been modified since the given version")
+	// ErrProjectNotFound is returned for missing projects and for projects the caller cannot see
+	ErrProjectNotFound = errors.New("project not found")
+	// ErrProjectForbidden is returned when the caller can see a project but lacks the required role
+	ErrProjectForbidden = errors.New("insufficient permissions on this project")
+)
+
+type ProjectService struct {
+	authorizer *Authorizer
+}
 
-func NewProjectService() *ProjectService {
-	return &ProjectService{}
+func NewProjectService(authorizer *Authorizer) *ProjectService {
+	return &ProjectService{authorizer: authorizer}
 }
 
 // CreateProject creates a new project
@@ -46,6 +59,9 @@ func (s *ProjectService) CreateProject(project *models.Project) error {
 	if project.Meta == nil {
 		project.Meta = make(models.JSONB)
 	}
+	if project.StorageUsage == nil {
+		project.StorageUsage = make(models.JSONB)
+	}
 	if project.RootBucket == "" {
 		project.RootBucket = "borderless-coding"
 	}
@@ -66,7 +82,7 @@ func (s *ProjectService) GetProjectByID(id uuid.UUID) (*models.Project, error) {
 		Where("id = ? AND deleted_at IS NULL", id).First(&project).Error
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, errors.New("project not found")
+			return nil, ErrProjectNotFound
 		}
 		return nil, err
 	}
@@ -112,6 +128,40 @@ func (s *ProjectService) UpdateProject(id uuid.UUID, updates map[string]interfac
 	return database.DB.Model(&project).Updates(updates).Error
 }
 
+// CompareAndBumpVersion increments the project version only if it still equals expected,
+// returning the new version or ErrVersionConflict
+func (s *ProjectService) CompareAndBumpVersion(id uuid.UUID, expected int) (int, error) {
+	result := database.DB.Model(&models.Project{}).
+		Where("id = ? AND version = ? AND deleted_at IS NULL", id, expected).
+		Updates(map[string]interface{}{
+			"version":    gorm.Expr("version + 1"),
+			"updated_at": time.Now(),
+		})
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return 0, ErrVersionConflict
+	}
+	return expected + 1, nil
+}
+
+// BumpVersion unconditionally increments the project version and returns the new value
+func (s *ProjectService) BumpVersion(id uuid.UUID) (int, error) {
+	var project models.Project
+	err := database.DB.Model(&project).
+		Clauses(clause.Returning{Columns: []clause.Column{{Name: "version"}}}).
+		Where("id = ? AND deleted_at IS NULL", id).
+		Updates(map[string]interface{}{
+			"version":    gorm.Expr("version + 1"),
+			"updated_at": time.Now(),
+		}).Error
+	if err != nil {
+		return 0, err
+	}
+	return project.Version, nil
+}
+
 // DeleteProject soft deletes a project
 func (s *ProjectService) DeleteProject(id uuid.UUID) error {
 	var project models.Project
@@ -125,6 +175,68 @@ func (s *ProjectService) DeleteProject(id uuid.UUID) error {
 	return database.DB.Delete(&project).Error
 }
 
+// ForkProject creates a project owned by ownerID with the metadata of source and records source
+// as its upstream in Meta["forked_from"]. The fork gets the default storage quota, since quotas
+// are only set by quota managers. The files are copied separately by the caller.
+func (s *ProjectService) ForkProject(source *models.Project, ownerID uuid.UUID, name string, visibility models.ProjectVisibility) (*models.Project, error) {
+	if name == "" {
+		name = s.availableProjectName(ownerID, source.Name)
+	}
+	if visibility == "" {
+		visibility = models.ProjectVisibilityPrivate
+	}
+
+	meta := make(models.JSONB, len(source.Meta)+1)
+	for k, v := range source.Meta {
+		meta[k] = v
+	}
+	meta["forked_from"] = map[string]interface{}{
+		"project_id": source.ID,
+		"owner_id":   source.OwnerID,
+		"name":       source.Name,
+		"version":    source.Version,
+		"forked_at":  time.Now().UTC(),
+	}
+
+	fork := &models.Project{
+		ID:          uuid.New(),
+		OwnerID:     ownerID,
+		Name:        name,
+		Description: source.Description,
+		Visibility:  visibility,
+		RootBucket:  source.RootBucket,
+		TemplateID:  source.TemplateID,
+		Meta:        meta,
+	}
+	if err := s.CreateProject(fork); err != nil {
+		return nil, err
+	}
+	return fork, nil
+}
+
+// availableProjectName returns base, or base with a "-fork" suffix if the owner already uses that name
+func (s *ProjectService) availableProjectName(ownerID uuid.UUID, base string) string {
+	candidate := base
+	for i := 1; i < 100; i++ {
+		var count int64
+		database.DB.Model(&models.Project{}).Where("owner_id = ? AND name = ? AND deleted_at IS NULL", ownerID, candidate).Count(&count)
+		if count == 0 {
+			return candidate
+		}
+		if i == 1 {
+			candidate = base + "-fork"
+		} else {
+			candidate = fmt.Sprintf("%s-fork-%d", base, i)
+		}
+	}
+	return fmt.Sprintf("%s-fork-%s", base, uuid.New().String()[:8])
+}
+
+// PurgeProject permanently deletes a project, e.g. to roll back a failed import
+func (s *ProjectService) PurgeProject(id uuid.UUID) error {
+	return database.DB.Unscoped().Where("id = ?", id).Delete(&models.Project{}).Error
+}
+
 // ListProjects retrieves a paginated list of projects
 func (s *ProjectService) ListProjects(ownerID *uuid.UUID, visibility *models.ProjectVisibility, offset, limit int) ([]models.Project, int64, error) {
 	var projects []models.Project
@@ -185,13 +297,19 @@ func (s *ProjectService) UpdateProjectStorageQuota(id uuid.UUID, quotaBytes int6
 	})
 }
 
-// SearchProjects searches projects by name or description
-func (s *ProjectService) SearchProjects(query string, ownerID *uuid.UUID, visibility *models.ProjectVisibility, limit int) ([]models.Project, error) {
+// SearchProjects searches projects by name or description. Unless subject is an admin or holds
+// projects.admin, only public projects and projects the subject owns or is a member of are searched.
+func (s *ProjectService) SearchProjects(subject Subject, query string, ownerID *uuid.UUID, visibility *models.ProjectVisibility, limit int) ([]models.Project, error) {
 	var projects []models.Project
 
 	dbQuery := database.DB.Where("deleted_at IS NULL AND (name ILIKE ? OR description ILIKE ?)",
 		"%"+query+"%", "%"+query+"%")
 
+	if !subject.IsAdmin() && !subject.HasPermission(models.PermissionProjectsAdmin) {
+		dbQuery = dbQuery.Where("(visibility = ? OR owner_id = ? OR id IN (SELECT project_id FROM project_members WHERE user_id = ? AND status = ?))",
+			models.ProjectVisibilityPublic, subject.UserID, subject.UserID, models.ProjectMemberStatusAccepted)
+	}
+
 	// Filter by owner if specified
 	if ownerID != nil {
 		dbQuery = dbQuery.Where("owner_id = ?", *ownerID)
@@ -242,3 +360,179 @@ func (s *ProjectService) GenerateSlug(name string) string {
 
 	return slug
 }
+
+// ProjectRoleFor returns the role userID has on project: owner, the role of an accepted
+// membership, viewer for public and unlisted projects, or "" without access
+func (s *ProjectService) ProjectRoleFor(project *models.Project, userID uuid.UUID) (models.ProjectRole, error) {
+	if project.OwnerID == userID {
+		return models.ProjectRoleOwner, nil
+	}
+
+	var role models.ProjectRole
+	var member models.ProjectMember
+	err := database.DB.Where("project_id = ? AND user_id = ? AND status = ?", project.ID, userID, models.ProjectMemberStatusAccepted).
+		First(&member).Error
+	if err == nil {
+		role = member.Role
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", err
+	}
+
+	if role == "" && project.Visibility != models.ProjectVisibilityPrivate {
+		role = models.ProjectRoleViewer
+	}
+	return role, nil
+}
+
+// AuthorizeProject loads a project and checks that subject may perform action on it.
+// Subjects without any access get ErrProjectNotFound so private projects are not revealed.
+func (s *ProjectService) AuthorizeProject(projectID uuid.UUID, subject Subject, action Action) (*models.Project, models.ProjectRole, error) {
+	project, err := s.GetProjectByID(projectID)
+	if err != nil {
+		return nil, "", err
+	}
+	role, err := s.ProjectRoleFor(project, subject.UserID)
+	if err != nil {
+		return nil, "", err
+	}
+	if !s.authorizer.Can(subject, action, ProjectResource(role)) {
+		if role == "" {
+			return nil, "", ErrProjectNotFound
+		}
+		return project, role, ErrProjectForbidden
+	}
+	return project, role, nil
+}
+
+// ListMembers lists the members and pending invitations of a project
+func (s *ProjectService) ListMembers(projectID uuid.UUID) ([]models.ProjectMember, error) {
+	var members []models.ProjectMember
+	err := database.DB.Preload("User").
+		Where("project_id = ?", projectID).
+		Order("created_at ASC").
+		Find(&members).Error
+	return members, err
+}
+
+// InviteMember invites a user (by ID or email) to a project with the given role.
+// Re-inviting a user with a pending invitation updates its role.
+func (s *ProjectService) InviteMember(project *models.Project, inviterID uuid.UUID, userID *uuid.UUID, email string, role models.ProjectRole) (*models.ProjectMember, error) {
+	if !role.IsMemberRole() {
+		return nil, errors.New("role must be one of viewer, editor, admin")
+	}
+
+	var invitee models.User
+	query := database.DB.Where("deleted_at IS NULL")
+	switch {
+	case userID != nil:
+		query = query.Where("id = ?", *userID)
+	case email != "":
+		query = query.Where("email = ?", strings.ToLower(strings.TrimSpace(email)))
+	default:
+		return nil, errors.New("user_id or email is required")
+	}
+	if err := query.First(&invitee).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("user not found")
+		}
+		return nil, err
+	}
+	if invitee.ID == project.OwnerID {
+		return nil, errors.New("the project owner cannot be invited")
+	}
+
+	var member models.ProjectMember
+	err := database.DB.Where("project_id = ? AND user_id = ?", project.ID, invitee.ID).First(&member).Error
+	if err == nil {
+		if member.Status == models.ProjectMemberStatusAccepted {
+			return nil, errors.New("user is already a member of this project")
+		}
+		if err := database.DB.Model(&member).Updates(map[string]interface{}{"role": role, "invited_by": inviterID}).Error; err != nil {
+			return nil, err
+		}
+		return &member, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	member = models.ProjectMember{
+		ProjectID: project.ID,
+		UserID:    invitee.ID,
+		Role:      role,
+		Status:    models.ProjectMemberStatusPending,
+		InvitedBy: &inviterID,
+	}
+	if err := database.DB.Create(&member).Error; err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+// AcceptInvitation accepts a pending invitation of userID to a project
+func (s *ProjectService) AcceptInvitation(projectID, userID uuid.UUID) (*models.ProjectMember, error) {
+	member, err := s.GetMember(projectID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if member.Status == models.ProjectMemberStatusAccepted {
+		return member, nil
+	}
+
+	now := time.Now()
+	if err := database.DB.Model(member).Updates(map[string]interface{}{
+		"status":      models.ProjectMemberStatusAccepted,
+		"accepted_at": now,
+	}).Error; err != nil {
+		return nil, err
+	}
+	member.Status = models.ProjectMemberStatusAccepted
+	member.AcceptedAt = &now
+	return member, nil
+}
+
+// GetMember retrieves the membership (or pending invitation) of userID on a project
+func (s *ProjectService) GetMember(projectID, userID uuid.UUID) (*models.ProjectMember, error) {
+	var member models.ProjectMember
+	if err := database.DB.Where("project_id = ? AND user_id = ?", projectID, userID).First(&member).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("membership not found")
+		}
+		return nil, err
+	}
+	return &member, nil
+}
+
+// UpdateMemberRole changes the role of a project member
+func (s *ProjectService) UpdateMemberRole(projectID, userID uuid.UUID, role models.ProjectRole) error {
+	if !role.IsMemberRole() {
+		return errors.New("role must be one of viewer, editor, admin")
+	}
+	member, err := s.GetMember(projectID, userID)
+	if err != nil {
+		return err
+	}
+	return database.DB.Model(member).Update("role", role).Error
+}
+
+// RemoveMember removes a member or declines/revokes an invitation
+func (s *ProjectService) RemoveMember(projectID, userID uuid.UUID) error {
+	result := database.DB.Where("project_id = ? AND user_id = ?", projectID, userID).Delete(&models.ProjectMember{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("membership not found")
+	}
+	return nil
+}
+
+// GetPendingInvitations lists the project invitations userID has not accepted yet
+func (s *ProjectService) GetPendingInvitations(userID uuid.UUID) ([]models.ProjectMember, error) {
+	var invitations []models.ProjectMember
+	err := database.DB.Preload("Project").
+		Where("user_id = ? AND status = ?", userID, models.ProjectMemberStatusPending).
+		Order("created_at DESC").
+		Find(&invitations).Error
+	return invitations, err
+}
@@ -0,0 +1,278 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"borderless_coding_server/internal/models"
+	"borderless_coding_server/pkg/database"
+	"borderless_coding_server/pkg/storage"
+	"borderless_coding_server/pkg/utils"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Storage usage components, stored as keys of Project.StorageUsage. The archive is the stored
+// form of the workspace, so only the workspace counts against the quota.
+const (
+	UsageWorkspace = "workspace_bytes" // uncompressed workspace files (including git history)
+	UsageArchive   = "archive_bytes"   // workspace archive stored in MinIO; reported, not counted
+	UsageArtifacts = "artifact_bytes"  // other objects under the project prefix in MinIO
+	UsagePreview   = "preview_bytes"   // deployed preview assets
+)
+
+var usageComponents = []string{UsageWorkspace, UsageArchive, UsageArtifacts, UsagePreview}
+
+// ErrQuotaExceeded is returned when a write would take a project over its storage quota
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// QuotaExceededError carries the numbers behind an ErrQuotaExceeded
+type QuotaExceededError struct {
+	UsedBytes      int64
+	RequestedBytes int64 // usage the write would result in
+	QuotaBytes     int64
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("storage quota exceeded: %d bytes needed, %d of %d bytes used", e.RequestedBytes, e.UsedBytes, e.QuotaBytes)
+}
+
+func (e *QuotaExceededError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+// StorageUsage is the storage accounted to a project
+type StorageUsage struct {
+	WorkspaceBytes int64      `json:"workspace_bytes"`
+	ArchiveBytes   int64      `json:"archive_bytes"`
+	ArtifactBytes  int64      `json:"artifact_bytes"`
+	PreviewBytes   int64      `json:"preview_bytes"`
+	TotalBytes     int64      `json:"total_bytes"`
+	QuotaBytes     int64      `json:"quota_bytes"`
+	Unlimited      bool       `json:"unlimited"`
+	MeasuredAt     *time.Time `json:"measured_at,omitempty"`
+}
+
+// QuotaService measures project storage usage and enforces Project.StorageQuotaBytes
+type QuotaService struct {
+	staticFolderPath string
+	logger           *logrus.Logger
+}
+
+func NewQuotaService(staticFolderPath string, logger *logrus.Logger) *QuotaService {
+	return &QuotaService{
+		staticFolderPath: staticFolderPath,
+		logger:           logger,
+	}
+}
+
+// Usage returns the usage last recorded for a project
+func (s *QuotaService) Usage(projectID uuid.UUID) (*StorageUsage, error) {
+	project, err := s.loadProject(projectID)
+	if err != nil {
+		return nil, err
+	}
+	return usageFromProject(project), nil
+}
+
+// Check verifies that replacing the given components with the given sizes keeps the project
+// within its quota. Writes that do not grow the total are always allowed.
+func (s *QuotaService) Check(projectID uuid.UUID, sizes map[string]int64) error {
+	project, err := s.loadProject(projectID)
+	if err != nil {
+		return err
+	}
+	usage := usageFromProject(project)
+
+	projected := *usage
+	for component, size := range sizes {
+		projected.set(component, size)
+	}
+	projected.total()
+
+	if usage.Unlimited || projected.TotalBytes <= usage.QuotaBytes || projected.TotalBytes <= usage.TotalBytes {
+		return nil
+	}
+	return &QuotaExceededError{
+		UsedBytes:      usage.TotalBytes,
+		RequestedBytes: projected.TotalBytes,
+		QuotaBytes:     usage.QuotaBytes,
+	}
+}
+
+// CheckGrowth verifies that growing one component by delta bytes keeps the project within its quota
+func (s *QuotaService) CheckGrowth(projectID uuid.UUID, component string, delta int64) error {
+	usage, err := s.Usage(projectID)
+	if err != nil {
+		return err
+	}
+	return s.Check(projectID, map[string]int64{component: usage.get(component) + delta})
+}
+
+// Record stores new sizes for the given components and refreshes Project.StorageUsedBytes
+func (s *QuotaService) Record(projectID uuid.UUID, sizes map[string]int64) error {
+	patch := models.JSONB{"measured_at": time.Now().UTC()}
+	for component, size := range sizes {
+		patch[component] = size
+	}
+
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.Project{}).Where("id = ?", projectID).
+			Update("storage_usage", gorm.Expr("COALESCE(storage_usage, '{}'::jsonb) || ?::jsonb", patch)).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.Project{}).Where("id = ?", projectID).
+			Update("storage_used_bytes", gorm.Expr(
+				"COALESCE((storage_usage->>?)::bigint, 0) + COALESCE((storage_usage->>?)::bigint, 0) + "+
+					"COALESCE((storage_usage->>?)::bigint, 0)",
+				UsageWorkspace, UsageArtifacts, UsagePreview,
+			)).Error
+	})
+}
+
+// Measure recomputes the archive, artifact and preview sizes from MinIO and disk and records them.
+// Workspace bytes are only known when the workspace is published, so the recorded value is kept.
+func (s *QuotaService) Measure(ctx context.Context, project *models.Project) (*StorageUsage, error) {
+	sizes := map[string]int64{UsageArchive: 0}
+
+	archiveBucket, archiveObject := "", ""
+	if project.StorageLocation != nil && project.StorageLocation.NetworkPath != nil {
+		archiveBucket, archiveObject = ParseNetworkPath(*project.StorageLocation.NetworkPath)
+	}
+	if archiveBucket != "" && archiveObject != "" {
+		size, err := storage.ObjectSize(ctx, archiveBucket, archiveObject)
+		if err != nil && !storage.IsNotFound(err) {
+			return nil, fmt.Errorf("failed to stat workspace archive: %w", err)
+		}
+		sizes[UsageArchive] = size
+	}
+
+	if project.RootBucket != "" && project.RootPrefix != "" {
+		var exclude []string
+		if archiveBucket == project.RootBucket {
+			exclude = append(exclude, archiveObject)
+		}
+		size, err := storage.PrefixSize(ctx, project.RootBucket, project.RootPrefix, exclude...)
+		if err != nil && !storage.IsNotFound(err) {
+			return nil, fmt.Errorf("failed to list project artifacts: %w", err)
+		}
+		sizes[UsageArtifacts] = size
+	}
+
+	previewSize, err := s.PreviewSize(project.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to measure preview assets: %w", err)
+	}
+	sizes[UsagePreview] = previewSize
+
+	if err := s.Record(project.ID, sizes); err != nil {
+		return nil, err
+	}
+	return s.Usage(project.ID)
+}
+
+// PreviewDir returns where the live preview of a project is served from. It is a symlink to
+// the active deployment under DeploymentsDir.
+func (s *QuotaService) PreviewDir(projectID uuid.UUID) string {
+	return filepath.Join(s.staticFolderPath, projectID.String())
+}
+
+// DeploymentsDir returns where the retained preview deployments of a project are stored
+func (s *QuotaService) DeploymentsDir(projectID uuid.UUID) string {
+	return filepath.Join(s.staticFolderPath, ".deployments", projectID.String())
+}
+
+// PreviewSize returns the disk space used by the preview deployments of a project, including
+// a preview deployed in place before deployments were versioned
+func (s *QuotaService) PreviewSize(projectID uuid.UUID) (int64, error) {
+	deployments, err := utils.DirSize(s.DeploymentsDir(projectID))
+	if err != nil {
+		return 0, err
+	}
+	// DirSize does not follow the PreviewDir symlink, so only a legacy directory is counted
+	legacy, err := utils.DirSize(s.PreviewDir(projectID))
+	if err != nil {
+		return 0, err
+	}
+	return deployments + legacy, nil
+}
+
+func (s *QuotaService) loadProject(projectID uuid.UUID) (*models.Project, error) {
+	var project models.Project
+	err := database.DB.Select("id", "storage_quota_bytes", "storage_used_bytes", "storage_usage").
+		Where("id = ? AND deleted_at IS NULL", projectID).First(&project).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("project not found")
+		}
+		return nil, err
+	}
+	return &project, nil
+}
+
+func usageFromProject(project *models.Project) *StorageUsage {
+	usage := &StorageUsage{
+		QuotaBytes: project.StorageQuotaBytes,
+		Unlimited:  project.IsUnlimitedStorage(),
+	}
+	for _, component := range usageComponents {
+		usage.set(component, jsonInt64(project.StorageUsage[component]))
+	}
+	if raw, ok := project.StorageUsage["measured_at"].(string); ok {
+		if t, err := time.Parse(time.RFC3339Nano, raw); err == nil {
+			usage.MeasuredAt = &t
+		}
+	}
+	usage.total()
+	return usage
+}
+
+func (u *StorageUsage) get(component string) int64 {
+	switch component {
+	case UsageWorkspace:
+		return u.WorkspaceBytes
+	case UsageArchive:
+		return u.ArchiveBytes
+	case UsageArtifacts:
+		return u.ArtifactBytes
+	case UsagePreview:
+		return u.PreviewBytes
+	}
+	return 0
+}
+
+func (u *StorageUsage) set(component string, size int64) {
+	switch component {
+	case UsageWorkspace:
+		u.WorkspaceBytes = size
+	case UsageArchive:
+		u.ArchiveBytes = size
+	case UsageArtifacts:
+		u.ArtifactBytes = size
+	case UsagePreview:
+		u.PreviewBytes = size
+	}
+}
+
+// total sums the counted components; the archive holds the same files as the workspace
+func (u *StorageUsage) total() {
+	u.TotalBytes = u.WorkspaceBytes + u.ArtifactBytes + u.PreviewBytes
+}
+
+// jsonInt64 converts a number decoded from JSONB into an int64
+func jsonInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case float64:
+		return int64(n)
+	case int64:
+		return n
+	case int:
+		return int64(n)
+	}
+	return 0
+}
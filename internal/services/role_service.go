@@ -0,0 +1,371 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"borderless_coding_server/internal/models"
+	"borderless_coding_server/pkg/cache"
+	"borderless_coding_server/pkg/database"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrRoleNotFound is returned when a role does not exist
+	ErrRoleNotFound = errors.New("role not found")
+	// ErrSystemRole is returned when changing or deleting a built-in role
+	ErrSystemRole = errors.New("built-in roles cannot be changed")
+	// ErrLastAdmin is returned when revoking the admin role from the last admin
+	ErrLastAdmin = errors.New("cannot revoke the admin role from the last admin")
+)
+
+var roleNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// userAccessCacheTTL bounds how long cached role lookups are trusted
+const userAccessCacheTTL = 5 * time.Minute
+
+// UserAccess is the set of roles and permissions a user holds
+type UserAccess struct {
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+}
+
+// RoleAuditContext identifies who changed a role assignment, for the audit log
+type RoleAuditContext struct {
+	ActorID   uuid.UUID
+	IPAddress string
+	UserAgent string
+}
+
+// RoleService manages roles, permissions and their assignment to users. Access tokens carry
+// the roles they were issued with, so revoking a role also invalidates the user's tokens.
+type RoleService struct {
+	revocation *TokenRevocationService
+	logger     *logrus.Logger
+}
+
+func NewRoleService(revocation *TokenRevocationService, logger *logrus.Logger) *RoleService {
+	return &RoleService{revocation: revocation, logger: logger}
+}
+
+// Bootstrap creates the known permissions and the built-in admin role, and moves roles
+// still stored in users.metadata["roles"] into user_roles
+func (s *RoleService) Bootstrap(ctx context.Context) error {
+	return database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		permissions := make([]models.Permission, 0, len(models.AllPermissions))
+		for name, description := range models.AllPermissions {
+			description := description
+			permission := models.Permission{Name: name, Description: &description}
+			if err := tx.Where("name = ?", name).FirstOrCreate(&permission).Error; err != nil {
+				return err
+			}
+			permissions = append(permissions, permission)
+		}
+
+		description := "Full access to everything"
+		admin := models.Role{Name: models.RoleAdmin, Description: &description, IsSystem: true}
+		if err := tx.Where("name = ?", models.RoleAdmin).FirstOrCreate(&admin).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&admin).Association("Permissions").Replace(permissions); err != nil {
+			return err
+		}
+
+		return s.migrateLegacyRoles(tx)
+	})
+}
+
+// migrateLegacyRoles grants the roles listed in users.metadata["roles"] and removes the key
+func (s *RoleService) migrateLegacyRoles(tx *gorm.DB) error {
+	var users []models.User
+	if err := tx.Where("jsonb_exists(metadata, 'roles')").Find(&users).Error; err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		values, _ := user.Metadata["roles"].([]interface{})
+		for _, value := range values {
+			name, ok := value.(string)
+			if !ok || !roleNamePattern.MatchString(name) {
+				continue
+			}
+			role := models.Role{Name: name}
+			if err := tx.Where("name = ?", name).FirstOrCreate(&role).Error; err != nil {
+				return err
+			}
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).
+				Create(&models.UserRole{UserID: user.ID, RoleID: role.ID}).Error; err != nil {
+				return err
+			}
+			if err := tx.Create(&models.AuthAudit{
+				UserID:  &user.ID,
+				Event:   "role_granted",
+				Details: models.JSONB{"role": name, "source": "metadata_migration"},
+			}).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Exec("UPDATE users SET metadata = metadata - 'roles' WHERE id = ?", user.ID).Error; err != nil {
+			return err
+		}
+		if s.logger != nil {
+			s.logger.WithField("user_id", user.ID).Info("Migrated legacy metadata roles")
+		}
+	}
+	return nil
+}
+
+// GetUserAccess returns the roles and permissions of a user, cached in Redis
+func (s *RoleService) GetUserAccess(ctx context.Context, userID uuid.UUID) (*UserAccess, error) {
+	key := userAccessCacheKey(userID)
+	if cache.Enabled() {
+		if cached, err := cache.Get(ctx, key); err == nil {
+			var access UserAccess
+			if err := json.Unmarshal([]byte(cached), &access); err == nil {
+				return &access, nil
+			}
+		}
+	}
+
+	access, err := s.loadUserAccess(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if cache.Enabled() {
+		if data, err := json.Marshal(access); err == nil {
+			if err := cache.Set(ctx, key, data, userAccessCacheTTL); err != nil && s.logger != nil {
+				s.logger.WithError(err).Warn("Failed to cache user roles")
+			}
+		}
+	}
+	return access, nil
+}
+
+func (s *RoleService) loadUserAccess(ctx context.Context, userID uuid.UUID) (*UserAccess, error) {
+	access := &UserAccess{Roles: []string{}, Permissions: []string{}}
+	db := database.DB.WithContext(ctx)
+
+	if err := db.Table("roles").
+		Joins("JOIN user_roles ON user_roles.role_id = roles.id").
+		Where("user_roles.user_id = ?", userID).
+		Order("roles.name").
+		Pluck("roles.name", &access.Roles).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Table("permissions").
+		Joins("JOIN role_permissions ON role_permissions.permission_id = permissions.id").
+		Joins("JOIN user_roles ON user_roles.role_id = role_permissions.role_id").
+		Where("user_roles.user_id = ?", userID).
+		Distinct().
+		Order("permissions.name").
+		Pluck("permissions.name", &access.Permissions).Error; err != nil {
+		return nil, err
+	}
+	return access, nil
+}
+
+// InvalidateUserAccess drops the cached roles of a user
+func (s *RoleService) InvalidateUserAccess(ctx context.Context, userID uuid.UUID) {
+	if !cache.Enabled() {
+		return
+	}
+	if err := cache.Delete(ctx, userAccessCacheKey(userID)); err != nil && s.logger != nil {
+		s.logger.WithError(err).Warn("Failed to invalidate cached user roles")
+	}
+}
+
+// ListRoles lists all roles with their permissions
+func (s *RoleService) ListRoles() ([]models.Role, error) {
+	var roles []models.Role
+	err := database.DB.Preload("Permissions").Order("name ASC").Find(&roles).Error
+	return roles, err
+}
+
+// ListPermissions lists all permissions
+func (s *RoleService) ListPermissions() ([]models.Permission, error) {
+	var permissions []models.Permission
+	err := database.DB.Order("name ASC").Find(&permissions).Error
+	return permissions, err
+}
+
+// CreateRole creates a custom role with the given permissions
+func (s *RoleService) CreateRole(name string, description *string, permissionNames []string) (*models.Role, error) {
+	if !roleNamePattern.MatchString(name) {
+		return nil, errors.New("role name must contain only lowercase letters, digits, hyphens and underscores")
+	}
+	for _, permission := range permissionNames {
+		if _, ok := models.AllPermissions[permission]; !ok {
+			return nil, errors.New("unknown permission: " + permission)
+		}
+	}
+
+	role := &models.Role{Name: name, Description: description}
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var existing int64
+		if err := tx.Model(&models.Role{}).Where("name = ?", name).Count(&existing).Error; err != nil {
+			return err
+		}
+		if existing > 0 {
+			return errors.New("role with this name already exists")
+		}
+
+		var permissions []models.Permission
+		if len(permissionNames) > 0 {
+			if err := tx.Where("name IN ?", permissionNames).Find(&permissions).Error; err != nil {
+				return err
+			}
+		}
+		role.Permissions = permissions
+		return tx.Create(role).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return role, nil
+}
+
+// DeleteRole deletes a custom role, revoking it from every user and invalidating their
+// access tokens
+func (s *RoleService) DeleteRole(ctx context.Context, id uuid.UUID) error {
+	var role models.Role
+	if err := database.DB.Where("id = ?", id).First(&role).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrRoleNotFound
+		}
+		return err
+	}
+	if role.IsSystem {
+		return ErrSystemRole
+	}
+
+	var holders []uuid.UUID
+	if err := database.DB.Model(&models.UserRole{}).Where("role_id = ?", role.ID).Pluck("user_id", &holders).Error; err != nil {
+		return err
+	}
+	if err := database.DB.Select("Permissions").Delete(&role).Error; err != nil {
+		return err
+	}
+	var errs []error
+	for _, userID := range holders {
+		errs = append(errs, s.revokeUserAccess(ctx, userID))
+	}
+	return errors.Join(errs...)
+}
+
+// GrantRole grants a role to a user and records it in the audit log
+func (s *RoleService) GrantRole(ctx context.Context, audit RoleAuditContext, userID uuid.UUID, roleName string) error {
+	role, err := s.getRoleByName(roleName)
+	if err != nil {
+		return err
+	}
+
+	err = database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		if err := tx.Where("id = ? AND deleted_at IS NULL", userID).First(&user).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errors.New("user not found")
+			}
+			return err
+		}
+
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&models.UserRole{UserID: userID, RoleID: role.ID, GrantedBy: &audit.ActorID})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil // already granted
+		}
+		return tx.Create(roleAuditEntry(audit, userID, "role_granted", role.Name)).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	s.InvalidateUserAccess(ctx, userID)
+	return nil
+}
+
+// RevokeRole revokes a role from a user, records it in the audit log and invalidates the
+// user's access tokens
+func (s *RoleService) RevokeRole(ctx context.Context, audit RoleAuditContext, userID uuid.UUID, roleName string) error {
+	role, err := s.getRoleByName(roleName)
+	if err != nil {
+		return err
+	}
+
+	err = database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if role.Name == models.RoleAdmin {
+			var admins int64
+			if err := tx.Model(&models.UserRole{}).Where("role_id = ?", role.ID).Count(&admins).Error; err != nil {
+				return err
+			}
+			if admins <= 1 {
+				return ErrLastAdmin
+			}
+		}
+
+		result := tx.Where("user_id = ? AND role_id = ?", userID, role.ID).Delete(&models.UserRole{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errors.New("user does not have this role")
+		}
+		return tx.Create(roleAuditEntry(audit, userID, "role_revoked", role.Name)).Error
+	})
+	if err != nil {
+		return err
+	}
+	return s.revokeUserAccess(ctx, userID)
+}
+
+// revokeUserAccess makes a user's roles take effect after one was revoked: their cached roles
+// are dropped, and the access tokens still carrying the revoked role stop working until the
+// client refreshes them
+func (s *RoleService) revokeUserAccess(ctx context.Context, userID uuid.UUID) error {
+	s.InvalidateUserAccess(ctx, userID)
+	if err := s.revocation.InvalidateUserTokens(ctx, userID); err != nil {
+		return fmt.Errorf("failed to invalidate access tokens of user %s: %w", userID, err)
+	}
+	return nil
+}
+
+func (s *RoleService) getRoleByName(name string) (*models.Role, error) {
+	var role models.Role
+	if err := database.DB.Where("name = ?", name).First(&role).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrRoleNotFound
+		}
+		return nil, err
+	}
+	return &role, nil
+}
+
+func roleAuditEntry(audit RoleAuditContext, userID uuid.UUID, event, role string) *models.AuthAudit {
+	entry := &models.AuthAudit{
+		UserID:  &userID,
+		Event:   event,
+		Details: models.JSONB{"role": role, "actor_id": audit.ActorID.String()},
+	}
+	if audit.IPAddress != "" {
+		entry.IPNet = &audit.IPAddress
+	}
+	if audit.UserAgent != "" {
+		entry.UserAgent = &audit.UserAgent
+	}
+	return entry
+}
+
+func userAccessCacheKey(userID uuid.UUID) string {
+	return "user_access:" + userID.String()
+}
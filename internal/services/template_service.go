@@ -0,0 +1,225 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"borderless_coding_server/internal/models"
+	"borderless_coding_server/pkg/database"
+	"borderless_coding_server/pkg/storage"
+	"borderless_coding_server/pkg/utils"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// ErrTemplateNotFound is returned when a project template does not exist
+var ErrTemplateNotFound = errors.New("template not found")
+
+var templateSlugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// TemplateService manages the registry of project templates
+type TemplateService struct {
+	bucketName  string
+	fallbackZip string
+	logger      *logrus.Logger
+}
+
+func NewTemplateService(bucketName, fallbackZip string, logger *logrus.Logger) *TemplateService {
+	return &TemplateService{
+		bucketName:  bucketName,
+		fallbackZip: fallbackZip,
+		logger:      logger,
+	}
+}
+
+// builtinTemplate describes the legacy PROJECT_TEMPLATE_ZIP layout. It is used for projects
+// without a template while no default template is registered.
+func builtinTemplate() *models.ProjectTemplate {
+	return &models.ProjectTemplate{
+		Slug:              "builtin",
+		Name:              "Default",
+		Framework:         "react-vite",
+		RootDir:           "project-template",
+		InstallCommand:    "npm install",
+		BuildCommand:      "npm run build",
+		OutputDir:         "dist",
+		PreviewEntrypoint: "index.html",
+		Meta:              models.JSONB{},
+	}
+}
+
+// CreateTemplate registers a template, uploading the archive at archivePath (if given) to MinIO
+func (s *TemplateService) CreateTemplate(ctx context.Context, template *models.ProjectTemplate, archivePath string) error {
+	if template.Name == "" {
+		return errors.New("template name is required")
+	}
+	if !templateSlugPattern.MatchString(template.Slug) {
+		return errors.New("template slug must contain only lowercase letters, digits and hyphens")
+	}
+
+	var existing models.ProjectTemplate
+	if err := database.DB.Where("slug = ?", template.Slug).First(&existing).Error; err == nil {
+		return errors.New("template with this slug already exists")
+	}
+
+	if template.Meta == nil {
+		template.Meta = make(models.JSONB)
+	}
+	if template.PreviewEntrypoint == "" {
+		template.PreviewEntrypoint = "index.html"
+	}
+	if template.ArchiveBucket == "" {
+		template.ArchiveBucket = s.bucketName
+	}
+	if template.ArchiveObject == "" {
+		template.ArchiveObject = "templates/" + template.Slug + ".zip"
+	}
+	if archivePath != "" {
+		if err := storage.UploadFile(ctx, template.ArchiveBucket, template.ArchiveObject, archivePath); err != nil {
+			return fmt.Errorf("failed to upload template archive: %w", err)
+		}
+	}
+
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if template.IsDefault {
+			if err := clearDefaultTemplate(tx); err != nil {
+				return err
+			}
+		}
+		return tx.Create(template).Error
+	})
+}
+
+// ListTemplates lists all registered templates, the default first
+func (s *TemplateService) ListTemplates() ([]models.ProjectTemplate, error) {
+	var templates []models.ProjectTemplate
+	err := database.DB.Order("is_default DESC, name ASC").Find(&templates).Error
+	return templates, err
+}
+
+// GetTemplate retrieves a template by ID or slug
+func (s *TemplateService) GetTemplate(idOrSlug string) (*models.ProjectTemplate, error) {
+	var template models.ProjectTemplate
+	query := database.DB.Where("slug = ?", idOrSlug)
+	if id, err := uuid.Parse(idOrSlug); err == nil {
+		query = database.DB.Where("id = ?", id)
+	}
+	if err := query.First(&template).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrTemplateNotFound
+		}
+		return nil, err
+	}
+	return &template, nil
+}
+
+// GetDefaultTemplate returns the template new projects use when none is chosen (nil if none is set)
+func (s *TemplateService) GetDefaultTemplate() (*models.ProjectTemplate, error) {
+	var template models.ProjectTemplate
+	err := database.DB.Where("is_default = ?", true).First(&template).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &template, nil
+}
+
+// UpdateTemplate updates template metadata
+func (s *TemplateService) UpdateTemplate(id uuid.UUID, updates map[string]interface{}) error {
+	var template models.ProjectTemplate
+	if err := database.DB.Where("id = ?", id).First(&template).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrTemplateNotFound
+		}
+		return err
+	}
+
+	if slug, ok := updates["slug"].(string); ok && !templateSlugPattern.MatchString(slug) {
+		return errors.New("template slug must contain only lowercase letters, digits and hyphens")
+	}
+
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if isDefault, ok := updates["is_default"].(bool); ok && isDefault {
+			if err := clearDefaultTemplate(tx); err != nil {
+				return err
+			}
+		}
+		return tx.Model(&template).Updates(updates).Error
+	})
+}
+
+// ReplaceArchive uploads a new archive for a template
+func (s *TemplateService) ReplaceArchive(ctx context.Context, template *models.ProjectTemplate, archivePath string) error {
+	return storage.UploadFile(ctx, template.ArchiveBucket, template.ArchiveObject, archivePath)
+}
+
+// DeleteTemplate soft deletes a template; projects created from it keep their files
+func (s *TemplateService) DeleteTemplate(id uuid.UUID) error {
+	result := database.DB.Where("id = ?", id).Delete(&models.ProjectTemplate{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrTemplateNotFound
+	}
+	return nil
+}
+
+// ForProject returns the template that drives initialization and builds of a project: its own
+// template, else the default template, else the built-in legacy template
+func (s *TemplateService) ForProject(project *models.Project) (*models.ProjectTemplate, error) {
+	if project.Template != nil {
+		return project.Template, nil
+	}
+	if project.TemplateID != nil {
+		template, err := s.GetTemplate(project.TemplateID.String())
+		if err == nil {
+			return template, nil
+		}
+		if !errors.Is(err, ErrTemplateNotFound) {
+			return nil, err
+		}
+	}
+
+	template, err := s.GetDefaultTemplate()
+	if err != nil {
+		return nil, err
+	}
+	if template != nil {
+		return template, nil
+	}
+	return builtinTemplate(), nil
+}
+
+// Extract unpacks the template files into dir
+func (s *TemplateService) Extract(ctx context.Context, template *models.ProjectTemplate, dir string) error {
+	// The built-in template lives on local disk
+	if template.ArchiveObject == "" {
+		if s.fallbackZip == "" {
+			return nil
+		}
+		if _, err := os.Stat(s.fallbackZip); err != nil {
+			return nil
+		}
+		return utils.UnZipFile(s.fallbackZip, dir)
+	}
+
+	tmpZip := filepath.Join(os.TempDir(), "template-"+uuid.New().String()+".zip")
+	defer os.Remove(tmpZip)
+	if err := storage.DownloadFile(ctx, template.ArchiveBucket, template.ArchiveObject, tmpZip); err != nil {
+		return fmt.Errorf("failed to download template archive: %w", err)
+	}
+	return utils.UnZipFile(tmpZip, dir)
+}
+
+func clearDefaultTemplate(tx *gorm.DB) error {
+	return tx.Model(&models.ProjectTemplate{}).Where("is_default = ?", true).Update("is_default", false).Error
+}
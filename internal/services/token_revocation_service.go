@@ -0,0 +1,178 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"borderless_coding_server/internal/models"
+	"borderless_coding_server/pkg/cache"
+	"borderless_coding_server/pkg/database"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// revocationCacheTTL covers the lifetime of any access token issued before a revocation,
+// plus some clock skew; older tokens have expired on their own
+const revocationCacheTTL = accessTokenLifetime + time.Minute
+
+// TokenRevocationService makes access tokens stop working before they expire. Revoked
+// sessions and each user's "tokens invalid before" time are kept in Redis, falling back to
+// the database when Redis is unavailable.
+type TokenRevocationService struct {
+	logger *logrus.Logger
+}
+
+func NewTokenRevocationService(logger *logrus.Logger) *TokenRevocationService {
+	return &TokenRevocationService{logger: logger}
+}
+
+// RevokeSessions rejects access tokens issued for the sessions from now on. The sessions
+// must already be revoked in the database. Sessions looked up before may be cached as not
+// revoked, so failing to overwrite that is an error.
+func (s *TokenRevocationService) RevokeSessions(ctx context.Context, sessionIDs ...uuid.UUID) error {
+	if !cache.Enabled() {
+		return nil
+	}
+	for _, id := range sessionIDs {
+		if err := cache.Set(ctx, revokedSessionCacheKey(id), "1", revocationCacheTTL); err != nil {
+			return fmt.Errorf("failed to cache revoked session: %w", err)
+		}
+	}
+	return nil
+}
+
+// InvalidateUserTokens rejects every access token issued to the user until now. Times are
+// kept to the second, like the tokens' iat claim.
+func (s *TokenRevocationService) InvalidateUserTokens(ctx context.Context, userID uuid.UUID) error {
+	now := time.Now().Truncate(time.Second)
+	err := database.DB.WithContext(ctx).Unscoped().Model(&models.User{}).
+		Where("id = ?", userID).
+		Update("tokens_invalid_before", now).Error
+	if err != nil {
+		return err
+	}
+
+	if cache.Enabled() {
+		if err := cache.Set(ctx, tokensInvalidBeforeCacheKey(userID), now.Unix(), revocationCacheTTL); err != nil {
+			return fmt.Errorf("failed to cache user token invalidation: %w", err)
+		}
+	}
+	return nil
+}
+
+// IsRevoked reports whether an access token's session was revoked or the token was issued
+// before its user's tokens were invalidated
+func (s *TokenRevocationService) IsRevoked(ctx context.Context, claims *Claims) (bool, error) {
+	if claims.SessionID != uuid.Nil {
+		revoked, err := s.isSessionRevoked(ctx, claims.SessionID)
+		if err != nil || revoked {
+			return revoked, err
+		}
+	}
+
+	invalidBefore, err := s.tokensInvalidBefore(ctx, claims.UserID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// The user no longer exists
+			return true, nil
+		}
+		return false, err
+	}
+	if invalidBefore.IsZero() {
+		return false, nil
+	}
+	return claims.IssuedAt == nil || claims.IssuedAt.Time.Before(invalidBefore), nil
+}
+
+// isSessionRevoked checks the cache first and falls back to the database when the session
+// is not cached, caching what it finds
+func (s *TokenRevocationService) isSessionRevoked(ctx context.Context, sessionID uuid.UUID) (bool, error) {
+	key := revokedSessionCacheKey(sessionID)
+	if cache.Enabled() {
+		cached, err := cache.Get(ctx, key)
+		if err == nil {
+			return cached == "1", nil
+		} else if !errors.Is(err, redis.Nil) && s.logger != nil {
+			s.logger.WithError(err).Warn("Failed to read cached session revocation")
+		}
+	}
+
+	var count int64
+	err := database.DB.WithContext(ctx).Model(&models.Session{}).
+		Where("id = ? AND revoked_at IS NOT NULL", sessionID).
+		Count(&count).Error
+	if err != nil {
+		return false, err
+	}
+
+	revoked := count > 0
+	if cache.Enabled() {
+		// Sessions that are not revoked are cached as "0" until RevokeSessions overwrites them
+		value := "0"
+		if revoked {
+			value = "1"
+		}
+		if err := cache.Set(ctx, key, value, revocationCacheTTL); err != nil && s.logger != nil {
+			s.logger.WithError(err).Warn("Failed to cache session revocation")
+		}
+	}
+	return revoked, nil
+}
+
+// tokensInvalidBefore returns the user's "tokens invalid before" time, or the zero time if
+// their tokens were never invalidated
+func (s *TokenRevocationService) tokensInvalidBefore(ctx context.Context, userID uuid.UUID) (time.Time, error) {
+	key := tokensInvalidBeforeCacheKey(userID)
+	if cache.Enabled() {
+		cached, err := cache.Get(ctx, key)
+		if err == nil {
+			if unix, err := strconv.ParseInt(cached, 10, 64); err == nil {
+				return unixOrZero(unix), nil
+			}
+		} else if !errors.Is(err, redis.Nil) && s.logger != nil {
+			s.logger.WithError(err).Warn("Failed to read cached user token invalidation")
+		}
+	}
+
+	var user models.User
+	err := database.DB.WithContext(ctx).Unscoped().
+		Select("tokens_invalid_before").
+		Where("id = ?", userID).
+		Take(&user).Error
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var unix int64
+	if user.TokensInvalidBefore != nil {
+		unix = user.TokensInvalidBefore.Unix()
+	}
+	if cache.Enabled() {
+		// Users whose tokens were never invalidated are cached as 0
+		if err := cache.Set(ctx, key, unix, revocationCacheTTL); err != nil && s.logger != nil {
+			s.logger.WithError(err).Warn("Failed to cache user token invalidation")
+		}
+	}
+	return unixOrZero(unix), nil
+}
+
+func unixOrZero(unix int64) time.Time {
+	if unix == 0 {
+		return time.Time{}
+	}
+	return time.Unix(unix, 0)
+}
+
+func revokedSessionCacheKey(sessionID uuid.UUID) string {
+	return "revoked_session:" + sessionID.String()
+}
+
+func tokensInvalidBeforeCacheKey(userID uuid.UUID) string {
+	return "tokens_invalid_before:" + userID.String()
+}
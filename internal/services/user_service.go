@@ -2,6 +2,8 @@ package services
 
 import (
 	"errors"
+	"fmt"
+	"strings"
 
 	"borderless_coding_server/internal/models"
 	"borderless_coding_server/pkg/database"
@@ -79,6 +81,10 @@ func (s *UserService) UpdateUser(id uuid.UUID, updates map[string]interface{}) e
 		if err := database.DB.Where("email = ? AND id != ?", email, id).First(&existingUser).Error; err == nil {
 			return errors.New("email already exists")
 		}
+		// A new email has to be verified again
+		if user.Email == nil || !strings.EqualFold(*user.Email, fmt.Sprint(email)) {
+			updates["email_verified_at"] = nil
+		}
 	}
 
 	return database.DB.Model(&user).Updates(updates).Error
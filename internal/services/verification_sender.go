@@ -0,0 +1,86 @@
+package services
+
+import (
+	"context"
+	"fmt"
+
+	"borderless_coding_server/internal/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+// VerificationSender delivers verification tokens, such as password reset links, to the
+// email address or phone number they were issued for
+type VerificationSender interface {
+	SendVerification(ctx context.Context, purpose models.TokenPurpose, sentTo, token string) error
+}
+
+// SMSSender sends text messages to E.164 phone numbers
+type SMSSender interface {
+	SendSMS(ctx context.Context, to, body string) error
+}
+
+// LogSMSSender writes text messages to the log instead of sending them. It is meant for local
+// development, where no SMS provider is configured.
+type LogSMSSender struct {
+	logger *logrus.Logger
+}
+
+func NewLogSMSSender(logger *logrus.Logger) *LogSMSSender {
+	return &LogSMSSender{logger: logger}
+}
+
+// SendSMS logs the message
+func (s *LogSMSSender) SendSMS(ctx context.Context, to, body string) error {
+	s.logger.WithFields(logrus.Fields{
+		"to":   to,
+		"body": body,
+	}).Warn("No SMS provider configured; logging the message instead of sending it")
+	return nil
+}
+
+// SMSCodeSender delivers phone one-time codes as text messages
+type SMSCodeSender struct {
+	sms SMSSender
+}
+
+func NewSMSCodeSender(sms SMSSender) *SMSCodeSender {
+	return &SMSCodeSender{sms: sms}
+}
+
+// SendVerification texts the code to sentTo
+func (s *SMSCodeSender) SendVerification(ctx context.Context, purpose models.TokenPurpose, sentTo, code string) error {
+	var action string
+	switch purpose {
+	case models.TokenPurposePhoneVerify:
+		action = "verify your phone number"
+	case models.TokenPurposePhoneLogin:
+		action = "sign in"
+	default:
+		return fmt.Errorf("no text message for %s tokens", purpose)
+	}
+	body := fmt.Sprintf("Your Borderless Coding code to %s is %s. It expires in %s. Do not share it with anyone.",
+		action, code, formatLifetime(tokenPolicies[purpose].lifetime))
+	return s.sms.SendSMS(ctx, sentTo, body)
+}
+
+// RoutingSender sends phone codes with one VerificationSender and everything else, which goes
+// to email addresses, with another
+type RoutingSender struct {
+	email VerificationSender
+	phone VerificationSender
+}
+
+func NewRoutingSender(email, phone VerificationSender) *RoutingSender {
+	return &RoutingSender{email: email, phone: phone}
+}
+
+// SendVerification picks the sender for the purpose
+func (s *RoutingSender) SendVerification(ctx context.Context, purpose models.TokenPurpose, sentTo, token string) error {
+	switch purpose {
+	case models.TokenPurposePhoneVerify, models.TokenPurposePhoneLogin:
+		return s.phone.SendVerification(ctx, purpose, sentTo, token)
+	default:
+		return s.email.SendVerification(ctx, purpose, sentTo, token)
+	}
+}
@@ -0,0 +1,520 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"borderless_coding_server/internal/models"
+	"borderless_coding_server/pkg/database"
+	"borderless_coding_server/pkg/storage"
+	"borderless_coding_server/pkg/utils"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrWorkspaceBusy is returned when another operation holds the project workspace for too long
+	ErrWorkspaceBusy = errors.New("project workspace is busy, try again later")
+	// ErrGitPathForbidden is returned for workspace paths inside the .git directory
+	ErrGitPathForbidden = errors.New("access to .git is not allowed")
+	// ErrNotDirectory is returned when listing a path that is not a directory
+	ErrNotDirectory = errors.New("not a directory")
+)
+
+// workspaceLockTimeout bounds how long a request waits for another operation on the same workspace
+const workspaceLockTimeout = 30 * time.Second
+
+// WorkspaceService materializes project workspaces on local disk and syncs them back to MinIO
+type WorkspaceService struct {
+	localStoragePath string
+	bucketName       string
+	templateService  *TemplateService
+	quotaService     *QuotaService
+	logger           *logrus.Logger
+
+	locksMu sync.Mutex
+	locks   map[uuid.UUID]chan struct{}
+
+	publishHooks []func(project *models.Project)
+}
+
+// Workspace is a checked out copy of a project's files
+type Workspace struct {
+	Dir      string
+	Project  *models.Project
+	Location *models.StorageLocation
+
+	temporary bool
+	unlock    func()
+}
+
+// FileEntry describes a file or directory inside a workspace
+type FileEntry struct {
+	Path    string    `json:"path"`
+	Name    string    `json:"name"`
+	Type    string    `json:"type"` // file, dir
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+func NewWorkspaceService(localStoragePath, bucketName string, templateService *TemplateService, quotaService *QuotaService, logger *logrus.Logger) *WorkspaceService {
+	return &WorkspaceService{
+		localStoragePath: localStoragePath,
+		bucketName:       bucketName,
+		templateService:  templateService,
+		quotaService:     quotaService,
+		logger:           logger,
+		locks:            make(map[uuid.UUID]chan struct{}),
+	}
+}
+
+// lockProject serializes workspace mutations for a project within this process
+func (s *WorkspaceService) lockProject(ctx context.Context, projectID uuid.UUID) (func(), error) {
+	s.locksMu.Lock()
+	lock, ok := s.locks[projectID]
+	if !ok {
+		lock = make(chan struct{}, 1)
+		s.locks[projectID] = lock
+	}
+	s.locksMu.Unlock()
+
+	timer := time.NewTimer(workspaceLockTimeout)
+	defer timer.Stop()
+
+	select {
+	case lock <- struct{}{}:
+		return func() { <-lock }, nil
+	case <-timer.C:
+		return nil, ErrWorkspaceBusy
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Checkout locks the project workspace and materializes its latest snapshot in the project's
+// working directory. The returned workspace must be released with Release.
+func (s *WorkspaceService) Checkout(ctx context.Context, project *models.Project) (*Workspace, error) {
+	unlock, err := s.lockProject(ctx, project.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	loc, err := s.getStorageLocation(project.ID)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+
+	dir := s.workingDirectory(project, loc)
+	// Start from a clean directory so stale files from earlier runs never leak into the snapshot
+	if err := os.RemoveAll(dir); err != nil {
+		unlock()
+		return nil, fmt.Errorf("failed to clean working directory: %w", err)
+	}
+
+	ws := &Workspace{Dir: dir, Project: project, Location: loc, unlock: unlock}
+	if err := s.materialize(ctx, ws); err != nil {
+		s.Release(ws)
+		return nil, err
+	}
+	return ws, nil
+}
+
+// Initialize replaces the project workspace with the files populate writes into an empty
+// directory, records them as a fresh history with a single commit and publishes the snapshot.
+// It returns the hash of that commit.
+func (s *WorkspaceService) Initialize(ctx context.Context, project *models.Project, message string, populate func(dir string) error) (string, error) {
+	unlock, err := s.lockProject(ctx, project.ID)
+	if err != nil {
+		return "", err
+	}
+
+	loc, err := s.getStorageLocation(project.ID)
+	if err != nil {
+		unlock()
+		return "", err
+	}
+
+	dir := s.workingDirectory(project, loc)
+	if err := os.RemoveAll(dir); err != nil {
+		unlock()
+		return "", fmt.Errorf("failed to clean working directory: %w", err)
+	}
+
+	ws := &Workspace{Dir: dir, Project: project, Location: loc, unlock: unlock}
+	defer s.Release(ws)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create working directory: %w", err)
+	}
+	if err := populate(dir); err != nil {
+		return "", err
+	}
+	// Imported history is not kept; the snapshot becomes the first commit
+	if err := os.RemoveAll(filepath.Join(dir, ".git")); err != nil {
+		return "", err
+	}
+
+	commit, err := s.Commit(ws, message)
+	if err != nil {
+		return "", err
+	}
+	if err := s.Publish(ctx, ws); err != nil {
+		return "", err
+	}
+	return commit, nil
+}
+
+// Snapshot materializes the latest project snapshot into a private temporary directory
+// without locking the project. Use it for read-only access.
+func (s *WorkspaceService) Snapshot(ctx context.Context, project *models.Project) (*Workspace, error) {
+	loc, err := s.getStorageLocation(project.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp("", "workspace-"+project.ID.String()+"-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+
+	ws := &Workspace{Dir: dir, Project: project, Location: loc, temporary: true}
+	if err := s.materialize(ctx, ws); err != nil {
+		s.Release(ws)
+		return nil, err
+	}
+	return ws, nil
+}
+
+// Release removes the local copy of the workspace and unlocks the project
+func (s *WorkspaceService) Release(ws *Workspace) {
+	if ws == nil {
+		return
+	}
+	if err := os.RemoveAll(ws.Dir); err != nil {
+		s.logger.WithError(err).Warn("Failed to clean up workspace")
+	}
+	if ws.unlock != nil {
+		ws.unlock()
+		ws.unlock = nil
+	}
+}
+
+// materialize syncs the workspace from MinIO, or initializes it from the project template
+func (s *WorkspaceService) materialize(ctx context.Context, ws *Workspace) error {
+	if err := os.MkdirAll(ws.Dir, 0755); err != nil {
+		return fmt.Errorf("failed to create working directory: %w", err)
+	}
+
+	if ws.Location != nil && ws.Location.NetworkPath != nil && *ws.Location.NetworkPath != "" {
+		bucket, object := ParseNetworkPath(*ws.Location.NetworkPath)
+		if bucket == "" || object == "" {
+			return errors.New("invalid network path")
+		}
+		tmpZip := filepath.Join(os.TempDir(), "download-"+uuid.New().String()+".zip")
+		defer os.Remove(tmpZip)
+		if err := storage.DownloadFile(ctx, bucket, object, tmpZip); err != nil {
+			return fmt.Errorf("failed to download remote archive: %w", err)
+		}
+		if err := utils.UnZipFile(tmpZip, ws.Dir); err != nil {
+			return fmt.Errorf("invalid zip archive: %w", err)
+		}
+		return nil
+	}
+
+	// New project: initialize from the project template
+	template, err := s.templateService.ForProject(ws.Project)
+	if err != nil {
+		return err
+	}
+	if err := s.templateService.Extract(ctx, template, ws.Dir); err != nil {
+		return fmt.Errorf("failed to initialize template: %w", err)
+	}
+	return nil
+}
+
+// Commit records every change in the workspace as a git commit and returns its hash
+// ("" when nothing changed)
+func (s *WorkspaceService) Commit(ws *Workspace, message string) (string, error) {
+	return utils.GitCommitAll(ws.Dir, message)
+}
+
+// Base returns the commit the workspace is at. A workspace without history (a project still on
+// its template) gets its files recorded as a first commit, so there is always one to go back to.
+func (s *WorkspaceService) Base(ws *Workspace) (string, error) {
+	if _, err := os.Stat(filepath.Join(ws.Dir, ".git")); err == nil {
+		if head := utils.GitHead(ws.Dir); head != "" {
+			return head, nil
+		}
+	}
+	return s.Commit(ws, "Initial snapshot")
+}
+
+// Rollback resets the workspace to commit, dropping the commits after it, and publishes it again
+func (s *WorkspaceService) Rollback(ctx context.Context, ws *Workspace, commit string) error {
+	if err := utils.GitResetHard(ws.Dir, commit); err != nil {
+		return err
+	}
+	return s.Publish(ctx, ws)
+}
+
+// OnPublish registers fn to be called after a project snapshot is published. Hooks run
+// synchronously and must return quickly.
+func (s *WorkspaceService) OnPublish(fn func(project *models.Project)) {
+	s.publishHooks = append(s.publishHooks, fn)
+}
+
+// Publish zips the workspace and uploads it to MinIO, persisting the network path on first upload.
+// It returns ErrQuotaExceeded (as a *QuotaExceededError) if the project would exceed its storage quota.
+func (s *WorkspaceService) Publish(ctx context.Context, ws *Workspace) error {
+	networkPath := s.networkPath(ws)
+	bucket, object := ParseNetworkPath(networkPath)
+	if bucket == "" || object == "" {
+		return errors.New("invalid network path")
+	}
+
+	tmpZip := filepath.Join(os.TempDir(), "upload-"+ws.Project.ID.String()+"-"+uuid.New().String()+".zip")
+	defer os.Remove(tmpZip)
+	if err := utils.ZipFolder(ws.Dir, tmpZip); err != nil {
+		return fmt.Errorf("zip failed: %w", err)
+	}
+
+	sizes, err := s.measure(ws.Dir, tmpZip)
+	if err != nil {
+		return err
+	}
+	if err := s.quotaService.Check(ws.Project.ID, sizes); err != nil {
+		return err
+	}
+
+	if err := storage.UploadFile(ctx, bucket, object, tmpZip); err != nil {
+		return fmt.Errorf("upload failed: %w", err)
+	}
+	if err := s.quotaService.Record(ws.Project.ID, sizes); err != nil {
+		s.logger.WithError(err).Warn("Failed to record project storage usage")
+	}
+
+	if ws.Location == nil || ws.Location.NetworkPath == nil || *ws.Location.NetworkPath != networkPath {
+		if err := s.saveNetworkPath(ws, networkPath); err != nil {
+			return err
+		}
+	}
+	for _, hook := range s.publishHooks {
+		hook(ws.Project)
+	}
+	return nil
+}
+
+// CopySnapshot copies the latest snapshot of source into target (a project without files yet),
+// including its git history. It is a no-op if source has never been published.
+func (s *WorkspaceService) CopySnapshot(ctx context.Context, source, target *models.Project) error {
+	srcLoc, err := s.getStorageLocation(source.ID)
+	if err != nil {
+		return err
+	}
+	if srcLoc == nil || srcLoc.NetworkPath == nil || *srcLoc.NetworkPath == "" {
+		return nil
+	}
+	srcBucket, srcObject := ParseNetworkPath(*srcLoc.NetworkPath)
+	if srcBucket == "" || srcObject == "" {
+		return errors.New("invalid network path")
+	}
+
+	// The copy counts against the target's quota just like a publish would
+	usage, err := s.quotaService.Usage(source.ID)
+	if err != nil {
+		return err
+	}
+	sizes := map[string]int64{UsageWorkspace: usage.WorkspaceBytes, UsageArchive: usage.ArchiveBytes}
+	if err := s.quotaService.Check(target.ID, sizes); err != nil {
+		return err
+	}
+
+	ws := &Workspace{Project: target}
+	networkPath := s.networkPath(ws)
+	dstBucket, dstObject := ParseNetworkPath(networkPath)
+	if err := storage.CopyObject(ctx, srcBucket, srcObject, dstBucket, dstObject); err != nil {
+		return fmt.Errorf("failed to copy workspace archive: %w", err)
+	}
+
+	loc := &models.StorageLocation{
+		ProjectID:   target.ID,
+		Type:        srcLoc.Type,
+		GitURL:      srcLoc.GitURL,
+		GitBranch:   srcLoc.GitBranch,
+		NetworkPath: &networkPath,
+	}
+	if err := database.DB.Create(loc).Error; err != nil {
+		return err
+	}
+
+	if err := s.quotaService.Record(target.ID, sizes); err != nil {
+		s.logger.WithError(err).Warn("Failed to record project storage usage")
+	}
+	return nil
+}
+
+// measure returns the workspace and archive sizes accounted against the project quota
+func (s *WorkspaceService) measure(dir, archive string) (map[string]int64, error) {
+	workspaceBytes, err := utils.DirSize(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to measure workspace: %w", err)
+	}
+	info, err := os.Stat(archive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to measure workspace archive: %w", err)
+	}
+	return map[string]int64{UsageWorkspace: workspaceBytes, UsageArchive: info.Size()}, nil
+}
+
+// saveNetworkPath persists the network path, creating the storage location if the project has none
+func (s *WorkspaceService) saveNetworkPath(ws *Workspace, networkPath string) error {
+	if ws.Location == nil {
+		loc := &models.StorageLocation{
+			ProjectID:   ws.Project.ID,
+			Type:        models.StorageTypeNetworkFS,
+			NetworkPath: &networkPath,
+		}
+		if err := database.DB.Create(loc).Error; err != nil {
+			return err
+		}
+		ws.Location = loc
+		return nil
+	}
+
+	if err := database.DB.Model(&models.StorageLocation{}).Where("id = ?", ws.Location.ID).Update("network_path", networkPath).Error; err != nil {
+		return err
+	}
+	ws.Location.NetworkPath = &networkPath
+	return nil
+}
+
+// networkPath returns the MinIO location ("bucket/object") of the workspace archive
+func (s *WorkspaceService) networkPath(ws *Workspace) string {
+	if ws.Location != nil && ws.Location.NetworkPath != nil && *ws.Location.NetworkPath != "" {
+		return *ws.Location.NetworkPath
+	}
+	bucket := ws.Project.RootBucket
+	if bucket == "" {
+		bucket = s.bucketName
+	}
+	return bucket + "/users/" + ws.Project.OwnerID.String() + "/projects/" + ws.Project.ID.String() + "/workspace.zip"
+}
+
+// workingDirectory returns where a locked checkout of the project lives on disk
+func (s *WorkspaceService) workingDirectory(project *models.Project, loc *models.StorageLocation) string {
+	if loc != nil && loc.LocalPath != nil && *loc.LocalPath != "" {
+		return *loc.LocalPath
+	}
+	return filepath.Join(s.localStoragePath, project.OwnerID.String(), project.ID.String())
+}
+
+func (s *WorkspaceService) getStorageLocation(projectID uuid.UUID) (*models.StorageLocation, error) {
+	var loc models.StorageLocation
+	err := database.DB.Where("project_id = ?", projectID).First(&loc).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &loc, nil
+}
+
+// ResolvePath maps a workspace-relative path to an absolute path inside the workspace.
+// Paths escaping the workspace or pointing into .git are rejected.
+func (ws *Workspace) ResolvePath(rel string) (string, error) {
+	abs, err := utils.SafeJoin(ws.Dir, rel)
+	if err != nil {
+		return "", err
+	}
+	cleaned := CleanWorkspacePath(rel)
+	if cleaned == ".git" || strings.HasPrefix(cleaned, ".git/") {
+		return "", ErrGitPathForbidden
+	}
+	return abs, nil
+}
+
+// ListFiles lists the entries below dir (workspace-relative), optionally recursing
+func (ws *Workspace) ListFiles(dir string, recursive bool) ([]FileEntry, error) {
+	root, err := ws.ResolvePath(dir)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is %w", CleanWorkspacePath(dir), ErrNotDirectory)
+	}
+
+	entries := []FileEntry{}
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		rel, err := filepath.Rel(ws.Dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+
+		entry := FileEntry{Path: rel, Name: info.Name(), Type: "file", Size: info.Size(), ModTime: info.ModTime()}
+		if info.IsDir() {
+			entry.Type = "dir"
+			entry.Size = 0
+		}
+		entries = append(entries, entry)
+
+		if info.IsDir() && !recursive {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries, nil
+}
+
+// CleanWorkspacePath normalizes a client supplied workspace-relative path
+func CleanWorkspacePath(p string) string {
+	p = strings.ReplaceAll(p, "\\", "/")
+	p = filepath.ToSlash(filepath.Clean("/" + p))
+	p = strings.TrimPrefix(p, "/")
+	if p == "" {
+		return "."
+	}
+	return p
+}
+
+// ParseNetworkPath splits a "bucket/objectKey" network path
+func ParseNetworkPath(p string) (string, string) {
+	for i := 0; i < len(p); i++ {
+		if p[i] == '/' {
+			return p[:i], p[i+1:]
+		}
+	}
+	return "", ""
+}
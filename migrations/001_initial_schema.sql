@@ -12,9 +12,6 @@ BEGIN
   IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'chat_sender') THEN
     CREATE TYPE chat_sender AS ENUM ('user','assistant','system','tool');
   END IF;
-  IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'auth_provider') THEN
-    CREATE TYPE auth_provider AS ENUM ('password','google');
-  END IF;
   IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'token_purpose') THEN
     CREATE TYPE token_purpose AS ENUM (
       'email_verify',      -- verify email ownership
@@ -24,6 +21,18 @@ BEGIN
       'reset_password'     -- password reset flow
     );
   END IF;
+  IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'user_level') THEN
+    CREATE TYPE user_level AS ENUM ('free','entry','senior','staff','principal');
+  END IF;
+  IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'project_role') THEN
+    CREATE TYPE project_role AS ENUM ('viewer','editor','admin');
+  END IF;
+  IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'project_member_status') THEN
+    CREATE TYPE project_member_status AS ENUM ('pending','accepted');
+  END IF;
+  IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'preview_deployment_status') THEN
+    CREATE TYPE preview_deployment_status AS ENUM ('active','inactive','pruned');
+  END IF;
 END$$;
 
 -- ===== Touch updated_at trigger =====
@@ -43,10 +52,13 @@ CREATE TABLE IF NOT EXISTS users (
   display_name   text,
   password_hash  text,                            -- or NULL if using SSO/OIDC
   is_active      boolean NOT NULL DEFAULT true,
+  level          user_level NOT NULL DEFAULT 'free', -- MFA may be required per level
   metadata       jsonb NOT NULL DEFAULT '{}'::jsonb,
   created_at     timestamptz NOT NULL DEFAULT now(),
   updated_at     timestamptz NOT NULL DEFAULT now(),
-  deleted_at     timestamptz
+  deleted_at     timestamptz,
+  tokens_invalid_before timestamptz,              -- access tokens issued earlier are rejected
+  email_verified_at timestamptz                   -- cleared when the email changes
 );
 CREATE TRIGGER trg_users_updated_at
 BEFORE UPDATE ON users FOR EACH ROW EXECUTE FUNCTION set_updated_at();
@@ -83,7 +95,7 @@ CREATE INDEX IF NOT EXISTS idx_user_phones_user ON user_phones(user_id);
 CREATE TABLE IF NOT EXISTS auth_identities (
   id              uuid PRIMARY KEY DEFAULT gen_random_uuid(),
   user_id         uuid NOT NULL REFERENCES users(id) ON DELETE CASCADE,
-  provider        auth_provider NOT NULL,
+  provider        text NOT NULL,        -- 'google', or a configured OIDC provider name
   provider_uid    text NOT NULL,        -- OIDC sub / Google user ID
   email_at_signup citext,               -- email seen at link time
   email_verified  boolean,
@@ -94,10 +106,26 @@ CREATE TABLE IF NOT EXISTS auth_identities (
 );
 CREATE INDEX IF NOT EXISTS idx_auth_identities_user ON auth_identities(user_id);
 
+-- OIDC sign-ins waiting for the provider's callback, consumed by it
+CREATE TABLE IF NOT EXISTS oidc_flows (
+  id           uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+  token_hash   text NOT NULL,                -- sha256 of the flow token the client holds
+  provider     text NOT NULL,
+  state        text NOT NULL,
+  nonce        text NOT NULL,
+  verifier     text NOT NULL,                -- PKCE code verifier
+  link_user_id uuid REFERENCES users(id) ON DELETE CASCADE, -- set when linking to an account
+  expires_at   timestamptz NOT NULL,
+  consumed_at  timestamptz,
+  created_at   timestamptz NOT NULL DEFAULT now()
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_oidc_flows_token_hash ON oidc_flows(token_hash);
+
 -- Credentials for password / email login (optional)
 CREATE TABLE IF NOT EXISTS user_credentials (
   user_id       uuid PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
-  password_hash text,                        -- bcrypt/argon2id; NULL if social-only
+  password_hash text,                        -- argon2id PHC string; NULL if social-only
+  salt          text,                        -- legacy sha256(salt || sha256(password)) hashes only
   password_set_at timestamptz
 );
 
@@ -120,26 +148,146 @@ CREATE INDEX IF NOT EXISTS idx_verification_tokens_lookup ON verification_tokens
 CREATE TABLE IF NOT EXISTS sessions (
   id              uuid PRIMARY KEY DEFAULT gen_random_uuid(),
   user_id         uuid NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  family_id       uuid,                      -- first session of the login; rotations share it
+  parent_id       uuid,                      -- session whose refresh token was rotated into this one
   user_agent      text,
   ip_net          inet,
   refresh_token_hash text NOT NULL,          -- hash only, never raw
   valid_until     timestamptz NOT NULL,      -- rotation/expiry
   created_at      timestamptz NOT NULL DEFAULT now(),
+  rotated_at      timestamptz,               -- refresh token exchanged; reuse revokes the family
   revoked_at      timestamptz
 );
 CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id);
+CREATE INDEX IF NOT EXISTS idx_sessions_family_id ON sessions(family_id);
+CREATE INDEX IF NOT EXISTS idx_sessions_refresh_token_hash ON sessions(refresh_token_hash);
 
 -- Audit (minimal but helpful)
 CREATE TABLE IF NOT EXISTS auth_audit (
   id          uuid PRIMARY KEY DEFAULT gen_random_uuid(),
   user_id     uuid REFERENCES users(id) ON DELETE SET NULL,
   event       text NOT NULL,                -- 'login_success','otp_sent','logout', etc.
-  provider    auth_provider,
+  provider    text,                         -- 'password', 'google' or an OIDC provider name
   ip_net      inet,
   user_agent  text,
   details     jsonb NOT NULL DEFAULT '{}'::jsonb,
   created_at  timestamptz NOT NULL DEFAULT now()
 );
+CREATE INDEX IF NOT EXISTS idx_auth_audit_user_event ON auth_audit(user_id, event, created_at);
+
+-- Attempts at guarded actions, e.g. 'password_change', counted atomically per window
+CREATE TABLE IF NOT EXISTS auth_attempts (
+  user_id      uuid NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  action       text NOT NULL,
+  count        integer NOT NULL DEFAULT 0,
+  window_start timestamptz NOT NULL,
+  PRIMARY KEY (user_id, action)
+);
+
+-- Verification tokens sent per purpose and address, counted atomically per window
+CREATE TABLE IF NOT EXISTS verification_sends (
+  purpose      text NOT NULL,
+  sent_to      text NOT NULL,
+  count        integer NOT NULL DEFAULT 0,
+  window_start timestamptz NOT NULL,
+  last_sent_at timestamptz NOT NULL,
+  PRIMARY KEY (purpose, sent_to)
+);
+
+-- TOTP second factor; pending until the first code confirms it
+CREATE TABLE IF NOT EXISTS user_mfa (
+  user_id        uuid PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+  totp_secret    text NOT NULL,               -- base32
+  enabled_at     timestamptz,                 -- NULL while enrollment is pending
+  last_used_step bigint NOT NULL DEFAULT 0,   -- time step of the last accepted code (no replays)
+  created_at     timestamptz NOT NULL DEFAULT now(),
+  updated_at     timestamptz NOT NULL DEFAULT now()
+);
+CREATE TRIGGER trg_user_mfa_updated_at
+BEFORE UPDATE ON user_mfa FOR EACH ROW EXECUTE FUNCTION set_updated_at();
+
+-- One-time recovery codes, replaced as a set
+CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+  id          uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+  user_id     uuid NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  code_hash   text NOT NULL,                  -- sha256 of the normalized code
+  used_at     timestamptz,
+  created_at  timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_mfa_recovery_codes_user ON mfa_recovery_codes(user_id);
+
+-- Logins waiting for their second factor, consumed when they complete
+CREATE TABLE IF NOT EXISTS mfa_challenges (
+  id          uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+  token_hash  text NOT NULL,                  -- sha256 of the token the client holds
+  user_id     uuid NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  method      text NOT NULL,                  -- first factor, as in login_success audits
+  enroll      boolean NOT NULL DEFAULT false, -- the level requires MFA the user has not set up
+  expires_at  timestamptz NOT NULL,
+  consumed_at timestamptz,
+  created_at  timestamptz NOT NULL DEFAULT now()
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_mfa_challenges_token_hash ON mfa_challenges(token_hash);
+
+-- Levels whose users must sign in with a second factor (missing rows: not required)
+CREATE TABLE IF NOT EXISTS mfa_policies (
+  level       user_level PRIMARY KEY,
+  required    boolean NOT NULL DEFAULT false,
+  updated_by  uuid REFERENCES users(id) ON DELETE SET NULL,
+  updated_at  timestamptz NOT NULL DEFAULT now()
+);
+
+-- Access token signing keys (rotated by the server; public halves served at /.well-known/jwks.json)
+CREATE TABLE IF NOT EXISTS signing_keys (
+  kid          text PRIMARY KEY,             -- RFC 7638 thumbprint of the public key
+  algorithm    text NOT NULL,                -- 'RS256' or 'EdDSA'
+  private_key  text NOT NULL,                -- PKCS #8 PEM
+  activates_at timestamptz NOT NULL,         -- published before it starts signing
+  expires_at   timestamptz,                  -- set once replaced; deleted after
+  created_at   timestamptz NOT NULL DEFAULT now()
+);
+
+-- Random secrets generated by the first server instance that needs them, e.g. 'preview_link'
+CREATE TABLE IF NOT EXISTS app_secrets (
+  name       text PRIMARY KEY,
+  value      text NOT NULL,
+  created_at timestamptz NOT NULL DEFAULT now()
+);
+
+-- Site roles and permissions (seeded at startup; 'admin' holds every permission)
+CREATE TABLE IF NOT EXISTS roles (
+  id          uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+  name        text NOT NULL UNIQUE,          -- 'admin', or custom roles
+  description text,
+  is_system   boolean NOT NULL DEFAULT false, -- built-in roles cannot be deleted
+  created_at  timestamptz NOT NULL DEFAULT now(),
+  updated_at  timestamptz NOT NULL DEFAULT now()
+);
+CREATE TRIGGER trg_roles_updated_at
+BEFORE UPDATE ON roles FOR EACH ROW EXECUTE FUNCTION set_updated_at();
+
+CREATE TABLE IF NOT EXISTS permissions (
+  id          uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+  name        text NOT NULL UNIQUE,          -- e.g. 'users.read', 'roles.manage'
+  description text,
+  created_at  timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+  role_id       uuid NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+  permission_id uuid NOT NULL REFERENCES permissions(id) ON DELETE CASCADE,
+  PRIMARY KEY (role_id, permission_id)
+);
+
+-- Grants and revocations are recorded in auth_audit ('role_granted','role_revoked')
+CREATE TABLE IF NOT EXISTS user_roles (
+  user_id     uuid NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  role_id     uuid NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+  granted_by  uuid REFERENCES users(id) ON DELETE SET NULL,
+  created_at  timestamptz NOT NULL DEFAULT now(),
+  PRIMARY KEY (user_id, role_id)
+);
+CREATE INDEX IF NOT EXISTS idx_user_roles_role ON user_roles(role_id);
 
 -- ===================== Project Tables =====================
 
@@ -158,6 +306,8 @@ CREATE TABLE IF NOT EXISTS projects (
   root_prefix          text NOT NULL,         -- e.g. 'users/{user_id}/projects/{project_id}/'
 
   storage_quota_bytes  bigint NOT NULL DEFAULT 0,  -- 0 = unlimited (enforced in app)
+  storage_used_bytes   bigint NOT NULL DEFAULT 0,  -- sum of storage_usage components except archive_bytes
+  storage_usage        jsonb  NOT NULL DEFAULT '{}'::jsonb,  -- workspace/archive/artifact/preview bytes
   meta                 jsonb  NOT NULL DEFAULT '{}'::jsonb,
   version              integer NOT NULL DEFAULT 1,  -- optimistic lock (optional)
 
@@ -175,6 +325,56 @@ CREATE INDEX IF NOT EXISTS idx_projects_owner
 CREATE INDEX IF NOT EXISTS idx_projects_slug_trgm
   ON projects USING gin (slug gin_trgm_ops);
 
+-- Collaborators; the owner is implied by projects.owner_id and never listed here
+CREATE TABLE IF NOT EXISTS project_members (
+  id           uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+  project_id   uuid NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+  user_id      uuid NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  role         project_role NOT NULL,
+  status       project_member_status NOT NULL DEFAULT 'pending',
+  invited_by   uuid REFERENCES users(id) ON DELETE SET NULL,
+  accepted_at  timestamptz,
+  created_at   timestamptz NOT NULL DEFAULT now(),
+  updated_at   timestamptz NOT NULL DEFAULT now(),
+  UNIQUE (project_id, user_id)
+);
+CREATE TRIGGER trg_project_members_updated_at
+BEFORE UPDATE ON project_members FOR EACH ROW EXECUTE FUNCTION set_updated_at();
+
+CREATE INDEX IF NOT EXISTS idx_project_members_user
+  ON project_members(user_id, status);
+
+-- Versioned preview deployments; the live preview is a symlink to the active one.
+-- Files of older deployments are pruned (status 'pruned') beyond the retention limit.
+CREATE TABLE IF NOT EXISTS preview_deployments (
+  id           uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+  project_id   uuid NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+  version      integer NOT NULL,              -- 1, 2, ... per project
+  build_id     uuid,                          -- preview build that produced it
+  status       preview_deployment_status NOT NULL DEFAULT 'inactive',
+  entry_point  text NOT NULL DEFAULT 'index.html',
+  size_bytes   bigint NOT NULL DEFAULT 0,
+  object_prefix text,                         -- MinIO location of the files: bucket/prefix/
+  created_by   uuid REFERENCES users(id) ON DELETE SET NULL,
+  activated_at timestamptz,
+  created_at   timestamptz NOT NULL DEFAULT now()
+);
+-- Versions are allocated while the project row is locked; the index backs that up
+CREATE UNIQUE INDEX IF NOT EXISTS idx_preview_deployments_project_version
+  ON preview_deployments(project_id, version);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_preview_deployments_active
+  ON preview_deployments(project_id) WHERE status = 'active';
+
+-- The project's active preview deployment in object storage (one per project)
+CREATE TABLE IF NOT EXISTS build_results (
+  id         uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+  project_id uuid NOT NULL UNIQUE REFERENCES projects(id) ON DELETE CASCADE,
+  built_url  text NOT NULL,                   -- bucket/prefix/ of the deployment files
+  meta       jsonb NOT NULL DEFAULT '{}'::jsonb,
+  created_at timestamptz NOT NULL DEFAULT now(),
+  updated_at timestamptz NOT NULL DEFAULT now()
+);
+
 -- ===================== Session Management (Chat) =====================
 
 -- A chat session is usually tied to a project and a user
@@ -60,3 +60,8 @@ func Exists(ctx context.Context, key string) (bool, error) {
 	result, err := RedisClient.Exists(ctx, key).Result()
 	return result > 0, err
 }
+
+// Enabled reports whether a Redis client has been configured
+func Enabled() bool {
+	return RedisClient != nil
+}
@@ -53,12 +53,18 @@ BEGIN
     IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'project_visibility') THEN
         CREATE TYPE project_visibility AS ENUM ('private','unlisted','public');
     END IF;
+    IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'project_role') THEN
+        CREATE TYPE project_role AS ENUM ('viewer','editor','admin');
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'project_member_status') THEN
+        CREATE TYPE project_member_status AS ENUM ('pending','accepted');
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'preview_deployment_status') THEN
+        CREATE TYPE preview_deployment_status AS ENUM ('active','inactive','pruned');
+    END IF;
     IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'chat_sender') THEN
         CREATE TYPE chat_sender AS ENUM ('user','assistant','system','tool');
     END IF;
-    IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'auth_provider') THEN
-        CREATE TYPE auth_provider AS ENUM ('password','google');
-    END IF;
     IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'token_purpose') THEN
         CREATE TYPE token_purpose AS ENUM ('email_verify','email_login','phone_verify','phone_login','reset_password');
     END IF;
@@ -86,15 +92,30 @@ func AutoMigrate() error {
 		&models.User{},
 		&models.UserPhone{},
 		&models.AuthIdentity{},
+		&models.OIDCFlow{},
 		&models.UserCredential{},
 		&models.VerificationToken{},
 		&models.Session{},
 		&models.AuthAudit{},
+		&models.AuthAttempt{},
+		&models.VerificationSend{},
+		&models.UserMFA{},
+		&models.MFARecoveryCode{},
+		&models.MFAChallenge{},
+		&models.MFAPolicy{},
+		&models.SigningKey{},
+		&models.AppSecret{},
+		&models.Permission{},
+		&models.Role{},
+		&models.UserRole{},
+		&models.ProjectTemplate{},
 		&models.Project{},
+		&models.ProjectMember{},
 		&models.ChatSession{},
 		&models.ChatMessage{},
 		&models.Build{},
 		&models.BuildLog{},
+		&models.PreviewDeployment{},
 		&models.StorageLocation{},
 		&models.BuildResult{},
 	)
@@ -103,6 +124,11 @@ func AutoMigrate() error {
 		return fmt.Errorf("failed to auto-migrate: %w", err)
 	}
 
+	// Sessions created before refresh token rotation each start their own family
+	if err := DB.Exec("UPDATE sessions SET family_id = id WHERE family_id IS NULL").Error; err != nil {
+		return fmt.Errorf("failed to backfill session families: %w", err)
+	}
+
 	log.Println("Database migration completed successfully")
 	return nil
 }
@@ -0,0 +1,79 @@
+package mailer
+
+import (
+	"context"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileMailerWritesMultipartMessage(t *testing.T) {
+	dir := t.TempDir()
+	m := NewFileMailer(dir, "Borderless Coding <no-reply@example.com>")
+	err := m.Send(context.Background(), Message{
+		To:      "ada@example.com",
+		Subject: "Vérifiez votre adresse",
+		Text:    "plain body",
+		HTML:    "<p>html body</p>",
+	})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("wrote %d files, want 1", len(files))
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	msg, err := mail.ReadMessage(f)
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+
+	if subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject")); subject != "Vérifiez votre adresse" {
+		t.Errorf("Subject = %q", subject)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Content-Type = %q, %v", msg.Header.Get("Content-Type"), err)
+	}
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	var bodies []string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("NextPart: %v", err)
+		}
+		body, _ := io.ReadAll(part)
+		bodies = append(bodies, part.Header.Get("Content-Type")+": "+string(body))
+	}
+	want := []string{`text/plain; charset="utf-8": plain body`, `text/html; charset="utf-8": <p>html body</p>`}
+	if strings.Join(bodies, "\n") != strings.Join(want, "\n") {
+		t.Errorf("parts = %q, want %q", bodies, want)
+	}
+}
+
+func TestBuildMessageRejectsHeaderInjection(t *testing.T) {
+	for _, msg := range []Message{
+		{To: "ada@example.com\r\nBcc: eve@example.com", Subject: "hi"},
+		{To: "ada@example.com", Subject: "hi\r\nBcc: eve@example.com"},
+		{To: "not an address", Subject: "hi"},
+	} {
+		if _, err := buildMessage("no-reply@example.com", msg, time.Now()); err == nil {
+			t.Errorf("buildMessage(%q, %q) succeeded", msg.To, msg.Subject)
+		}
+	}
+}
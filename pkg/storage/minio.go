@@ -3,7 +3,9 @@ package storage
 import (
 	"context"
 	"fmt"
+	"io/fs"
 	"log"
+	"path/filepath"
 	"time"
 
 	"borderless_coding_server/config"
@@ -86,6 +88,15 @@ func DeleteObject(ctx context.Context, bucketName, objectName string) error {
 	return MinIOClient.RemoveObject(ctx, bucketName, objectName, minio.RemoveObjectOptions{})
 }
 
+// CopyObject copies an object server-side
+func CopyObject(ctx context.Context, srcBucket, srcObject, dstBucket, dstObject string) error {
+	_, err := MinIOClient.CopyObject(ctx,
+		minio.CopyDestOptions{Bucket: dstBucket, Object: dstObject},
+		minio.CopySrcOptions{Bucket: srcBucket, Object: srcObject},
+	)
+	return err
+}
+
 // ListObjects lists objects in a bucket
 func ListObjects(ctx context.Context, bucketName string, prefix string) <-chan minio.ObjectInfo {
 	return MinIOClient.ListObjects(ctx, bucketName, minio.ListObjectsOptions{
@@ -93,3 +104,99 @@ func ListObjects(ctx context.Context, bucketName string, prefix string) <-chan m
 		Recursive: true,
 	})
 }
+
+// ObjectSize returns the size in bytes of an object
+func ObjectSize(ctx context.Context, bucketName, objectName string) (int64, error) {
+	info, err := MinIOClient.StatObject(ctx, bucketName, objectName, minio.StatObjectOptions{})
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+// IsNotFound reports whether err is a MinIO "object/bucket does not exist" error
+func IsNotFound(err error) bool {
+	code := minio.ToErrorResponse(err).Code
+	return code == "NoSuchKey" || code == "NoSuchBucket"
+}
+
+// PrefixSize sums the sizes of all objects under prefix; objects listed in exclude are skipped
+func PrefixSize(ctx context.Context, bucketName, prefix string, exclude ...string) (int64, error) {
+	var total int64
+	for obj := range ListObjects(ctx, bucketName, prefix) {
+		if obj.Err != nil {
+			return 0, obj.Err
+		}
+		skip := false
+		for _, name := range exclude {
+			if obj.Key == name {
+				skip = true
+				break
+			}
+		}
+		if !skip {
+			total += obj.Size
+		}
+	}
+	return total, nil
+}
+
+// UploadDir uploads every regular file below dir as objects named prefix + relative path and
+// returns how many files were uploaded
+func UploadDir(ctx context.Context, bucketName, prefix, dir string) (int, error) {
+	count := 0
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if err := UploadFile(ctx, bucketName, prefix+filepath.ToSlash(rel), path); err != nil {
+			return fmt.Errorf("failed to upload %s: %w", rel, err)
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// OpenObject opens an object for reading and seeking. Missing objects fail with an error
+// matched by IsNotFound.
+func OpenObject(ctx context.Context, bucketName, objectName string) (*minio.Object, minio.ObjectInfo, error) {
+	obj, err := MinIOClient.GetObject(ctx, bucketName, objectName, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, minio.ObjectInfo{}, err
+	}
+	info, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, minio.ObjectInfo{}, err
+	}
+	return obj, info, nil
+}
+
+// RemovePrefix deletes every object under prefix
+func RemovePrefix(ctx context.Context, bucketName, prefix string) error {
+	objects := make(chan minio.ObjectInfo)
+	go func() {
+		defer close(objects)
+		for obj := range ListObjects(ctx, bucketName, prefix) {
+			if obj.Err != nil {
+				return
+			}
+			objects <- obj
+		}
+	}()
+	var firstErr error
+	for result := range MinIOClient.RemoveObjects(ctx, bucketName, objects, minio.RemoveObjectsOptions{}) {
+		if result.Err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to remove %s: %w", result.ObjectName, result.Err)
+		}
+	}
+	return firstErr
+}
@@ -1,7 +1,12 @@
 package utils
 
 import (
+	"archive/tar"
 	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
@@ -17,6 +22,44 @@ func CreateFolderIfNotExists(path string) error {
 	return nil
 }
 
+// ErrPathEscapesRoot is returned by SafeJoin for paths outside the root
+var ErrPathEscapesRoot = errors.New("path escapes the workspace")
+
+// SafeJoin joins a client supplied relative path onto root, rejecting paths that escape root
+func SafeJoin(root, rel string) (string, error) {
+	rootAbs, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	rel = strings.ReplaceAll(rel, "\\", "/")
+	targetAbs, err := filepath.Abs(filepath.Join(rootAbs, filepath.FromSlash(rel)))
+	if err != nil {
+		return "", err
+	}
+	if targetAbs != rootAbs && !strings.HasPrefix(targetAbs, rootAbs+string(os.PathSeparator)) {
+		return "", ErrPathEscapesRoot
+	}
+	return targetAbs, nil
+}
+
+// DirSize returns the total size in bytes of the regular files below dir (0 if dir does not exist)
+func DirSize(dir string) (int64, error) {
+	var total int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
 func CreateZipFile(path string) error {
 	zipFile, err := os.Create(path)
 	if err != nil {
@@ -27,8 +70,18 @@ func CreateZipFile(path string) error {
 	return zipWriter.Close()
 }
 
+// ErrArchiveTooLarge is returned when an archive expands beyond the allowed size
+var ErrArchiveTooLarge = errors.New("archive exceeds the maximum allowed size")
+
 // UnZipFile extracts a zip archive (zipPath) into the destination directory (destPath)
 func UnZipFile(zipPath, destPath string) error {
+	return UnZipFileLimited(zipPath, destPath, 0)
+}
+
+// UnZipFileLimited extracts a zip archive like UnZipFile, failing with ErrArchiveTooLarge once
+// more than maxBytes (uncompressed) would be written. A maxBytes of 0 means no limit.
+// Entries escaping destPath and symlinks are rejected.
+func UnZipFileLimited(zipPath, destPath string, maxBytes int64) error {
 	r, err := zip.OpenReader(zipPath)
 	if err != nil {
 		return err
@@ -43,6 +96,18 @@ func UnZipFile(zipPath, destPath string) error {
 		return err
 	}
 
+	// Reject archives whose declared size is already over the limit before writing anything
+	if maxBytes > 0 {
+		var declared uint64
+		for _, f := range r.File {
+			declared += f.UncompressedSize64
+		}
+		if declared > uint64(maxBytes) {
+			return ErrArchiveTooLarge
+		}
+	}
+
+	var written int64
 	for _, f := range r.File {
 		// Normalize to forward slashes
 		name := strings.ReplaceAll(f.Name, "\\", "/")
@@ -53,11 +118,14 @@ func UnZipFile(zipPath, destPath string) error {
 		}
 		// ZipSlip protection
 		if !strings.HasPrefix(targetAbs, destAbs+string(os.PathSeparator)) && targetAbs != destAbs {
-			return err
+			return fmt.Errorf("illegal file path in archive: %s", f.Name)
+		}
+		if f.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("symlinks are not allowed in archive: %s", f.Name)
 		}
 
 		if f.FileInfo().IsDir() {
-			if err := os.MkdirAll(targetAbs, f.Mode()); err != nil {
+			if err := os.MkdirAll(targetAbs, dirMode(f.Mode())); err != nil {
 				return err
 			}
 			continue
@@ -67,40 +135,68 @@ func UnZipFile(zipPath, destPath string) error {
 			return err
 		}
 
-		rc, err := f.Open()
-		if err != nil {
-			return err
-		}
-
-		outFile, err := os.OpenFile(targetAbs, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
+		n, err := extractZipFile(f, targetAbs, maxBytes-written, maxBytes > 0)
 		if err != nil {
-			rc.Close()
 			return err
 		}
-
-		if _, err := io.Copy(outFile, rc); err != nil {
-			outFile.Close()
-			rc.Close()
-			return err
-		}
-		outFile.Close()
-		rc.Close()
+		written += n
 	}
 
 	return nil
 }
 
-// ZipFolder zips the entire srcDir into destZip (absolute or relative path)
-func ZipFolder(srcDir, destZip string) error {
-	zipFile, err := os.Create(destZip)
+// extractZipFile writes a single archive entry to target, copying at most limit bytes when limited
+func extractZipFile(f *zip.File, target string, limit int64, limited bool) (int64, error) {
+	rc, err := f.Open()
 	if err != nil {
-		return err
+		return 0, err
 	}
-	defer zipFile.Close()
+	defer rc.Close()
 
-	zipWriter := zip.NewWriter(zipFile)
-	defer zipWriter.Close()
+	outFile, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode().Perm()|0600)
+	if err != nil {
+		return 0, err
+	}
+	defer outFile.Close()
+
+	// The declared size can lie; count what is actually decompressed
+	var src io.Reader = rc
+	if limited {
+		src = io.LimitReader(rc, limit+1)
+	}
+	n, err := io.Copy(outFile, src)
+	if err != nil {
+		return n, err
+	}
+	if limited && n > limit {
+		return n, ErrArchiveTooLarge
+	}
+	return n, nil
+}
+
+// dirMode makes sure extracted directories stay traversable
+func dirMode(mode os.FileMode) os.FileMode {
+	return mode.Perm() | 0700
+}
 
+// ArchiveOptions controls which files are written by WriteZip and WriteTarGz
+type ArchiveOptions struct {
+	// Exclude lists file or directory names skipped at any depth (e.g. "node_modules", ".git")
+	Exclude []string
+}
+
+func (o ArchiveOptions) excluded(name string) bool {
+	for _, ex := range o.Exclude {
+		if ex == name {
+			return true
+		}
+	}
+	return false
+}
+
+// walkArchive calls fn for every file and directory below srcDir that belongs in an archive,
+// with its slash-separated path relative to srcDir. Symlinks and OS junk files are skipped.
+func walkArchive(srcDir string, opts ArchiveOptions, fn func(path, name string, info os.FileInfo) error) error {
 	return filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -114,11 +210,17 @@ func ZipFolder(srcDir, destZip string) error {
 			return nil
 		}
 
-		// Skip VCS and junk files
+		// Skip junk files and excluded entries
 		base := filepath.Base(path)
 		if base == ".DS_Store" || base == "Thumbs.db" {
 			return nil
 		}
+		if opts.excluded(base) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
 
 		// Skip symlinks
 		if info.Mode()&os.ModeSymlink != 0 {
@@ -128,12 +230,35 @@ func ZipFolder(srcDir, destZip string) error {
 			return nil
 		}
 
+		// Ensure forward slashes for cross-platform compatibility (macOS Finder)
+		return fn(path, strings.ReplaceAll(rel, string(filepath.Separator), "/"), info)
+	})
+}
+
+// ZipFolder zips the entire srcDir into destZip (absolute or relative path)
+func ZipFolder(srcDir, destZip string) error {
+	zipFile, err := os.Create(destZip)
+	if err != nil {
+		return err
+	}
+	defer zipFile.Close()
+
+	if err := WriteZip(zipFile, srcDir, ArchiveOptions{}); err != nil {
+		return err
+	}
+	return zipFile.Close()
+}
+
+// WriteZip streams srcDir as a zip archive to w
+func WriteZip(w io.Writer, srcDir string, opts ArchiveOptions) error {
+	zipWriter := zip.NewWriter(w)
+
+	err := walkArchive(srcDir, opts, func(path, name string, info os.FileInfo) error {
 		header, err := zip.FileInfoHeader(info)
 		if err != nil {
 			return err
 		}
-		// Ensure forward slashes for cross-platform compatibility (macOS Finder)
-		header.Name = strings.ReplaceAll(rel, string(filepath.Separator), "/")
+		header.Name = name
 		if info.IsDir() {
 			header.Name += "/"
 		} else {
@@ -147,16 +272,58 @@ func ZipFolder(srcDir, destZip string) error {
 		if info.IsDir() {
 			return nil
 		}
-		f, err := os.Open(path)
+		return copyFileTo(writer, path)
+	})
+	if err != nil {
+		zipWriter.Close()
+		return err
+	}
+	return zipWriter.Close()
+}
+
+// WriteTarGz streams srcDir as a gzip compressed tar archive to w
+func WriteTarGz(w io.Writer, srcDir string, opts ArchiveOptions) error {
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	err := walkArchive(srcDir, opts, func(path, name string, info os.FileInfo) error {
+		header, err := tar.FileInfoHeader(info, "")
 		if err != nil {
 			return err
 		}
-		defer f.Close()
-		if _, err := io.Copy(writer, f); err != nil {
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		// Do not leak server account names into exported archives
+		header.Uname, header.Gname = "", ""
+		header.Uid, header.Gid = 0, 0
+
+		if err := tarWriter.WriteHeader(header); err != nil {
 			return err
 		}
-		return nil
+		if info.IsDir() {
+			return nil
+		}
+		return copyFileTo(tarWriter, path)
 	})
+	if err == nil {
+		err = tarWriter.Close()
+	}
+	if closeErr := gzipWriter.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func copyFileTo(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
 }
 
 // CopyDir copies all files and subdirectories from src to dst (dst is created if not exists)
@@ -217,3 +384,92 @@ func CopyDir(src, dst string) error {
 		return out.Close()
 	})
 }
+
+// SyncDir makes dst match src, rewriting only files whose content changed so file watchers
+// see the smallest possible change. Files missing from src are removed from dst, except
+// entries named in keep (at any depth), which are left alone on both sides.
+func SyncDir(src, dst string, keep ...string) error {
+	opts := ArchiveOptions{Exclude: keep}
+	wanted := make(map[string]bool)
+
+	err := walkArchive(src, opts, func(path, name string, info os.FileInfo) error {
+		wanted[name] = true
+		target := filepath.Join(dst, filepath.FromSlash(name))
+		if info.IsDir() {
+			return os.MkdirAll(target, dirMode(info.Mode()))
+		}
+		same, err := sameContent(path, target)
+		if err != nil || same {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+	if err != nil {
+		return err
+	}
+
+	// Remove what src no longer has; removed directories take their contents with them
+	var stale []string
+	err = walkArchive(dst, opts, func(path, name string, info os.FileInfo) error {
+		if wanted[name] {
+			return nil
+		}
+		stale = append(stale, path)
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, path := range stale {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sameContent reports whether the regular file b exists with the same content as a
+func sameContent(a, b string) (bool, error) {
+	infoB, err := os.Stat(b)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	if !infoB.Mode().IsRegular() || infoA.Size() != infoB.Size() {
+		return false, nil
+	}
+	contentA, err := os.ReadFile(a)
+	if err != nil {
+		return false, err
+	}
+	contentB, err := os.ReadFile(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(contentA, contentB), nil
+}
@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestZip(t *testing.T, entries map[string]string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.zip")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	zw := zip.NewWriter(f)
+	for name, content := range entries {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("zip Create: %v", err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatalf("zip Write: %v", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("zip Close: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return path
+}
+
+func TestUnZipFileLimited(t *testing.T) {
+	t.Run("extracts", func(t *testing.T) {
+		dest := t.TempDir()
+		archive := writeTestZip(t, map[string]string{"src/main.go": "package main\n"})
+		if err := UnZipFileLimited(archive, dest, 1024); err != nil {
+			t.Fatalf("UnZipFileLimited: %v", err)
+		}
+		got, err := os.ReadFile(filepath.Join(dest, "src", "main.go"))
+		if err != nil || string(got) != "package main\n" {
+			t.Fatalf("extracted file: %q, %v", got, err)
+		}
+	})
+
+	t.Run("rejects zip slip", func(t *testing.T) {
+		archive := writeTestZip(t, map[string]string{"../escape.txt": "x"})
+		err := UnZipFile(archive, t.TempDir())
+		if err == nil || !strings.Contains(err.Error(), "illegal file path") {
+			t.Fatalf("expected illegal path error, got %v", err)
+		}
+	})
+
+	t.Run("rejects oversized archives", func(t *testing.T) {
+		archive := writeTestZip(t, map[string]string{"big.txt": strings.Repeat("a", 2048)})
+		if err := UnZipFileLimited(archive, t.TempDir(), 1024); !errors.Is(err, ErrArchiveTooLarge) {
+			t.Fatalf("expected ErrArchiveTooLarge, got %v", err)
+		}
+	})
+}
+
+func TestWriteTarGzExcludes(t *testing.T) {
+	src := t.TempDir()
+	writeTestFile(t, src, "src/app.js", "console.log(1)\n")
+	writeTestFile(t, src, "node_modules/dep/index.js", "module.exports = 1\n")
+	writeTestFile(t, src, ".git/HEAD", "ref: refs/heads/main\n")
+
+	var buf bytes.Buffer
+	if err := WriteTarGz(&buf, src, ArchiveOptions{Exclude: []string{"node_modules", ".git"}}); err != nil {
+		t.Fatalf("WriteTarGz: %v", err)
+	}
+
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	tr := tar.NewReader(gz)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("tar Next: %v", err)
+		}
+		names = append(names, hdr.Name)
+	}
+	if strings.Join(names, ",") != "src/,src/app.js" {
+		t.Fatalf("archive entries = %v", names)
+	}
+}
+
+func TestSyncDir(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	writeTestFile(t, src, "src/app.js", "console.log(2)\n")
+	writeTestFile(t, src, "src/same.js", "same\n")
+	writeTestFile(t, dst, "src/app.js", "console.log(1)\n")
+	writeTestFile(t, dst, "src/same.js", "same\n")
+	writeTestFile(t, dst, "src/removed.js", "gone\n")
+	writeTestFile(t, dst, "old/file.txt", "gone\n")
+	writeTestFile(t, dst, "node_modules/dep/index.js", "module.exports = 1\n")
+
+	unchanged := filepath.Join(dst, "src", "same.js")
+	before, err := os.Stat(unchanged)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	if err := SyncDir(src, dst, "node_modules"); err != nil {
+		t.Fatalf("SyncDir: %v", err)
+	}
+
+	if got, _ := os.ReadFile(filepath.Join(dst, "src", "app.js")); string(got) != "console.log(2)\n" {
+		t.Errorf("changed file not updated: %q", got)
+	}
+	for _, name := range []string{"src/removed.js", "old"} {
+		if _, err := os.Stat(filepath.Join(dst, name)); !os.IsNotExist(err) {
+			t.Errorf("%s not removed: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dst, "node_modules", "dep", "index.js")); err != nil {
+		t.Errorf("kept entry removed: %v", err)
+	}
+	if after, err := os.Stat(unchanged); err != nil || !after.ModTime().Equal(before.ModTime()) {
+		t.Errorf("unchanged file was rewritten")
+	}
+}
@@ -0,0 +1,304 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Identity used for commits made by the server inside project workspaces
+const (
+	gitAuthorName  = "Borderless Coding"
+	gitAuthorEmail = "workspace@borderless-coding.local"
+)
+
+// GitFileChange describes how a single path changed in a commit
+type GitFileChange struct {
+	Path      string `json:"path"`
+	OldPath   string `json:"old_path,omitempty"`
+	Status    string `json:"status"` // added, modified, deleted, renamed, copied, type_changed
+	Additions int    `json:"additions"`
+	Deletions int    `json:"deletions"`
+	Binary    bool   `json:"binary,omitempty"`
+}
+
+// GitDiffSummary summarizes the changes introduced by a single commit
+type GitDiffSummary struct {
+	Commit        string          `json:"commit,omitempty"`
+	Parent        string          `json:"parent,omitempty"`
+	Files         []GitFileChange `json:"files"`
+	FilesAdded    int             `json:"files_added"`
+	FilesModified int             `json:"files_modified"`
+	FilesDeleted  int             `json:"files_deleted"`
+	Additions     int             `json:"additions"`
+	Deletions     int             `json:"deletions"`
+	Diff          string          `json:"diff,omitempty"`
+	DiffTruncated bool            `json:"diff_truncated,omitempty"`
+}
+
+// runGit runs a git command inside dir and returns its stdout
+func runGit(dir string, args ...string) ([]byte, error) {
+	fullArgs := append([]string{"-c", "user.name=" + gitAuthorName, "-c", "user.email=" + gitAuthorEmail}, args...)
+	cmd := exec.Command("git", fullArgs...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return out, fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// ValidateGitURL checks that url uses a transport the server is willing to clone from
+// (https, http, ssh, git, file or scp-like user@host:path) and cannot be mistaken for an option
+func ValidateGitURL(url string) error {
+	if url == "" {
+		return fmt.Errorf("git url is required")
+	}
+	if strings.HasPrefix(url, "-") || strings.ContainsAny(url, " \t\r\n") {
+		return fmt.Errorf("invalid git url")
+	}
+	for _, scheme := range []string{"https://", "http://", "ssh://", "git://", "file://"} {
+		if strings.HasPrefix(strings.ToLower(url), scheme) {
+			return nil
+		}
+	}
+	// scp-like syntax: user@host:path
+	if at, colon := strings.Index(url, "@"), strings.Index(url, ":"); at > 0 && colon > at+1 && !strings.Contains(url[:colon], "/") {
+		return nil
+	}
+	return fmt.Errorf("unsupported git url scheme")
+}
+
+// GitClone clones the given branch (or the default branch) of url into dir without history
+func GitClone(ctx context.Context, url, branch, dir string) error {
+	if err := ValidateGitURL(url); err != nil {
+		return err
+	}
+	args := []string{"clone", "--depth", "1", "--single-branch", "--no-tags"}
+	if branch != "" {
+		args = append(args, "--branch", branch)
+	}
+	args = append(args, "--", url, dir)
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	// Never prompt for credentials on the server
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_ASKPASS=true")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git clone: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// GitHead returns the commit hash HEAD points to, or "" if the repository has no commits yet
+func GitHead(dir string) string {
+	out, err := runGit(dir, "rev-parse", "--verify", "--quiet", "HEAD")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// GitCommitAll stages every change in dir and commits it, initializing the repository if needed.
+// It returns the new commit hash, or "" when there was nothing to commit.
+func GitCommitAll(dir, message string) (string, error) {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); os.IsNotExist(err) {
+		if _, err := runGit(dir, "init"); err != nil {
+			return "", err
+		}
+	}
+	if _, err := runGit(dir, "add", "-A", "."); err != nil {
+		return "", err
+	}
+
+	// Nothing staged means nothing to commit
+	if _, err := runGit(dir, "diff", "--cached", "--quiet"); err == nil && GitHead(dir) != "" {
+		return "", nil
+	}
+
+	if message == "" {
+		message = "update via chat"
+	}
+	if _, err := runGit(dir, "commit", "--allow-empty", "-m", message); err != nil {
+		return "", err
+	}
+	return GitHead(dir), nil
+}
+
+// GitResetHard moves the repository in dir back to commit, discarding later commits and every
+// uncommitted or untracked file
+func GitResetHard(dir, commit string) error {
+	if _, err := runGit(dir, "reset", "--hard", "--quiet", commit); err != nil {
+		return err
+	}
+	_, err := runGit(dir, "clean", "-fdq")
+	return err
+}
+
+// GitBundle streams a git bundle with every ref of the repository in dir to w
+func GitBundle(ctx context.Context, dir string, w io.Writer) error {
+	if GitHead(dir) == "" {
+		return fmt.Errorf("repository has no commits")
+	}
+	cmd := exec.CommandContext(ctx, "git", "bundle", "create", "-", "--all")
+	cmd.Dir = dir
+	cmd.Stdout = w
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git bundle: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// GitCommitDiff summarizes the changes introduced by commit (compared to its first parent,
+// or to the empty tree for a root commit). When includeDiff is set the unified diff is
+// attached as well, truncated to maxDiffBytes when that is positive.
+func GitCommitDiff(dir, commit string, includeDiff bool, maxDiffBytes int) (*GitDiffSummary, error) {
+	summary := &GitDiffSummary{Commit: commit, Files: []GitFileChange{}}
+	if out, err := runGit(dir, "rev-parse", "--verify", "--quiet", commit+"^"); err == nil {
+		summary.Parent = strings.TrimSpace(string(out))
+	}
+
+	nameStatus, err := runGit(dir, "show", "--no-color", "--format=", "--root", "-M", "--name-status", "-z", commit)
+	if err != nil {
+		return nil, err
+	}
+	numStat, err := runGit(dir, "show", "--no-color", "--format=", "--root", "-M", "--numstat", "-z", commit)
+	if err != nil {
+		return nil, err
+	}
+
+	summary.Files = parseNameStatus(nameStatus)
+	applyNumStat(summary.Files, numStat)
+
+	for _, f := range summary.Files {
+		switch f.Status {
+		case "added", "copied":
+			summary.FilesAdded++
+		case "deleted":
+			summary.FilesDeleted++
+		default:
+			summary.FilesModified++
+		}
+		summary.Additions += f.Additions
+		summary.Deletions += f.Deletions
+	}
+
+	if includeDiff {
+		patch, err := runGit(dir, "show", "--no-color", "--format=", "--root", "-M", "--patch", commit)
+		if err != nil {
+			return nil, err
+		}
+		if maxDiffBytes > 0 && len(patch) > maxDiffBytes {
+			patch = patch[:maxDiffBytes]
+			summary.DiffTruncated = true
+		}
+		summary.Diff = string(patch)
+	}
+
+	return summary, nil
+}
+
+// parseNameStatus parses `git show --name-status -z` output
+func parseNameStatus(out []byte) []GitFileChange {
+	fields := splitNul(out)
+	changes := []GitFileChange{}
+	for i := 0; i < len(fields); i++ {
+		code := fields[i]
+		if code == "" {
+			continue
+		}
+		change := GitFileChange{Status: gitStatusName(code[0])}
+		// Renames and copies carry both the source and destination paths
+		if code[0] == 'R' || code[0] == 'C' {
+			if i+2 >= len(fields) {
+				break
+			}
+			change.OldPath = fields[i+1]
+			change.Path = fields[i+2]
+			i += 2
+		} else {
+			if i+1 >= len(fields) {
+				break
+			}
+			change.Path = fields[i+1]
+			i++
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// applyNumStat fills line counts from `git show --numstat -z` output into changes
+func applyNumStat(changes []GitFileChange, out []byte) {
+	index := make(map[string]int, len(changes))
+	for i, c := range changes {
+		index[c.Path] = i
+	}
+
+	fields := splitNul(out)
+	for i := 0; i < len(fields); i++ {
+		parts := strings.SplitN(fields[i], "\t", 3)
+		if len(parts) < 3 {
+			continue
+		}
+		path := parts[2]
+		// Renames are reported as "added\tdeleted\t" followed by the old and new paths
+		if path == "" {
+			if i+2 >= len(fields) {
+				break
+			}
+			path = fields[i+2]
+			i += 2
+		}
+		idx, ok := index[path]
+		if !ok {
+			continue
+		}
+		if parts[0] == "-" && parts[1] == "-" {
+			changes[idx].Binary = true
+			continue
+		}
+		changes[idx].Additions, _ = strconv.Atoi(parts[0])
+		changes[idx].Deletions, _ = strconv.Atoi(parts[1])
+	}
+}
+
+func splitNul(out []byte) []string {
+	trimmed := strings.Trim(string(out), "\x00\n")
+	if trimmed == "" {
+		return nil
+	}
+	fields := strings.Split(trimmed, "\x00")
+	for i := range fields {
+		fields[i] = strings.TrimLeft(fields[i], "\n")
+	}
+	return fields
+}
+
+func gitStatusName(code byte) string {
+	switch code {
+	case 'A':
+		return "added"
+	case 'D':
+		return "deleted"
+	case 'R':
+		return "renamed"
+	case 'C':
+		return "copied"
+	case 'T':
+		return "type_changed"
+	default:
+		return "modified"
+	}
+}
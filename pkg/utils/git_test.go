@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+}
+
+func TestGitCommitDiff_SummarizesTurn(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir := t.TempDir()
+
+	writeTestFile(t, dir, "keep.txt", "one\ntwo\n")
+	writeTestFile(t, dir, "remove.txt", "bye\n")
+	writeTestFile(t, dir, "old/name.txt", "same content that is long enough to be detected as a rename\n")
+	first, err := GitCommitAll(dir, "initial")
+	if err != nil || first == "" {
+		t.Fatalf("initial commit: %q, %v", first, err)
+	}
+
+	root, err := GitCommitDiff(dir, first, false, 0)
+	if err != nil {
+		t.Fatalf("GitCommitDiff root: %v", err)
+	}
+	if root.FilesAdded != 3 || root.Parent != "" {
+		t.Fatalf("root summary: added=%d parent=%q", root.FilesAdded, root.Parent)
+	}
+
+	writeTestFile(t, dir, "keep.txt", "one\nTWO\nthree\n")
+	writeTestFile(t, dir, "new.txt", "hello\n")
+	if err := os.Remove(filepath.Join(dir, "remove.txt")); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "new"), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := os.Rename(filepath.Join(dir, "old/name.txt"), filepath.Join(dir, "new/name.txt")); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+
+	second, err := GitCommitAll(dir, "turn")
+	if err != nil || second == "" || second == first {
+		t.Fatalf("second commit: %q, %v", second, err)
+	}
+
+	summary, err := GitCommitDiff(dir, second, true, 0)
+	if err != nil {
+		t.Fatalf("GitCommitDiff: %v", err)
+	}
+	if summary.Parent != first {
+		t.Fatalf("parent = %q, want %q", summary.Parent, first)
+	}
+	if summary.FilesAdded != 1 || summary.FilesDeleted != 1 || summary.FilesModified != 2 {
+		t.Fatalf("counts: added=%d deleted=%d modified=%d", summary.FilesAdded, summary.FilesDeleted, summary.FilesModified)
+	}
+
+	byPath := map[string]GitFileChange{}
+	for _, f := range summary.Files {
+		byPath[f.Path] = f
+	}
+	if f := byPath["keep.txt"]; f.Status != "modified" || f.Additions != 2 || f.Deletions != 1 {
+		t.Fatalf("keep.txt: %+v", f)
+	}
+	if f := byPath["new/name.txt"]; f.Status != "renamed" || f.OldPath != "old/name.txt" {
+		t.Fatalf("rename: %+v", f)
+	}
+	if summary.Diff == "" {
+		t.Fatalf("expected unified diff")
+	}
+
+	// A turn without changes produces no commit
+	third, err := GitCommitAll(dir, "noop")
+	if err != nil || third != "" {
+		t.Fatalf("noop commit: %q, %v", third, err)
+	}
+}
+
+func TestGitResetHard(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir := t.TempDir()
+
+	writeTestFile(t, dir, "a.txt", "one\n")
+	base, err := GitCommitAll(dir, "base")
+	if err != nil {
+		t.Fatalf("base commit: %v", err)
+	}
+	writeTestFile(t, dir, "a.txt", "two\n")
+	writeTestFile(t, dir, "b.txt", "new\n")
+	if _, err := GitCommitAll(dir, "change"); err != nil {
+		t.Fatalf("change commit: %v", err)
+	}
+	writeTestFile(t, dir, "untracked.txt", "stray\n")
+
+	if err := GitResetHard(dir, base); err != nil {
+		t.Fatalf("GitResetHard: %v", err)
+	}
+	if head := GitHead(dir); head != base {
+		t.Errorf("HEAD = %s, want %s", head, base)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "a.txt")); string(content) != "one\n" {
+		t.Errorf("a.txt = %q, want the base content", content)
+	}
+	for _, name := range []string{"b.txt", "untracked.txt"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s still exists after reset", name)
+		}
+	}
+}
+
+func TestValidateGitURL(t *testing.T) {
+	valid := []string{
+		"https://github.com/org/repo.git",
+		"ssh://git@github.com/org/repo.git",
+		"git@github.com:org/repo.git",
+		"file:///srv/git/repo.git",
+	}
+	for _, url := range valid {
+		if err := ValidateGitURL(url); err != nil {
+			t.Errorf("ValidateGitURL(%q) = %v, want nil", url, err)
+		}
+	}
+
+	invalid := []string{"", "--upload-pack=touch /tmp/x", "ext::sh -c touch% /tmp/x", "/srv/git/repo.git", "ftp://example.com/repo"}
+	for _, url := range invalid {
+		if err := ValidateGitURL(url); err == nil {
+			t.Errorf("ValidateGitURL(%q) = nil, want error", url)
+		}
+	}
+}